@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// describeCacheJitter is the maximum factor by which the TTL of a description
+// is extended, so that the ASGs described one by one don't all expire together.
+const describeCacheJitter = 0.1
+
+type groupDescription struct {
+	group  *autoscaling.Group
+	expiry time.Time
+}
+
+// groupDescriptionCache caches the descriptions of the ASGs, so that the ASGs
+// aren't described again by every loop of the autoscaler. They are refreshed
+// all together, in batches, and described one by one only once expired.
+type groupDescriptionCache struct {
+	service      autoScalingWrapper
+	ttl          time.Duration
+	descriptions map[string]*groupDescription
+	// invalidations counts the calls to invalidate, so that the descriptions
+	// of the ASGs changed while they were being described aren't cached.
+	invalidations uint64
+	mutex         sync.Mutex
+}
+
+// newGroupDescriptionCache creates a cache of the descriptions of the ASGs
+// which caches them for ttl, or not at all if ttl is 0.
+func newGroupDescriptionCache(service autoScalingWrapper, ttl time.Duration) *groupDescriptionCache {
+	return &groupDescriptionCache{
+		service:      service,
+		ttl:          ttl,
+		descriptions: make(map[string]*groupDescription),
+	}
+}
+
+// refresh describes the ASGs again and caches their descriptions. The ASGs
+// which no longer exist are not returned.
+func (c *groupDescriptionCache) refresh(names []string) ([]*autoscaling.Group, error) {
+	c.mutex.Lock()
+	invalidations := c.invalidations
+	c.mutex.Unlock()
+
+	groups, err := c.service.getAutoscalingGroupsByNames(names)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, name := range names {
+		delete(c.descriptions, name)
+	}
+	if c.invalidations == invalidations {
+		for _, group := range groups {
+			c.store(group)
+		}
+	}
+	return groups, nil
+}
+
+// get returns the description of the ASG, described again if it expired. The
+// ASG is described without holding the lock of the cache, so that the other
+// ASGs can be read meanwhile.
+func (c *groupDescriptionCache) get(name string) (*autoscaling.Group, error) {
+	c.mutex.Lock()
+	if description, found := c.descriptions[name]; found && time.Now().Before(description.expiry) {
+		c.mutex.Unlock()
+		return description.group, nil
+	}
+	invalidations := c.invalidations
+	c.mutex.Unlock()
+
+	group, err := c.service.getAutoscalingGroupByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.invalidations == invalidations {
+		c.store(group)
+	}
+	return group, nil
+}
+
+// invalidate drops the description of the ASG after it's changed by the
+// autoscaler, so that it's described again next time.
+func (c *groupDescriptionCache) invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.descriptions, name)
+	c.invalidations++
+}
+
+func (c *groupDescriptionCache) store(group *autoscaling.Group) {
+	if c.ttl <= 0 {
+		return
+	}
+	name := aws.StringValue(group.AutoScalingGroupName)
+	glog.V(5).Infof("Caching the description of ASG %s", name)
+	c.descriptions[name] = &groupDescription{
+		group:  group,
+		expiry: time.Now().Add(wait.Jitter(c.ttl, describeCacheJitter)),
+	}
+}
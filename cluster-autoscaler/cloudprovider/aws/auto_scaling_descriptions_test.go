@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRefreshDescriptionsInBatches(t *testing.T) {
+	names := make([]string, 120)
+	for i := range names {
+		names[i] = fmt.Sprintf("asg-%d", i)
+	}
+
+	s := &AutoScalingMock{}
+	s.On("DescribeAutoScalingGroupsPages",
+		mock.AnythingOfType("*autoscaling.DescribeAutoScalingGroupsInput"),
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		input := args.Get(0).(*autoscaling.DescribeAutoScalingGroupsInput)
+		assert.True(t, len(input.AutoScalingGroupNames) <= maxAsgNamesPerDescribe)
+		output := &autoscaling.DescribeAutoScalingGroupsOutput{}
+		for _, name := range input.AutoScalingGroupNames {
+			output.AutoScalingGroups = append(output.AutoScalingGroups, &autoscaling.Group{
+				AutoScalingGroupName: name,
+				DesiredCapacity:      aws.Int64(1),
+			})
+		}
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(output, false)
+	}).Return(nil)
+
+	c := newGroupDescriptionCache(autoScalingWrapper{s}, time.Hour)
+	groups, err := c.refresh(names)
+	assert.NoError(t, err)
+	assert.Equal(t, 120, len(groups))
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroupsPages", 3)
+
+	// The refreshed ASGs aren't described again one by one.
+	group, err := c.get("asg-42")
+	assert.NoError(t, err)
+	assert.Equal(t, "asg-42", aws.StringValue(group.AutoScalingGroupName))
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 0)
+}
+
+func TestGetDescription(t *testing.T) {
+	s := &AutoScalingMock{}
+	s.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{"test-asg"}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testNamedDescribeAutoScalingGroupsOutput("test-asg", 2, "test-instance-id"))
+
+	c := newGroupDescriptionCache(autoScalingWrapper{s}, time.Hour)
+	for i := 0; i < 3; i++ {
+		group, err := c.get("test-asg")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), aws.Int64Value(group.DesiredCapacity))
+	}
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 1)
+
+	// The ASG is described again once changed...
+	c.invalidate("test-asg")
+	_, err := c.get("test-asg")
+	assert.NoError(t, err)
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 2)
+
+	// ...or once expired.
+	c.descriptions["test-asg"].expiry = time.Now().Add(-time.Second)
+	_, err = c.get("test-asg")
+	assert.NoError(t, err)
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 3)
+
+	// Nothing is cached without a TTL.
+	c = newGroupDescriptionCache(autoScalingWrapper{s}, 0)
+	_, err = c.get("test-asg")
+	assert.NoError(t, err)
+	_, err = c.get("test-asg")
+	assert.NoError(t, err)
+	s.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 5)
+}
+
+func TestGetDescriptionInvalidatedWhileDescribed(t *testing.T) {
+	s := &AutoScalingMock{}
+	c := newGroupDescriptionCache(autoScalingWrapper{s}, time.Hour)
+	s.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{"test-asg"}),
+		MaxRecords:            aws.Int64(1),
+	}).Run(func(args mock.Arguments) {
+		// The ASG is scaled while it's being described, without waiting
+		// for the description.
+		c.invalidate("test-asg")
+	}).Return(testNamedDescribeAutoScalingGroupsOutput("test-asg", 2, "test-instance-id"))
+
+	_, err := c.get("test-asg")
+	assert.NoError(t, err)
+	assert.Empty(t, c.descriptions)
+}
@@ -19,31 +19,44 @@ package aws
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/golang/glog"
 )
 
-const scaleToZeroSupported = false
+const (
+	scaleToZeroSupported = true
+
+	// placeholderInstancePrefix prefixes the names of the placeholders of the
+	// instances an ASG is missing to reach its desired capacity, e.g. when
+	// spot instances are unavailable or the instance limit is reached. Their
+	// nodes never register, so they time out like the nodes which fail to
+	// start, and deleting them decreases the desired capacity of the ASG.
+	placeholderInstancePrefix = "i-placeholder-"
+)
 
 type asgCache struct {
 	registeredAsgs     []*asgInformation
 	instanceToAsg      map[AwsRef]*Asg
+	unremovable        map[AwsRef]string
 	notInRegisteredAsg map[AwsRef]bool
 	mutex              sync.Mutex
-	service            autoScalingWrapper
+	descriptions       *groupDescriptionCache
 	interrupt          chan struct{}
 }
 
-func newASGCache(service autoScalingWrapper) (*asgCache, error) {
+func newASGCache(descriptions *groupDescriptionCache) (*asgCache, error) {
 	registry := &asgCache{
 		registeredAsgs:     make([]*asgInformation, 0),
-		service:            service,
+		descriptions:       descriptions,
 		instanceToAsg:      make(map[AwsRef]*Asg),
+		unremovable:        make(map[AwsRef]string),
 		notInRegisteredAsg: make(map[AwsRef]bool),
 		interrupt:          make(chan struct{}),
 	}
@@ -135,6 +148,15 @@ func (m *asgCache) FindForInstance(instance *AwsRef) (*Asg, error) {
 	return nil, nil
 }
 
+// UnremovableReason returns why the given instance can't be removed from its
+// ASG, or an empty string if it can be removed.
+func (m *asgCache) UnremovableReason(instance *AwsRef) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.unremovable[*instance]
+}
+
 func (m *asgCache) invalidateUnownedInstanceCache() {
 	glog.V(4).Info("Invalidating unowned instance cache")
 	m.notInRegisteredAsg = make(map[AwsRef]bool)
@@ -142,6 +164,7 @@ func (m *asgCache) invalidateUnownedInstanceCache() {
 
 func (m *asgCache) regenerate() error {
 	newCache := make(map[AwsRef]*Asg)
+	unremovable := make(map[AwsRef]string)
 
 	names := make([]string, len(m.registeredAsgs))
 	configs := make(map[string]*Asg)
@@ -151,21 +174,93 @@ func (m *asgCache) regenerate() error {
 	}
 
 	glog.V(4).Infof("Regenerating instance to ASG map for ASGs: %v", names)
-	groups, err := m.service.getAutoscalingGroupsByNames(names)
+	groups, err := m.descriptions.refresh(names)
 	if err != nil {
 		return err
 	}
 	for _, group := range groups {
-		for _, instance := range group.Instances {
+		for _, instance := range instancesWithPlaceholders(group) {
 			ref := AwsRef{Name: aws.StringValue(instance.InstanceId)}
 			newCache[ref] = configs[aws.StringValue(group.AutoScalingGroupName)]
+			if reason := instanceUnremovableReason(instance); reason != "" {
+				unremovable[ref] = reason
+			}
 		}
 	}
 
 	m.instanceToAsg = newCache
+	m.unremovable = unremovable
 	return nil
 }
 
+// instanceUnremovableReason returns why the instance can't be removed from its
+// ASG: the ASG won't terminate it on scale-in when it's protected from it,
+// doesn't count it in its desired capacity when it's in standby, and already
+// removes it when it's leaving.
+func instanceUnremovableReason(instance *autoscaling.Instance) string {
+	if aws.BoolValue(instance.ProtectedFromScaleIn) {
+		return "instance is protected from scale-in"
+	}
+	switch state := aws.StringValue(instance.LifecycleState); {
+	case state == autoscaling.LifecycleStateStandby, state == autoscaling.LifecycleStateEnteringStandby, isLeavingInstance(instance):
+		return fmt.Sprintf("instance is in the %s lifecycle state", state)
+	}
+	return ""
+}
+
+// isLeavingInstance returns whether the instance is being terminated or
+// detached by its ASG, e.g. when the ASG rebalances its instances across its
+// zones or replaces an unhealthy one, and so no longer counts towards its
+// desired capacity.
+func isLeavingInstance(instance *autoscaling.Instance) bool {
+	switch state := aws.StringValue(instance.LifecycleState); {
+	case strings.HasPrefix(state, autoscaling.LifecycleStateTerminating),
+		state == autoscaling.LifecycleStateTerminated,
+		state == autoscaling.LifecycleStateDetaching,
+		state == autoscaling.LifecycleStateDetached:
+		return true
+	}
+	return false
+}
+
+// groupInstances returns the instances of the ASG which are its nodes, without
+// the ones in its warm pool or leaving it.
+func groupInstances(group *autoscaling.Group) []*autoscaling.Instance {
+	instances := make([]*autoscaling.Instance, 0, len(group.Instances))
+	for _, instance := range group.Instances {
+		if !isWarmedInstance(instance) && !isLeavingInstance(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// instancesWithPlaceholders returns the instances of the ASG, without the ones
+// in its warm pool or leaving it, followed by the placeholders of the
+// instances it's missing to reach its desired capacity. The placeholders are named after their index
+// among the instances, so that they keep their names while the ASG is short of
+// instances.
+func instancesWithPlaceholders(group *autoscaling.Group) []*autoscaling.Instance {
+	var zone string
+	if len(group.AvailabilityZones) > 0 {
+		zone = aws.StringValue(group.AvailabilityZones[0])
+	}
+	instances := groupInstances(group)
+	for i := len(instances); i < int(aws.Int64Value(group.DesiredCapacity)); i++ {
+		instances = append(instances, &autoscaling.Instance{
+			InstanceId:       aws.String(fmt.Sprintf("%s%s-%d", placeholderInstancePrefix, aws.StringValue(group.AutoScalingGroupName), i)),
+			AvailabilityZone: aws.String(zone),
+		})
+	}
+	return instances
+}
+
+// isPlaceholderInstance returns whether the instance is the placeholder of an
+// instance not launched yet.
+func isPlaceholderInstance(instance *AwsRef) bool {
+	return strings.HasPrefix(instance.Name, placeholderInstancePrefix)
+}
+
 // Cleanup closes the channel to signal the go routine to stop that is handling the cache
 func (m *asgCache) Cleanup() {
 	close(m.interrupt)
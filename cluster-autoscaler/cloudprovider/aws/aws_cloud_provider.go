@@ -90,7 +90,7 @@ func (aws *awsCloudProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.N
 
 // Pricing returns pricing model for this cloud provider or error if not available.
 func (aws *awsCloudProvider) Pricing() (cloudprovider.PricingModel, errors.AutoscalerError) {
-	return nil, cloudprovider.ErrNotImplemented
+	return &AwsPriceModel{prices: aws.awsManager.prices}, nil
 }
 
 // GetAvailableMachineTypes get all machine types that can be requested from the cloud provider.
@@ -121,7 +121,9 @@ type AwsRef struct {
 	Name string
 }
 
-var validAwsRefIdRegex = regexp.MustCompile(`^aws\:\/\/\/[-0-9a-z]*\/[-0-9a-z]*$`)
+// The names of the placeholder instances contain the names of the ASGs, which
+// may contain any character.
+var validAwsRefIdRegex = regexp.MustCompile(`^aws\:\/\/\/[-0-9a-z]*\/([-0-9a-z]*|i-placeholder-.+-[0-9]+)$`)
 
 // AwsRefFromProviderId creates InstanceConfig object from provider id which
 // must be in format: aws:///zone/name
@@ -129,7 +131,7 @@ func AwsRefFromProviderId(id string) (*AwsRef, error) {
 	if validAwsRefIdRegex.FindStringSubmatch(id) == nil {
 		return nil, fmt.Errorf("Wrong id: expected format aws:///<zone>/<name>, got %v", id)
 	}
-	splitted := strings.Split(id[7:], "/")
+	splitted := strings.SplitN(id[7:], "/", 2)
 	return &AwsRef{
 		Name: splitted[1],
 	}, nil
@@ -208,19 +210,8 @@ func (asg *Asg) DecreaseTargetSize(delta int) error {
 	if delta >= 0 {
 		return fmt.Errorf("size decrease size must be negative")
 	}
-	size, err := asg.awsManager.GetAsgSize(asg)
-	if err != nil {
-		return err
-	}
-	nodes, err := asg.awsManager.GetAsgNodes(asg)
-	if err != nil {
-		return err
-	}
-	if int(size)+delta < len(nodes) {
-		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
-			size, delta, len(nodes))
-	}
-	return asg.awsManager.SetAsgSize(asg, size+int64(delta))
+	// Only the placeholders, the instances not launched yet, can be dropped.
+	return asg.awsManager.DecreaseAsgSize(asg, delta)
 }
 
 // Belongs returns true if the given node belongs to the NodeGroup.
@@ -269,6 +260,22 @@ func (asg *Asg) DeleteNodes(nodes []*apiv1.Node) error {
 	return asg.awsManager.DeleteInstances(refs)
 }
 
+// UnremovableReason returns why the node can't be removed from the Asg, or an
+// empty string if it can be removed.
+func (asg *Asg) UnremovableReason(node *apiv1.Node) (string, error) {
+	ref, err := AwsRefFromProviderId(node.Spec.ProviderID)
+	if err != nil {
+		return "", err
+	}
+	return asg.awsManager.GetInstanceUnremovableReason(ref), nil
+}
+
+// HasWarmPool returns whether the Asg has a warm pool of pre-initialized
+// instances, which provision faster.
+func (asg *Asg) HasWarmPool() bool {
+	return asg.awsManager.HasWarmPool(asg)
+}
+
 // Id returns asg id.
 func (asg *Asg) Id() string {
 	return asg.Name
@@ -300,3 +307,25 @@ func (asg *Asg) TemplateNodeInfo() (*schedulercache.NodeInfo, error) {
 	nodeInfo.SetNode(node)
 	return nodeInfo, nil
 }
+
+// MaxTemplateNodeInfo returns a node template of the largest instance type the
+// ASG may launch, or nil if it launches a single one.
+func (asg *Asg) MaxTemplateNodeInfo() (*schedulercache.NodeInfo, error) {
+	template, err := asg.awsManager.getAsgTemplate(asg.Name)
+	if err != nil {
+		return nil, err
+	}
+	if *template.LargestInstanceType == *template.InstanceType {
+		return nil, nil
+	}
+	template.InstanceType = template.LargestInstanceType
+
+	node, err := asg.awsManager.buildNodeFromTemplate(asg, template)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(asg.Name))
+	nodeInfo.SetNode(node)
+	return nodeInfo, nil
+}
@@ -18,6 +18,7 @@ package aws
 
 import (
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
@@ -63,26 +64,31 @@ func (a *AutoScalingMock) TerminateInstanceInAutoScalingGroup(input *autoscaling
 
 var testService = autoScalingWrapper{&AutoScalingMock{}}
 
+var testDescriptions = newGroupDescriptionCache(testService, 0)
+
 var testAwsManager = &AwsManager{
 	asgCache: &asgCache{
 		registeredAsgs: make([]*asgInformation, 0),
 		instanceToAsg:  make(map[AwsRef]*Asg),
 		interrupt:      make(chan struct{}),
-		service:        testService,
+		descriptions:   testDescriptions,
 	},
 	explicitlyConfigured: make(map[AwsRef]bool),
 	service:              testService,
+	descriptions:         testDescriptions,
 }
 
 func newTestAwsManagerWithService(service autoScaling) *AwsManager {
 	wrapper := autoScalingWrapper{service}
+	descriptions := newGroupDescriptionCache(wrapper, 0)
 	return &AwsManager{
-		service: wrapper,
+		service:      wrapper,
+		descriptions: descriptions,
 		asgCache: &asgCache{
 			registeredAsgs: make([]*asgInformation, 0),
 			instanceToAsg:  make(map[AwsRef]*Asg),
 			interrupt:      make(chan struct{}),
-			service:        wrapper,
+			descriptions:   descriptions,
 		},
 		explicitlyConfigured: make(map[AwsRef]bool),
 	}
@@ -203,6 +209,13 @@ func TestAwsRefFromProviderId(t *testing.T) {
 	awsRef, err := AwsRefFromProviderId("aws:///us-east-1a/i-260942b3")
 	assert.NoError(t, err)
 	assert.Equal(t, awsRef, &AwsRef{Name: "i-260942b3"})
+
+	// The names of the placeholders contain the names of the ASGs.
+	awsRef, err = AwsRefFromProviderId("aws:///us-east-1a/i-placeholder-Nodes/Spot_1-2")
+	assert.NoError(t, err)
+	assert.Equal(t, awsRef, &AwsRef{Name: "i-placeholder-Nodes/Spot_1-2"})
+	_, err = AwsRefFromProviderId("aws:///us-east-1a/Nodes/Spot_1")
+	assert.Error(t, err)
 }
 
 func TestTargetSize(t *testing.T) {
@@ -321,10 +334,347 @@ func TestDeleteNodes(t *testing.T) {
 	err := asgs[0].DeleteNodes([]*apiv1.Node{node})
 	assert.NoError(t, err)
 	service.AssertNumberOfCalls(t, "TerminateInstanceInAutoScalingGroup", 1)
-	service.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 1)
+	// Once for the size, once for the state of the instances.
+	service.AssertNumberOfCalls(t, "DescribeAutoScalingGroups", 2)
 	service.AssertNumberOfCalls(t, "DescribeAutoScalingGroupsPages", 1)
 }
 
+func testProtectedDescribeAutoScalingGroupsOutput(groupName string) *autoscaling.DescribeAutoScalingGroupsOutput {
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(groupName),
+				DesiredCapacity:      aws.Int64(3),
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("test-instance-id"),
+						LifecycleState: aws.String(autoscaling.LifecycleStateInService),
+					},
+					{
+						InstanceId:           aws.String("protected-instance-id"),
+						LifecycleState:       aws.String(autoscaling.LifecycleStateInService),
+						ProtectedFromScaleIn: aws.Bool(true),
+					},
+					{
+						InstanceId:     aws.String("standby-instance-id"),
+						LifecycleState: aws.String(autoscaling.LifecycleStateStandby),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestUnremovableReason(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testProtectedDescribeAutoScalingGroupsOutput("test-asg"), false)
+	}).Return(nil)
+	assert.NoError(t, provider.awsManager.regenerateCache())
+
+	for id, expected := range map[string]string{
+		"test-instance-id":      "",
+		"protected-instance-id": "instance is protected from scale-in",
+		"standby-instance-id":   "instance is in the Standby lifecycle state",
+		"unknown-instance-id":   "",
+	} {
+		node := &apiv1.Node{
+			Spec: apiv1.NodeSpec{
+				ProviderID: "aws:///us-east-1a/" + id,
+			},
+		}
+		reason, err := asgs[0].UnremovableReason(node)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, reason, id)
+	}
+
+	_, err := asgs[0].UnremovableReason(&apiv1.Node{})
+	assert.Error(t, err)
+}
+
+func TestDeleteNodesProtectedFromScaleIn(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testProtectedDescribeAutoScalingGroupsOutput("test-asg"))
+
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testProtectedDescribeAutoScalingGroupsOutput("test-asg"), false)
+	}).Return(nil)
+
+	for _, id := range []string{"protected-instance-id", "standby-instance-id"} {
+		node := &apiv1.Node{
+			Spec: apiv1.NodeSpec{
+				ProviderID: "aws:///us-east-1a/" + id,
+			},
+		}
+		err := asgs[0].DeleteNodes([]*apiv1.Node{node})
+		assert.Error(t, err)
+	}
+	service.AssertNumberOfCalls(t, "TerminateInstanceInAutoScalingGroup", 0)
+}
+
+func testRebalancingDescribeAutoScalingGroupsOutput(groupName string) *autoscaling.DescribeAutoScalingGroupsOutput {
+	output := testNamedDescribeAutoScalingGroupsOutput(groupName, 2, "test-instance-id", "terminating-instance-id", "detaching-instance-id", "launched-instance-id")
+	for _, instance := range output.AutoScalingGroups[0].Instances {
+		instance.AvailabilityZone = aws.String("us-east-1a")
+	}
+	output.AutoScalingGroups[0].Instances[1].LifecycleState = aws.String(autoscaling.LifecycleStateTerminatingWait)
+	output.AutoScalingGroups[0].Instances[2].LifecycleState = aws.String(autoscaling.LifecycleStateDetaching)
+	output.AutoScalingGroups[0].Instances[3].LifecycleState = aws.String(autoscaling.LifecycleStatePending)
+	return output
+}
+
+func TestNodesWithoutLeavingInstances(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testRebalancingDescribeAutoScalingGroupsOutput("test-asg"))
+
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testRebalancingDescribeAutoScalingGroupsOutput("test-asg"), false)
+	}).Return(nil)
+
+	// The instances the ASG is terminating or detaching, e.g. after
+	// launching their replacements in other zones, aren't its nodes.
+	nodes, err := asgs[0].Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"aws:///us-east-1a/test-instance-id",
+		"aws:///us-east-1a/launched-instance-id",
+	}, nodes)
+
+	assert.NoError(t, provider.Refresh())
+	for _, id := range []string{"terminating-instance-id", "detaching-instance-id"} {
+		node := &apiv1.Node{
+			Spec: apiv1.NodeSpec{
+				ProviderID: "aws:///us-east-1a/" + id,
+			},
+		}
+		nodeGroup, err := provider.NodeGroupForNode(node)
+		assert.NoError(t, err)
+		assert.Nil(t, nodeGroup)
+	}
+}
+
+func TestDeleteNodesDetached(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testNamedDescribeAutoScalingGroupsOutput("test-asg", 2, "test-instance-id", "detached-instance-id"), false)
+	}).Return(nil)
+
+	// The ASG has detached the instance since the cache was regenerated.
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testNamedDescribeAutoScalingGroupsOutput("test-asg", 1, "test-instance-id"))
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "aws:///us-east-1a/detached-instance-id",
+		},
+	}
+	err := asgs[0].DeleteNodes([]*apiv1.Node{node})
+	assert.Error(t, err)
+	service.AssertNumberOfCalls(t, "TerminateInstanceInAutoScalingGroup", 0)
+}
+
+func testPlaceholderDescribeAutoScalingGroupsOutput(groupName string, desiredCap int64) *autoscaling.DescribeAutoScalingGroupsOutput {
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(groupName),
+				AvailabilityZones:    aws.StringSlice([]string{"us-east-1a", "us-east-1b"}),
+				DesiredCapacity:      aws.Int64(desiredCap),
+				Instances: []*autoscaling.Instance{{
+					AvailabilityZone: aws.String("us-east-1b"),
+					InstanceId:       aws.String("test-instance-id"),
+				}},
+			},
+		},
+	}
+}
+
+func TestNodesWithPlaceholders(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	// The ASG has launched only one of its 3 instances.
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3))
+
+	nodes, err := asgs[0].Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"aws:///us-east-1b/test-instance-id",
+		"aws:///us-east-1a/i-placeholder-test-asg-1",
+		"aws:///us-east-1a/i-placeholder-test-asg-2",
+	}, nodes)
+
+	// The instances not launched can be dropped.
+	service.On("SetDesiredCapacity", &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: aws.String(asgs[0].Name),
+		DesiredCapacity:      aws.Int64(1),
+		HonorCooldown:        aws.Bool(false),
+	}).Return(&autoscaling.SetDesiredCapacityOutput{})
+	err = asgs[0].DecreaseTargetSize(-2)
+	assert.NoError(t, err)
+	service.AssertNumberOfCalls(t, "SetDesiredCapacity", 1)
+	err = asgs[0].DecreaseTargetSize(-3)
+	assert.Error(t, err)
+}
+
+func TestDeleteNodesWithPlaceholder(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3))
+
+	// Refresh the instance to ASG cache, with the placeholders...
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3), false)
+	}).Return(nil)
+
+	// ...so that deleting the timed out placeholder decreases the desired
+	// capacity instead of terminating an instance.
+	service.On("SetDesiredCapacity", &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: aws.String(asgs[0].Name),
+		DesiredCapacity:      aws.Int64(2),
+		HonorCooldown:        aws.Bool(false),
+	}).Return(&autoscaling.SetDesiredCapacityOutput{})
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "aws:///us-east-1a/i-placeholder-test-asg-2",
+		},
+	}
+	err := asgs[0].DeleteNodes([]*apiv1.Node{node})
+	assert.NoError(t, err)
+	service.AssertNumberOfCalls(t, "TerminateInstanceInAutoScalingGroup", 0)
+	service.AssertNumberOfCalls(t, "SetDesiredCapacity", 1)
+	service.AssertNumberOfCalls(t, "DescribeAutoScalingGroupsPages", 1)
+}
+
+func TestDeleteNodesWithLaunchedPlaceholder(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3)).Twice()
+
+	service.On("DescribeAutoScalingGroupsPages",
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3), false)
+	}).Return(nil)
+
+	// The ASG launches its missing instances before the desired capacity is
+	// decreased, which then would terminate any of them.
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testNamedDescribeAutoScalingGroupsOutput("test-asg", 3, "test-instance-id", "second-test-instance-id", "third-test-instance-id"))
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "aws:///us-east-1a/i-placeholder-test-asg-2",
+		},
+	}
+	err := asgs[0].DeleteNodes([]*apiv1.Node{node})
+	assert.NoError(t, err)
+	service.AssertNumberOfCalls(t, "TerminateInstanceInAutoScalingGroup", 0)
+	service.AssertNumberOfCalls(t, "SetDesiredCapacity", 0)
+}
+
+func TestDecreaseTargetSizeDescribesAgain(t *testing.T) {
+	service := &AutoScalingMock{}
+	m := newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"})
+	m.descriptions.ttl = time.Hour
+	provider := testProvider(t, m)
+	asgs := provider.asgs()
+
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 3)).Once()
+	size, err := asgs[0].TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	// The ASG has launched its missing instances since it was cached.
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(testNamedDescribeAutoScalingGroupsOutput("test-asg", 3, "test-instance-id", "second-test-instance-id", "third-test-instance-id"))
+	err = asgs[0].DecreaseTargetSize(-1)
+	assert.Error(t, err)
+	service.AssertNumberOfCalls(t, "SetDesiredCapacity", 0)
+}
+
 func TestGetResourceLimiter(t *testing.T) {
 	service := &AutoScalingMock{}
 	m := newTestAwsManagerWithService(service)
@@ -21,18 +21,24 @@ package aws
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/golang/glog"
 	"gopkg.in/gcfg.v1"
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	"k8s.io/autoscaler/cluster-autoscaler/config/dynamic"
 	provider_aws "k8s.io/kubernetes/pkg/cloudprovider/providers/aws"
@@ -43,7 +49,21 @@ const (
 	operationWaitTimeout    = 5 * time.Second
 	operationPollInterval   = 100 * time.Millisecond
 	maxRecordsReturnedByAPI = 100
+	maxAsgNamesPerDescribe  = 50
 	refreshInterval         = 1 * time.Minute
+	// refreshJitter is the maximum factor by which the refresh interval is
+	// extended, so that several autoscalers don't refresh together.
+	refreshJitter = 0.1
+	// instanceTypesRefreshInterval is how often the instance types are
+	// described, for the new ones to be known.
+	instanceTypesRefreshInterval = 1 * time.Hour
+	// defaultDescribeCacheTTL is how long the descriptions of the ASGs are
+	// cached when the cloud-config doesn't tell.
+	defaultDescribeCacheTTL = 1 * time.Minute
+	// assumeRoleExpiryWindow is how long before they expire the credentials
+	// of the assumed role are refreshed.
+	assumeRoleExpiryWindow = 5 * time.Minute
+	assumeRoleSessionName  = "cluster-autoscaler"
 )
 
 type asgInformation struct {
@@ -54,40 +74,91 @@ type asgInformation struct {
 // AwsManager is handles aws communication and data caching.
 type AwsManager struct {
 	service               autoScalingWrapper
+	descriptions          *groupDescriptionCache
+	launchTemplates       launchTemplates
 	asgCache              *asgCache
-	lastRefresh           time.Time
+	nextRefresh           time.Time
 	asgAutoDiscoverySpecs []cloudprovider.ASGAutoDiscoveryConfig
 	explicitlyConfigured  map[AwsRef]bool
+	prices                *instancePrices
+	warmPools             *warmPools
+
+	// instanceTypes are the instance types described by EC2, the generated
+	// ones are used for the others.
+	instanceTypes            map[string]*instanceType
+	instanceTypeDescriber    instanceTypeDescriber
+	nextInstanceTypesRefresh time.Time
+	// instanceTypesCacheFile is the file the described instance types are
+	// saved to, and read from when they can't be described. None if empty.
+	instanceTypesCacheFile string
 }
 
 type asgTemplate struct {
 	InstanceType *instanceType
-	Region       string
-	Zone         string
-	Tags         []*autoscaling.TagDescription
+	// LargestInstanceType is the largest of the instance types the ASG may
+	// launch, the same as InstanceType if it launches a single one.
+	LargestInstanceType *instanceType
+	Region              string
+	Zone                string
+	Tags                []*autoscaling.TagDescription
+	// SpotPercentage is the percentage of the instances launched above the
+	// on-demand base capacity that are spot instances.
+	SpotPercentage int64
 }
 
-// createAwsManagerInternal allows for a customer autoScalingWrapper to be passed in by tests
+// autoscalerConfig is the [autoscaler] section of the cloud-config, with the
+// settings of the autoscaler next to the ones of the AWS cloud provider of
+// Kubernetes.
+type autoscalerConfig struct {
+	Autoscaler struct {
+		// DescribeCacheTTL is how long the descriptions of the ASGs are
+		// cached between refreshes, e.g. "30s", defaultDescribeCacheTTL if
+		// not set and not at all if "0".
+		DescribeCacheTTL string
+		// InstanceTypesCacheFile is the file the instance types described
+		// by EC2 are saved to, and read from when they can't be described
+		// at start. They aren't saved if not set.
+		InstanceTypesCacheFile string
+	}
+}
+
+// createAwsManagerInternal allows for a customer autoScalingWrapper,
+// launchTemplates and instanceTypeDescriber to be passed in by tests
 func createAWSManagerInternal(
 	configReader io.Reader,
 	discoveryOpts cloudprovider.NodeGroupDiscoveryOptions,
 	service *autoScalingWrapper,
+	templates launchTemplates,
+	instanceTypes instanceTypeDescriber,
 ) (*AwsManager, error) {
+	describeCacheTTL := defaultDescribeCacheTTL
+	var instanceTypesCacheFile string
 	if configReader != nil {
+		data, err := ioutil.ReadAll(configReader)
+		if err != nil {
+			glog.Errorf("Couldn't read config: %v", err)
+			return nil, err
+		}
 		var cfg provider_aws.CloudConfig
-		if err := gcfg.ReadInto(&cfg, configReader); err != nil {
+		if err := gcfg.FatalOnly(gcfg.ReadStringInto(&cfg, string(data))); err != nil {
 			glog.Errorf("Couldn't read config: %v", err)
 			return nil, err
 		}
-	}
-
-	if service == nil {
-		service = &autoScalingWrapper{
-			autoscaling.New(session.New()),
+		describeCacheTTL, err = readDescribeCacheTTL(string(data))
+		if err != nil {
+			glog.Errorf("Couldn't read config: %v", err)
+			return nil, err
 		}
+		autoscalerCfg, err := readAutoscalerConfig(string(data))
+		if err != nil {
+			glog.Errorf("Couldn't read config: %v", err)
+			return nil, err
+		}
+		instanceTypesCacheFile = autoscalerCfg.Autoscaler.InstanceTypesCacheFile
 	}
 
-	cache, err := newASGCache(*service)
+	descriptions := newGroupDescriptionCache(*service, describeCacheTTL)
+	cache, err := newASGCache(descriptions)
 	if err != nil {
 		return nil, err
 	}
@@ -98,10 +169,14 @@ func createAWSManagerInternal(
 	}
 
 	manager := &AwsManager{
-		service:               *service,
-		asgCache:              cache,
-		asgAutoDiscoverySpecs: specs,
-		explicitlyConfigured:  make(map[AwsRef]bool),
+		service:                *service,
+		descriptions:           descriptions,
+		launchTemplates:        templates,
+		instanceTypeDescriber:  instanceTypes,
+		instanceTypesCacheFile: instanceTypesCacheFile,
+		asgCache:               cache,
+		asgAutoDiscoverySpecs:  specs,
+		explicitlyConfigured:   make(map[AwsRef]bool),
 	}
 
 	if err := manager.fetchExplicitAsgs(discoveryOpts.NodeGroupSpecs); err != nil {
@@ -115,31 +190,88 @@ func createAWSManagerInternal(
 	return manager, nil
 }
 
-// CreateAwsManager constructs awsManager object.
-func CreateAwsManager(configReader io.Reader, discoveryOpts cloudprovider.NodeGroupDiscoveryOptions) (*AwsManager, error) {
-	return createAWSManagerInternal(configReader, discoveryOpts, nil)
+// readDescribeCacheTTL returns how long the descriptions of the ASGs are cached
+// according to the [autoscaler] section of the cloud-config.
+func readDescribeCacheTTL(config string) (time.Duration, error) {
+	cfg, err := readAutoscalerConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.Autoscaler.DescribeCacheTTL == "" {
+		return defaultDescribeCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(cfg.Autoscaler.DescribeCacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid describeCacheTTL %q: %v", cfg.Autoscaler.DescribeCacheTTL, err)
+	}
+	return ttl, nil
+}
+
+// readAutoscalerConfig reads the [autoscaler] section of the cloud-config.
+func readAutoscalerConfig(config string) (*autoscalerConfig, error) {
+	var cfg autoscalerConfig
+	if err := gcfg.FatalOnly(gcfg.ReadStringInto(&cfg, config)); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// CreateAwsManager constructs awsManager object. The ASGs are managed with the
+// role assumeRoleARN, e.g. of another account, if not empty.
+func CreateAwsManager(configReader io.Reader, discoveryOpts cloudprovider.NodeGroupDiscoveryOptions, assumeRoleARN string) (*AwsManager, error) {
+	sess := newSession(assumeRoleARN)
+	autoScalingClient := autoscaling.New(sess)
+	ec2Client := ec2.New(sess)
+	templates := &awsLaunchTemplates{
+		autoscaling: autoScalingClient.Client,
+		ec2:         ec2Client.Client,
+	}
+	instanceTypes := &awsInstanceTypes{ec2: ec2Client.Client}
+	manager, err := createAWSManagerInternal(configReader, discoveryOpts, &autoScalingWrapper{autoScalingClient}, templates, instanceTypes)
+	if err != nil {
+		return nil, err
+	}
+	manager.prices = newInstancePrices(&awsInstancePrices{
+		ec2:     ec2Client,
+		pricing: newPricingClient(sess),
+	})
+	manager.warmPools = newWarmPools(&awsWarmPools{autoscaling: autoScalingClient.Client})
+	return manager, nil
+}
+
+// newSession creates the session of the AWS clients. The default credentials
+// of the autoscaler are the ones of the role of its service account, if the
+// environment gives one, or else the ones of the default chain of the SDK.
+// With a role ARN, the clients use temporary credentials of the role, assumed
+// with the default credentials and assumed again before they expire.
+func newSession(assumeRoleARN string) *session.Session {
+	sess := session.New()
+	if creds := newWebIdentityCredentials(sess); creds != nil {
+		glog.V(1).Infof("Using the web identity credentials of the role %s", os.Getenv(roleARNEnvVar))
+		sess = session.New(&aws.Config{Credentials: creds})
+	}
+	if assumeRoleARN == "" {
+		return sess
+	}
+	glog.V(1).Infof("Using the credentials of the role %s", assumeRoleARN)
+	creds := stscreds.NewCredentials(sess, assumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = assumeRoleSessionName
+		p.ExpiryWindow = assumeRoleExpiryWindow
+	})
+	return session.New(&aws.Config{Credentials: creds})
 }
 
 // Fetch explicitly configured ASGs. These ASGs should never be unregistered
 // during refreshes, even if they no longer exist in AWS.
 func (m *AwsManager) fetchExplicitAsgs(specs []string) error {
-	changed := false
 	for _, spec := range specs {
 		asg, err := m.buildAsgFromSpec(spec)
 		if err != nil {
 			return fmt.Errorf("failed to parse node group spec: %v", err)
 		}
-		if m.RegisterAsg(asg) {
-			changed = true
-		}
+		m.RegisterAsg(asg)
 		m.explicitlyConfigured[asg.AwsRef] = true
 	}
-
-	if changed {
-		if err := m.regenerateCache(); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
@@ -161,7 +293,6 @@ func (m *AwsManager) buildAsgFromSpec(spec string) (*Asg, error) {
 // they no longer exist in AWS.
 func (m *AwsManager) fetchAutoAsgs() error {
 	exists := make(map[AwsRef]bool)
-	changed := false
 	for _, spec := range m.asgAutoDiscoverySpecs {
 		groups, err := m.getAutoscalingGroupsByTags(spec.TagKeys)
 		if err != nil {
@@ -170,7 +301,10 @@ func (m *AwsManager) fetchAutoAsgs() error {
 		for _, g := range groups {
 			asg, err := m.buildAsgFromAWS(g)
 			if err != nil {
-				return err
+				// Don't let a single misconfigured ASG prevent the discovery
+				// of the others. It is unregistered until it is fixed.
+				glog.Warningf("Ignoring ASG %s discovered using tags %v: %v", aws.StringValue(g.AutoScalingGroupName), spec.TagKeys, err)
+				continue
 			}
 			exists[asg.AwsRef] = true
 			if m.explicitlyConfigured[asg.AwsRef] {
@@ -182,7 +316,6 @@ func (m *AwsManager) fetchAutoAsgs() error {
 			}
 			if m.RegisterAsg(asg) {
 				glog.V(3).Infof("Autodiscovered ASG %s using tags %v", asg.AwsRef.Name, spec.TagKeys)
-				changed = true
 			}
 		}
 	}
@@ -190,13 +323,6 @@ func (m *AwsManager) fetchAutoAsgs() error {
 	for _, asg := range m.getAsgs() {
 		if !exists[asg.config.AwsRef] && !m.explicitlyConfigured[asg.config.AwsRef] {
 			m.UnregisterAsg(asg.config)
-			changed = true
-		}
-	}
-
-	if changed {
-		if err := m.regenerateCache(); err != nil {
-			return err
 		}
 	}
 
@@ -225,22 +351,86 @@ func (m *AwsManager) buildAsgFromAWS(g *autoscaling.Group) (*Asg, error) {
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
 // In particular the list of node groups returned by NodeGroups can change as a result of CloudProvider.Refresh().
 func (m *AwsManager) Refresh() error {
-	if m.lastRefresh.Add(refreshInterval).After(time.Now()) {
+	if m.nextRefresh.After(time.Now()) {
 		return nil
 	}
 	return m.forceRefresh()
 }
 
 func (m *AwsManager) forceRefresh() error {
+	m.refreshInstanceTypes()
 	if err := m.fetchAutoAsgs(); err != nil {
 		glog.Errorf("Failed to fetch ASGs: %v", err)
 		return err
 	}
-	m.lastRefresh = time.Now()
-	glog.V(2).Infof("Refreshed ASG list, next refresh after %v", m.lastRefresh.Add(refreshInterval))
+	// The instance cache is regenerated even if the ASGs haven't changed,
+	// since their instances may have been protected from scale-in or put
+	// in standby.
+	if err := m.regenerateCache(); err != nil {
+		glog.Errorf("Failed to regenerate ASG cache: %v", err)
+		return err
+	}
+	m.nextRefresh = time.Now().Add(wait.Jitter(refreshInterval, refreshJitter))
+	glog.V(2).Infof("Refreshed ASG list, next refresh after %v", m.nextRefresh)
 	return nil
 }
 
+// refreshInstanceTypes describes the instance types again if they're due to,
+// keeping the ones described before if it fails. If none were, the ones saved
+// to the cache file are read instead.
+func (m *AwsManager) refreshInstanceTypes() {
+	if m.instanceTypeDescriber == nil || m.nextInstanceTypesRefresh.After(time.Now()) {
+		return
+	}
+	m.nextInstanceTypesRefresh = time.Now().Add(instanceTypesRefreshInterval)
+	instanceTypes, err := m.instanceTypeDescriber.describeInstanceTypes()
+	if err != nil {
+		if m.instanceTypes == nil && m.instanceTypesCacheFile != "" {
+			cached, cacheErr := readInstanceTypesCache(m.instanceTypesCacheFile)
+			if cacheErr == nil {
+				glog.Warningf("Failed to describe instance types, falling back to the %d cached in %s: %v", len(cached), m.instanceTypesCacheFile, err)
+				m.instanceTypes = cached
+				return
+			}
+			glog.Warningf("Failed to read the instance types cached in %s: %v", m.instanceTypesCacheFile, cacheErr)
+		}
+		glog.Warningf("Failed to describe instance types, falling back to the known ones: %v", err)
+		return
+	}
+	glog.V(2).Infof("Described %d instance types", len(instanceTypes))
+	m.instanceTypes = instanceTypes
+	if m.instanceTypesCacheFile != "" {
+		if err := writeInstanceTypesCache(m.instanceTypesCacheFile, instanceTypes); err != nil {
+			glog.Warningf("Failed to cache the instance types in %s: %v", m.instanceTypesCacheFile, err)
+		}
+	}
+}
+
+// getInstanceType returns the instance type described by EC2 or, if it wasn't,
+// the generated one.
+func (m *AwsManager) getInstanceType(name string) (*instanceType, bool) {
+	if t, found := m.instanceTypes[name]; found {
+		return t, true
+	}
+	t, found := InstanceTypes[name]
+	return t, found
+}
+
+// getKnownInstanceTypes returns the instance types described by EC2 and the
+// generated ones not described.
+func (m *AwsManager) getKnownInstanceTypes() []*instanceType {
+	known := make([]*instanceType, 0, len(InstanceTypes))
+	for _, t := range m.instanceTypes {
+		known = append(known, t)
+	}
+	for name, t := range InstanceTypes {
+		if _, found := m.instanceTypes[name]; !found {
+			known = append(known, t)
+		}
+	}
+	return known
+}
+
 func (m *AwsManager) getAsgs() []*asgInformation {
 	return m.asgCache.get()
 }
@@ -277,21 +467,11 @@ func (m *AwsManager) getAutoscalingGroupsByTags(keys []string) ([]*autoscaling.G
 
 // GetAsgSize gets ASG size.
 func (m *AwsManager) GetAsgSize(asgConfig *Asg) (int64, error) {
-	params := &autoscaling.DescribeAutoScalingGroupsInput{
-		AutoScalingGroupNames: []*string{aws.String(asgConfig.Name)},
-		MaxRecords:            aws.Int64(1),
-	}
-	groups, err := m.service.DescribeAutoScalingGroups(params)
-
+	group, err := m.descriptions.get(asgConfig.Name)
 	if err != nil {
 		return -1, err
 	}
-
-	if len(groups.AutoScalingGroups) < 1 {
-		return -1, fmt.Errorf("Unable to get first autoscaling.Group for %s", asgConfig.Name)
-	}
-	asg := *groups.AutoScalingGroups[0]
-	return *asg.DesiredCapacity, nil
+	return aws.Int64Value(group.DesiredCapacity), nil
 }
 
 // SetAsgSize sets ASG size.
@@ -303,6 +483,7 @@ func (m *AwsManager) SetAsgSize(asg *Asg, size int64) error {
 	}
 	glog.V(0).Infof("Setting asg %s size to %d", asg.Id(), size)
 	_, err := m.service.SetDesiredCapacity(params)
+	m.descriptions.invalidate(asg.Name)
 	if err != nil {
 		return err
 	}
@@ -328,29 +509,123 @@ func (m *AwsManager) DeleteInstances(instances []*AwsRef) error {
 		}
 	}
 
+	// Terminating an instance ignores its scale-in protection, its state is
+	// checked first in case it changed since the cache was regenerated. The
+	// ASG may also have detached or replaced the instance since, e.g. when
+	// rebalancing its instances across its zones.
+	group, err := m.getFreshAutoscalingGroup(commonAsg.Name)
+	if err != nil {
+		return err
+	}
+	reasons := make(map[AwsRef]string)
+	for _, instance := range group.Instances {
+		reasons[AwsRef{Name: aws.StringValue(instance.InstanceId)}] = instanceUnremovableReason(instance)
+	}
 	for _, instance := range instances {
+		reason, found := reasons[*instance]
+		if !found && !isPlaceholderInstance(instance) {
+			reason = fmt.Sprintf("instance is no longer in ASG %s", commonAsg.Name)
+		}
+		if reason != "" {
+			return fmt.Errorf("cannot delete instance %s: %s", instance.Name, reason)
+		}
+	}
+
+	placeholders := 0
+	for _, instance := range instances {
+		// A placeholder has no instance to terminate, the desired capacity
+		// which it stands for is decreased instead.
+		if isPlaceholderInstance(instance) {
+			placeholders++
+			continue
+		}
+		// The desired capacity is decremented with the termination of the
+		// instance, a smaller desired capacity alone would let the ASG
+		// terminate any of its instances instead.
 		params := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
 			InstanceId:                     aws.String(instance.Name),
 			ShouldDecrementDesiredCapacity: aws.Bool(true),
 		}
 		resp, err := m.service.TerminateInstanceInAutoScalingGroup(params)
+		m.descriptions.invalidate(commonAsg.Name)
+		if err != nil {
+			return err
+		}
+		glog.V(4).Info(aws.StringValue(resp.Activity.Description))
+	}
+
+	if placeholders > 0 {
+		group, err := m.getFreshAutoscalingGroup(commonAsg.Name)
 		if err != nil {
 			return err
 		}
-		glog.V(4).Infof(*resp.Activity.Description)
+		// The ASG may have launched some of the missing instances since,
+		// the desired capacity is decreased only by the ones still
+		// missing so that the ASG doesn't terminate any instance.
+		size := aws.Int64Value(group.DesiredCapacity)
+		if missing := int(size) - len(groupInstances(group)); placeholders > missing {
+			glog.Warningf("ASG %s has launched %d of the instances of the removed placeholders", commonAsg.Name, placeholders-missing)
+			placeholders = missing
+		}
+		if placeholders <= 0 {
+			return nil
+		}
+		glog.V(0).Infof("Removing %d placeholders of the instances ASG %s failed to launch", placeholders, commonAsg.Name)
+		return m.SetAsgSize(commonAsg, size-int64(placeholders))
 	}
 
 	return nil
 }
 
+// DecreaseAsgSize decreases the desired capacity of the ASG by the instances it
+// hasn't launched yet. It fails rather than decreasing the desired capacity
+// below the number of instances of the ASG, which would terminate any of them.
+func (m *AwsManager) DecreaseAsgSize(asg *Asg, delta int) error {
+	// The ASG may have launched instances since it was last described.
+	group, err := m.getFreshAutoscalingGroup(asg.Name)
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(group.DesiredCapacity)
+	existing := len(groupInstances(group))
+	if int(size)+delta < existing {
+		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
+			size, delta, existing)
+	}
+	return m.SetAsgSize(asg, size+int64(delta))
+}
+
+// getFreshAutoscalingGroup describes the ASG again, bypassing the cache, before
+// the instances of the ASG are changed.
+func (m *AwsManager) getFreshAutoscalingGroup(name string) (*autoscaling.Group, error) {
+	m.descriptions.invalidate(name)
+	return m.descriptions.get(name)
+}
+
+// GetInstanceUnremovableReason returns why the instance can't be removed from
+// its ASG, or an empty string if it can be removed.
+func (m *AwsManager) GetInstanceUnremovableReason(instance *AwsRef) string {
+	return m.asgCache.UnremovableReason(instance)
+}
+
+// HasWarmPool returns whether the ASG has a warm pool to launch its instances
+// from.
+func (m *AwsManager) HasWarmPool(asg *Asg) bool {
+	return m.warmPools.hasWarmPool(asg.Name)
+}
+
 // GetAsgNodes returns Asg nodes.
 func (m *AwsManager) GetAsgNodes(asg *Asg) ([]string, error) {
 	result := make([]string, 0)
-	group, err := m.service.getAutoscalingGroupByName(asg.Name)
+	group, err := m.descriptions.get(asg.Name)
 	if err != nil {
 		return []string{}, err
 	}
-	for _, instance := range group.Instances {
+	instances := instancesWithPlaceholders(group)
+	if missing := len(instances) - len(groupInstances(group)); missing > 0 {
+		glog.V(4).Infof("ASG %s is missing %d instances to reach its desired capacity", asg.Name, missing)
+	}
+	for _, instance := range instances {
 		result = append(result,
 			fmt.Sprintf("aws:///%s/%s", *instance.AvailabilityZone, *instance.InstanceId))
 	}
@@ -358,15 +633,49 @@ func (m *AwsManager) GetAsgNodes(asg *Asg) ([]string, error) {
 }
 
 func (m *AwsManager) getAsgTemplate(name string) (*asgTemplate, error) {
-	asg, err := m.service.getAutoscalingGroupByName(name)
+	asg, err := m.descriptions.get(name)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceTypeName, err := m.service.getInstanceTypeByLCName(*asg.LaunchConfigurationName)
+	instanceTypeNames, requirements, spotPercentage, err := m.getAsgInstanceTypeNames(asg)
 	if err != nil {
 		return nil, err
 	}
+	// An ASG with a mixed instances policy may launch any of its instance
+	// types, the template is the smallest of them so that a pod fitting the
+	// template fits any node launched, and the largest one is given to the
+	// estimator for the pods not fitting it. The instance types selected by
+	// their attributes are as small or as large as their requirements allow.
+	var candidates, largestCandidates []*instanceType
+	for _, instanceTypeName := range instanceTypeNames {
+		candidate, found := m.getInstanceType(instanceTypeName)
+		if !found {
+			glog.Warningf("Ignoring unknown instance type %s of %s", instanceTypeName, name)
+			continue
+		}
+		candidates = append(candidates, candidate)
+		largestCandidates = append(largestCandidates, candidate)
+	}
+	if len(requirements) > 0 {
+		known := m.getKnownInstanceTypes()
+		for _, r := range requirements {
+			candidates = append(candidates, r.instanceType())
+			largestCandidates = append(largestCandidates, r.largestInstanceType(known))
+		}
+	}
+	var instanceType, largestInstanceType *instanceType
+	for i, candidate := range candidates {
+		if instanceType == nil || smallerInstanceType(candidate, instanceType) {
+			instanceType = candidate
+		}
+		if largestInstanceType == nil || smallerInstanceType(largestInstanceType, largestCandidates[i]) {
+			largestInstanceType = largestCandidates[i]
+		}
+	}
+	if instanceType == nil {
+		return nil, fmt.Errorf("Unknown instance types %v of %s", instanceTypeNames, name)
+	}
 
 	if len(asg.AvailabilityZones) < 1 {
 		return nil, fmt.Errorf("Unable to get first AvailabilityZone for %s", name)
@@ -380,13 +689,81 @@ func (m *AwsManager) getAsgTemplate(name string) (*asgTemplate, error) {
 	}
 
 	return &asgTemplate{
-		InstanceType: InstanceTypes[instanceTypeName],
-		Region:       region,
-		Zone:         az,
-		Tags:         asg.Tags,
+		InstanceType:        instanceType,
+		LargestInstanceType: largestInstanceType,
+		Region:              region,
+		Zone:                az,
+		Tags:                asg.Tags,
+		SpotPercentage:      spotPercentage,
 	}, nil
 }
 
+// getAsgInstanceTypeNames returns the instance types the ASG launches, from its
+// launch configuration or, if it has none, from its launch template or mixed
+// instances policy, the requirements of the ones it selects by their
+// attributes, and the percentage of spot instances it launches above its
+// on-demand base capacity.
+func (m *AwsManager) getAsgInstanceTypeNames(asg *autoscaling.Group) ([]string, []*instanceRequirements, int64, error) {
+	name := aws.StringValue(asg.AutoScalingGroupName)
+	if asg.LaunchConfigurationName != nil {
+		instanceTypeName, err := m.service.getInstanceTypeByLCName(*asg.LaunchConfigurationName)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return []string{instanceTypeName}, nil, 0, nil
+	}
+	if m.launchTemplates == nil {
+		return nil, nil, 0, fmt.Errorf("Unable to get the launch template of %s", name)
+	}
+	group, err := m.launchTemplates.getAsgLaunchTemplates(name)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	template := group.LaunchTemplate
+	var spotPercentage int64
+	if policy := group.MixedInstancesPolicy; policy != nil && policy.LaunchTemplate != nil {
+		spotPercentage = policy.spotPercentage()
+		var overrides []string
+		var requirements []*instanceRequirements
+		for _, override := range policy.LaunchTemplate.Overrides {
+			if override.InstanceType != nil {
+				overrides = append(overrides, *override.InstanceType)
+			}
+			if override.InstanceRequirements != nil {
+				requirements = append(requirements, override.InstanceRequirements)
+			}
+		}
+		if len(overrides) > 0 || len(requirements) > 0 {
+			return overrides, requirements, spotPercentage, nil
+		}
+		template = policy.LaunchTemplate.LaunchTemplateSpecification
+	}
+	if template == nil {
+		return nil, nil, 0, fmt.Errorf("Neither a LaunchConfiguration nor a LaunchTemplate found for %s", name)
+	}
+	instanceTypeName, requirements, err := m.launchTemplates.getInstanceTypeByLaunchTemplate(template)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if requirements != nil {
+		return nil, []*instanceRequirements{requirements}, spotPercentage, nil
+	}
+	return []string{instanceTypeName}, nil, spotPercentage, nil
+}
+
+// smallerInstanceType returns whether a has fewer vCPUs than b, or as many and
+// less memory or, with as much memory, fewer GPUs.
+func smallerInstanceType(a, b *instanceType) bool {
+	if a.VCPU != b.VCPU {
+		return a.VCPU < b.VCPU
+	}
+	if a.MemoryMb != b.MemoryMb {
+		return a.MemoryMb < b.MemoryMb
+	}
+	return a.GPU < b.GPU
+}
+
 func (m *AwsManager) buildNodeFromTemplate(asg *Asg, template *asgTemplate) (*apiv1.Node, error) {
 	node := apiv1.Node{}
 	nodeName := fmt.Sprintf("%s-asg-%d", asg.Name, rand.Int63())
@@ -406,6 +783,11 @@ func (m *AwsManager) buildNodeFromTemplate(asg *Asg, template *asgTemplate) (*ap
 	node.Status.Capacity[apiv1.ResourceCPU] = *resource.NewQuantity(template.InstanceType.VCPU, resource.DecimalSI)
 	node.Status.Capacity[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(template.InstanceType.GPU, resource.DecimalSI)
 	node.Status.Capacity[apiv1.ResourceMemory] = *resource.NewQuantity(template.InstanceType.MemoryMb*1024*1024, resource.DecimalSI)
+	// The resources tagged on the ASG, e.g. extended resources like
+	// nvidia.com/gpu, override the ones of the instance type.
+	for name, quantity := range extractAllocatableResourcesFromAsg(template.Tags) {
+		node.Status.Capacity[name] = quantity
+	}
 
 	// TODO: use proper allocatable!!
 	node.Status.Allocatable = node.Status.Capacity
@@ -427,7 +809,13 @@ func buildGenericLabels(template *asgTemplate, nodeName string) map[string]strin
 	result[kubeletapis.LabelArch] = cloudprovider.DefaultArch
 	result[kubeletapis.LabelOS] = cloudprovider.DefaultOS
 
-	result[kubeletapis.LabelInstanceType] = template.InstanceType.InstanceType
+	// The instance types selected by their attributes have no single name.
+	if template.InstanceType.InstanceType != "" {
+		result[kubeletapis.LabelInstanceType] = template.InstanceType.InstanceType
+	}
+	if template.SpotPercentage > 0 {
+		result[spotPercentageLabel] = strconv.FormatInt(template.SpotPercentage, 10)
+	}
 
 	result[kubeletapis.LabelZoneRegion] = template.Region
 	result[kubeletapis.LabelZoneFailureDomain] = template.Zone
@@ -439,8 +827,8 @@ func extractLabelsFromAsg(tags []*autoscaling.TagDescription) map[string]string
 	result := make(map[string]string)
 
 	for _, tag := range tags {
-		k := *tag.Key
-		v := *tag.Value
+		k := aws.StringValue(tag.Key)
+		v := aws.StringValue(tag.Value)
 		splits := strings.Split(k, "k8s.io/cluster-autoscaler/node-template/label/")
 		if len(splits) > 1 {
 			label := splits[1]
@@ -453,15 +841,42 @@ func extractLabelsFromAsg(tags []*autoscaling.TagDescription) map[string]string
 	return result
 }
 
+func extractAllocatableResourcesFromAsg(tags []*autoscaling.TagDescription) apiv1.ResourceList {
+	result := apiv1.ResourceList{}
+
+	for _, tag := range tags {
+		k := aws.StringValue(tag.Key)
+		v := aws.StringValue(tag.Value)
+		splits := strings.Split(k, "k8s.io/cluster-autoscaler/node-template/resources/")
+		if len(splits) > 1 {
+			name := splits[1]
+			if name == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(v)
+			if err != nil {
+				glog.Warningf("Ignoring resource tag %s: %q is not a quantity: %v", k, v, err)
+				continue
+			}
+			result[apiv1.ResourceName(name)] = quantity
+		}
+	}
+	return result
+}
+
 func extractTaintsFromAsg(tags []*autoscaling.TagDescription) []apiv1.Taint {
 	taints := make([]apiv1.Taint, 0)
 
 	for _, tag := range tags {
-		k := *tag.Key
-		v := *tag.Value
+		k := aws.StringValue(tag.Key)
+		v := aws.StringValue(tag.Value)
 		splits := strings.Split(k, "k8s.io/cluster-autoscaler/node-template/taint/")
 		if len(splits) > 1 {
 			values := strings.SplitN(v, ":", 2)
+			if len(values) < 2 {
+				glog.Warningf("Ignoring taint tag %s: %q is not of the form value:effect", k, v)
+				continue
+			}
 			taints = append(taints, apiv1.Taint{
 				Key:    splits[1],
 				Value:  values[0],
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 
@@ -27,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/stretchr/testify/assert"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
 )
@@ -71,6 +73,10 @@ func TestExtractTaintsFromAsg(t *testing.T) {
 			Key:   aws.String("k8s.io/cluster-autoscaler/node-template/taint/dedicated"),
 			Value: aws.String("foo:NoSchedule"),
 		},
+		{
+			Key:   aws.String("k8s.io/cluster-autoscaler/node-template/taint/noeffect"),
+			Value: aws.String("foo"),
+		},
 		{
 			Key:   aws.String("bar"),
 			Value: aws.String("baz"),
@@ -90,6 +96,202 @@ func TestExtractTaintsFromAsg(t *testing.T) {
 	assert.Equal(t, makeTaintSet(expectedTaints), makeTaintSet(taints))
 }
 
+func TestExtractAllocatableResourcesFromAsg(t *testing.T) {
+	tags := []*autoscaling.TagDescription{
+		{
+			Key:   aws.String("k8s.io/cluster-autoscaler/node-template/resources/nvidia.com/gpu"),
+			Value: aws.String("4"),
+		},
+		{
+			Key:   aws.String("k8s.io/cluster-autoscaler/node-template/resources/memory"),
+			Value: aws.String("2Gi"),
+		},
+		{
+			Key:   aws.String("k8s.io/cluster-autoscaler/node-template/resources/invalid"),
+			Value: aws.String("foo"),
+		},
+		{
+			Key:   aws.String("bar"),
+			Value: aws.String("baz"),
+		},
+	}
+
+	resources := extractAllocatableResourcesFromAsg(tags)
+	assert.Equal(t, 2, len(resources))
+	assert.Equal(t, resource.MustParse("4"), resources["nvidia.com/gpu"])
+	assert.Equal(t, resource.MustParse("2Gi"), resources[apiv1.ResourceMemory])
+}
+
+type launchTemplatesMock struct {
+	groups map[string]*launchTemplateGroup
+	// instanceTypes and requirements are keyed by template ID and version.
+	instanceTypes map[string]string
+	requirements  map[string]*instanceRequirements
+}
+
+func (l *launchTemplatesMock) getAsgLaunchTemplates(asgName string) (*launchTemplateGroup, error) {
+	return l.groups[asgName], nil
+}
+
+func (l *launchTemplatesMock) getInstanceTypeByLaunchTemplate(spec *launchTemplateSpecification) (string, *instanceRequirements, error) {
+	key := aws.StringValue(spec.LaunchTemplateId) + "/" + aws.StringValue(spec.Version)
+	if requirements, found := l.requirements[key]; found {
+		return "", requirements, nil
+	}
+	if instanceType, found := l.instanceTypes[key]; found {
+		return instanceType, nil, nil
+	}
+	return "", nil, fmt.Errorf("no LaunchTemplate %s", key)
+}
+
+func TestGetAsgTemplate(t *testing.T) {
+	s := &AutoScalingMock{}
+	for name, lc := range map[string]*string{"lcasg": aws.String("lc"), "ltasg": nil, "mixedasg": nil, "noneasg": nil, "abisasg": nil, "abisltasg": nil} {
+		s.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []*string{aws.String(name)},
+			MaxRecords:            aws.Int64(1),
+		}).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{{
+				AutoScalingGroupName:    aws.String(name),
+				LaunchConfigurationName: lc,
+				AvailabilityZones:       []*string{aws.String("us-east-1a")},
+				Tags: []*autoscaling.TagDescription{{
+					Key:   aws.String("k8s.io/cluster-autoscaler/node-template/label/foo"),
+					Value: aws.String("bar"),
+				}, {
+					Key:   aws.String("k8s.io/cluster-autoscaler/node-template/taint/dedicated"),
+					Value: aws.String("gpu:NoSchedule"),
+				}, {
+					Key:   aws.String("k8s.io/cluster-autoscaler/node-template/resources/nvidia.com/gpu"),
+					Value: aws.String("1"),
+				}},
+			}},
+		})
+	}
+	s.On("DescribeLaunchConfigurations", &autoscaling.DescribeLaunchConfigurationsInput{
+		LaunchConfigurationNames: []*string{aws.String("lc")},
+		MaxRecords:               aws.Int64(1),
+	}).Return(&autoscaling.DescribeLaunchConfigurationsOutput{
+		LaunchConfigurations: []*autoscaling.LaunchConfiguration{{InstanceType: aws.String("c4.large")}},
+	})
+
+	m := newTestAwsManagerWithService(s)
+	m.launchTemplates = &launchTemplatesMock{
+		groups: map[string]*launchTemplateGroup{
+			"ltasg": {LaunchTemplate: &launchTemplateSpecification{LaunchTemplateId: aws.String("lt-1"), Version: aws.String("2")}},
+			"mixedasg": {MixedInstancesPolicy: &mixedInstancesPolicy{
+				LaunchTemplate: &mixedInstancesLaunchTemplate{
+					LaunchTemplateSpecification: &launchTemplateSpecification{LaunchTemplateId: aws.String("lt-1")},
+					Overrides: []*launchTemplateOverride{
+						{InstanceType: aws.String("m4.xlarge")},
+						{InstanceType: aws.String("m4.large")},
+						{InstanceType: aws.String("unknown.large")},
+						{InstanceType: aws.String("c4.xlarge")},
+					},
+				},
+				InstancesDistribution: &instancesDistribution{
+					OnDemandBaseCapacity:                aws.Int64(1),
+					OnDemandPercentageAboveBaseCapacity: aws.Int64(25),
+				},
+			}},
+			"noneasg": {},
+			"abisasg": {MixedInstancesPolicy: &mixedInstancesPolicy{
+				LaunchTemplate: &mixedInstancesLaunchTemplate{
+					LaunchTemplateSpecification: &launchTemplateSpecification{LaunchTemplateId: aws.String("lt-1")},
+					Overrides: []*launchTemplateOverride{{
+						InstanceRequirements: &instanceRequirements{
+							VCpuCount:        &instanceRequirementRange{Min: aws.Int64(4), Max: aws.Int64(16)},
+							MemoryMiB:        &instanceRequirementRange{Min: aws.Int64(16384)},
+							AcceleratorCount: &instanceRequirementRange{Min: aws.Int64(1), Max: aws.Int64(2)},
+							AcceleratorTypes: aws.StringSlice([]string{acceleratorTypeGPU}),
+						},
+					}},
+				},
+			}},
+			"abisltasg": {LaunchTemplate: &launchTemplateSpecification{LaunchTemplateId: aws.String("lt-2"), Version: aws.String("1")}},
+		},
+		instanceTypes: map[string]string{"lt-1/2": "p2.xlarge"},
+		requirements: map[string]*instanceRequirements{
+			"lt-2/1": {
+				VCpuCount: &instanceRequirementRange{Min: aws.Int64(2)},
+				MemoryMiB: &instanceRequirementRange{Min: aws.Int64(4096), Max: aws.Int64(8192)},
+				// The accelerators may be other than GPUs.
+				AcceleratorCount: &instanceRequirementRange{Min: aws.Int64(1)},
+			},
+		},
+	}
+
+	template, err := m.getAsgTemplate("lcasg")
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceTypes["c4.large"], template.InstanceType)
+	assert.Equal(t, "us-east-1", template.Region)
+	assert.Equal(t, "us-east-1a", template.Zone)
+
+	template, err = m.getAsgTemplate("ltasg")
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceTypes["p2.xlarge"], template.InstanceType)
+
+	asg := &Asg{AwsRef: AwsRef{Name: "ltasg"}}
+	node, err := m.buildNodeFromTemplate(asg, template)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", node.Labels["foo"])
+	assert.Equal(t, "p2.xlarge", node.Labels[kubeletapis.LabelInstanceType])
+	gpus := node.Status.Capacity[apiv1.ResourceNvidiaGPU]
+	assert.Equal(t, InstanceTypes["p2.xlarge"].GPU, gpus.Value())
+	assert.Equal(t, []apiv1.Taint{{Key: "dedicated", Value: "gpu", Effect: apiv1.TaintEffectNoSchedule}}, node.Spec.Taints)
+	// The tagged extended resources can be requested by the pods.
+	gpus = node.Status.Allocatable["nvidia.com/gpu"]
+	assert.Equal(t, int64(1), gpus.Value())
+
+	assert.Empty(t, node.Labels[spotPercentageLabel])
+
+	// The smallest of the instance types of a mixed instances policy is the
+	// template.
+	template, err = m.getAsgTemplate("mixedasg")
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceTypes["m4.large"], template.InstanceType)
+	assert.Equal(t, InstanceTypes["m4.xlarge"], template.LargestInstanceType)
+	assert.Equal(t, int64(75), template.SpotPercentage)
+	node, err = m.buildNodeFromTemplate(&Asg{AwsRef: AwsRef{Name: "mixedasg"}}, template)
+	assert.NoError(t, err)
+	assert.Equal(t, "75", node.Labels[spotPercentageLabel])
+
+	_, err = m.getAsgTemplate("noneasg")
+	assert.Error(t, err)
+
+	// The template of the instance types selected by their attributes has
+	// the minimum of their requirements.
+	template, err = m.getAsgTemplate("abisasg")
+	assert.NoError(t, err)
+	assert.Equal(t, &instanceType{VCPU: 4, MemoryMb: 16384, GPU: 1}, template.InstanceType)
+	node, err = m.buildNodeFromTemplate(&Asg{AwsRef: AwsRef{Name: "abisasg"}}, template)
+	assert.NoError(t, err)
+	_, found := node.Labels[kubeletapis.LabelInstanceType]
+	assert.False(t, found)
+	cpus := node.Status.Capacity[apiv1.ResourceCPU]
+	assert.Equal(t, int64(4), cpus.Value())
+	// The largest one has the maximum of their requirements, or the most of
+	// the known instance types matching them.
+	assert.Equal(t, int64(16), template.LargestInstanceType.VCPU)
+	assert.Equal(t, int64(2), template.LargestInstanceType.GPU)
+	assert.True(t, template.LargestInstanceType.MemoryMb >= 16384)
+
+	template, err = m.getAsgTemplate("abisltasg")
+	assert.NoError(t, err)
+	assert.Equal(t, &instanceType{VCPU: 2, MemoryMb: 4096}, template.InstanceType)
+	assert.Equal(t, int64(8192), template.LargestInstanceType.MemoryMb)
+	assert.Equal(t, int64(0), template.LargestInstanceType.GPU)
+
+	nodeInfo, err := (&Asg{AwsRef: AwsRef{Name: "abisasg"}, awsManager: m}).MaxTemplateNodeInfo()
+	assert.NoError(t, err)
+	cpus = nodeInfo.Node().Status.Capacity[apiv1.ResourceCPU]
+	assert.Equal(t, int64(16), cpus.Value())
+	// An ASG launching a single instance type has no larger node.
+	nodeInfo, err = (&Asg{AwsRef: AwsRef{Name: "ltasg"}, awsManager: m}).MaxTemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Nil(t, nodeInfo)
+}
+
 func makeTaintSet(taints []apiv1.Taint) map[apiv1.Taint]bool {
 	set := make(map[apiv1.Taint]bool)
 	for _, taint := range taints {
@@ -99,7 +301,7 @@ func makeTaintSet(taints []apiv1.Taint) map[apiv1.Taint]bool {
 }
 func TestBuildAsg(t *testing.T) {
 	do := cloudprovider.NodeGroupDiscoveryOptions{}
-	m, err := createAWSManagerInternal(nil, do, &testService)
+	m, err := createAWSManagerInternal(nil, do, &testService, nil, nil)
 	assert.NoError(t, err)
 
 	asg, err := m.buildAsgFromSpec("1:5:test-asg")
@@ -163,7 +365,7 @@ func TestFetchExplicitAsgs(t *testing.T) {
 		},
 	}
 	// fetchExplicitASGs is called at manager creation time.
-	m, err := createAWSManagerInternal(nil, do, &autoScalingWrapper{s})
+	m, err := createAWSManagerInternal(nil, do, &autoScalingWrapper{s}, nil, nil)
 	assert.NoError(t, err)
 
 	asgs := m.asgCache.get()
@@ -218,7 +420,7 @@ func TestFetchAutoAsgs(t *testing.T) {
 	}
 
 	// fetchAutoASGs is called at manager creation time, via forceRefresh
-	m, err := createAWSManagerInternal(nil, do, &autoScalingWrapper{s})
+	m, err := createAWSManagerInternal(nil, do, &autoScalingWrapper{s}, nil, nil)
 	assert.NoError(t, err)
 
 	asgs := m.asgCache.get()
@@ -244,3 +446,93 @@ func TestFetchAutoAsgs(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, m.asgCache.get())
 }
+
+func TestFetchAutoAsgsSkipsInvalidAsgs(t *testing.T) {
+	tag := "tag"
+	s := &AutoScalingMock{}
+	s.On("DescribeTagsPages",
+		&autoscaling.DescribeTagsInput{
+			Filters: []*autoscaling.Filter{
+				{Name: aws.String("key"), Values: aws.StringSlice([]string{tag})},
+			},
+			MaxRecords: aws.Int64(maxRecordsReturnedByAPI),
+		},
+		mock.AnythingOfType("func(*autoscaling.DescribeTagsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeTagsOutput, bool) bool)
+		fn(&autoscaling.DescribeTagsOutput{
+			Tags: []*autoscaling.TagDescription{
+				{ResourceId: aws.String("badasg")},
+				{ResourceId: aws.String("coolasg")},
+			}}, false)
+	}).Return(nil)
+
+	groups := map[string]*autoscaling.Group{
+		"badasg":  {AutoScalingGroupName: aws.String("badasg"), MinSize: aws.Int64(5), MaxSize: aws.Int64(2)},
+		"coolasg": {AutoScalingGroupName: aws.String("coolasg"), MinSize: aws.Int64(1), MaxSize: aws.Int64(10)},
+	}
+	s.On("DescribeAutoScalingGroupsPages",
+		mock.AnythingOfType("*autoscaling.DescribeAutoScalingGroupsInput"),
+		mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool"),
+	).Run(func(args mock.Arguments) {
+		input := args.Get(0).(*autoscaling.DescribeAutoScalingGroupsInput)
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		output := &autoscaling.DescribeAutoScalingGroupsOutput{}
+		for _, name := range input.AutoScalingGroupNames {
+			output.AutoScalingGroups = append(output.AutoScalingGroups, groups[aws.StringValue(name)])
+		}
+		fn(output, false)
+	}).Return(nil)
+
+	do := cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{fmt.Sprintf("asg:tag=%s", tag)},
+	}
+
+	// The ASG whose min size exceeds its max size doesn't prevent the
+	// discovery of the other.
+	m, err := createAWSManagerInternal(nil, do, &autoScalingWrapper{s}, nil, nil)
+	assert.NoError(t, err)
+	asgs := m.asgCache.get()
+	assert.Equal(t, 1, len(asgs))
+	validateAsg(t, asgs[0].config, "coolasg", 1, 10)
+}
+
+func TestReadDescribeCacheTTL(t *testing.T) {
+	ttl, err := readDescribeCacheTTL("[global]\nzone = us-east-1a\n")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDescribeCacheTTL, ttl)
+
+	ttl, err = readDescribeCacheTTL("[global]\nzone = us-east-1a\n[autoscaler]\ndescribeCacheTTL = 30s\n")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	ttl, err = readDescribeCacheTTL("[autoscaler]\ndescribeCacheTTL = 0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	_, err = readDescribeCacheTTL("[autoscaler]\ndescribeCacheTTL = soon\n")
+	assert.Error(t, err)
+}
+
+func TestReadAutoscalerConfig(t *testing.T) {
+	cfg, err := readAutoscalerConfig("[global]\nzone = us-east-1a\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.Autoscaler.InstanceTypesCacheFile)
+
+	cfg, err = readAutoscalerConfig("[autoscaler]\ninstanceTypesCacheFile = /var/cache/instance-types.json\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/cache/instance-types.json", cfg.Autoscaler.InstanceTypesCacheFile)
+}
+
+func TestCreateAwsManagerWithAutoscalerConfig(t *testing.T) {
+	s := &AutoScalingMock{}
+	config := strings.NewReader("[global]\nzone = us-east-1a\n[autoscaler]\ndescribeCacheTTL = 0\n")
+	m, err := createAWSManagerInternal(config, cloudprovider.NodeGroupDiscoveryOptions{}, &autoScalingWrapper{s}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), m.descriptions.ttl)
+
+	// Invalid values are still rejected.
+	config = strings.NewReader("[autoscaler]\nunknown = 1\n[global]\ndisableSecurityGroupIngress = maybe\n")
+	_, err = createAWSManagerInternal(config, cloudprovider.NodeGroupDiscoveryOptions{}, &autoScalingWrapper{s}, nil, nil)
+	assert.Error(t, err)
+}
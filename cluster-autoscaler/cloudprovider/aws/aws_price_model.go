@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// AwsPriceModel implements PriceModel interface for AWS. The nodes are priced
+// at the prices of their instance types, or estimated from their resources if
+// the prices are unknown.
+type AwsPriceModel struct {
+	prices *instancePrices
+}
+
+const (
+	//TODO: Move it to a config file.
+	cpuPricePerHour         = 0.0332
+	memoryPricePerHourPerGb = 0.0044
+	gpuPricePerHour         = 0.700
+	// spotDiscount is the estimated price of a spot instance relative to
+	// the price of the same on-demand instance, when its price is unknown.
+	spotDiscount = 0.3
+
+	gigabyte = 1024.0 * 1024.0 * 1024.0
+
+	// spotPercentageLabel is set on the template nodes of the ASGs with a
+	// mixed instances policy to the percentage of spot instances they
+	// launch above their on-demand base capacity.
+	spotPercentageLabel = "k8s.io/cluster-autoscaler/aws-spot-percentage"
+)
+
+// NodePrice returns a price of running the given node for a given period of time.
+// All prices are in USD.
+func (model *AwsPriceModel) NodePrice(node *apiv1.Node, startTime time.Time, endTime time.Time) (float64, error) {
+	instanceType := node.Labels[kubeletapis.LabelInstanceType]
+	hours := getHours(startTime, endTime)
+	prices := model.prices
+	if instanceType == "" {
+		// The node stands for any of the instance types selected by
+		// their attributes, its price is estimated.
+		prices = nil
+	}
+
+	var price float64
+	if hourly, found := prices.onDemandPrice(node.Labels[kubeletapis.LabelZoneRegion], instanceType); found {
+		price = hourly * hours
+	} else {
+		price = getBasePrice(node.Status.Capacity, startTime, endTime)
+		price += getAdditionalPrice(node.Status.Capacity, startTime, endTime)
+	}
+	if percentage, err := strconv.ParseInt(node.Labels[spotPercentageLabel], 10, 64); err == nil {
+		// The node is a spot instance with the probability of the percentage.
+		spotPrice := price * spotDiscount
+		if hourly, found := prices.spotPrice(node.Labels[kubeletapis.LabelZoneFailureDomain], instanceType); found {
+			spotPrice = hourly * hours
+		}
+		spotFraction := float64(percentage) / 100.0
+		price = price*(1-spotFraction) + spotPrice*spotFraction
+	}
+	return price, nil
+}
+
+func getHours(startTime time.Time, endTime time.Time) float64 {
+	minutes := math.Ceil(float64(endTime.Sub(startTime)) / float64(time.Minute))
+	hours := minutes / 60.0
+	return hours
+}
+
+// PodPrice returns a theoretical minimum priece of running a pod for a given
+// period of time on a perfectly matching machine.
+func (model *AwsPriceModel) PodPrice(pod *apiv1.Pod, startTime time.Time, endTime time.Time) (float64, error) {
+	price := 0.0
+	for _, container := range pod.Spec.Containers {
+		price += getBasePrice(container.Resources.Requests, startTime, endTime)
+		price += getAdditionalPrice(container.Resources.Requests, startTime, endTime)
+	}
+	return price, nil
+}
+
+func getBasePrice(resources apiv1.ResourceList, startTime time.Time, endTime time.Time) float64 {
+	if len(resources) == 0 {
+		return 0
+	}
+	hours := getHours(startTime, endTime)
+	price := 0.0
+	cpu := resources[apiv1.ResourceCPU]
+	mem := resources[apiv1.ResourceMemory]
+	price += float64(cpu.MilliValue()) / 1000.0 * cpuPricePerHour * hours
+	price += float64(mem.Value()) / gigabyte * memoryPricePerHourPerGb * hours
+	return price
+}
+
+func getAdditionalPrice(resources apiv1.ResourceList, startTime time.Time, endTime time.Time) float64 {
+	if len(resources) == 0 {
+		return 0
+	}
+	hours := getHours(startTime, endTime)
+	price := 0.0
+	// The template nodes of the ASGs have the alpha GPU resource.
+	gpus := resources[gpu.ResourceNvidiaGPU]
+	alphaGpus := resources[apiv1.ResourceNvidiaGPU]
+	if alphaGpus.Cmp(gpus) > 0 {
+		gpus = alphaGpus
+	}
+	price += float64(gpus.MilliValue()) / 1000.0 * gpuPricePerHour * hours
+	return price
+}
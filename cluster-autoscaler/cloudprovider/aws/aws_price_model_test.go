@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	. "k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNodePrice(t *testing.T) {
+	model := &AwsPriceModel{}
+	now := time.Now()
+
+	// on-demand
+	node1 := BuildTestNode("sillyname1", 8000, 32*1024*1024*1024)
+	price1, err := model.NodePrice(node1, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+
+	// all spot
+	node2 := BuildTestNode("sillyname2", 8000, 32*1024*1024*1024)
+	node2.Labels = map[string]string{spotPercentageLabel: "100"}
+	price2, err := model.NodePrice(node2, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	// spot nodes should be way cheaper than on-demand.
+	assert.True(t, price1 > 3*price2)
+
+	// half spot
+	node3 := BuildTestNode("sillyname3", 8000, 32*1024*1024*1024)
+	node3.Labels = map[string]string{spotPercentageLabel: "50"}
+	price3, err := model.NodePrice(node3, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, price2 < price3)
+	assert.True(t, price3 < price1)
+
+	// on-demand with gpu, as on the template nodes
+	node4 := BuildTestNode("sillyname4", 8000, 32*1024*1024*1024)
+	node4.Status.Capacity[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(1, resource.DecimalSI)
+	price4, err := model.NodePrice(node4, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, price4 > price1+gpuPricePerHour/2)
+}
+
+func TestGetNodePriceFromInstancePrices(t *testing.T) {
+	model := &AwsPriceModel{prices: newInstancePrices(&instancePriceDescriberMock{
+		onDemand: map[string]float64{"us-east-1/m4.large": 0.1},
+		spot:     map[string]float64{"us-east-1a/m4.large": 0.03},
+	})}
+	now := time.Now()
+	labels := func(spotPercentage string) map[string]string {
+		labels := map[string]string{
+			kubeletapis.LabelInstanceType:      "m4.large",
+			kubeletapis.LabelZoneRegion:        "us-east-1",
+			kubeletapis.LabelZoneFailureDomain: "us-east-1a",
+		}
+		if spotPercentage != "" {
+			labels[spotPercentageLabel] = spotPercentage
+		}
+		return labels
+	}
+
+	// on-demand
+	node1 := BuildTestNode("sillyname1", 2000, 8*1024*1024*1024)
+	node1.Labels = labels("")
+	price1, err := model.NodePrice(node1, now, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.2, price1, 1e-9)
+
+	// half spot
+	node2 := BuildTestNode("sillyname2", 2000, 8*1024*1024*1024)
+	node2.Labels = labels("50")
+	price2, err := model.NodePrice(node2, now, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.1+0.03, price2, 1e-9)
+
+	// unknown price, estimated
+	node3 := BuildTestNode("sillyname3", 2000, 8*1024*1024*1024)
+	node3.Labels = labels("")
+	node3.Labels[kubeletapis.LabelInstanceType] = "c4.large"
+	price3, err := model.NodePrice(node3, now, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	estimated, err := (&AwsPriceModel{}).NodePrice(node3, now, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, estimated, price3)
+
+	// no instance type, estimated without describing a price
+	describer := &instancePriceDescriberMock{}
+	node4 := BuildTestNode("sillyname4", 2000, 8*1024*1024*1024)
+	node4.Labels = labels("")
+	delete(node4.Labels, kubeletapis.LabelInstanceType)
+	price4, err := (&AwsPriceModel{prices: newInstancePrices(describer)}).NodePrice(node4, now, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, estimated, price4)
+	assert.Equal(t, 0, describer.calls)
+}
+
+func TestGetPodPrice(t *testing.T) {
+	pod1 := BuildTestPod("a1", 100, 500*1024*1024)
+	pod2 := BuildTestPod("a2", 2*100, 2*500*1024*1024)
+
+	model := &AwsPriceModel{}
+	now := time.Now()
+
+	price1, err := model.PodPrice(pod1, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	price2, err := model.PodPrice(pod2, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	// 2 times bigger pod should cost twice as much.
+	assert.InDelta(t, 2*price1, price2, 1e-9)
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/jsonrpc"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+const (
+	// onDemandPriceTTL is how long the on-demand prices, which seldom
+	// change, are cached.
+	onDemandPriceTTL = 24 * time.Hour
+	// spotPriceTTL is how long the spot prices are cached, as are the
+	// prices which couldn't be described.
+	spotPriceTTL = 10 * time.Minute
+
+	// The prices are the ones of the Linux instances.
+	linuxSpotProductDescription = "Linux/UNIX"
+)
+
+// The vendored AWS SDK predates the Price List Service API. Its client and the
+// request and response of the GetProducts API call are declared below, with
+// only the fields used by the autoscaler.
+const (
+	pricingServiceName        = "pricing"
+	pricingEndpointsID        = "api.pricing"
+	pricingAPIVersion         = "2017-10-15"
+	pricingTargetPrefix       = "AWSPriceListService"
+	opGetProducts             = "GetProducts"
+	pricingRegion             = "us-east-1"
+	pricingEC2ServiceCode     = "AmazonEC2"
+	pricingTermMatch          = "TERM_MATCH"
+	pricingHourlyUnit         = "Hrs"
+	pricingCurrency           = "USD"
+	maxProductsPerGetProducts = 10
+)
+
+// instancePriceDescriber describes the hourly prices in USD of the instances.
+type instancePriceDescriber interface {
+	// getOnDemandPrice returns the price of an on-demand instance of the
+	// type in the region.
+	getOnDemandPrice(region string, instanceType string) (float64, error)
+	// getSpotPrice returns the current price of a spot instance of the type
+	// in the zone.
+	getSpotPrice(zone string, instanceType string) (float64, error)
+}
+
+type cachedPrice struct {
+	price  float64
+	found  bool
+	expiry time.Time
+}
+
+// instancePrices caches the prices of the instances, described again once
+// expired. The zero value knows no prices.
+type instancePrices struct {
+	describer instancePriceDescriber
+	prices    map[string]*cachedPrice
+	mutex     sync.Mutex
+}
+
+func newInstancePrices(describer instancePriceDescriber) *instancePrices {
+	return &instancePrices{
+		describer: describer,
+		prices:    make(map[string]*cachedPrice),
+	}
+}
+
+// onDemandPrice returns the hourly price of an on-demand instance of the type
+// in the region, if known.
+func (p *instancePrices) onDemandPrice(region string, instanceType string) (float64, bool) {
+	return p.get(fmt.Sprintf("on-demand/%s/%s", region, instanceType), onDemandPriceTTL, func() (float64, error) {
+		return p.describer.getOnDemandPrice(region, instanceType)
+	})
+}
+
+// spotPrice returns the current hourly price of a spot instance of the type in
+// the zone, if known.
+func (p *instancePrices) spotPrice(zone string, instanceType string) (float64, bool) {
+	return p.get(fmt.Sprintf("spot/%s/%s", zone, instanceType), spotPriceTTL, func() (float64, error) {
+		return p.describer.getSpotPrice(zone, instanceType)
+	})
+}
+
+// get returns the cached price, described again if it expired. The price is
+// described without holding the lock of the cache, so that the other prices
+// can be read meanwhile.
+func (p *instancePrices) get(key string, ttl time.Duration, describe func() (float64, error)) (float64, bool) {
+	if p == nil || p.describer == nil {
+		return 0, false
+	}
+	p.mutex.Lock()
+	if cached, found := p.prices[key]; found && time.Now().Before(cached.expiry) {
+		p.mutex.Unlock()
+		return cached.price, cached.found
+	}
+	p.mutex.Unlock()
+
+	cached := &cachedPrice{}
+	if price, err := describe(); err != nil {
+		glog.Warningf("Failed to describe the %s price, estimating it: %v", key, err)
+		cached.expiry = time.Now().Add(spotPriceTTL)
+	} else {
+		glog.V(4).Infof("The %s price is %v", key, price)
+		cached.price, cached.found = price, true
+		cached.expiry = time.Now().Add(ttl)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.prices[key] = cached
+	return cached.price, cached.found
+}
+
+type pricingFilter struct {
+	_ struct{} `type:"structure"`
+
+	Field *string `type:"string"`
+	Type  *string `type:"string"`
+	Value *string `type:"string"`
+}
+
+type getProductsInput struct {
+	_ struct{} `type:"structure"`
+
+	Filters     []*pricingFilter `type:"list"`
+	MaxResults  *int64           `min:"1" type:"integer"`
+	ServiceCode *string          `type:"string"`
+}
+
+type getProductsOutput struct {
+	_ struct{} `type:"structure"`
+
+	// PriceList are the products, each a JSON document.
+	PriceList []*string `type:"list"`
+}
+
+// product is the part of a product of the Price List Service with its
+// on-demand prices.
+type product struct {
+	Terms struct {
+		OnDemand map[string]struct {
+			PriceDimensions map[string]struct {
+				Unit         string            `json:"unit"`
+				PricePerUnit map[string]string `json:"pricePerUnit"`
+			} `json:"priceDimensions"`
+		} `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// awsInstancePrices describes the on-demand prices with the Price List Service
+// and the spot prices with the EC2 service.
+type awsInstancePrices struct {
+	ec2     *ec2.EC2
+	pricing *client.Client
+}
+
+// newPricingClient creates a client of the Price List Service, whose endpoint
+// is in pricingRegion whatever the region of the instances.
+func newPricingClient(p client.ConfigProvider) *client.Client {
+	c := p.ClientConfig(pricingEndpointsID, &aws.Config{Region: aws.String(pricingRegion)})
+	pricing := client.New(
+		*c.Config,
+		metadata.ClientInfo{
+			ServiceName:   pricingServiceName,
+			SigningName:   pricingServiceName,
+			SigningRegion: c.SigningRegion,
+			Endpoint:      c.Endpoint,
+			APIVersion:    pricingAPIVersion,
+			JSONVersion:   "1.1",
+			TargetPrefix:  pricingTargetPrefix,
+		},
+		c.Handlers,
+	)
+	pricing.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	pricing.Handlers.Build.PushBackNamed(jsonrpc.BuildHandler)
+	pricing.Handlers.Unmarshal.PushBackNamed(jsonrpc.UnmarshalHandler)
+	pricing.Handlers.UnmarshalMeta.PushBackNamed(jsonrpc.UnmarshalMetaHandler)
+	pricing.Handlers.UnmarshalError.PushBackNamed(jsonrpc.UnmarshalErrorHandler)
+	return pricing
+}
+
+func (d *awsInstancePrices) getOnDemandPrice(region string, instanceType string) (float64, error) {
+	filters := []*pricingFilter{}
+	for field, value := range map[string]string{
+		"instanceType":    instanceType,
+		"regionCode":      region,
+		"operatingSystem": "Linux",
+		"tenancy":         "Shared",
+		"preInstalledSw":  "NA",
+		"capacitystatus":  "Used",
+	} {
+		filters = append(filters, &pricingFilter{
+			Field: aws.String(field),
+			Type:  aws.String(pricingTermMatch),
+			Value: aws.String(value),
+		})
+	}
+	input := &getProductsInput{
+		Filters:     filters,
+		MaxResults:  aws.Int64(maxProductsPerGetProducts),
+		ServiceCode: aws.String(pricingEC2ServiceCode),
+	}
+	output := &getProductsOutput{}
+	op := &request.Operation{Name: opGetProducts, HTTPMethod: "POST", HTTPPath: "/"}
+	if err := d.pricing.NewRequest(op, input, output).Send(); err != nil {
+		return 0, err
+	}
+	for _, priceList := range output.PriceList {
+		var p product
+		if err := json.Unmarshal([]byte(aws.StringValue(priceList)), &p); err != nil {
+			return 0, fmt.Errorf("malformed product of %s in %s: %v", instanceType, region, err)
+		}
+		for _, term := range p.Terms.OnDemand {
+			for _, dimension := range term.PriceDimensions {
+				if dimension.Unit != pricingHourlyUnit {
+					continue
+				}
+				price, err := strconv.ParseFloat(dimension.PricePerUnit[pricingCurrency], 64)
+				if err == nil && price > 0 {
+					return price, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no on-demand price of %s in %s", instanceType, region)
+}
+
+func (d *awsInstancePrices) getSpotPrice(zone string, instanceType string) (float64, error) {
+	output, err := d.ec2.DescribeSpotPriceHistory(&ec2.DescribeSpotPriceHistoryInput{
+		AvailabilityZone:    aws.String(zone),
+		InstanceTypes:       []*string{aws.String(instanceType)},
+		ProductDescriptions: []*string{aws.String(linuxSpotProductDescription)},
+		// The history starting now is the current price.
+		StartTime: aws.Time(time.Now()),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var latest *ec2.SpotPrice
+	for _, spotPrice := range output.SpotPriceHistory {
+		if latest == nil || aws.TimeValue(spotPrice.Timestamp).After(aws.TimeValue(latest.Timestamp)) {
+			latest = spotPrice
+		}
+	}
+	if latest == nil {
+		return 0, fmt.Errorf("no spot price of %s in %s", instanceType, zone)
+	}
+	return strconv.ParseFloat(aws.StringValue(latest.SpotPrice), 64)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+const getProductsResponse = `{
+  "FormatVersion": "aws_v1",
+  "PriceList": [
+    "{\"product\":{\"attributes\":{\"instanceType\":\"m4.large\"}},\"terms\":{\"OnDemand\":{\"SKU.JRTCKXETXF\":{\"priceDimensions\":{\"SKU.JRTCKXETXF.6YS6EN2CT7\":{\"unit\":\"Hrs\",\"pricePerUnit\":{\"USD\":\"0.1000000000\"}}}}}}}"
+  ]
+}`
+
+const describeSpotPriceHistoryResponse = `<DescribeSpotPriceHistoryResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <spotPriceHistorySet>
+    <item>
+      <instanceType>m4.large</instanceType>
+      <productDescription>Linux/UNIX</productDescription>
+      <spotPrice>0.025000</spotPrice>
+      <timestamp>2017-11-01T10:00:00.000Z</timestamp>
+      <availabilityZone>us-east-1a</availabilityZone>
+    </item>
+    <item>
+      <instanceType>m4.large</instanceType>
+      <productDescription>Linux/UNIX</productDescription>
+      <spotPrice>0.030000</spotPrice>
+      <timestamp>2017-11-01T11:00:00.000Z</timestamp>
+      <availabilityZone>us-east-1a</availabilityZone>
+    </item>
+  </spotPriceHistorySet>
+</DescribeSpotPriceHistoryResponse>`
+
+func newTestSession(t *testing.T, handler func(r *http.Request) string) (*session.Session, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, handler(r))
+	}))
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	return sess, server.Close
+}
+
+func TestGetOnDemandPrice(t *testing.T) {
+	var input struct {
+		Filters []struct {
+			Field string
+			Value string
+		}
+		ServiceCode string
+	}
+	sess, cleanup := newTestSession(t, func(r *http.Request) string {
+		assert.Equal(t, "AWSPriceListService.GetProducts", r.Header.Get("X-Amz-Target"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		return getProductsResponse
+	})
+	defer cleanup()
+
+	prices := &awsInstancePrices{pricing: newPricingClient(sess)}
+	price, err := prices.getOnDemandPrice("eu-west-1", "m4.large")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, price)
+	assert.Equal(t, "AmazonEC2", input.ServiceCode)
+	filters := make(map[string]string)
+	for _, filter := range input.Filters {
+		filters[filter.Field] = filter.Value
+	}
+	assert.Equal(t, "m4.large", filters["instanceType"])
+	assert.Equal(t, "eu-west-1", filters["regionCode"])
+	assert.Equal(t, "Linux", filters["operatingSystem"])
+}
+
+func TestGetSpotPrice(t *testing.T) {
+	var form url.Values
+	sess, cleanup := newTestSession(t, func(r *http.Request) string {
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		return describeSpotPriceHistoryResponse
+	})
+	defer cleanup()
+
+	prices := &awsInstancePrices{ec2: ec2.New(sess)}
+	price, err := prices.getSpotPrice("us-east-1a", "m4.large")
+	assert.NoError(t, err)
+	// The latest price is the current one.
+	assert.Equal(t, 0.03, price)
+	assert.Equal(t, "DescribeSpotPriceHistory", form.Get("Action"))
+	assert.Equal(t, "us-east-1a", form.Get("AvailabilityZone"))
+	assert.Equal(t, "m4.large", form.Get("InstanceType.1"))
+	assert.Equal(t, linuxSpotProductDescription, form.Get("ProductDescription.1"))
+}
+
+type instancePriceDescriberMock struct {
+	onDemand map[string]float64
+	spot     map[string]float64
+	calls    int
+}
+
+func (d *instancePriceDescriberMock) getOnDemandPrice(region string, instanceType string) (float64, error) {
+	d.calls++
+	if price, found := d.onDemand[region+"/"+instanceType]; found {
+		return price, nil
+	}
+	return 0, fmt.Errorf("no on-demand price")
+}
+
+func (d *instancePriceDescriberMock) getSpotPrice(zone string, instanceType string) (float64, error) {
+	d.calls++
+	if price, found := d.spot[zone+"/"+instanceType]; found {
+		return price, nil
+	}
+	return 0, fmt.Errorf("no spot price")
+}
+
+func TestInstancePrices(t *testing.T) {
+	describer := &instancePriceDescriberMock{
+		onDemand: map[string]float64{"us-east-1/m4.large": 0.1},
+		spot:     map[string]float64{"us-east-1a/m4.large": 0.03},
+	}
+	prices := newInstancePrices(describer)
+
+	for i := 0; i < 2; i++ {
+		price, found := prices.onDemandPrice("us-east-1", "m4.large")
+		assert.True(t, found)
+		assert.Equal(t, 0.1, price)
+		price, found = prices.spotPrice("us-east-1a", "m4.large")
+		assert.True(t, found)
+		assert.Equal(t, 0.03, price)
+		_, found = prices.onDemandPrice("us-east-1", "c4.large")
+		assert.False(t, found)
+	}
+	// The prices, found or not, are described only once until they expire.
+	assert.Equal(t, 3, describer.calls)
+	prices.prices["spot/us-east-1a/m4.large"].expiry = prices.prices["spot/us-east-1a/m4.large"].expiry.Add(-spotPriceTTL)
+	prices.spotPrice("us-east-1a", "m4.large")
+	assert.Equal(t, 4, describer.calls)
+
+	// No prices are known without a describer.
+	var none *instancePrices
+	_, found := none.onDemandPrice("us-east-1", "m4.large")
+	assert.False(t, found)
+}
+
+// blockingSpotPriceDescriber describes the spot prices once released.
+type blockingSpotPriceDescriber struct {
+	*instancePriceDescriberMock
+	describing chan struct{}
+	release    chan struct{}
+}
+
+func (d *blockingSpotPriceDescriber) getSpotPrice(zone string, instanceType string) (float64, error) {
+	close(d.describing)
+	<-d.release
+	return d.instancePriceDescriberMock.getSpotPrice(zone, instanceType)
+}
+
+func TestInstancePricesReadWhileDescribed(t *testing.T) {
+	describer := &blockingSpotPriceDescriber{
+		instancePriceDescriberMock: &instancePriceDescriberMock{
+			onDemand: map[string]float64{"us-east-1/m4.large": 0.1},
+			spot:     map[string]float64{"us-east-1a/m4.large": 0.03},
+		},
+		describing: make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	prices := newInstancePrices(describer)
+	_, found := prices.onDemandPrice("us-east-1", "m4.large")
+	assert.True(t, found)
+
+	spotPrice := make(chan float64)
+	go func() {
+		price, _ := prices.spotPrice("us-east-1a", "m4.large")
+		spotPrice <- price
+	}()
+	<-describer.describing
+
+	// The cached prices are read while the spot price is being described.
+	read := make(chan float64)
+	go func() {
+		price, _ := prices.onDemandPrice("us-east-1", "m4.large")
+		read <- price
+	}()
+	select {
+	case price := <-read:
+		assert.Equal(t, 0.1, price)
+	case <-time.After(time.Second):
+		t.Fatal("The cached price wasn't read while a price was being described")
+	}
+
+	close(describer.release)
+	assert.Equal(t, 0.03, <-spotPrice)
+	assert.Equal(t, 2, describer.calls)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The vendored AWS SDK predates the DescribeInstanceTypes API call. Its request
+// and response are declared below, with only the fields used by the
+// autoscaler, and sent with the client of the SDK, like the ones describing the
+// launch templates.
+
+const (
+	opDescribeInstanceTypes = "DescribeInstanceTypes"
+
+	// maxInstanceTypesPerDescribe is the maximum number of instance types
+	// described per call.
+	maxInstanceTypesPerDescribe = 100
+)
+
+// instanceTypeDescriber describes the instance types EC2 offers in the region.
+type instanceTypeDescriber interface {
+	// describeInstanceTypes returns the instance types by name.
+	describeInstanceTypes() (map[string]*instanceType, error)
+}
+
+type describeInstanceTypesInput struct {
+	_ struct{} `type:"structure"`
+
+	MaxResults *int64  `type:"integer"`
+	NextToken  *string `type:"string"`
+}
+
+type vCpuInfo struct {
+	_ struct{} `type:"structure"`
+
+	DefaultVCpus *int64 `locationName:"defaultVCpus" type:"integer"`
+}
+
+type memoryInfo struct {
+	_ struct{} `type:"structure"`
+
+	SizeInMiB *int64 `locationName:"sizeInMiB" type:"long"`
+}
+
+type gpuDeviceInfo struct {
+	_ struct{} `type:"structure"`
+
+	Count *int64 `locationName:"count" type:"integer"`
+}
+
+type gpuInfo struct {
+	_ struct{} `type:"structure"`
+
+	Gpus []*gpuDeviceInfo `locationName:"gpus" locationNameList:"item" type:"list"`
+}
+
+type instanceTypeInfo struct {
+	_ struct{} `type:"structure"`
+
+	InstanceType *string     `locationName:"instanceType" type:"string"`
+	VCpuInfo     *vCpuInfo   `locationName:"vCpuInfo" type:"structure"`
+	MemoryInfo   *memoryInfo `locationName:"memoryInfo" type:"structure"`
+	GpuInfo      *gpuInfo    `locationName:"gpuInfo" type:"structure"`
+}
+
+type describeInstanceTypesOutput struct {
+	_ struct{} `type:"structure"`
+
+	InstanceTypes []*instanceTypeInfo `locationName:"instanceTypeSet" locationNameList:"item" type:"list"`
+	NextToken     *string             `locationName:"nextToken" type:"string"`
+}
+
+// awsInstanceTypes describes the instance types with the client of the EC2
+// service.
+type awsInstanceTypes struct {
+	ec2 *client.Client
+}
+
+func (d *awsInstanceTypes) describeInstanceTypes() (map[string]*instanceType, error) {
+	instanceTypes := make(map[string]*instanceType)
+	input := &describeInstanceTypesInput{
+		MaxResults: aws.Int64(maxInstanceTypesPerDescribe),
+	}
+	for {
+		output := &describeInstanceTypesOutput{}
+		op := &request.Operation{Name: opDescribeInstanceTypes, HTTPMethod: "POST", HTTPPath: "/"}
+		if err := d.ec2.NewRequest(op, input, output).Send(); err != nil {
+			return nil, err
+		}
+		for _, info := range output.InstanceTypes {
+			t := info.instanceType()
+			instanceTypes[t.InstanceType] = t
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return instanceTypes, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// instanceType returns the resources of the instance type.
+func (info *instanceTypeInfo) instanceType() *instanceType {
+	t := &instanceType{
+		InstanceType: aws.StringValue(info.InstanceType),
+	}
+	if info.VCpuInfo != nil {
+		t.VCPU = aws.Int64Value(info.VCpuInfo.DefaultVCpus)
+	}
+	if info.MemoryInfo != nil {
+		t.MemoryMb = aws.Int64Value(info.MemoryInfo.SizeInMiB)
+	}
+	if info.GpuInfo != nil {
+		for _, gpu := range info.GpuInfo.Gpus {
+			t.GPU += aws.Int64Value(gpu.Count)
+		}
+	}
+	return t
+}
+
+// readInstanceTypesCache reads the instance types saved to the file by
+// writeInstanceTypesCache.
+func readInstanceTypesCache(file string) (map[string]*instanceType, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var instanceTypes map[string]*instanceType
+	if err := json.Unmarshal(data, &instanceTypes); err != nil {
+		return nil, fmt.Errorf("malformed instance types cache: %v", err)
+	}
+	if len(instanceTypes) == 0 {
+		return nil, fmt.Errorf("no instance types cached")
+	}
+	return instanceTypes, nil
+}
+
+// writeInstanceTypesCache saves the instance types to the file, replacing it
+// at once so that it's never read partially written.
+func writeInstanceTypesCache(file string, instanceTypes map[string]*instanceType) error {
+	data, err := json.Marshal(instanceTypes)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const describeInstanceTypesFirstPage = `<DescribeInstanceTypesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <instanceTypeSet>
+    <item>
+      <instanceType>m7.large</instanceType>
+      <vCpuInfo>
+        <defaultVCpus>2</defaultVCpus>
+      </vCpuInfo>
+      <memoryInfo>
+        <sizeInMiB>8192</sizeInMiB>
+      </memoryInfo>
+    </item>
+  </instanceTypeSet>
+  <nextToken>page-2</nextToken>
+</DescribeInstanceTypesResponse>`
+
+const describeInstanceTypesSecondPage = `<DescribeInstanceTypesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>2</requestId>
+  <instanceTypeSet>
+    <item>
+      <instanceType>p7.xlarge</instanceType>
+      <vCpuInfo>
+        <defaultVCpus>4</defaultVCpus>
+      </vCpuInfo>
+      <memoryInfo>
+        <sizeInMiB>62464</sizeInMiB>
+      </memoryInfo>
+      <gpuInfo>
+        <gpus>
+          <item>
+            <count>1</count>
+          </item>
+          <item>
+            <count>2</count>
+          </item>
+        </gpus>
+      </gpuInfo>
+    </item>
+  </instanceTypeSet>
+</DescribeInstanceTypesResponse>`
+
+func TestDescribeInstanceTypes(t *testing.T) {
+	var tokens []string
+	templates, cleanup := newTestLaunchTemplates(t, func(form url.Values) string {
+		assert.Equal(t, "DescribeInstanceTypes", form.Get("Action"))
+		assert.Equal(t, fmt.Sprint(maxInstanceTypesPerDescribe), form.Get("MaxResults"))
+		tokens = append(tokens, form.Get("NextToken"))
+		if form.Get("NextToken") == "" {
+			return describeInstanceTypesFirstPage
+		}
+		return describeInstanceTypesSecondPage
+	})
+	defer cleanup()
+
+	instanceTypes, err := (&awsInstanceTypes{ec2: templates.ec2}).describeInstanceTypes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "page-2"}, tokens)
+	assert.Equal(t, map[string]*instanceType{
+		"m7.large": {
+			InstanceType: "m7.large",
+			VCPU:         2,
+			MemoryMb:     8192,
+		},
+		"p7.xlarge": {
+			InstanceType: "p7.xlarge",
+			VCPU:         4,
+			MemoryMb:     62464,
+			GPU:          3,
+		},
+	}, instanceTypes)
+}
+
+type instanceTypeDescriberMock struct {
+	instanceTypes map[string]*instanceType
+	err           error
+}
+
+func (d *instanceTypeDescriberMock) describeInstanceTypes() (map[string]*instanceType, error) {
+	return d.instanceTypes, d.err
+}
+
+func TestRefreshInstanceTypes(t *testing.T) {
+	m7 := &instanceType{InstanceType: "m7.large", VCPU: 2, MemoryMb: 8192}
+	describer := &instanceTypeDescriberMock{
+		instanceTypes: map[string]*instanceType{"m7.large": m7},
+	}
+	m := newTestAwsManagerWithService(&AutoScalingMock{})
+	m.instanceTypeDescriber = describer
+
+	// The generated instance types are known before any is described...
+	_, found := m.getInstanceType("m7.large")
+	assert.False(t, found)
+	c4, found := m.getInstanceType("c4.large")
+	assert.True(t, found)
+	assert.Equal(t, InstanceTypes["c4.large"], c4)
+
+	// ...and still are after.
+	m.refreshInstanceTypes()
+	described, found := m.getInstanceType("m7.large")
+	assert.True(t, found)
+	assert.Equal(t, m7, described)
+	_, found = m.getInstanceType("c4.large")
+	assert.True(t, found)
+
+	// The instance types described before are kept when describing them
+	// fails.
+	describer.instanceTypes, describer.err = nil, fmt.Errorf("access denied")
+	m.nextInstanceTypesRefresh = m.nextInstanceTypesRefresh.Add(-instanceTypesRefreshInterval)
+	m.refreshInstanceTypes()
+	_, found = m.getInstanceType("m7.large")
+	assert.True(t, found)
+}
+
+func TestRefreshInstanceTypesCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-types")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "instance-types.json")
+
+	// The described instance types are saved to the cache file...
+	m7 := &instanceType{InstanceType: "m7.large", VCPU: 2, MemoryMb: 8192}
+	m := newTestAwsManagerWithService(&AutoScalingMock{})
+	m.instanceTypeDescriber = &instanceTypeDescriberMock{
+		instanceTypes: map[string]*instanceType{"m7.large": m7},
+	}
+	m.instanceTypesCacheFile = file
+	m.refreshInstanceTypes()
+
+	// ...and read from it when they can't be described at start.
+	m = newTestAwsManagerWithService(&AutoScalingMock{})
+	m.instanceTypeDescriber = &instanceTypeDescriberMock{err: fmt.Errorf("access denied")}
+	m.instanceTypesCacheFile = file
+	m.refreshInstanceTypes()
+	cached, found := m.getInstanceType("m7.large")
+	assert.True(t, found)
+	assert.Equal(t, m7, cached)
+	_, found = m.getInstanceType("c4.large")
+	assert.True(t, found)
+
+	// Only the generated instance types are known without a valid cache
+	// file.
+	assert.NoError(t, ioutil.WriteFile(file, []byte("{"), 0644))
+	m = newTestAwsManagerWithService(&AutoScalingMock{})
+	m.instanceTypeDescriber = &instanceTypeDescriberMock{err: fmt.Errorf("access denied")}
+	m.instanceTypesCacheFile = file
+	m.refreshInstanceTypes()
+	_, found = m.getInstanceType("m7.large")
+	assert.False(t, found)
+	_, found = m.getInstanceType("c4.large")
+	assert.True(t, found)
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// The vendored AWS SDK predates the launch templates. The requests and
+// responses of the API calls describing them are declared below, with only the
+// fields used by the autoscaler, and sent with the clients of the SDK.
+
+const (
+	opDescribeAutoScalingGroups      = "DescribeAutoScalingGroups"
+	opDescribeLaunchTemplateVersions = "DescribeLaunchTemplateVersions"
+
+	// defaultLaunchTemplateVersion is the version of the launch template of
+	// an ASG which doesn't specify one.
+	defaultLaunchTemplateVersion = "$Default"
+
+	// acceleratorTypeGPU is the type of the GPU accelerators in the
+	// requirements of the instance types.
+	acceleratorTypeGPU = "gpu"
+)
+
+// launchTemplates describes the launch templates of the ASGs.
+type launchTemplates interface {
+	// getAsgLaunchTemplates returns the launch template and the mixed
+	// instances policy of the ASG, either of which may be nil.
+	getAsgLaunchTemplates(asgName string) (*launchTemplateGroup, error)
+	// getInstanceTypeByLaunchTemplate returns the instance type of the
+	// version of the launch template or, if it selects its instance types
+	// by their attributes, the requirements of the instance types.
+	getInstanceTypeByLaunchTemplate(spec *launchTemplateSpecification) (string, *instanceRequirements, error)
+}
+
+// launchTemplateSpecification is the launch template of an ASG.
+type launchTemplateSpecification struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateId   *string `min:"1" type:"string"`
+	LaunchTemplateName *string `min:"3" type:"string"`
+	Version            *string `min:"1" type:"string"`
+}
+
+// instanceRequirementRange is the range of an attribute of the instance types
+// selected by their attributes, without maximum when Max is nil.
+type instanceRequirementRange struct {
+	_ struct{} `type:"structure"`
+
+	Min *int64 `type:"integer"`
+	Max *int64 `type:"integer"`
+}
+
+// instanceRequirements are the attributes of the instance types an ASG
+// launches, any instance type matching them, instead of a list of instance
+// types.
+type instanceRequirements struct {
+	_ struct{} `type:"structure"`
+
+	VCpuCount        *instanceRequirementRange `type:"structure"`
+	MemoryMiB        *instanceRequirementRange `type:"structure"`
+	AcceleratorCount *instanceRequirementRange `type:"structure"`
+	AcceleratorTypes []*string                 `type:"list"`
+}
+
+// launchTemplateOverride is an instance type, or the requirements of the
+// instance types, an ASG with a mixed instances policy can launch instead of
+// the one of its launch template.
+type launchTemplateOverride struct {
+	_ struct{} `type:"structure"`
+
+	InstanceType         *string               `min:"1" type:"string"`
+	InstanceRequirements *instanceRequirements `type:"structure"`
+}
+
+type mixedInstancesLaunchTemplate struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateSpecification *launchTemplateSpecification `type:"structure"`
+	Overrides                   []*launchTemplateOverride    `type:"list"`
+}
+
+// instancesDistribution is the split between the on-demand and the spot
+// instances of an ASG with a mixed instances policy.
+type instancesDistribution struct {
+	_ struct{} `type:"structure"`
+
+	OnDemandBaseCapacity                *int64 `type:"integer"`
+	OnDemandPercentageAboveBaseCapacity *int64 `type:"integer"`
+}
+
+// mixedInstancesPolicy lets an ASG launch several instance types, on-demand
+// and spot.
+type mixedInstancesPolicy struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplate        *mixedInstancesLaunchTemplate `type:"structure"`
+	InstancesDistribution *instancesDistribution        `type:"structure"`
+}
+
+type launchTemplateGroup struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string                      `min:"1" type:"string"`
+	LaunchTemplate       *launchTemplateSpecification `type:"structure"`
+	MixedInstancesPolicy *mixedInstancesPolicy        `type:"structure"`
+}
+
+type describeLaunchTemplateGroupsOutput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroups []*launchTemplateGroup `type:"list"`
+}
+
+type describeLaunchTemplateVersionsInput struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateId   *string   `type:"string"`
+	LaunchTemplateName *string   `min:"3" type:"string"`
+	Versions           []*string `locationName:"LaunchTemplateVersion" locationNameList:"item" type:"list"`
+}
+
+// The EC2 service names the fields of the requirements differently than the
+// Auto Scaling service.
+
+type ec2InstanceRequirementRange struct {
+	_ struct{} `type:"structure"`
+
+	Min *int64 `locationName:"min" type:"integer"`
+	Max *int64 `locationName:"max" type:"integer"`
+}
+
+type ec2InstanceRequirements struct {
+	_ struct{} `type:"structure"`
+
+	VCpuCount        *ec2InstanceRequirementRange `locationName:"vCpuCount" type:"structure"`
+	MemoryMiB        *ec2InstanceRequirementRange `locationName:"memoryMiB" type:"structure"`
+	AcceleratorCount *ec2InstanceRequirementRange `locationName:"acceleratorCount" type:"structure"`
+	AcceleratorTypes []*string                    `locationName:"acceleratorTypeSet" locationNameList:"item" type:"list"`
+}
+
+type launchTemplateData struct {
+	_ struct{} `type:"structure"`
+
+	InstanceType         *string                  `locationName:"instanceType" type:"string"`
+	InstanceRequirements *ec2InstanceRequirements `locationName:"instanceRequirements" type:"structure"`
+}
+
+type launchTemplateVersion struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateData *launchTemplateData `locationName:"launchTemplateData" type:"structure"`
+}
+
+type describeLaunchTemplateVersionsOutput struct {
+	_ struct{} `type:"structure"`
+
+	LaunchTemplateVersions []*launchTemplateVersion `locationName:"launchTemplateVersionSet" locationNameList:"item" type:"list"`
+}
+
+// awsLaunchTemplates describes the launch templates with the clients of the
+// Auto Scaling and EC2 services.
+type awsLaunchTemplates struct {
+	autoscaling *client.Client
+	ec2         *client.Client
+}
+
+func (l *awsLaunchTemplates) getAsgLaunchTemplates(asgName string) (*launchTemplateGroup, error) {
+	input := &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(asgName)},
+		MaxRecords:            aws.Int64(1),
+	}
+	output := &describeLaunchTemplateGroupsOutput{}
+	op := &request.Operation{Name: opDescribeAutoScalingGroups, HTTPMethod: "POST", HTTPPath: "/"}
+	if err := l.autoscaling.NewRequest(op, input, output).Send(); err != nil {
+		glog.V(4).Infof("Failed launch template request for ASG %s: %v", asgName, err)
+		return nil, err
+	}
+	if len(output.AutoScalingGroups) < 1 {
+		return nil, fmt.Errorf("Unable to get first AutoScalingGroup for %s", asgName)
+	}
+	return output.AutoScalingGroups[0], nil
+}
+
+func (l *awsLaunchTemplates) getInstanceTypeByLaunchTemplate(spec *launchTemplateSpecification) (string, *instanceRequirements, error) {
+	version := aws.StringValue(spec.Version)
+	if version == "" {
+		version = defaultLaunchTemplateVersion
+	}
+	input := &describeLaunchTemplateVersionsInput{
+		LaunchTemplateId:   spec.LaunchTemplateId,
+		LaunchTemplateName: spec.LaunchTemplateName,
+		Versions:           []*string{aws.String(version)},
+	}
+	// Only one of the ID and the name of the template can be given.
+	if input.LaunchTemplateId != nil {
+		input.LaunchTemplateName = nil
+	}
+	output := &describeLaunchTemplateVersionsOutput{}
+	op := &request.Operation{Name: opDescribeLaunchTemplateVersions, HTTPMethod: "POST", HTTPPath: "/"}
+	if err := l.ec2.NewRequest(op, input, output).Send(); err != nil {
+		glog.V(4).Infof("Failed LaunchTemplateVersion info request for %s: %v", spec, err)
+		return "", nil, err
+	}
+	if len(output.LaunchTemplateVersions) < 1 || output.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return "", nil, fmt.Errorf("Unable to get version %s of LaunchTemplate %s", version, spec)
+	}
+	data := output.LaunchTemplateVersions[0].LaunchTemplateData
+	if data.InstanceRequirements != nil {
+		return "", data.InstanceRequirements.instanceRequirements(), nil
+	}
+	instanceType := aws.StringValue(data.InstanceType)
+	if instanceType == "" {
+		return "", nil, fmt.Errorf("Version %s of LaunchTemplate %s has no instance type", version, spec)
+	}
+	return instanceType, nil, nil
+}
+
+// instanceRequirements returns the requirements as named by the Auto Scaling
+// service.
+func (r *ec2InstanceRequirements) instanceRequirements() *instanceRequirements {
+	convert := func(r *ec2InstanceRequirementRange) *instanceRequirementRange {
+		if r == nil {
+			return nil
+		}
+		return &instanceRequirementRange{Min: r.Min, Max: r.Max}
+	}
+	return &instanceRequirements{
+		VCpuCount:        convert(r.VCpuCount),
+		MemoryMiB:        convert(r.MemoryMiB),
+		AcceleratorCount: convert(r.AcceleratorCount),
+		AcceleratorTypes: r.AcceleratorTypes,
+	}
+}
+
+// instanceType returns the smallest instance type matching the requirements,
+// with the minimum of each of their ranges, so that a pod fitting it fits any
+// instance launched. It has no name since it stands for any of them.
+func (r *instanceRequirements) instanceType() *instanceType {
+	t := &instanceType{}
+	if r.VCpuCount != nil {
+		t.VCPU = aws.Int64Value(r.VCpuCount.Min)
+	}
+	if r.MemoryMiB != nil {
+		t.MemoryMb = aws.Int64Value(r.MemoryMiB.Min)
+	}
+	if r.gpuAccelerators() {
+		t.GPU = aws.Int64Value(r.AcceleratorCount.Min)
+	}
+	return t
+}
+
+// largestInstanceType returns the largest instance type matching the
+// requirements, with the maximum of each of their ranges or, for the ranges
+// without one, the most of the known instance types matching them. Like
+// instanceType, it has no name.
+func (r *instanceRequirements) largestInstanceType(known []*instanceType) *instanceType {
+	t := r.instanceType()
+	for _, k := range known {
+		if !r.matches(k) {
+			continue
+		}
+		if k.VCPU > t.VCPU {
+			t.VCPU = k.VCPU
+		}
+		if k.MemoryMb > t.MemoryMb {
+			t.MemoryMb = k.MemoryMb
+		}
+		if r.gpuAccelerators() && k.GPU > t.GPU {
+			t.GPU = k.GPU
+		}
+	}
+	if r.VCpuCount != nil && r.VCpuCount.Max != nil {
+		t.VCPU = *r.VCpuCount.Max
+	}
+	if r.MemoryMiB != nil && r.MemoryMiB.Max != nil {
+		t.MemoryMb = *r.MemoryMiB.Max
+	}
+	if r.gpuAccelerators() && r.AcceleratorCount.Max != nil {
+		t.GPU = *r.AcceleratorCount.Max
+	}
+	return t
+}
+
+// matches returns whether the instance type is within the ranges of the
+// requirements.
+func (r *instanceRequirements) matches(t *instanceType) bool {
+	if !r.VCpuCount.contains(t.VCPU) || !r.MemoryMiB.contains(t.MemoryMb) {
+		return false
+	}
+	return !r.gpuAccelerators() || r.AcceleratorCount.contains(t.GPU)
+}
+
+// gpuAccelerators returns whether the accelerators of the requirements are
+// GPUs, which they are only when no other type is allowed.
+func (r *instanceRequirements) gpuAccelerators() bool {
+	return r.AcceleratorCount != nil && len(r.AcceleratorTypes) == 1 && aws.StringValue(r.AcceleratorTypes[0]) == acceleratorTypeGPU
+}
+
+// contains returns whether the value is within the range, a nil range or
+// bound being unbounded.
+func (r *instanceRequirementRange) contains(value int64) bool {
+	if r == nil {
+		return true
+	}
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value <= *r.Max)
+}
+
+// spotPercentage returns the percentage of the instances launched above the
+// on-demand base capacity that are spot instances, 0 when all are on-demand.
+func (p *mixedInstancesPolicy) spotPercentage() int64 {
+	if p.InstancesDistribution == nil || p.InstancesDistribution.OnDemandPercentageAboveBaseCapacity == nil {
+		return 0
+	}
+	return 100 - aws.Int64Value(p.InstancesDistribution.OnDemandPercentageAboveBaseCapacity)
+}
+
+// String returns the ID or the name of the launch template.
+func (s *launchTemplateSpecification) String() string {
+	if s.LaunchTemplateId != nil {
+		return aws.StringValue(s.LaunchTemplateId)
+	}
+	return aws.StringValue(s.LaunchTemplateName)
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+const describeLaunchTemplateGroupsResponse = `<DescribeAutoScalingGroupsResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeAutoScalingGroupsResult>
+    <AutoScalingGroups>
+      <member>
+        <AutoScalingGroupName>ltasg</AutoScalingGroupName>
+        <LaunchTemplate>
+          <LaunchTemplateId>lt-1</LaunchTemplateId>
+          <LaunchTemplateName>nodes</LaunchTemplateName>
+          <Version>2</Version>
+        </LaunchTemplate>
+      </member>
+    </AutoScalingGroups>
+  </DescribeAutoScalingGroupsResult>
+</DescribeAutoScalingGroupsResponse>`
+
+const describeMixedInstancesGroupsResponse = `<DescribeAutoScalingGroupsResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeAutoScalingGroupsResult>
+    <AutoScalingGroups>
+      <member>
+        <AutoScalingGroupName>mixedasg</AutoScalingGroupName>
+        <MixedInstancesPolicy>
+          <LaunchTemplate>
+            <LaunchTemplateSpecification>
+              <LaunchTemplateId>lt-1</LaunchTemplateId>
+              <Version>$Latest</Version>
+            </LaunchTemplateSpecification>
+            <Overrides>
+              <member>
+                <InstanceType>m4.large</InstanceType>
+              </member>
+              <member>
+                <InstanceType>c4.large</InstanceType>
+              </member>
+            </Overrides>
+          </LaunchTemplate>
+          <InstancesDistribution>
+            <OnDemandBaseCapacity>1</OnDemandBaseCapacity>
+            <OnDemandPercentageAboveBaseCapacity>20</OnDemandPercentageAboveBaseCapacity>
+          </InstancesDistribution>
+        </MixedInstancesPolicy>
+      </member>
+    </AutoScalingGroups>
+  </DescribeAutoScalingGroupsResult>
+</DescribeAutoScalingGroupsResponse>`
+
+const describeLaunchTemplateVersionsResponse = `<DescribeLaunchTemplateVersionsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <launchTemplateVersionSet>
+    <item>
+      <launchTemplateId>lt-1</launchTemplateId>
+      <versionNumber>2</versionNumber>
+      <launchTemplateData>
+        <instanceType>m4.large</instanceType>
+      </launchTemplateData>
+    </item>
+  </launchTemplateVersionSet>
+</DescribeLaunchTemplateVersionsResponse>`
+
+const describeInstanceRequirementsLaunchTemplateVersionsResponse = `<DescribeLaunchTemplateVersionsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <launchTemplateVersionSet>
+    <item>
+      <launchTemplateId>lt-2</launchTemplateId>
+      <versionNumber>1</versionNumber>
+      <launchTemplateData>
+        <instanceRequirements>
+          <vCpuCount>
+            <min>2</min>
+            <max>8</max>
+          </vCpuCount>
+          <memoryMiB>
+            <min>4096</min>
+          </memoryMiB>
+          <acceleratorCount>
+            <min>1</min>
+          </acceleratorCount>
+          <acceleratorTypeSet>
+            <item>gpu</item>
+          </acceleratorTypeSet>
+        </instanceRequirements>
+      </launchTemplateData>
+    </item>
+  </launchTemplateVersionSet>
+</DescribeLaunchTemplateVersionsResponse>`
+
+const describeInstanceRequirementsGroupsResponse = `<DescribeAutoScalingGroupsResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeAutoScalingGroupsResult>
+    <AutoScalingGroups>
+      <member>
+        <AutoScalingGroupName>abisasg</AutoScalingGroupName>
+        <MixedInstancesPolicy>
+          <LaunchTemplate>
+            <LaunchTemplateSpecification>
+              <LaunchTemplateId>lt-1</LaunchTemplateId>
+            </LaunchTemplateSpecification>
+            <Overrides>
+              <member>
+                <InstanceRequirements>
+                  <VCpuCount>
+                    <Min>4</Min>
+                    <Max>16</Max>
+                  </VCpuCount>
+                  <MemoryMiB>
+                    <Min>16384</Min>
+                  </MemoryMiB>
+                </InstanceRequirements>
+              </member>
+            </Overrides>
+          </LaunchTemplate>
+        </MixedInstancesPolicy>
+      </member>
+    </AutoScalingGroups>
+  </DescribeAutoScalingGroupsResult>
+</DescribeAutoScalingGroupsResponse>`
+
+func newTestLaunchTemplates(t *testing.T, handler func(form url.Values) string) (*awsLaunchTemplates, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("bad request: %v", err)
+		}
+		fmt.Fprint(w, handler(r.PostForm))
+	}))
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	return &awsLaunchTemplates{
+		autoscaling: autoscaling.New(sess).Client,
+		ec2:         ec2.New(sess).Client,
+	}, server.Close
+}
+
+func TestGetAsgLaunchTemplates(t *testing.T) {
+	templates, cleanup := newTestLaunchTemplates(t, func(form url.Values) string {
+		assert.Equal(t, "DescribeAutoScalingGroups", form.Get("Action"))
+		assert.Equal(t, "ltasg", form.Get("AutoScalingGroupNames.member.1"))
+		return describeLaunchTemplateGroupsResponse
+	})
+	defer cleanup()
+
+	group, err := templates.getAsgLaunchTemplates("ltasg")
+	assert.NoError(t, err)
+	assert.Equal(t, &launchTemplateSpecification{
+		LaunchTemplateId:   aws.String("lt-1"),
+		LaunchTemplateName: aws.String("nodes"),
+		Version:            aws.String("2"),
+	}, group.LaunchTemplate)
+	assert.Nil(t, group.MixedInstancesPolicy)
+}
+
+func TestGetAsgMixedInstancesPolicy(t *testing.T) {
+	templates, cleanup := newTestLaunchTemplates(t, func(form url.Values) string {
+		return describeMixedInstancesGroupsResponse
+	})
+	defer cleanup()
+
+	group, err := templates.getAsgLaunchTemplates("mixedasg")
+	assert.NoError(t, err)
+	assert.Nil(t, group.LaunchTemplate)
+	policy := group.MixedInstancesPolicy
+	if assert.NotNil(t, policy) && assert.NotNil(t, policy.LaunchTemplate) {
+		assert.Equal(t, "lt-1", aws.StringValue(policy.LaunchTemplate.LaunchTemplateSpecification.LaunchTemplateId))
+		assert.Equal(t, []*launchTemplateOverride{
+			{InstanceType: aws.String("m4.large")},
+			{InstanceType: aws.String("c4.large")},
+		}, policy.LaunchTemplate.Overrides)
+		assert.Equal(t, int64(80), policy.spotPercentage())
+	}
+
+	// All the instances are on-demand without a distribution.
+	assert.Equal(t, int64(0), (&mixedInstancesPolicy{}).spotPercentage())
+}
+
+func TestGetInstanceTypeByLaunchTemplate(t *testing.T) {
+	var form url.Values
+	templates, cleanup := newTestLaunchTemplates(t, func(f url.Values) string {
+		form = f
+		return describeLaunchTemplateVersionsResponse
+	})
+	defer cleanup()
+
+	instanceType, requirements, err := templates.getInstanceTypeByLaunchTemplate(&launchTemplateSpecification{
+		LaunchTemplateId:   aws.String("lt-1"),
+		LaunchTemplateName: aws.String("nodes"),
+		Version:            aws.String("2"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "m4.large", instanceType)
+	assert.Nil(t, requirements)
+	assert.Equal(t, "DescribeLaunchTemplateVersions", form.Get("Action"))
+	assert.Equal(t, "lt-1", form.Get("LaunchTemplateId"))
+	assert.Equal(t, "", form.Get("LaunchTemplateName"))
+	assert.Equal(t, "2", form.Get("LaunchTemplateVersion.1"))
+
+	// The default version is described when the ASG doesn't specify one.
+	_, _, err = templates.getInstanceTypeByLaunchTemplate(&launchTemplateSpecification{
+		LaunchTemplateName: aws.String("nodes"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "nodes", form.Get("LaunchTemplateName"))
+	assert.Equal(t, defaultLaunchTemplateVersion, form.Get("LaunchTemplateVersion.1"))
+}
+
+func TestGetAsgInstanceRequirements(t *testing.T) {
+	templates, cleanup := newTestLaunchTemplates(t, func(form url.Values) string {
+		return describeInstanceRequirementsGroupsResponse
+	})
+	defer cleanup()
+
+	group, err := templates.getAsgLaunchTemplates("abisasg")
+	assert.NoError(t, err)
+	policy := group.MixedInstancesPolicy
+	if assert.NotNil(t, policy) && assert.NotNil(t, policy.LaunchTemplate) && assert.Len(t, policy.LaunchTemplate.Overrides, 1) {
+		assert.Equal(t, &instanceRequirements{
+			VCpuCount: &instanceRequirementRange{Min: aws.Int64(4), Max: aws.Int64(16)},
+			MemoryMiB: &instanceRequirementRange{Min: aws.Int64(16384)},
+		}, policy.LaunchTemplate.Overrides[0].InstanceRequirements)
+	}
+}
+
+func TestGetInstanceRequirementsByLaunchTemplate(t *testing.T) {
+	templates, cleanup := newTestLaunchTemplates(t, func(form url.Values) string {
+		return describeInstanceRequirementsLaunchTemplateVersionsResponse
+	})
+	defer cleanup()
+
+	name, requirements, err := templates.getInstanceTypeByLaunchTemplate(&launchTemplateSpecification{
+		LaunchTemplateId: aws.String("lt-2"),
+		Version:          aws.String("1"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+	assert.Equal(t, &instanceRequirements{
+		VCpuCount:        &instanceRequirementRange{Min: aws.Int64(2), Max: aws.Int64(8)},
+		MemoryMiB:        &instanceRequirementRange{Min: aws.Int64(4096)},
+		AcceleratorCount: &instanceRequirementRange{Min: aws.Int64(1)},
+		AcceleratorTypes: aws.StringSlice([]string{acceleratorTypeGPU}),
+	}, requirements)
+	assert.Equal(t, &instanceType{VCPU: 2, MemoryMb: 4096, GPU: 1}, requirements.instanceType())
+}
+
+func TestLargestInstanceType(t *testing.T) {
+	requirements := &instanceRequirements{
+		VCpuCount:        &instanceRequirementRange{Min: aws.Int64(2), Max: aws.Int64(8)},
+		MemoryMiB:        &instanceRequirementRange{Min: aws.Int64(4096)},
+		AcceleratorCount: &instanceRequirementRange{Min: aws.Int64(1)},
+		AcceleratorTypes: aws.StringSlice([]string{acceleratorTypeGPU}),
+	}
+	known := []*instanceType{
+		{InstanceType: "g.large", VCPU: 2, MemoryMb: 8192, GPU: 1},
+		{InstanceType: "g.xlarge", VCPU: 4, MemoryMb: 16384, GPU: 2},
+		// Too many vCPUs.
+		{InstanceType: "g.8xlarge", VCPU: 32, MemoryMb: 131072, GPU: 8},
+		// No GPU.
+		{InstanceType: "m.4xlarge", VCPU: 8, MemoryMb: 65536},
+	}
+	// The bounded ranges give their maximum, the others the most of the
+	// matching instance types.
+	assert.Equal(t, &instanceType{VCPU: 8, MemoryMb: 16384, GPU: 2}, requirements.largestInstanceType(known))
+
+	// Without a matching instance type, the unbounded ranges give their
+	// minimum.
+	assert.Equal(t, &instanceType{VCPU: 8, MemoryMb: 4096, GPU: 1}, requirements.largestInstanceType(nil))
+}
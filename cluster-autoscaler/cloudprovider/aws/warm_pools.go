@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// The vendored AWS SDK predates the warm pools. The request and response of
+// the DescribeWarmPool API call are declared below, with only the fields used
+// by the autoscaler, and sent with the client of the SDK.
+
+const (
+	opDescribeWarmPool = "DescribeWarmPool"
+
+	// warmPoolTTL is how long whether an ASG has a warm pool is cached.
+	warmPoolTTL = 10 * time.Minute
+
+	// warmPoolStatusPendingDelete is the status of a warm pool being
+	// deleted.
+	warmPoolStatusPendingDelete = "PendingDelete"
+
+	// warmedLifecycleStatePrefix prefixes the lifecycle states of the
+	// instances in the warm pool of an ASG, which aren't nodes of the ASG.
+	warmedLifecycleStatePrefix = "Warmed:"
+)
+
+// warmPoolDescriber describes the warm pools of the ASGs.
+type warmPoolDescriber interface {
+	// describeWarmPool returns the configuration of the warm pool of the
+	// ASG, nil if it has none.
+	describeWarmPool(asgName string) (*warmPoolConfiguration, error)
+}
+
+type describeWarmPoolInput struct {
+	_ struct{} `type:"structure"`
+
+	AutoScalingGroupName *string `min:"1" type:"string"`
+	MaxRecords           *int64  `type:"integer"`
+}
+
+type warmPoolConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	MinSize   *int64  `type:"integer"`
+	PoolState *string `type:"string"`
+	Status    *string `type:"string"`
+}
+
+type describeWarmPoolOutput struct {
+	_ struct{} `type:"structure"`
+
+	WarmPoolConfiguration *warmPoolConfiguration `type:"structure"`
+}
+
+// awsWarmPools describes the warm pools with the client of the Auto Scaling
+// service.
+type awsWarmPools struct {
+	autoscaling *client.Client
+}
+
+func (d *awsWarmPools) describeWarmPool(asgName string) (*warmPoolConfiguration, error) {
+	input := &describeWarmPoolInput{
+		AutoScalingGroupName: aws.String(asgName),
+		MaxRecords:           aws.Int64(1),
+	}
+	output := &describeWarmPoolOutput{}
+	op := &request.Operation{Name: opDescribeWarmPool, HTTPMethod: "POST", HTTPPath: "/"}
+	if err := d.autoscaling.NewRequest(op, input, output).Send(); err != nil {
+		return nil, err
+	}
+	return output.WarmPoolConfiguration, nil
+}
+
+type cachedWarmPool struct {
+	found  bool
+	expiry time.Time
+}
+
+// warmPools caches whether the ASGs have a warm pool. The zero value knows no
+// warm pools.
+type warmPools struct {
+	describer warmPoolDescriber
+	pools     map[string]*cachedWarmPool
+	mutex     sync.Mutex
+}
+
+func newWarmPools(describer warmPoolDescriber) *warmPools {
+	return &warmPools{
+		describer: describer,
+		pools:     make(map[string]*cachedWarmPool),
+	}
+}
+
+// hasWarmPool returns whether the ASG has a warm pool, not being deleted, to
+// launch its instances from.
+func (w *warmPools) hasWarmPool(asgName string) bool {
+	if w == nil || w.describer == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if cached, found := w.pools[asgName]; found && time.Now().Before(cached.expiry) {
+		return cached.found
+	}
+	cached := &cachedWarmPool{expiry: time.Now().Add(warmPoolTTL)}
+	configuration, err := w.describer.describeWarmPool(asgName)
+	if err != nil {
+		glog.Warningf("Failed to describe the warm pool of ASG %s: %v", asgName, err)
+	} else if configuration != nil && aws.StringValue(configuration.Status) != warmPoolStatusPendingDelete {
+		glog.V(4).Infof("ASG %s has a warm pool", asgName)
+		cached.found = true
+	}
+	w.pools[asgName] = cached
+	return cached.found
+}
+
+// isWarmedInstance returns whether the instance is in the warm pool of its ASG
+// rather than one of its nodes.
+func isWarmedInstance(instance *autoscaling.Instance) bool {
+	return strings.HasPrefix(aws.StringValue(instance.LifecycleState), warmedLifecycleStatePrefix)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+const describeWarmPoolResponse = `<DescribeWarmPoolResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeWarmPoolResult>
+    <WarmPoolConfiguration>
+      <MinSize>2</MinSize>
+      <PoolState>Stopped</PoolState>
+    </WarmPoolConfiguration>
+    <Instances/>
+  </DescribeWarmPoolResult>
+  <ResponseMetadata>
+    <RequestId>1</RequestId>
+  </ResponseMetadata>
+</DescribeWarmPoolResponse>`
+
+func TestDescribeWarmPool(t *testing.T) {
+	sess, cleanup := newTestSession(t, func(r *http.Request) string {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "DescribeWarmPool", r.PostForm.Get("Action"))
+		assert.Equal(t, "test-asg", r.PostForm.Get("AutoScalingGroupName"))
+		return describeWarmPoolResponse
+	})
+	defer cleanup()
+
+	describer := &awsWarmPools{autoscaling: autoscaling.New(sess).Client}
+	configuration, err := describer.describeWarmPool("test-asg")
+	assert.NoError(t, err)
+	if assert.NotNil(t, configuration) {
+		assert.Equal(t, int64(2), aws.Int64Value(configuration.MinSize))
+		assert.Equal(t, "Stopped", aws.StringValue(configuration.PoolState))
+	}
+}
+
+type warmPoolDescriberMock struct {
+	configurations map[string]*warmPoolConfiguration
+	calls          int
+}
+
+func (d *warmPoolDescriberMock) describeWarmPool(asgName string) (*warmPoolConfiguration, error) {
+	d.calls++
+	if asgName == "broken-asg" {
+		return nil, fmt.Errorf("access denied")
+	}
+	return d.configurations[asgName], nil
+}
+
+func TestHasWarmPool(t *testing.T) {
+	describer := &warmPoolDescriberMock{
+		configurations: map[string]*warmPoolConfiguration{
+			"warm-asg":    {PoolState: aws.String("Stopped")},
+			"deleted-asg": {PoolState: aws.String("Stopped"), Status: aws.String(warmPoolStatusPendingDelete)},
+		},
+	}
+	pools := newWarmPools(describer)
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, pools.hasWarmPool("warm-asg"))
+		assert.False(t, pools.hasWarmPool("deleted-asg"))
+		assert.False(t, pools.hasWarmPool("cold-asg"))
+		assert.False(t, pools.hasWarmPool("broken-asg"))
+	}
+	// The warm pools, found or not, are described only once until they
+	// expire.
+	assert.Equal(t, 4, describer.calls)
+	pools.pools["warm-asg"].expiry = pools.pools["warm-asg"].expiry.Add(-warmPoolTTL)
+	pools.hasWarmPool("warm-asg")
+	assert.Equal(t, 5, describer.calls)
+
+	// No warm pools are known without a describer.
+	var none *warmPools
+	assert.False(t, none.hasWarmPool("warm-asg"))
+}
+
+func TestNodesWithoutWarmedInstances(t *testing.T) {
+	service := &AutoScalingMock{}
+	provider := testProvider(t, newTestAwsManagerWithAsgs(t, service, []string{"1:5:test-asg"}))
+	asgs := provider.asgs()
+
+	output := testPlaceholderDescribeAutoScalingGroupsOutput("test-asg", 2)
+	output.AutoScalingGroups[0].Instances = append(output.AutoScalingGroups[0].Instances, &autoscaling.Instance{
+		AvailabilityZone: aws.String("us-east-1b"),
+		InstanceId:       aws.String("warm-instance-id"),
+		LifecycleState:   aws.String("Warmed:Stopped"),
+	})
+	service.On("DescribeAutoScalingGroups", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgs[0].Name}),
+		MaxRecords:            aws.Int64(1),
+	}).Return(output)
+
+	// The warmed instance isn't a node of the ASG, which misses one.
+	nodes, err := asgs[0].Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"aws:///us-east-1b/test-instance-id",
+		"aws:///us-east-1a/i-placeholder-test-asg-1",
+	}, nodes)
+}
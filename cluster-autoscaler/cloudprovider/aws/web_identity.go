@@ -0,0 +1,103 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// The vendored AWS SDK predates the web identity credentials of the IAM roles
+// for service accounts, which are retrieved below as the newer SDKs do.
+
+const (
+	// roleARNEnvVar is the ARN of the role of the service account.
+	roleARNEnvVar = "AWS_ROLE_ARN"
+	// webIdentityTokenFileEnvVar is the path of the token of the service
+	// account, which kubelet rotates.
+	webIdentityTokenFileEnvVar = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	// roleSessionNameEnvVar is the name of the session of the role, optional.
+	roleSessionNameEnvVar = "AWS_ROLE_SESSION_NAME"
+
+	webIdentityProviderName = "WebIdentityRoleProvider"
+)
+
+// webIdentityRoleAssumer assumes a role with a web identity token.
+type webIdentityRoleAssumer interface {
+	AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// webIdentityRoleProvider retrieves the credentials of a role assumed with the
+// web identity token read from a file, read again each time the credentials
+// are refreshed since the token expires too.
+type webIdentityRoleProvider struct {
+	credentials.Expiry
+
+	client      webIdentityRoleAssumer
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+// newWebIdentityCredentials returns the credentials of the role of the service
+// account of the autoscaler given by the environment, nil if there is none.
+func newWebIdentityCredentials(c client.ConfigProvider) *credentials.Credentials {
+	roleARN := os.Getenv(roleARNEnvVar)
+	tokenFile := os.Getenv(webIdentityTokenFileEnvVar)
+	if roleARN == "" || tokenFile == "" {
+		return nil
+	}
+	sessionName := os.Getenv(roleSessionNameEnvVar)
+	if sessionName == "" {
+		sessionName = assumeRoleSessionName
+	}
+	return credentials.NewCredentials(&webIdentityRoleProvider{
+		client:      sts.New(c),
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		tokenFile:   tokenFile,
+	})
+}
+
+// Retrieve assumes the role with the current token.
+func (p *webIdentityRoleProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, fmt.Errorf("failed to read web identity token: %v", err)
+	}
+	output, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(string(token)),
+	})
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, fmt.Errorf("failed to assume role %s with web identity: %v", p.roleARN, err)
+	}
+	p.SetExpiration(aws.TimeValue(output.Credentials.Expiration), assumeRoleExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(output.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(output.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(output.Credentials.SessionToken),
+		ProviderName:    webIdentityProviderName,
+	}, nil
+}
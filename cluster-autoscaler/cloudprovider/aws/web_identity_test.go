@@ -0,0 +1,110 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+type webIdentityRoleAssumerMock struct {
+	inputs []*sts.AssumeRoleWithWebIdentityInput
+	err    error
+}
+
+func (m *webIdentityRoleAssumerMock) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	m.inputs = append(m.inputs, input)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String(fmt.Sprintf("id%d", len(m.inputs))),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("session"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWebIdentityRoleProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web-identity")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("token1"), 0600))
+
+	client := &webIdentityRoleAssumerMock{}
+	provider := &webIdentityRoleProvider{
+		client:      client,
+		roleARN:     "arn:aws:iam::123456789012:role/autoscaler",
+		sessionName: "session",
+		tokenFile:   tokenFile,
+	}
+	assert.True(t, provider.IsExpired())
+
+	value, err := provider.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "id1", value.AccessKeyID)
+	assert.Equal(t, "secret", value.SecretAccessKey)
+	assert.Equal(t, "session", value.SessionToken)
+	assert.Equal(t, webIdentityProviderName, value.ProviderName)
+	assert.Equal(t, &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String("arn:aws:iam::123456789012:role/autoscaler"),
+		RoleSessionName:  aws.String("session"),
+		WebIdentityToken: aws.String("token1"),
+	}, client.inputs[0])
+	assert.False(t, provider.IsExpired())
+
+	// The rotated token is read when the credentials are refreshed.
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("token2"), 0600))
+	value, err = provider.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "id2", value.AccessKeyID)
+	assert.Equal(t, "token2", aws.StringValue(client.inputs[1].WebIdentityToken))
+
+	client.err = fmt.Errorf("denied")
+	_, err = provider.Retrieve()
+	assert.Error(t, err)
+
+	provider.tokenFile = filepath.Join(dir, "missing")
+	_, err = provider.Retrieve()
+	assert.Error(t, err)
+}
+
+func TestNewWebIdentityCredentials(t *testing.T) {
+	for _, name := range []string{roleARNEnvVar, webIdentityTokenFileEnvVar} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	sess := session.New()
+
+	os.Setenv(roleARNEnvVar, "")
+	os.Setenv(webIdentityTokenFileEnvVar, "/var/run/secrets/token")
+	assert.Nil(t, newWebIdentityCredentials(sess))
+
+	os.Setenv(roleARNEnvVar, "arn:aws:iam::123456789012:role/autoscaler")
+	assert.NotNil(t, newWebIdentityCredentials(sess))
+}
@@ -0,0 +1,716 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/kubernetes/plugin/pkg/scheduler/schedulercache"
+)
+
+// aksAPIVersion is the ContainerService API version of the managed clusters
+// and agent pools of AKS, which the vendored SDK has no client of.
+const aksAPIVersion = "2020-11-01"
+
+// Tags identifying the agent pool of the scale sets in the node resource group
+// of an AKS cluster, the aks-managed one being set by the newer clusters.
+const (
+	aksPoolNameTag        = "poolName"
+	aksManagedPoolNameTag = "aks-managed-poolName"
+)
+
+// aksAgentPoolLabel is set by AKS on the nodes of an agent pool to its name.
+const aksAgentPoolLabel = "agentpool"
+
+// Provisioning states of AKS agent pools in which no operation is in progress.
+const (
+	aksProvisioningStateSucceeded = "Succeeded"
+	aksProvisioningStateFailed    = "Failed"
+)
+
+// ErrAgentPoolUpdating is returned when an AKS agent pool is resized while an
+// operation on it is in progress, which AKS rejects.
+var ErrAgentPoolUpdating = errors.New("agent pool is being updated")
+
+// managedCluster is the part of an AKS managed cluster used by the autoscaler.
+type managedCluster struct {
+	Location   string `json:"location"`
+	Properties struct {
+		// NodeResourceGroup holds the scale sets of the agent pools.
+		NodeResourceGroup string `json:"nodeResourceGroup"`
+	} `json:"properties"`
+}
+
+// agentPool is an agent pool of an AKS managed cluster. Its properties are
+// kept as returned by Azure, so that updating its count doesn't reset the
+// properties the autoscaler doesn't know.
+type agentPool struct {
+	ID         *string                    `json:"id,omitempty"`
+	Name       *string                    `json:"name,omitempty"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// property unmarshals the property of the agent pool into value, which is
+// left unchanged if the property isn't set.
+func (p agentPool) property(name string, value interface{}) error {
+	raw, found := p.Properties[name]
+	if !found {
+		return nil
+	}
+	return json.Unmarshal(raw, value)
+}
+
+// count returns the number of nodes the agent pool should have.
+func (p agentPool) count() (int64, error) {
+	var count *int64
+	if err := p.property("count", &count); err != nil {
+		return -1, err
+	}
+	if count == nil {
+		return -1, fmt.Errorf("agent pool %s has no count", stringOrEmpty(p.Name))
+	}
+	return *count, nil
+}
+
+// stringProperty returns the string property of the agent pool, empty if it
+// isn't set.
+func (p agentPool) stringProperty(name string) string {
+	var value string
+	if err := p.property(name, &value); err != nil {
+		return ""
+	}
+	return value
+}
+
+// withCount returns a copy of the agent pool to send to Azure to set its
+// count, without its read-only properties.
+func (p agentPool) withCount(count int64) agentPool {
+	properties := make(map[string]json.RawMessage, len(p.Properties)+1)
+	for name, value := range p.Properties {
+		if name != "provisioningState" && name != "powerState" {
+			properties[name] = value
+		}
+	}
+	properties["count"] = json.RawMessage(fmt.Sprintf("%d", count))
+	return agentPool{ID: p.ID, Name: p.Name, Properties: properties}
+}
+
+type agentPoolClient interface {
+	GetCluster(resourceGroupName string, clusterName string) (managedCluster, error)
+	Get(resourceGroupName string, clusterName string, agentPoolName string) (agentPool, error)
+	// CreateOrUpdate starts the update of the agent pool, whose progress is
+	// reflected by its provisioning state.
+	CreateOrUpdate(resourceGroupName string, clusterName string, agentPoolName string, parameters agentPool) error
+}
+
+// azureAgentPoolClient gets the AKS managed clusters and updates their agent
+// pools with aksAPIVersion.
+type azureAgentPoolClient struct {
+	autorest.Client
+	baseURI        string
+	subscriptionID string
+}
+
+func newAgentPoolClient(baseURI string, subscriptionID string, authorizer autorest.Authorizer) *azureAgentPoolClient {
+	client := &azureAgentPoolClient{
+		Client:         autorest.NewClientWithUserAgent(""),
+		baseURI:        baseURI,
+		subscriptionID: subscriptionID,
+	}
+	client.Authorizer = authorizer
+	return client
+}
+
+// send sends the request prepared with decorators, unmarshalling the response
+// into result unless it's nil.
+func (c *azureAgentPoolClient) send(method string, result interface{}, decorators ...autorest.PrepareDecorator) error {
+	req, err := autorest.CreatePreparer(decorators...).Prepare(&http.Request{})
+	if err != nil {
+		return autorest.NewErrorWithError(err, "azure.azureAgentPoolClient", method, nil, "Failure preparing request")
+	}
+	resp, err := autorest.SendWithSender(c, req)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "azure.azureAgentPoolClient", method, resp, "Failure sending request")
+	}
+	responders := []autorest.RespondDecorator{
+		c.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated),
+	}
+	if result != nil {
+		responders = append(responders, autorest.ByUnmarshallingJSON(result))
+	}
+	responders = append(responders, autorest.ByClosing())
+	if err := autorest.Respond(resp, responders...); err != nil {
+		return autorest.NewErrorWithError(err, "azure.azureAgentPoolClient", method, resp, "Failure responding to request")
+	}
+	return nil
+}
+
+func (c *azureAgentPoolClient) pathParameters(resourceGroupName string, clusterName string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resourceGroupName),
+		"resourceName":      autorest.Encode("path", clusterName),
+		"subscriptionId":    autorest.Encode("path", c.subscriptionID),
+	}
+}
+
+// GetCluster gets the managed cluster.
+func (c *azureAgentPoolClient) GetCluster(resourceGroupName string, clusterName string) (managedCluster, error) {
+	var cluster managedCluster
+	err := c.send("GetCluster", &cluster,
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.ContainerService/managedClusters/{resourceName}",
+			c.pathParameters(resourceGroupName, clusterName)),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": aksAPIVersion}))
+	return cluster, err
+}
+
+// Get gets the agent pool of the managed cluster.
+func (c *azureAgentPoolClient) Get(resourceGroupName string, clusterName string, agentPoolName string) (agentPool, error) {
+	pathParameters := c.pathParameters(resourceGroupName, clusterName)
+	pathParameters["agentPoolName"] = autorest.Encode("path", agentPoolName)
+	var pool agentPool
+	err := c.send("Get", &pool,
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.ContainerService/managedClusters/{resourceName}/agentPools/{agentPoolName}", pathParameters),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": aksAPIVersion}))
+	return pool, err
+}
+
+// CreateOrUpdate starts the update of the agent pool of the managed cluster.
+// It doesn't wait for AKS to complete it.
+func (c *azureAgentPoolClient) CreateOrUpdate(resourceGroupName string, clusterName string, agentPoolName string, parameters agentPool) error {
+	pathParameters := c.pathParameters(resourceGroupName, clusterName)
+	pathParameters["agentPoolName"] = autorest.Encode("path", agentPoolName)
+	return c.send("CreateOrUpdate", nil,
+		autorest.AsPut(),
+		autorest.AsJSON(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.ContainerService/managedClusters/{resourceName}/agentPools/{agentPoolName}", pathParameters),
+		autorest.WithJSON(parameters),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": aksAPIVersion}))
+}
+
+// AKSAgentPool implements NodeGroup interface for an agent pool of the AKS
+// managed cluster of the manager. The pool is resized by updating its count
+// through the ContainerService API, so that AKS keeps the count in sync with
+// the scale set of the pool. Only the pools backed by scale sets are supported.
+type AKSAgentPool struct {
+	AzureRef
+
+	azureManager *AzureManager
+	minSize      int
+	maxSize      int
+}
+
+// Create AKSAgentPool from provided spec.
+// spec is in the following format: min-size:max-size:agent-pool-name.
+func buildAKSAgentPool(spec string, azureManager *AzureManager) (*AKSAgentPool, error) {
+	nodeGroupSpec, err := parseNodeGroupSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if nodeGroupSpec.subscriptionID != "" || nodeGroupSpec.resourceGroup != "" {
+		return nil, fmt.Errorf("agent pools must be in the AKS cluster of the cloud-config, got spec: %s", spec)
+	}
+	return &AKSAgentPool{
+		AzureRef:     AzureRef{Name: nodeGroupSpec.name},
+		azureManager: azureManager,
+		minSize:      nodeGroupSpec.minSize,
+		maxSize:      nodeGroupSpec.maxSize,
+	}, nil
+}
+
+func (ap *AKSAgentPool) register(ctx context.Context) error {
+	return ap.azureManager.RegisterAKSAgentPool(ctx, ap)
+}
+
+// MinSize returns minimum size of the node group.
+func (ap *AKSAgentPool) MinSize() int {
+	return ap.minSize
+}
+
+// MaxSize returns maximum size of the node group.
+func (ap *AKSAgentPool) MaxSize() int {
+	return ap.maxSize
+}
+
+// Exist checks if the node group really exists on the cloud provider side. Allows to tell the
+// theoretical node group from the real one.
+func (ap *AKSAgentPool) Exist() bool {
+	return true
+}
+
+// Create creates the node group on the cloud provider side.
+func (ap *AKSAgentPool) Create() error {
+	return cloudprovider.ErrAlreadyExist
+}
+
+// Delete deletes the node group on the cloud provider side.
+// This will be executed only for autoprovisioned node groups, once their size drops to 0.
+func (ap *AKSAgentPool) Delete() error {
+	return cloudprovider.ErrNotImplemented
+}
+
+// Autoprovisioned returns true if the node group is autoprovisioned.
+func (ap *AKSAgentPool) Autoprovisioned() bool {
+	return false
+}
+
+// TargetSize returns the current TARGET size of the node group, the count of
+// the agent pool.
+func (ap *AKSAgentPool) TargetSize() (int, error) {
+	size, err := ap.azureManager.GetAKSAgentPoolSize(ap.azureManager.context(), ap)
+	return int(size), err
+}
+
+// IncreaseSize increases the count of the agent pool by delta.
+func (ap *AKSAgentPool) IncreaseSize(delta int) error {
+	if delta <= 0 {
+		return fmt.Errorf("size increase must be positive")
+	}
+	size, err := ap.azureManager.GetAKSAgentPoolSize(ap.azureManager.context(), ap)
+	if err != nil {
+		return err
+	}
+	if int(size)+delta > ap.MaxSize() {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", int(size)+delta, ap.MaxSize())
+	}
+	return ap.azureManager.SetAKSAgentPoolSize(ap.azureManager.context(), ap, size+int64(delta))
+}
+
+// DecreaseTargetSize decreases the count of the agent pool by delta without
+// deleting any existing node. Delta should be negative.
+func (ap *AKSAgentPool) DecreaseTargetSize(delta int) error {
+	if delta >= 0 {
+		return fmt.Errorf("size decrease size must be negative")
+	}
+	size, err := ap.azureManager.GetAKSAgentPoolSize(ap.azureManager.context(), ap)
+	if err != nil {
+		return err
+	}
+	nodes, err := ap.azureManager.GetAKSAgentPoolVMs(ap.azureManager.context(), ap)
+	if err != nil {
+		return err
+	}
+	if int(size)+delta < len(nodes) {
+		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
+			size, delta, len(nodes))
+	}
+	return ap.azureManager.SetAKSAgentPoolSize(ap.azureManager.context(), ap, size+int64(delta))
+}
+
+// Belongs returns true if the given node belongs to the NodeGroup.
+func (ap *AKSAgentPool) Belongs(node *apiv1.Node) (bool, error) {
+	glog.V(6).Infof("Check if node belongs to this agent pool: agentpool:%v, node:%v\n", ap, node)
+
+	ref := &AzureRef{
+		Name: node.Spec.ProviderID,
+	}
+
+	targetPool, err := ap.azureManager.GetAKSAgentPoolForInstance(ref)
+	if err != nil {
+		return false, err
+	}
+	if targetPool == nil {
+		return false, fmt.Errorf("%s doesn't belong to a known agent pool", node.Name)
+	}
+	return targetPool.Id() == ap.Id(), nil
+}
+
+// DeleteNodes deletes the instances of the nodes from the scale set of the
+// agent pool, then decreases the count of the pool accordingly.
+func (ap *AKSAgentPool) DeleteNodes(nodes []*apiv1.Node) error {
+	glog.V(8).Infof("Delete nodes requested: %v\n", nodes)
+	size, err := ap.azureManager.GetAKSAgentPoolSize(ap.azureManager.context(), ap)
+	if err != nil {
+		return err
+	}
+	if int(size) <= ap.MinSize() {
+		return fmt.Errorf("min size reached, nodes will not be deleted")
+	}
+	refs := make([]*AzureRef, 0, len(nodes))
+	for _, node := range nodes {
+		belongs, err := ap.Belongs(node)
+		if err != nil {
+			return err
+		}
+		if !belongs {
+			return fmt.Errorf("%s belongs to a different agent pool than %s", node.Name, ap.Id())
+		}
+		refs = append(refs, &AzureRef{
+			Name: node.Spec.ProviderID,
+		})
+	}
+	ap.azureManager.waitForDrain(ap.azureManager.context(), nodes)
+	return ap.azureManager.DeleteAKSAgentPoolInstances(ap.azureManager.context(), ap, refs)
+}
+
+// Id returns AKSAgentPool id.
+func (ap *AKSAgentPool) Id() string {
+	return ap.Name
+}
+
+// Debug returns a debug string for the agent pool.
+func (ap *AKSAgentPool) Debug() string {
+	return fmt.Sprintf("%s (%d:%d)", ap.Id(), ap.MinSize(), ap.MaxSize())
+}
+
+// Nodes returns a list of all nodes that belong to this node group.
+func (ap *AKSAgentPool) Nodes() ([]string, error) {
+	return ap.azureManager.GetAKSAgentPoolVMs(ap.azureManager.context(), ap)
+}
+
+// TemplateNodeInfo returns a node template for this agent pool, built from its
+// VM size along with the labels and taints AKS sets on its nodes.
+func (ap *AKSAgentPool) TemplateNodeInfo() (*schedulercache.NodeInfo, error) {
+	pool, err := ap.azureManager.getAgentPool(ap.azureManager.context(), ap)
+	if err != nil {
+		return nil, err
+	}
+	template, err := ap.azureManager.getAKSAgentPoolTemplate(ap, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := ap.azureManager.buildNodeFromTemplate(ap.Name, template)
+	if err != nil {
+		return nil, err
+	}
+	addAgentPoolLabelsAndTaints(ap.azureManager.log(), node, ap.Name, pool)
+
+	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(ap.Name))
+	nodeInfo.SetNode(node)
+	return nodeInfo, nil
+}
+
+// RegisterAKSAgentPool registers the agent pool in the manager.
+func (m *AzureManager) RegisterAKSAgentPool(ctx context.Context, ap *AKSAgentPool) error {
+	if m.aksClusterName == "" {
+		return fmt.Errorf("cannot register agent pool %s, the AKS cluster isn't set", ap.Name)
+	}
+
+	size, err := m.GetAKSAgentPoolSize(ctx, ap)
+	if err != nil {
+		m.log().Warningf("Failed to get the size of agent pool %s: %v", ap.Name, err)
+	} else if size < int64(ap.MinSize()) || size > int64(ap.MaxSize()) {
+		m.log().Warningf("Size %d of agent pool %s is outside of its bounds [%d, %d]", size, ap.Name, ap.MinSize(), ap.MaxSize())
+	}
+
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	m.aksAgentPools = append(m.aksAgentPools, ap)
+	return nil
+}
+
+// getAgentPool gets the agent pool from Azure.
+func (m *AzureManager) getAgentPool(ctx context.Context, ap *AKSAgentPool) (agentPool, error) {
+	if err := ctx.Err(); err != nil {
+		return agentPool{}, err
+	}
+	return m.agentPoolClient.Get(m.resourceGroupName, m.aksClusterName, ap.Name)
+}
+
+// getManagedCluster returns the AKS cluster of the manager, fetched the first
+// time it's needed.
+func (m *AzureManager) getManagedCluster() (*managedCluster, error) {
+	m.aksMutex.Lock()
+	defer m.aksMutex.Unlock()
+	if m.aksCluster != nil {
+		return m.aksCluster, nil
+	}
+	cluster, err := m.agentPoolClient.GetCluster(m.resourceGroupName, m.aksClusterName)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Properties.NodeResourceGroup == "" {
+		return nil, fmt.Errorf("AKS cluster %s has no node resource group", m.aksClusterName)
+	}
+	m.aksCluster = &cluster
+	return m.aksCluster, nil
+}
+
+// GetAKSAgentPoolSize returns the count of the agent pool.
+func (m *AzureManager) GetAKSAgentPoolSize(ctx context.Context, ap *AKSAgentPool) (int64, error) {
+	pool, err := m.getAgentPool(ctx, ap)
+	if err != nil {
+		return -1, err
+	}
+	return pool.count()
+}
+
+// SetAKSAgentPoolSize sets the count of the agent pool to size. AKS resizes
+// the scale set of the pool asynchronously.
+func (m *AzureManager) SetAKSAgentPoolSize(ctx context.Context, ap *AKSAgentPool, size int64) error {
+	pool, err := m.getAgentPool(ctx, ap)
+	if err != nil {
+		return err
+	}
+	if state := pool.stringProperty("provisioningState"); state != "" && state != aksProvisioningStateSucceeded && state != aksProvisioningStateFailed {
+		m.log().V(2).Infof("Not resizing agent pool %s in provisioning state %s", ap.Name, state)
+		return ErrAgentPoolUpdating
+	}
+	m.log().V(2).Infof("Setting count of agent pool %s to %d", ap.Name, size)
+	return m.agentPoolClient.CreateOrUpdate(m.resourceGroupName, m.aksClusterName, ap.Name, pool.withCount(size))
+}
+
+// listAKSAgentPoolVMs returns the sorted resource IDs of the VMs of the scale
+// sets of the agent pool in the node resource group of the cluster.
+func (m *AzureManager) listAKSAgentPoolVMs(ap *AKSAgentPool) ([]string, error) {
+	cluster, err := m.getManagedCluster()
+	if err != nil {
+		return nil, err
+	}
+	resourceGroup := cluster.Properties.NodeResourceGroup
+	scaleSets, err := m.listScaleSets(m.subscription, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for _, scaleSet := range scaleSets {
+		if scaleSet.Name == nil || !isAgentPoolScaleSet(scaleSet, ap.Name) {
+			continue
+		}
+		vms, err := m.listScaleSetVMs(m.scaleSetVmClient, resourceGroup, *scaleSet.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range vms {
+			if vm.ID != nil {
+				ids = append(ids, *vm.ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// isAgentPoolScaleSet returns true if the scale set is tagged as the one of
+// the agent pool.
+func isAgentPoolScaleSet(scaleSet compute.VirtualMachineScaleSet, poolName string) bool {
+	if scaleSet.Tags == nil {
+		return false
+	}
+	for _, tag := range []string{aksManagedPoolNameTag, aksPoolNameTag} {
+		if value := (*scaleSet.Tags)[tag]; value != nil && strings.EqualFold(*value, poolName) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAKSAgentPoolVMs returns list of nodes for the given agent pool.
+func (m *AzureManager) GetAKSAgentPoolVMs(ctx context.Context, ap *AKSAgentPool) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, err
+	}
+	ids, err := m.listAKSAgentPoolVMs(ap)
+	if err != nil {
+		m.log().V(4).Infof("Failed agent pool info request for %s: %v", ap.Name, err)
+		return []string{}, err
+	}
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, normalizeAzureRef(AzureRef{Name: id}).Name)
+	}
+	return result, nil
+}
+
+// GetAKSAgentPoolForInstance returns the agent pool of the given instance.
+func (m *AzureManager) GetAKSAgentPoolForInstance(instance *AzureRef) (*AKSAgentPool, error) {
+	m.log().V(5).Infof("Looking for agent pool for instance: %v\n", instance)
+
+	since := time.Now()
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	ref := normalizeAzureRef(*instance)
+	if ap, found := m.aksAgentPoolCache[ref]; found {
+		return ap, nil
+	}
+
+	if err := m.refreshCacheOnMiss(instance, since); err != nil {
+		return nil, fmt.Errorf("Error while looking for agent pool for instance %+v, error: %v", *instance, err)
+	}
+
+	if ap, found := m.aksAgentPoolCache[ref]; found {
+		return ap, nil
+	}
+	// instance does not belong to any configured agent pool
+	return nil, nil
+}
+
+// buildAKSAgentPoolCache returns the mapping from the VMs of the registered
+// agent pools to their pool.
+func (m *AzureManager) buildAKSAgentPoolCache() (map[AzureRef]*AKSAgentPool, error) {
+	cache := make(map[AzureRef]*AKSAgentPool)
+	for _, ap := range m.aksAgentPools {
+		m.log().V(4).Infof("Regenerating agent pool information for %s", ap.Name)
+		ids, err := m.listAKSAgentPoolVMs(ap)
+		if err != nil {
+			m.log().Errorf("Failed to list the VMs of agent pool %s: %v", ap.Name, err)
+			return nil, err
+		}
+		for _, id := range ids {
+			cache[normalizeAzureRef(AzureRef{Name: id})] = ap
+		}
+	}
+	return cache, nil
+}
+
+// DeleteAKSAgentPoolInstances deletes the given instances from the scale sets
+// of the agent pool, then decreases the count of the pool by the number of
+// deleted instances, so that AKS doesn't create them again on its next
+// reconciliation. Instances which can't be deleted are reported in a
+// *DeleteInstancesError.
+func (m *AzureManager) DeleteAKSAgentPoolInstances(ctx context.Context, ap *AKSAgentPool, instances []*AzureRef) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cluster, err := m.getManagedCluster()
+	if err != nil {
+		return err
+	}
+
+	// The instances are deleted per scale set, a pool may have several during an upgrade.
+	failed := make(map[string]error)
+	byScaleSet := make(map[string][]*AzureRef)
+	for _, instance := range instances {
+		ref, err := parseAzureRef(*instance)
+		if err != nil || ref.scaleSet == "" {
+			failed[instance.Name] = fmt.Errorf("not a scale set VM")
+			continue
+		}
+		byScaleSet[ref.scaleSet] = append(byScaleSet[ref.scaleSet], instance)
+	}
+	deleted := make([]*AzureRef, 0, len(instances))
+	for scaleSet, refs := range byScaleSet {
+		instanceIDs := make([]string, 0, len(refs))
+		for _, instance := range refs {
+			ref, _ := parseAzureRef(*instance)
+			instanceIDs = append(instanceIDs, ref.name)
+		}
+		m.log().V(2).Infof("Deleting instances %v of scale set %s of agent pool %s", instanceIDs, scaleSet, ap.Name)
+		opCtx, cancel := m.operationContext(ctx)
+		requiredIDs := compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &instanceIDs}
+		_, errChan := m.scaleSetClient.DeleteInstances(cluster.Properties.NodeResourceGroup, scaleSet, requiredIDs, opCtx.Done())
+		err := waitForOperation(opCtx, errChan)
+		cancel()
+		if err != nil {
+			m.log().Warningf("Failed to delete instances of scale set %s of agent pool %s: %v", scaleSet, ap.Name, err)
+			for _, instance := range refs {
+				failed[instance.Name] = err
+			}
+			continue
+		}
+		deleted = append(deleted, refs...)
+	}
+
+	m.cacheMutex.Lock()
+	for _, instance := range deleted {
+		delete(m.aksAgentPoolCache, normalizeAzureRef(*instance))
+	}
+	m.cacheMutex.Unlock()
+
+	if len(deleted) > 0 {
+		size, err := m.GetAKSAgentPoolSize(ctx, ap)
+		if err == nil {
+			size -= int64(len(deleted))
+			if size < 0 {
+				size = 0
+			}
+			err = m.SetAKSAgentPoolSize(ctx, ap, size)
+		}
+		if err != nil {
+			return fmt.Errorf("deleted %d instance(s) of agent pool %s but failed to decrease its count: %v", len(deleted), ap.Name, err)
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteInstancesError{Failed: failed}
+	}
+	return nil
+}
+
+// getAKSAgentPoolTemplate returns the template of the nodes of the agent pool.
+func (m *AzureManager) getAKSAgentPoolTemplate(ap *AKSAgentPool, pool agentPool) (*scaleSetTemplate, error) {
+	cluster, err := m.getManagedCluster()
+	if err != nil {
+		return nil, err
+	}
+	sizeName := pool.stringProperty("vmSize")
+	size, found := getVMSize(sizeName)
+	if !found {
+		return nil, fmt.Errorf("VM size %q of agent pool %s is not supported", sizeName, ap.Name)
+	}
+	template := &scaleSetTemplate{
+		VMSize:   size,
+		GPU:      size.GPU,
+		Location: cluster.Location,
+		Spot:     strings.EqualFold(pool.stringProperty("scaleSetPriority"), "Spot"),
+	}
+	var zones []string
+	if err := pool.property("availabilityZones", &zones); err == nil && len(zones) == 1 {
+		template.Zone = zones[0]
+	}
+	return template, nil
+}
+
+// addAgentPoolLabelsAndTaints adds the labels and taints AKS sets on the nodes
+// of the agent pool to the template node. The taints of the pool are in the
+// key=value:effect format.
+func addAgentPoolLabelsAndTaints(logger Logger, node *apiv1.Node, poolName string, pool agentPool) {
+	labels := make(map[string]string)
+	if err := pool.property("nodeLabels", &labels); err != nil {
+		logger.Warningf("Ignoring invalid node labels of agent pool %s: %v", poolName, err)
+	}
+	labels[aksAgentPoolLabel] = poolName
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, labels)
+
+	var taints []string
+	if err := pool.property("nodeTaints", &taints); err != nil {
+		logger.Warningf("Ignoring invalid node taints of agent pool %s: %v", poolName, err)
+	}
+	for _, taint := range taints {
+		values := strings.SplitN(taint, ":", 2)
+		keyValue := strings.SplitN(values[0], "=", 2)
+		if len(values) != 2 || len(keyValue) != 2 {
+			logger.Warningf("Ignoring taint %q of agent pool %s, expected key=value:effect", taint, poolName)
+			continue
+		}
+		node.Spec.Taints = append(node.Spec.Taints, apiv1.Taint{
+			Key:    keyValue[0],
+			Value:  keyValue[1],
+			Effect: apiv1.TaintEffect(values[1]),
+		})
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	apiv1 "k8s.io/api/core/v1"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// agentPoolClientMock is an agentPoolClient whose responses are set up per test.
+type agentPoolClientMock struct {
+	mock.Mock
+}
+
+func (client *agentPoolClientMock) GetCluster(resourceGroupName string, clusterName string) (managedCluster, error) {
+	args := client.Called(resourceGroupName, clusterName)
+	return args.Get(0).(managedCluster), args.Error(1)
+}
+
+func (client *agentPoolClientMock) Get(resourceGroupName string, clusterName string, agentPoolName string) (agentPool, error) {
+	args := client.Called(resourceGroupName, clusterName, agentPoolName)
+	return args.Get(0).(agentPool), args.Error(1)
+}
+
+func (client *agentPoolClientMock) CreateOrUpdate(resourceGroupName string, clusterName string, agentPoolName string, parameters agentPool) error {
+	args := client.Called(resourceGroupName, clusterName, agentPoolName, parameters)
+	return args.Error(0)
+}
+
+const testNodeResourceGroup = "MC_rg_aks_westus"
+
+func newTestManagedCluster() managedCluster {
+	cluster := managedCluster{Location: "westus"}
+	cluster.Properties.NodeResourceGroup = testNodeResourceGroup
+	return cluster
+}
+
+func newTestAgentPool(t *testing.T, properties string) agentPool {
+	var pool agentPool
+	assert.NoError(t, json.Unmarshal([]byte(`{"name": "nodepool1", "properties": `+properties+`}`), &pool))
+	return pool
+}
+
+// withCount matches the agent pools sent to Azure with the given count.
+func withCount(count int64) interface{} {
+	return mock.MatchedBy(func(pool agentPool) bool {
+		c, err := pool.count()
+		return err == nil && c == count
+	})
+}
+
+func newTestAKSManager(apClient *agentPoolClientMock, ssClient *scaleSetClientMock, vmClient *scaleSetVMClientMock) *AzureManager {
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.subscription = "sub"
+	m.vmType = vmTypeAKS
+	m.aksClusterName = "aks"
+	m.agentPoolClient = apClient
+	m.aksAgentPoolCache = make(map[AzureRef]*AKSAgentPool)
+	return m
+}
+
+// setUpTestAgentPoolScaleSet lists the scale set of nodepool1 with count VMs
+// in the node resource group, along with the scale set of another pool.
+func setUpTestAgentPoolScaleSet(apClient *agentPoolClientMock, ssClient *scaleSetClientMock, vmClient *scaleSetVMClientMock, count int) {
+	apClient.On("GetCluster", "rg", "aks").Return(newTestManagedCluster(), nil)
+	pool, other := newTestScaleSet("aks-nodepool1-123-vmss", int64(count)), newTestScaleSet("aks-other-456-vmss", 1)
+	poolName, otherName := "nodepool1", "other"
+	pool.Tags = &map[string]*string{aksManagedPoolNameTag: &poolName}
+	other.Tags = &map[string]*string{aksPoolNameTag: &otherName}
+	ssClient.On("List", testNodeResourceGroup).Return(compute.VirtualMachineScaleSetListResult{
+		Value: &[]compute.VirtualMachineScaleSet{pool, other},
+	}, nil)
+	vmClient.On("List", testNodeResourceGroup, "aks-nodepool1-123-vmss").Return(newTestVMListResult("aks-nodepool1-123-vmss", count), nil)
+	vmClient.On("List", testNodeResourceGroup, "aks-other-456-vmss").Return(newTestVMListResult("aks-other-456-vmss", 1), nil)
+}
+
+func TestAgentPoolClient(t *testing.T) {
+	var updated map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, aksAPIVersion, r.URL.Query().Get("api-version"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/aks":
+			fmt.Fprint(w, `{"location": "westus", "properties": {"nodeResourceGroup": "MC_rg_aks_westus"}}`)
+		case "GET /subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/aks/agentPools/nodepool1":
+			fmt.Fprint(w, `{"name": "nodepool1", "properties": {"count": 3, "vmSize": "Standard_DS2_v2", "provisioningState": "Succeeded", "upgradeSettings": {"maxSurge": "33%"}}}`)
+		case "PUT /subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/aks/agentPools/nodepool1":
+			body, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(body, &updated))
+			fmt.Fprint(w, string(body))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "NotFound"}}`)
+		}
+	}))
+	defer server.Close()
+	client := newAgentPoolClient(server.URL, "sub", autorest.NullAuthorizer{})
+
+	cluster, err := client.GetCluster("rg", "aks")
+	assert.NoError(t, err)
+	assert.Equal(t, newTestManagedCluster(), cluster)
+
+	pool, err := client.Get("rg", "aks", "nodepool1")
+	assert.NoError(t, err)
+	count, err := pool.count()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, "Standard_DS2_v2", pool.stringProperty("vmSize"))
+
+	// Only the count changes, the read-only properties aren't sent.
+	assert.NoError(t, client.CreateOrUpdate("rg", "aks", "nodepool1", pool.withCount(5)))
+	assert.Equal(t, map[string]interface{}{
+		"name": "nodepool1",
+		"properties": map[string]interface{}{
+			"count":           float64(5),
+			"vmSize":          "Standard_DS2_v2",
+			"upgradeSettings": map[string]interface{}{"maxSurge": "33%"},
+		},
+	}, updated)
+
+	_, err = client.Get("rg", "aks", "missing")
+	assert.True(t, isNotFoundError(err))
+}
+
+func TestBuildAKSAgentPool(t *testing.T) {
+	ap, err := buildAKSAgentPool("1:5:nodepool1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "nodepool1", ap.Id())
+	assert.Equal(t, 1, ap.MinSize())
+	assert.Equal(t, 5, ap.MaxSize())
+
+	_, err = buildAKSAgentPool("1:5:rg/nodepool1", nil)
+	assert.Error(t, err)
+	_, err = buildAKSAgentPool("5:1:nodepool1", nil)
+	assert.Error(t, err)
+}
+
+func TestAKSAgentPoolSize(t *testing.T) {
+	apClient := &agentPoolClientMock{}
+	apClient.On("Get", "rg", "aks", "nodepool1").Return(newTestAgentPool(t, `{"count": 2, "provisioningState": "Succeeded"}`), nil)
+	apClient.On("CreateOrUpdate", "rg", "aks", "nodepool1", withCount(4)).Return(nil)
+	ssClient, vmClient := &scaleSetClientMock{}, &scaleSetVMClientMock{}
+	setUpTestAgentPoolScaleSet(apClient, ssClient, vmClient, 2)
+	m := newTestAKSManager(apClient, ssClient, vmClient)
+	ap, err := buildAKSAgentPool("1:4:nodepool1", m)
+	assert.NoError(t, err)
+	assert.NoError(t, ap.register(m.context()))
+
+	size, err := ap.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	nodes, err := ap.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"azure:///subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachinescalesets/aks-nodepool1-123-vmss/virtualmachines/0",
+		"azure:///subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachinescalesets/aks-nodepool1-123-vmss/virtualmachines/1",
+	}, nodes)
+
+	assert.Error(t, ap.IncreaseSize(3))
+	assert.NoError(t, ap.IncreaseSize(2))
+	apClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+
+	// The existing nodes are never removed by decreasing the target size.
+	assert.Error(t, ap.DecreaseTargetSize(-1))
+	apClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+}
+
+func TestAKSAgentPoolSizeUpdating(t *testing.T) {
+	apClient := &agentPoolClientMock{}
+	apClient.On("Get", "rg", "aks", "nodepool1").Return(newTestAgentPool(t, `{"count": 2, "provisioningState": "Scaling"}`), nil)
+	m := newTestAKSManager(apClient, &scaleSetClientMock{}, &scaleSetVMClientMock{})
+	ap, err := buildAKSAgentPool("1:4:nodepool1", m)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrAgentPoolUpdating, ap.IncreaseSize(1))
+	apClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAKSAgentPoolDeleteNodes(t *testing.T) {
+	apClient := &agentPoolClientMock{}
+	apClient.On("Get", "rg", "aks", "nodepool1").Return(newTestAgentPool(t, `{"count": 3, "provisioningState": "Succeeded"}`), nil)
+	apClient.On("CreateOrUpdate", "rg", "aks", "nodepool1", withCount(2)).Return(nil)
+	ssClient, vmClient := &scaleSetClientMock{}, &scaleSetVMClientMock{}
+	setUpTestAgentPoolScaleSet(apClient, ssClient, vmClient, 3)
+	instanceIDs := []string{"1"}
+	ssClient.On("DeleteInstances", testNodeResourceGroup, "aks-nodepool1-123-vmss",
+		compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &instanceIDs}).Return(nil)
+	m := newTestAKSManager(apClient, ssClient, vmClient)
+	ap, err := buildAKSAgentPool("1:4:nodepool1", m)
+	assert.NoError(t, err)
+	assert.NoError(t, ap.register(m.context()))
+
+	node := &apiv1.Node{Spec: apiv1.NodeSpec{
+		ProviderID: "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-nodepool1-123-vmss/virtualMachines/1",
+	}}
+	group, err := (&AzureCloudProvider{azureManager: m}).NodeGroupForNode(node)
+	assert.NoError(t, err)
+	assert.Equal(t, ap, group)
+
+	// The nodes of the other pools are rejected.
+	other := &apiv1.Node{Spec: apiv1.NodeSpec{
+		ProviderID: "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-other-456-vmss/virtualMachines/0",
+	}}
+	assert.Error(t, ap.DeleteNodes([]*apiv1.Node{other}))
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+
+	// The count is decreased along with the deletion of the instance.
+	assert.NoError(t, ap.DeleteNodes([]*apiv1.Node{node}))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+	apClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+}
+
+func TestAKSAgentPoolDeleteNodesMinSize(t *testing.T) {
+	apClient := &agentPoolClientMock{}
+	apClient.On("Get", "rg", "aks", "nodepool1").Return(newTestAgentPool(t, `{"count": 1}`), nil)
+	m := newTestAKSManager(apClient, &scaleSetClientMock{}, &scaleSetVMClientMock{})
+	ap, err := buildAKSAgentPool("1:4:nodepool1", m)
+	assert.NoError(t, err)
+
+	err = ap.DeleteNodes([]*apiv1.Node{{}})
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "min size reached"))
+}
+
+func TestAKSAgentPoolTemplateNodeInfo(t *testing.T) {
+	apClient := &agentPoolClientMock{}
+	apClient.On("GetCluster", "rg", "aks").Return(newTestManagedCluster(), nil)
+	apClient.On("Get", "rg", "aks", "nodepool1").Return(newTestAgentPool(t, `{
+		"count": 1,
+		"vmSize": "Standard_DS2_v2",
+		"availabilityZones": ["2"],
+		"nodeLabels": {"team": "infra"},
+		"nodeTaints": ["dedicated=infra:NoSchedule", "invalid"]
+	}`), nil)
+	m := newTestAKSManager(apClient, &scaleSetClientMock{}, &scaleSetVMClientMock{})
+	ap, err := buildAKSAgentPool("1:4:nodepool1", m)
+	assert.NoError(t, err)
+
+	nodeInfo, err := ap.TemplateNodeInfo()
+	assert.NoError(t, err)
+	node := nodeInfo.Node()
+	assert.Equal(t, "nodepool1", node.Labels[aksAgentPoolLabel])
+	assert.Equal(t, "infra", node.Labels["team"])
+	assert.Equal(t, "Standard_DS2_v2", node.Labels[kubeletapis.LabelInstanceType])
+	assert.Equal(t, "westus-2", node.Labels[kubeletapis.LabelZoneFailureDomain])
+	assert.Equal(t, []apiv1.Taint{{Key: "dedicated", Value: "infra", Effect: apiv1.TaintEffectNoSchedule}}, node.Spec.Taints)
+	cpu := node.Status.Capacity[apiv1.ResourceCPU]
+	assert.Equal(t, int64(2), cpu.Value())
+}
@@ -0,0 +1,755 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/plugin/pkg/scheduler/schedulercache"
+)
+
+type availabilitySetClient interface {
+	Get(resourceGroupName string, availabilitySetName string) (result compute.AvailabilitySet, err error)
+}
+
+type virtualMachineClient interface {
+	Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (result compute.VirtualMachine, err error)
+	CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error)
+	Delete(resourceGroupName string, VMName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+}
+
+type interfaceClient interface {
+	Get(resourceGroupName string, networkInterfaceName string, expand string) (result network.Interface, err error)
+	CreateOrUpdate(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (<-chan network.Interface, <-chan error)
+	Delete(resourceGroupName string, networkInterfaceName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error)
+}
+
+type diskClient interface {
+	Delete(resourceGroupName string, diskName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+}
+
+// AvailabilitySet implements NodeGroup interface for the VMs of an availability
+// set, e.g. the agent pools created by acs-engine. Availability sets have no
+// capacity: new VMs are created from the model of an existing VM of the set.
+type AvailabilitySet struct {
+	AzureRef
+
+	azureManager *AzureManager
+	minSize      int
+	maxSize      int
+
+	// ResourceGroup of the availability set, the one of the AzureManager if empty.
+	ResourceGroup string
+}
+
+// Create AvailabilitySet from provided spec.
+// spec is in the following format: min-size:max-size:availability-set-name.
+func buildAvailabilitySet(spec string, azureManager *AzureManager) (*AvailabilitySet, error) {
+	nodeGroupSpec, err := parseNodeGroupSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if nodeGroupSpec.subscriptionID != "" {
+		return nil, fmt.Errorf("availability sets must be in the subscription of the cloud-config, got spec: %s", spec)
+	}
+	return &AvailabilitySet{
+		AzureRef:      AzureRef{Name: nodeGroupSpec.name},
+		azureManager:  azureManager,
+		minSize:       nodeGroupSpec.minSize,
+		maxSize:       nodeGroupSpec.maxSize,
+		ResourceGroup: nodeGroupSpec.resourceGroup,
+	}, nil
+}
+
+func (as *AvailabilitySet) register(ctx context.Context) error {
+	return as.azureManager.RegisterAvailabilitySet(ctx, as)
+}
+
+// MinSize returns minimum size of the node group.
+func (as *AvailabilitySet) MinSize() int {
+	return as.minSize
+}
+
+// MaxSize returns maximum size of the node group.
+func (as *AvailabilitySet) MaxSize() int {
+	return as.maxSize
+}
+
+// Exist checks if the node group really exists on the cloud provider side. Allows to tell the
+// theoretical node group from the real one.
+func (as *AvailabilitySet) Exist() bool {
+	return true
+}
+
+// Create creates the node group on the cloud provider side.
+func (as *AvailabilitySet) Create() error {
+	return cloudprovider.ErrAlreadyExist
+}
+
+// Delete deletes the node group on the cloud provider side.
+// This will be executed only for autoprovisioned node groups, once their size drops to 0.
+func (as *AvailabilitySet) Delete() error {
+	return cloudprovider.ErrNotImplemented
+}
+
+// Autoprovisioned returns true if the node group is autoprovisioned.
+func (as *AvailabilitySet) Autoprovisioned() bool {
+	return false
+}
+
+// TargetSize returns the current TARGET size of the node group. VMs are created
+// synchronously, so it's the number of VMs in the availability set.
+func (as *AvailabilitySet) TargetSize() (int, error) {
+	size, err := as.azureManager.GetAvailabilitySetSize(as.azureManager.context(), as)
+	return int(size), err
+}
+
+// IncreaseSize creates delta new VMs in the availability set.
+func (as *AvailabilitySet) IncreaseSize(delta int) error {
+	if delta <= 0 {
+		return fmt.Errorf("size increase must be positive")
+	}
+	size, err := as.azureManager.GetAvailabilitySetSize(as.azureManager.context(), as)
+	if err != nil {
+		return err
+	}
+	if int(size)+delta > as.MaxSize() {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", int(size)+delta, as.MaxSize())
+	}
+	return as.azureManager.CreateAvailabilitySetVMs(as.azureManager.context(), as, delta)
+}
+
+// DecreaseTargetSize decreases the target size of the node group. The target
+// size of an availability set is the number of its VMs, so there is never a
+// request for new nodes to reduce.
+func (as *AvailabilitySet) DecreaseTargetSize(delta int) error {
+	if delta >= 0 {
+		return fmt.Errorf("size decrease size must be negative")
+	}
+	size, err := as.azureManager.GetAvailabilitySetSize(as.azureManager.context(), as)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
+		size, delta, size)
+}
+
+// Belongs returns true if the given node belongs to the NodeGroup.
+func (as *AvailabilitySet) Belongs(node *apiv1.Node) (bool, error) {
+	glog.V(6).Infof("Check if node belongs to this availability set: availabilityset:%v, node:%v\n", as, node)
+
+	ref := &AzureRef{
+		Name: node.Spec.ProviderID,
+	}
+
+	targetAs, err := as.azureManager.GetAvailabilitySetForInstance(ref)
+	if err != nil {
+		return false, err
+	}
+	if targetAs == nil {
+		return false, fmt.Errorf("%s doesn't belong to a known availability set", node.Name)
+	}
+	return targetAs.Id() == as.Id(), nil
+}
+
+// DeleteNodes deletes the VMs of the nodes, along with their network interfaces
+// and managed OS disks.
+func (as *AvailabilitySet) DeleteNodes(nodes []*apiv1.Node) error {
+	glog.V(8).Infof("Delete nodes requested: %v\n", nodes)
+	size, err := as.azureManager.GetAvailabilitySetSize(as.azureManager.context(), as)
+	if err != nil {
+		return err
+	}
+	if int(size) <= as.MinSize() {
+		return fmt.Errorf("min size reached, nodes will not be deleted")
+	}
+	refs := make([]*AzureRef, 0, len(nodes))
+	for _, node := range nodes {
+		belongs, err := as.Belongs(node)
+		if err != nil {
+			return err
+		}
+		if !belongs {
+			return fmt.Errorf("%s belongs to a different availability set than %s", node.Name, as.Id())
+		}
+		refs = append(refs, &AzureRef{
+			Name: node.Spec.ProviderID,
+		})
+	}
+	as.azureManager.waitForDrain(as.azureManager.context(), nodes)
+	return as.azureManager.DeleteAvailabilitySetInstances(as.azureManager.context(), as, refs)
+}
+
+// Id returns AvailabilitySet id.
+func (as *AvailabilitySet) Id() string {
+	if as.ResourceGroup != "" {
+		return as.ResourceGroup + "/" + as.Name
+	}
+	return as.Name
+}
+
+// Debug returns a debug string for the availability set.
+func (as *AvailabilitySet) Debug() string {
+	return fmt.Sprintf("%s (%d:%d)", as.Id(), as.MinSize(), as.MaxSize())
+}
+
+// Nodes returns a list of all nodes that belong to this node group.
+func (as *AvailabilitySet) Nodes() ([]string, error) {
+	return as.azureManager.GetAvailabilitySetVms(as.azureManager.context(), as)
+}
+
+// TemplateNodeInfo returns a node template for this availability set, built
+// from the VM used as model for new VMs.
+func (as *AvailabilitySet) TemplateNodeInfo() (*schedulercache.NodeInfo, error) {
+	template, err := as.azureManager.getAvailabilitySetTemplate(as)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := as.azureManager.buildNodeFromTemplate(as.Name, template)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(as.Name))
+	nodeInfo.SetNode(node)
+	return nodeInfo, nil
+}
+
+// RegisterAvailabilitySet registers the availability set in the manager. The
+// VMs of the set are the models of the new VMs, so it must never be emptied.
+func (m *AzureManager) RegisterAvailabilitySet(ctx context.Context, as *AvailabilitySet) error {
+	if as.MinSize() < 1 {
+		return fmt.Errorf("min size of availability set %s must be at least 1, its VMs are the models of the new VMs", as.Name)
+	}
+	if as.MinSize() > as.MaxSize() {
+		return fmt.Errorf("min size of availability set %s (%d) is greater than its max size (%d)", as.Name, as.MinSize(), as.MaxSize())
+	}
+
+	size, err := m.GetAvailabilitySetSize(ctx, as)
+	if err != nil {
+		m.log().Warningf("Failed to get the size of availability set %s: %v", as.Name, err)
+	} else if size < int64(as.MinSize()) || size > int64(as.MaxSize()) {
+		m.log().Warningf("Size %d of availability set %s is outside of its bounds [%d, %d]", size, as.Name, as.MinSize(), as.MaxSize())
+	}
+
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	m.availabilitySets = append(m.availabilitySets, as)
+	return nil
+}
+
+// availabilitySetResourceGroup returns the resource group of the availability set.
+func (m *AzureManager) availabilitySetResourceGroup(as *AvailabilitySet) string {
+	if as.ResourceGroup != "" {
+		return as.ResourceGroup
+	}
+	return m.resourceGroupName
+}
+
+// listAvailabilitySetVMIDs returns the sorted resource IDs of the VMs of the
+// availability set, as returned by Azure.
+func (m *AzureManager) listAvailabilitySetVMIDs(as *AvailabilitySet) ([]string, error) {
+	set, err := m.availabilitySetClient.Get(m.availabilitySetResourceGroup(as), as.Name)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	if set.AvailabilitySetProperties != nil && set.AvailabilitySetProperties.VirtualMachines != nil {
+		for _, vm := range *set.AvailabilitySetProperties.VirtualMachines {
+			if vm.ID != nil {
+				ids = append(ids, *vm.ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// GetAvailabilitySetSize returns the number of VMs in the availability set.
+func (m *AzureManager) GetAvailabilitySetSize(ctx context.Context, as *AvailabilitySet) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	ids, err := m.listAvailabilitySetVMIDs(as)
+	if err != nil {
+		return -1, err
+	}
+	return int64(len(ids)), nil
+}
+
+// GetAvailabilitySetVms returns list of nodes for the given availability set.
+func (m *AzureManager) GetAvailabilitySetVms(ctx context.Context, as *AvailabilitySet) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, err
+	}
+	ids, err := m.listAvailabilitySetVMIDs(as)
+	if err != nil {
+		m.log().V(4).Infof("Failed availability set info request for %s: %v", as.Name, err)
+		return []string{}, err
+	}
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, normalizeAzureRef(AzureRef{Name: id}).Name)
+	}
+	return result, nil
+}
+
+// GetAvailabilitySetForInstance returns the availability set of the given instance.
+func (m *AzureManager) GetAvailabilitySetForInstance(instance *AzureRef) (*AvailabilitySet, error) {
+	m.log().V(5).Infof("Looking for availability set for instance: %v\n", instance)
+
+	since := time.Now()
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	ref := normalizeAzureRef(*instance)
+	if as, found := m.availabilitySetCache[ref]; found {
+		return as, nil
+	}
+
+	if err := m.refreshCacheOnMiss(instance, since); err != nil {
+		return nil, fmt.Errorf("Error while looking for availability set for instance %+v, error: %v", *instance, err)
+	}
+
+	if as, found := m.availabilitySetCache[ref]; found {
+		return as, nil
+	}
+	// instance does not belong to any configured availability set
+	return nil, nil
+}
+
+// buildAvailabilitySetCache returns the mapping from the VMs of the registered
+// availability sets to their set.
+func (m *AzureManager) buildAvailabilitySetCache() (map[AzureRef]*AvailabilitySet, error) {
+	cache := make(map[AzureRef]*AvailabilitySet)
+	for _, as := range m.availabilitySets {
+		m.log().V(4).Infof("Regenerating availability set information for %s", as.Name)
+		ids, err := m.listAvailabilitySetVMIDs(as)
+		if err != nil {
+			m.log().Errorf("Failed to get availability set with name %s: %v", as.Name, err)
+			return nil, err
+		}
+		for _, id := range ids {
+			cache[normalizeAzureRef(AzureRef{Name: id})] = as
+		}
+	}
+	return cache, nil
+}
+
+// getAvailabilitySetModelVM returns the first VM of the availability set, used
+// as the model of the new VMs, along with the names of all the VMs of the set.
+func (m *AzureManager) getAvailabilitySetModelVM(as *AvailabilitySet) (*compute.VirtualMachine, []string, error) {
+	ids, err := m.listAvailabilitySetVMIDs(as)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, fmt.Errorf("availability set %s has no VM to use as model", as.Name)
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		_, name, err := parseResourceID(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+	}
+	resourceGroup, _, err := parseResourceID(ids[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	vm, err := m.virtualMachineClient.Get(resourceGroup, names[0], "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &vm, names, nil
+}
+
+// getAvailabilitySetTemplate returns the template of the VMs of the
+// availability set from its model VM.
+func (m *AzureManager) getAvailabilitySetTemplate(as *AvailabilitySet) (*scaleSetTemplate, error) {
+	vm, _, err := m.getAvailabilitySetModelVM(as)
+	if err != nil {
+		return nil, err
+	}
+	if vm.VirtualMachineProperties == nil || vm.VirtualMachineProperties.HardwareProfile == nil {
+		return nil, fmt.Errorf("VM size of availability set %s is unknown", as.Name)
+	}
+	sizeName := string(vm.VirtualMachineProperties.HardwareProfile.VMSize)
+	size, found := getVMSize(sizeName)
+	if !found {
+		return nil, fmt.Errorf("VM size %s of availability set %s is not supported", sizeName, as.Name)
+	}
+	template := &scaleSetTemplate{
+		VMSize: size,
+	}
+	if vm.Location != nil {
+		template.Location = *vm.Location
+	}
+	if vm.Tags != nil {
+		template.Tags = *vm.Tags
+	}
+	return template, nil
+}
+
+// CreateAvailabilitySetVMs creates count new VMs in the availability set,
+// modeled after its first VM. The VMs are created concurrently.
+func (m *AzureManager) CreateAvailabilitySetVMs(ctx context.Context, as *AvailabilitySet, count int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	model, existing, err := m.getAvailabilitySetModelVM(as)
+	if err != nil {
+		return err
+	}
+	if err := validateModelVM(model); err != nil {
+		return fmt.Errorf("cannot create VMs in availability set %s: %v", as.Name, err)
+	}
+	names := nextVMNames(*model.Name, existing, count)
+
+	var errMutex sync.Mutex
+	var firstErr error
+	workqueue.Parallelize(count, count, func(piece int) {
+		if err := m.createVM(ctx, as, model, names[piece]); err != nil {
+			m.log().Errorf("Failed to create VM %s in availability set %s: %v", names[piece], as.Name, err)
+			errMutex.Lock()
+			defer errMutex.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+// validateModelVM checks that new VMs can be created from the model. Secrets
+// like passwords and custom data are not returned by Azure, so only Linux VMs
+// authenticated with SSH keys and managed disks can be copied.
+func validateModelVM(vm *compute.VirtualMachine) error {
+	props := vm.VirtualMachineProperties
+	if vm.Name == nil || props == nil || props.StorageProfile == nil || props.StorageProfile.OsDisk == nil ||
+		props.OsProfile == nil || props.NetworkProfile == nil || props.NetworkProfile.NetworkInterfaces == nil ||
+		len(*props.NetworkProfile.NetworkInterfaces) == 0 {
+		return fmt.Errorf("model VM is incomplete")
+	}
+	if props.StorageProfile.OsDisk.ManagedDisk == nil {
+		return fmt.Errorf("VMs with unmanaged disks are not supported")
+	}
+	if props.OsProfile.WindowsConfiguration != nil {
+		return fmt.Errorf("Windows VMs are not supported")
+	}
+	return nil
+}
+
+// nextVMNames returns count unused names of VMs following the
+// <prefix>-<index> naming of acs-engine, the prefix being the one of the model.
+func nextVMNames(model string, existing []string, count int) []string {
+	prefix := model
+	if i := strings.LastIndex(model, "-"); i >= 0 {
+		if _, err := strconv.Atoi(model[i+1:]); err == nil {
+			prefix = model[:i]
+		}
+	}
+	used := make(map[string]bool)
+	for _, name := range existing {
+		used[strings.ToLower(name)] = true
+	}
+	names := make([]string, 0, count)
+	for index := 0; len(names) < count; index++ {
+		name := fmt.Sprintf("%s-%d", prefix, index)
+		if !used[strings.ToLower(name)] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// interfaceName returns the name of the primary network interface of the VM
+// following the <prefix>-nic-<index> naming of acs-engine, so that acs-engine
+// finds the interfaces of the created VMs when upgrading or scaling the pool.
+func interfaceName(vmName string) string {
+	if i := strings.LastIndex(vmName, "-"); i >= 0 {
+		if _, err := strconv.Atoi(vmName[i+1:]); err == nil {
+			return vmName[:i] + "-nic" + vmName[i:]
+		}
+	}
+	return vmName + "-nic"
+}
+
+// createVM creates the VM with the given name and its primary network interface
+// as copies of the ones of the model.
+func (m *AzureManager) createVM(ctx context.Context, as *AvailabilitySet, model *compute.VirtualMachine, name string) error {
+	resourceGroup := m.availabilitySetResourceGroup(as)
+	nicName := interfaceName(name)
+	if err := m.createInterface(ctx, resourceGroup, nicName, model); err != nil {
+		return err
+	}
+	nicID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/networkInterfaces/%s", m.subscription, resourceGroup, nicName)
+
+	props := model.VirtualMachineProperties
+	modelDisk := props.StorageProfile.OsDisk
+	diskName := name + "-osdisk"
+	computerName := name
+	primary := true
+	vm := compute.VirtualMachine{
+		Location: model.Location,
+		Tags:     model.Tags,
+		Plan:     model.Plan,
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile: props.HardwareProfile,
+			StorageProfile: &compute.StorageProfile{
+				ImageReference: props.StorageProfile.ImageReference,
+				OsDisk: &compute.OSDisk{
+					Name:         &diskName,
+					OsType:       modelDisk.OsType,
+					Caching:      modelDisk.Caching,
+					CreateOption: compute.DiskCreateOptionTypesFromImage,
+					DiskSizeGB:   modelDisk.DiskSizeGB,
+					ManagedDisk: &compute.ManagedDiskParameters{
+						StorageAccountType: modelDisk.ManagedDisk.StorageAccountType,
+					},
+				},
+			},
+			OsProfile: &compute.OSProfile{
+				ComputerName:       &computerName,
+				AdminUsername:      props.OsProfile.AdminUsername,
+				LinuxConfiguration: props.OsProfile.LinuxConfiguration,
+				Secrets:            props.OsProfile.Secrets,
+			},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &[]compute.NetworkInterfaceReference{{
+					ID: &nicID,
+					NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
+						Primary: &primary,
+					},
+				}},
+			},
+			DiagnosticsProfile: props.DiagnosticsProfile,
+			AvailabilitySet:    props.AvailabilitySet,
+			LicenseType:        props.LicenseType,
+		},
+	}
+
+	m.log().V(2).Infof("Creating VM %s in availability set %s", name, as.Name)
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	_, errChan := m.virtualMachineClient.CreateOrUpdate(resourceGroup, name, vm, opCtx.Done())
+	if err := waitForOperation(opCtx, errChan); err != nil {
+		m.deleteInterface(ctx, resourceGroup, nicName)
+		return err
+	}
+	return nil
+}
+
+// createInterface creates a network interface with the IP configurations of
+// the primary network interface of the model.
+func (m *AzureManager) createInterface(ctx context.Context, resourceGroup string, name string, model *compute.VirtualMachine) error {
+	refs := *model.VirtualMachineProperties.NetworkProfile.NetworkInterfaces
+	modelRef := refs[0]
+	for _, ref := range refs {
+		if ref.NetworkInterfaceReferenceProperties != nil && ref.Primary != nil && *ref.Primary {
+			modelRef = ref
+		}
+	}
+	if modelRef.ID == nil {
+		return fmt.Errorf("network interface of model VM %s has no ID", *model.Name)
+	}
+	nicResourceGroup, nicName, err := parseResourceID(*modelRef.ID)
+	if err != nil {
+		return err
+	}
+	modelNic, err := m.interfaceClient.Get(nicResourceGroup, nicName, "")
+	if err != nil {
+		return err
+	}
+	if modelNic.InterfacePropertiesFormat == nil || modelNic.IPConfigurations == nil {
+		return fmt.Errorf("network interface %s has no IP configuration", nicName)
+	}
+
+	// Only the references to other resources are copied, their other fields are read-only.
+	ipConfigs := make([]network.InterfaceIPConfiguration, 0, len(*modelNic.IPConfigurations))
+	for _, modelConfig := range *modelNic.IPConfigurations {
+		props := &network.InterfaceIPConfigurationPropertiesFormat{
+			PrivateIPAllocationMethod: network.Dynamic,
+		}
+		if modelProps := modelConfig.InterfaceIPConfigurationPropertiesFormat; modelProps != nil {
+			props.Primary = modelProps.Primary
+			props.PrivateIPAddressVersion = modelProps.PrivateIPAddressVersion
+			if modelProps.Subnet != nil {
+				props.Subnet = &network.Subnet{ID: modelProps.Subnet.ID}
+			}
+			if modelProps.LoadBalancerBackendAddressPools != nil {
+				pools := make([]network.BackendAddressPool, 0, len(*modelProps.LoadBalancerBackendAddressPools))
+				for _, pool := range *modelProps.LoadBalancerBackendAddressPools {
+					pools = append(pools, network.BackendAddressPool{ID: pool.ID})
+				}
+				props.LoadBalancerBackendAddressPools = &pools
+			}
+		}
+		ipConfigs = append(ipConfigs, network.InterfaceIPConfiguration{
+			Name:                                     modelConfig.Name,
+			InterfaceIPConfigurationPropertiesFormat: props,
+		})
+	}
+	nic := network.Interface{
+		Location: modelNic.Location,
+		Tags:     modelNic.Tags,
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations:            &ipConfigs,
+			EnableIPForwarding:          modelNic.EnableIPForwarding,
+			EnableAcceleratedNetworking: modelNic.EnableAcceleratedNetworking,
+		},
+	}
+	if modelNic.NetworkSecurityGroup != nil {
+		nic.NetworkSecurityGroup = &network.SecurityGroup{ID: modelNic.NetworkSecurityGroup.ID}
+	}
+
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	_, errChan := m.interfaceClient.CreateOrUpdate(resourceGroup, name, nic, opCtx.Done())
+	return waitForOperation(opCtx, errChan)
+}
+
+// DeleteAvailabilitySetInstances deletes the VMs of the given instances along
+// with their network interfaces and managed OS disks. Instances which can't be
+// deleted are reported in a *DeleteInstancesError.
+func (m *AzureManager) DeleteAvailabilitySetInstances(ctx context.Context, as *AvailabilitySet, instances []*AzureRef) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	failed := make(map[string]error)
+	deleted := make([]*AzureRef, 0, len(instances))
+	for _, instance := range instances {
+		if err := m.deleteVM(ctx, instance); err != nil {
+			m.log().Warningf("Failed to delete instance %s of availability set %s: %v", instance.Name, as.Name, err)
+			failed[instance.Name] = err
+			continue
+		}
+		deleted = append(deleted, instance)
+	}
+
+	m.cacheMutex.Lock()
+	for _, instance := range deleted {
+		delete(m.availabilitySetCache, normalizeAzureRef(*instance))
+	}
+	m.cacheMutex.Unlock()
+
+	if len(failed) > 0 {
+		return &DeleteInstancesError{Failed: failed}
+	}
+	return nil
+}
+
+// deleteVM deletes the VM of the instance, then its network interfaces and
+// managed OS disk. Failures to delete the latter are only logged.
+func (m *AzureManager) deleteVM(ctx context.Context, instance *AzureRef) error {
+	resourceGroup, name, err := parseResourceID(strings.TrimPrefix(normalizeAzureRef(*instance).Name, "azure://"))
+	if err != nil {
+		return err
+	}
+	vm, err := m.virtualMachineClient.Get(resourceGroup, name, "")
+	if err != nil {
+		return err
+	}
+
+	m.log().V(2).Infof("Deleting VM %s", name)
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	_, errChan := m.virtualMachineClient.Delete(resourceGroup, name, opCtx.Done())
+	if err := waitForOperation(opCtx, errChan); err != nil {
+		return err
+	}
+
+	props := vm.VirtualMachineProperties
+	if props == nil {
+		return nil
+	}
+	if props.NetworkProfile != nil && props.NetworkProfile.NetworkInterfaces != nil {
+		for _, nic := range *props.NetworkProfile.NetworkInterfaces {
+			if nic.ID == nil {
+				continue
+			}
+			if nicResourceGroup, nicName, err := parseResourceID(*nic.ID); err == nil {
+				m.deleteInterface(ctx, nicResourceGroup, nicName)
+			}
+		}
+	}
+	if props.StorageProfile != nil && props.StorageProfile.OsDisk != nil && props.StorageProfile.OsDisk.ManagedDisk != nil {
+		osDisk := props.StorageProfile.OsDisk
+		diskResourceGroup, diskName := resourceGroup, stringOrEmpty(osDisk.Name)
+		if osDisk.ManagedDisk.ID != nil {
+			if diskResourceGroup, diskName, err = parseResourceID(*osDisk.ManagedDisk.ID); err != nil {
+				m.log().Warningf("Failed to parse ID of OS disk of VM %s: %v", name, err)
+				return nil
+			}
+		}
+		if diskName != "" {
+			m.deleteDisk(ctx, diskResourceGroup, diskName)
+		}
+	}
+	return nil
+}
+
+func (m *AzureManager) deleteInterface(ctx context.Context, resourceGroup string, name string) {
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	_, errChan := m.interfaceClient.Delete(resourceGroup, name, opCtx.Done())
+	if err := waitForOperation(opCtx, errChan); err != nil {
+		m.log().Warningf("Failed to delete network interface %s: %v", name, err)
+	}
+}
+
+func (m *AzureManager) deleteDisk(ctx context.Context, resourceGroup string, name string) {
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	_, errChan := m.diskClient.Delete(resourceGroup, name, opCtx.Done())
+	if err := waitForOperation(opCtx, errChan); err != nil && !isNotFoundError(err) {
+		m.log().Warningf("Failed to delete disk %s: %v", name, err)
+	}
+}
+
+// parseResourceID returns the resource group and the name of the resource with
+// the given ID, e.g. /subscriptions/<id>/resourceGroups/<rg>/providers/Microsoft.Compute/virtualMachines/<name>.
+func parseResourceID(id string) (resourceGroup string, name string, err error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			resourceGroup = parts[i+1]
+			break
+		}
+	}
+	name = parts[len(parts)-1]
+	if resourceGroup == "" || name == "" || len(parts) < 8 {
+		return "", "", fmt.Errorf("invalid resource ID %q", id)
+	}
+	return resourceGroup, name, nil
+}
@@ -0,0 +1,399 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	apiv1 "k8s.io/api/core/v1"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// availabilitySetClientMock is an availabilitySetClient whose responses are set up per test.
+type availabilitySetClientMock struct {
+	mock.Mock
+}
+
+func (client *availabilitySetClientMock) Get(resourceGroupName string, availabilitySetName string) (compute.AvailabilitySet, error) {
+	args := client.Called(resourceGroupName, availabilitySetName)
+	return args.Get(0).(compute.AvailabilitySet), args.Error(1)
+}
+
+// virtualMachineClientMock is a virtualMachineClient whose responses are set up per test.
+type virtualMachineClientMock struct {
+	mock.Mock
+}
+
+func (client *virtualMachineClientMock) Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error) {
+	args := client.Called(resourceGroupName, VMName)
+	return args.Get(0).(compute.VirtualMachine), args.Error(1)
+}
+
+func (client *virtualMachineClientMock) CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error) {
+	args := client.Called(resourceGroupName, VMName, parameters)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+func (client *virtualMachineClientMock) Delete(resourceGroupName string, VMName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, VMName)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+// interfaceClientMock is an interfaceClient whose responses are set up per test.
+type interfaceClientMock struct {
+	mock.Mock
+}
+
+func (client *interfaceClientMock) Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error) {
+	args := client.Called(resourceGroupName, networkInterfaceName)
+	return args.Get(0).(network.Interface), args.Error(1)
+}
+
+func (client *interfaceClientMock) CreateOrUpdate(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (<-chan network.Interface, <-chan error) {
+	args := client.Called(resourceGroupName, networkInterfaceName, parameters)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+func (client *interfaceClientMock) Delete(resourceGroupName string, networkInterfaceName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error) {
+	args := client.Called(resourceGroupName, networkInterfaceName)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+// diskClientMock is a diskClient whose responses are set up per test.
+type diskClientMock struct {
+	mock.Mock
+}
+
+func (client *diskClientMock) Delete(resourceGroupName string, diskName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, diskName)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+func testVMID(name string) string {
+	return fmt.Sprintf("/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Compute/virtualMachines/%s", name)
+}
+
+func newTestAvailabilitySet(vmNames ...string) compute.AvailabilitySet {
+	vms := make([]compute.SubResource, len(vmNames))
+	for i, name := range vmNames {
+		id := testVMID(name)
+		vms[i] = compute.SubResource{ID: &id}
+	}
+	return compute.AvailabilitySet{
+		AvailabilitySetProperties: &compute.AvailabilitySetProperties{
+			VirtualMachines: &vms,
+		},
+	}
+}
+
+func newTestVM(name string) compute.VirtualMachine {
+	location := "westus"
+	nicID := "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Network/networkInterfaces/" + name + "-nic"
+	diskID := "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Compute/disks/" + name + "-osdisk"
+	diskName := name + "-osdisk"
+	user := "azureuser"
+	asID := "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Compute/availabilitySets/agentpool"
+	return compute.VirtualMachine{
+		Name:     &name,
+		Location: &location,
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile: &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD2V2},
+			StorageProfile: &compute.StorageProfile{
+				ImageReference: &compute.ImageReference{},
+				OsDisk: &compute.OSDisk{
+					Name:        &diskName,
+					OsType:      compute.Linux,
+					ManagedDisk: &compute.ManagedDiskParameters{ID: &diskID, StorageAccountType: compute.PremiumLRS},
+				},
+			},
+			OsProfile: &compute.OSProfile{
+				AdminUsername:      &user,
+				LinuxConfiguration: &compute.LinuxConfiguration{},
+			},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &[]compute.NetworkInterfaceReference{{ID: &nicID}},
+			},
+			AvailabilitySet: &compute.SubResource{ID: &asID},
+		},
+	}
+}
+
+func newTestInterface() network.Interface {
+	subnetID := "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet"
+	configName := "ipconfig1"
+	return network.Interface{
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations: &[]network.InterfaceIPConfiguration{{
+				Name: &configName,
+				InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+					Subnet: &network.Subnet{ID: &subnetID},
+				},
+			}},
+		},
+	}
+}
+
+func newTestAvailabilitySetManager(asClient *availabilitySetClientMock, vmClient *virtualMachineClientMock) *AzureManager {
+	return &AzureManager{
+		resourceGroupName:     "rg",
+		subscription:          "sub",
+		vmType:                vmTypeStandard,
+		availabilitySetClient: asClient,
+		virtualMachineClient:  vmClient,
+		interfaceClient:       &interfaceClientMock{},
+		diskClient:            &diskClientMock{},
+		availabilitySetCache:  make(map[AzureRef]*AvailabilitySet),
+	}
+}
+
+func TestBuildAvailabilitySet(t *testing.T) {
+	as, err := buildAvailabilitySet("1:5:test-rg/agentpool", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "agentpool", as.Name)
+	assert.Equal(t, "test-rg/agentpool", as.Id())
+	assert.Equal(t, 1, as.MinSize())
+	assert.Equal(t, 5, as.MaxSize())
+
+	_, err = buildAvailabilitySet("5:1:agentpool", nil)
+	assert.Error(t, err)
+}
+
+func TestRegisterAvailabilitySet(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0"), nil)
+	m := newTestAvailabilitySetManager(asClient, &virtualMachineClientMock{})
+
+	as, err := buildAvailabilitySet("0:5:agentpool", m)
+	assert.NoError(t, err)
+	assert.Error(t, m.RegisterAvailabilitySet(context.Background(), as))
+
+	as, err = buildAvailabilitySet("1:5:agentpool", m)
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterAvailabilitySet(context.Background(), as))
+	assert.Equal(t, 1, len(m.availabilitySets))
+}
+
+func TestAvailabilitySetSize(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-1", "agentpool-0", "agentpool-2"), nil)
+	m := newTestAvailabilitySetManager(asClient, &virtualMachineClientMock{})
+	as, err := buildAvailabilitySet("1:5:agentpool", m)
+	assert.NoError(t, err)
+
+	size, err := as.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	nodes, err := as.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"azure://" + strings.ToLower(testVMID("agentpool-0")),
+		"azure://" + strings.ToLower(testVMID("agentpool-1")),
+		"azure://" + strings.ToLower(testVMID("agentpool-2")),
+	}, nodes)
+
+	assert.Error(t, as.DecreaseTargetSize(-1))
+}
+
+func TestAvailabilitySetSizeError(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(compute.AvailabilitySet{}, fmt.Errorf("not found"))
+	m := newTestAvailabilitySetManager(asClient, &virtualMachineClientMock{})
+	as, err := buildAvailabilitySet("1:5:agentpool", m)
+	assert.NoError(t, err)
+
+	_, err = as.TargetSize()
+	assert.Error(t, err)
+}
+
+func TestAvailabilitySetIncreaseSize(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("k8s-agentpool-1234-0", "k8s-agentpool-1234-2"), nil)
+	vmClient := &virtualMachineClientMock{}
+	vmClient.On("Get", "RG", "k8s-agentpool-1234-0").Return(newTestVM("k8s-agentpool-1234-0"), nil)
+	vmClient.On("CreateOrUpdate", "rg", mock.Anything, mock.Anything).Return(nil)
+	nicClient := &interfaceClientMock{}
+	nicClient.On("Get", "RG", "k8s-agentpool-1234-0-nic").Return(newTestInterface(), nil)
+	nicClient.On("CreateOrUpdate", "rg", mock.Anything, mock.Anything).Return(nil)
+	m := newTestAvailabilitySetManager(asClient, vmClient)
+	m.interfaceClient = nicClient
+	as, err := buildAvailabilitySet("1:4:agentpool", m)
+	assert.NoError(t, err)
+
+	assert.Error(t, as.IncreaseSize(3))
+	assert.NoError(t, as.IncreaseSize(2))
+
+	vmClient.AssertNumberOfCalls(t, "CreateOrUpdate", 2)
+	nicClient.AssertNumberOfCalls(t, "CreateOrUpdate", 2)
+	created := make(map[string]compute.VirtualMachine)
+	for _, call := range vmClient.Calls {
+		if call.Method == "CreateOrUpdate" {
+			created[call.Arguments.String(1)] = call.Arguments.Get(2).(compute.VirtualMachine)
+		}
+	}
+	assert.Contains(t, created, "k8s-agentpool-1234-1")
+	assert.Contains(t, created, "k8s-agentpool-1234-3")
+	vm := created["k8s-agentpool-1234-1"]
+	assert.Equal(t, "k8s-agentpool-1234-1", *vm.OsProfile.ComputerName)
+	assert.Equal(t, "k8s-agentpool-1234-1-osdisk", *vm.StorageProfile.OsDisk.Name)
+	assert.Equal(t, compute.DiskCreateOptionTypesFromImage, vm.StorageProfile.OsDisk.CreateOption)
+	assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/k8s-agentpool-1234-nic-1",
+		*(*vm.NetworkProfile.NetworkInterfaces)[0].ID)
+}
+
+func TestAvailabilitySetIncreaseSizeUnsupportedModel(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0"), nil)
+	model := newTestVM("agentpool-0")
+	model.StorageProfile.OsDisk.ManagedDisk = nil
+	vmClient := &virtualMachineClientMock{}
+	vmClient.On("Get", "RG", "agentpool-0").Return(model, nil)
+	m := newTestAvailabilitySetManager(asClient, vmClient)
+	as, err := buildAvailabilitySet("1:4:agentpool", m)
+	assert.NoError(t, err)
+
+	err = as.IncreaseSize(1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unmanaged disks")
+	vmClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAvailabilitySetDeleteNodes(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0", "agentpool-1"), nil)
+	vmClient := &virtualMachineClientMock{}
+	vmClient.On("Get", "rg", "agentpool-1").Return(newTestVM("agentpool-1"), nil)
+	vmClient.On("Delete", "rg", "agentpool-1").Return(nil)
+	nicClient := &interfaceClientMock{}
+	nicClient.On("Delete", "RG", "agentpool-1-nic").Return(nil)
+	disks := &diskClientMock{}
+	disks.On("Delete", "RG", "agentpool-1-osdisk").Return(nil)
+	m := newTestAvailabilitySetManager(asClient, vmClient)
+	m.interfaceClient = nicClient
+	m.diskClient = disks
+	as, err := buildAvailabilitySet("1:4:agentpool", m)
+	assert.NoError(t, err)
+	m.availabilitySets = append(m.availabilitySets, as)
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure://" + testVMID("agentpool-1"),
+		},
+	}
+	assert.NoError(t, as.DeleteNodes([]*apiv1.Node{node}))
+	vmClient.AssertNumberOfCalls(t, "Delete", 1)
+	nicClient.AssertNumberOfCalls(t, "Delete", 1)
+	disks.AssertNumberOfCalls(t, "Delete", 1)
+	_, found := m.availabilitySetCache[AzureRef{Name: strings.ToLower(node.Spec.ProviderID)}]
+	assert.False(t, found)
+}
+
+func TestAvailabilitySetDeleteNodesMinSize(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0"), nil)
+	vmClient := &virtualMachineClientMock{}
+	m := newTestAvailabilitySetManager(asClient, vmClient)
+	as, err := buildAvailabilitySet("1:4:agentpool", m)
+	assert.NoError(t, err)
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure://" + testVMID("agentpool-0"),
+		},
+	}
+	assert.Error(t, as.DeleteNodes([]*apiv1.Node{node}))
+	vmClient.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestAvailabilitySetTemplateNodeInfo(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0"), nil)
+	vmClient := &virtualMachineClientMock{}
+	vmClient.On("Get", "RG", "agentpool-0").Return(newTestVM("agentpool-0"), nil)
+	m := newTestAvailabilitySetManager(asClient, vmClient)
+	as, err := buildAvailabilitySet("1:4:agentpool", m)
+	assert.NoError(t, err)
+
+	nodeInfo, err := as.TemplateNodeInfo()
+	assert.NoError(t, err)
+	node := nodeInfo.Node()
+	assert.Equal(t, string(compute.VirtualMachineSizeTypesStandardD2V2), node.Labels[kubeletapis.LabelInstanceType])
+	assert.Equal(t, "westus", node.Labels[kubeletapis.LabelZoneRegion])
+}
+
+func TestNodeGroupForNodeAvailabilitySet(t *testing.T) {
+	asClient := &availabilitySetClientMock{}
+	asClient.On("Get", "rg", "agentpool").Return(newTestAvailabilitySet("agentpool-0"), nil)
+	m := newTestAvailabilitySetManager(asClient, &virtualMachineClientMock{})
+	provider := testProvider(t, m)
+	assert.NoError(t, provider.addNodeGroup("1:4:agentpool"))
+	assert.Equal(t, 1, len(provider.NodeGroups()))
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure://" + testVMID("agentpool-0"),
+		},
+	}
+	group, err := provider.NodeGroupForNode(node)
+	assert.NoError(t, err)
+	assert.Equal(t, "agentpool", group.Id())
+
+	node.Spec.ProviderID = "azure://" + testVMID("other-0")
+	group, err = provider.NodeGroupForNode(node)
+	assert.NoError(t, err)
+	assert.Nil(t, group)
+}
+
+func TestNextVMNames(t *testing.T) {
+	assert.Equal(t, []string{"k8s-agentpool-1234-1", "k8s-agentpool-1234-3"},
+		nextVMNames("k8s-agentpool-1234-0", []string{"k8s-agentpool-1234-0", "K8S-AGENTPOOL-1234-2"}, 2))
+	assert.Equal(t, []string{"node-0"}, nextVMNames("node", []string{"node"}, 1))
+}
+
+func TestInterfaceName(t *testing.T) {
+	assert.Equal(t, "k8s-agentpool-1234-nic-1", interfaceName("k8s-agentpool-1234-1"))
+	assert.Equal(t, "node-nic", interfaceName("node"))
+}
+
+func TestParseResourceID(t *testing.T) {
+	resourceGroup, name, err := parseResourceID(testVMID("agentpool-0"))
+	assert.NoError(t, err)
+	assert.Equal(t, "RG", resourceGroup)
+	assert.Equal(t, "agentpool-0", name)
+
+	_, _, err = parseResourceID("agentpool-0")
+	assert.Error(t, err)
+}
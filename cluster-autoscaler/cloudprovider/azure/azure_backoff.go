@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScaleSetBackedOffError is returned by the operations on a scale set while
+// its API calls are backed off, e.g. because Azure throttled them.
+type ScaleSetBackedOffError struct {
+	ScaleSet string
+	// Until is the time the scale set is backed off until.
+	Until time.Time
+	// Reason is the cause of the backoff.
+	Reason string
+}
+
+func (e *ScaleSetBackedOffError) Error() string {
+	return fmt.Sprintf("calls to scale set %s are backed off until %v: %s", e.ScaleSet, e.Until, e.Reason)
+}
+
+// checkBackoff returns a *ScaleSetBackedOffError if the calls to the scale set
+// are backed off.
+func (m *AzureManager) checkBackoff(asConfig *ScaleSet) error {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	backoff, found := m.backoffs[m.scaleSetKey(asConfig)]
+	if !found {
+		return nil
+	}
+	if !time.Now().Before(backoff.Until) {
+		delete(m.backoffs, m.scaleSetKey(asConfig))
+		return nil
+	}
+	return backoff
+}
+
+// backOffIfThrottled suspends the calls to the scale set if err was caused by
+// Azure throttling them, for at least the time requested by Azure.
+func (m *AzureManager) backOffIfThrottled(asConfig *ScaleSet, err error) {
+	retryAfter, throttled := getRetryAfter(err)
+	if !throttled {
+		return
+	}
+	backoff := m.throttlingBackoff
+	if backoff <= 0 {
+		backoff = defaultThrottlingBackoff
+	}
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	m.backOff(asConfig, backoff, "throttled by Azure")
+}
+
+// backOffIfAllocationFailed suspends the calls to a spot scale set, or to one
+// pinned to a dedicated host group or a proximity placement group, if err was
+// caused by Azure failing to allocate its VMs, e.g. for lack of spot capacity
+// or of room on the hosts. Retrying such a scale set is bound to fail again,
+// the other node groups are tried meanwhile.
+func (m *AzureManager) backOffIfAllocationFailed(asConfig *ScaleSet, err error) {
+	if !isAllocationError(err) {
+		return
+	}
+	reason := "failed to allocate spot VMs"
+	if !asConfig.Spot {
+		pinnedTo := m.pinnedTo(asConfig)
+		if pinnedTo == "" {
+			return
+		}
+		reason = "failed to allocate VMs in its " + pinnedTo
+	}
+	backoff := m.spotAllocationBackoff
+	if backoff <= 0 {
+		backoff = defaultSpotAllocationBackoff
+	}
+	m.backOff(asConfig, backoff, reason)
+}
+
+// pinnedTo describes the placement group the VMs of the registered scale set
+// are pinned to according to its first refresh, empty if none.
+func (m *AzureManager) pinnedTo(asConfig *ScaleSet) string {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	sset := m.getScaleSetInformation(asConfig)
+	switch {
+	case sset == nil:
+		return ""
+	case sset.properties.hostGroupID != "":
+		return "dedicated host group"
+	case sset.properties.proximityPlacementGroupID != "":
+		return "proximity placement group"
+	}
+	return ""
+}
+
+// backOff suspends the calls to the scale set for the given duration.
+func (m *AzureManager) backOff(asConfig *ScaleSet, duration time.Duration, reason string) {
+	until := time.Now().Add(duration)
+	m.log().Warningf("Backing off scale set %s until %v: %s", asConfig.Name, until, reason)
+
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	if m.backoffs == nil {
+		m.backoffs = make(map[string]*ScaleSetBackedOffError)
+	}
+	m.backoffs[m.scaleSetKey(asConfig)] = &ScaleSetBackedOffError{ScaleSet: asConfig.Name, Until: until, Reason: reason}
+}
+
+// allocationErrorCodes are the codes of the errors returned by Azure when it
+// can't allocate the VMs of a scale set.
+var allocationErrorCodes = []string{
+	"AllocationFailed",
+	"ZonalAllocationFailed",
+	"OverconstrainedAllocationRequest",
+	"OverconstrainedZonalAllocationRequest",
+	"SkuNotAvailable",
+}
+
+// isAllocationError returns true if err was caused by Azure failing to
+// allocate VMs. The error codes are nested in the errors of the long running
+// operations, so they are looked up in the error message.
+func isAllocationError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, code := range allocationErrorCodes {
+		if strings.Contains(err.Error(), code) {
+			return true
+		}
+	}
+	return false
+}
+
+// SpotFallback returns the registered scale set to scale up instead of the
+// given spot scale set while it's backed off, nil if there is none. Spot
+// scale sets are not fallbacks.
+func (m *AzureManager) SpotFallback(scaleSet *ScaleSet) *ScaleSet {
+	if !scaleSet.Spot {
+		return nil
+	}
+	name, found := m.spotFallbackScaleSets[strings.ToLower(scaleSet.Name)]
+	if !found {
+		return nil
+	}
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	for _, sset := range m.scaleSets {
+		if strings.EqualFold(sset.config.Name, name) && !sset.config.Spot {
+			return sset.config
+		}
+	}
+	return nil
+}
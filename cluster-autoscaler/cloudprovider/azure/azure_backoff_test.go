@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAllocationError(t *testing.T) {
+	assert.True(t, isAllocationError(fmt.Errorf("Code=\"AllocationFailed\" Message=\"Allocation failed\"")))
+	assert.True(t, isAllocationError(fmt.Errorf("Code=\"OverconstrainedZonalAllocationRequest\"")))
+	assert.False(t, isAllocationError(fmt.Errorf("Code=\"OperationNotAllowed\"")))
+	assert.False(t, isAllocationError(nil))
+}
+
+func TestThrottledScaleSetBackedOff(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.sizeCacheTTL = 0
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Once()
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestThrottledError("600")).Once()
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// Azure asks to retry after 10 minutes, longer than the default backoff.
+	_, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.Error(t, err)
+	until := m.backoffs["rg/ss1"].Until
+	assert.True(t, until.After(time.Now().Add(9*time.Minute)), "backed off until %v", until)
+
+	// The scale set is no longer called until the end of the backoff.
+	_, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.Equal(t, &ScaleSetBackedOffError{ScaleSet: "ss1", Until: until, Reason: "throttled by Azure"}, err)
+	err = m.SetScaleSetSize(context.Background(), scaleSet, 3)
+	assert.Equal(t, &ScaleSetBackedOffError{ScaleSet: "ss1", Until: until, Reason: "throttled by Azure"}, err)
+	ssClient.AssertNumberOfCalls(t, "Get", 2)
+
+	// The instances of the backed off scale set are kept in the cache.
+	assert.NoError(t, m.Refresh())
+	ssClient.AssertNumberOfCalls(t, "Get", 2)
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	found, err := m.GetScaleSetForInstance(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSet, found)
+	assert.False(t, m.Snapshot()[0].Healthy)
+
+	// The calls resume once the backoff is over.
+	m.backoffs["rg/ss1"].Until = time.Now().Add(-time.Second)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	assert.Empty(t, m.backoffs)
+}
+
+func TestBackedOffScaleSetKeepsOnlyItsInstances(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	pool := registerTestScaleSet(t, m, "1:5:pool")
+	registerTestScaleSet(t, m, "1:5:pool2")
+
+	for _, name := range []string{"pool", "pool2"} {
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, 1), nil)
+	}
+	vmClient.On("List", "rg", "pool").Return(newTestVMListResultWithStates("pool", "Succeeded"), nil)
+	vmClient.On("List", "rg", "pool2").Return(newTestVMListResultWithStates("pool2", "Creating"), nil).Once()
+	assert.NoError(t, m.Refresh())
+
+	// The instances of pool2, whose name starts with the one of pool, aren't
+	// kept with the ones of the backed off pool.
+	m.backOff(pool, time.Minute, "throttled by Azure")
+	vmClient.On("List", "rg", "pool2").Return(newTestVMListResult("pool2", 0), nil)
+	m.regenerated = time.Time{}
+	assert.NoError(t, m.Refresh())
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	assert.Equal(t, map[string]string{
+		"azure:///subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachinescalesets/pool/virtualmachines/0": "Succeeded",
+	}, m.instanceStateCache)
+}
+
+func TestThrottlingBackoffDefault(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	m.backOffIfThrottled(scaleSet, newTestDetailedError(http.StatusInternalServerError))
+	assert.NoError(t, m.checkBackoff(scaleSet))
+
+	m.backOffIfThrottled(scaleSet, newTestThrottledError("1"))
+	err, ok := m.checkBackoff(scaleSet).(*ScaleSetBackedOffError)
+	assert.True(t, ok)
+	assert.True(t, err.Until.After(time.Now().Add(defaultThrottlingBackoff-time.Minute)), "backed off until %v", err.Until)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Tags of the auto-discovered scale sets overriding the bounds of the auto
+// discovery spec they match.
+const (
+	minSizeTag = "min"
+	maxSizeTag = "max"
+)
+
+// scaleSetBounds are the min and max sizes of a scale set.
+type scaleSetBounds struct {
+	minSize int
+	maxSize int
+}
+
+// parseNodeGroupBounds parses the comma separated
+// <min>:<max>:[[<subscription-id>/]<resource-group>/]<scale-set-name> specs of the nodeGroupBounds
+// setting, keyed like sizeCache.
+func (m *AzureManager) parseNodeGroupBounds(specs string) (map[string]scaleSetBounds, error) {
+	result := make(map[string]scaleSetBounds)
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parsed, err := parseNodeGroupSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("azure: invalid nodeGroupBounds: %v", err)
+		}
+		key := m.scaleSetKey(&ScaleSet{AzureRef: AzureRef{Name: parsed.name}, ResourceGroup: parsed.resourceGroup, SubscriptionID: parsed.subscriptionID})
+		result[key] = scaleSetBounds{minSize: parsed.minSize, maxSize: parsed.maxSize}
+	}
+	return result, nil
+}
+
+// setBoundsOverrides replaces the bounds overriding the ones the scale sets
+// were registered with.
+func (m *AzureManager) setBoundsOverrides(bounds map[string]scaleSetBounds) {
+	m.boundsMutex.Lock()
+	defer m.boundsMutex.Unlock()
+	for key, b := range bounds {
+		if previous, found := m.boundsOverrides[key]; !found || previous != b {
+			m.log().Infof("Bounds of scale set %s set to [%d, %d]", key, b.minSize, b.maxSize)
+		}
+	}
+	for key := range m.boundsOverrides {
+		if _, found := bounds[key]; !found {
+			m.log().Infof("Bounds of scale set %s no longer overridden", key)
+		}
+	}
+	m.boundsOverrides = bounds
+}
+
+// boundsOverride returns the bounds overriding the ones the scale set was
+// registered with, if any.
+func (m *AzureManager) boundsOverride(scaleSet *ScaleSet) (scaleSetBounds, bool) {
+	if m == nil {
+		return scaleSetBounds{}, false
+	}
+	m.boundsMutex.Lock()
+	defer m.boundsMutex.Unlock()
+	bounds, found := m.boundsOverrides[m.scaleSetKey(scaleSet)]
+	return bounds, found
+}
+
+// boundsFromTags returns the bounds set by the min and max tags of an
+// auto-discovered scale set, defaulting to the given ones. Invalid tags are
+// logged and ignored.
+func boundsFromTags(name string, tags *map[string]*string, minSize int, maxSize int) (int, int) {
+	if tags == nil {
+		return minSize, maxSize
+	}
+	tagMin, tagMax := minSize, maxSize
+	for tagName, value := range *tags {
+		if value == nil {
+			continue
+		}
+		var target *int
+		switch {
+		case strings.EqualFold(tagName, minSizeTag):
+			target = &tagMin
+		case strings.EqualFold(tagName, maxSizeTag):
+			target = &tagMax
+		default:
+			continue
+		}
+		size, err := strconv.Atoi(*value)
+		if err != nil || size < 0 {
+			glog.Warningf("Ignoring the %s tag of scale set %s, expected a non-negative integer, got %q", tagName, name, *value)
+			return minSize, maxSize
+		}
+		*target = size
+	}
+	if tagMin > tagMax {
+		glog.Warningf("Ignoring the bounds tags of scale set %s, min size %d is greater than max size %d", name, tagMin, tagMax)
+		return minSize, maxSize
+	}
+	return tagMin, tagMax
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeGroupBounds(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+
+	bounds, err := m.parseNodeGroupBounds("")
+	assert.NoError(t, err)
+	assert.Empty(t, bounds)
+
+	bounds, err = m.parseNodeGroupBounds("1:5:ss1, 0:10:Other-RG/SS2")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]scaleSetBounds{
+		"rg/ss1":       {minSize: 1, maxSize: 5},
+		"other-rg/ss2": {minSize: 0, maxSize: 10},
+	}, bounds)
+
+	_, err = m.parseNodeGroupBounds("1:5:ss1,5:1:ss2")
+	assert.Error(t, err)
+	_, err = m.parseNodeGroupBounds("ss1")
+	assert.Error(t, err)
+}
+
+func TestBoundsOverride(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+	other := registerTestScaleSet(t, m, "1:5:ss2")
+
+	m.setBoundsOverrides(map[string]scaleSetBounds{"rg/ss1": {minSize: 2, maxSize: 8}})
+	assert.Equal(t, 2, scaleSet.MinSize())
+	assert.Equal(t, 8, scaleSet.MaxSize())
+	assert.Equal(t, 1, other.MinSize())
+	assert.Equal(t, 5, other.MaxSize())
+
+	m.setBoundsOverrides(map[string]scaleSetBounds{})
+	assert.Equal(t, 1, scaleSet.MinSize())
+	assert.Equal(t, 5, scaleSet.MaxSize())
+}
+
+func TestReloadNodeGroupBounds(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	f, err := ioutil.TempFile("", "cloud-config")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(testCloudConfigWithSecret("secret"), "nodeGroupBounds = 1:5:ss1\n"...))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	m, err := CreateAzureManagerFromFile(f.Name())
+	assert.NoError(t, err)
+	defer m.Cleanup()
+	scaleSet := &ScaleSet{AzureRef: AzureRef{Name: "ss1"}, minSize: 0, maxSize: 3, azureManager: m}
+	assert.Equal(t, 1, scaleSet.MinSize())
+	assert.Equal(t, 5, scaleSet.MaxSize())
+
+	reload := func(bounds string) error {
+		return m.reloadCloudConfig(func() ([]byte, error) {
+			return append(testCloudConfigWithSecret("secret"), "nodeGroupBounds = "+bounds+"\n"...), nil
+		})
+	}
+	assert.NoError(t, reload("2:10:ss1"))
+	assert.Equal(t, 2, scaleSet.MinSize())
+	assert.Equal(t, 10, scaleSet.MaxSize())
+
+	// Invalid bounds keep the previous ones.
+	assert.Error(t, reload("10:2:ss1"))
+	assert.Equal(t, 2, scaleSet.MinSize())
+	assert.Equal(t, 10, scaleSet.MaxSize())
+
+	assert.NoError(t, reload(""))
+	assert.Equal(t, 0, scaleSet.MinSize())
+	assert.Equal(t, 3, scaleSet.MaxSize())
+}
+
+func TestBoundsFromTags(t *testing.T) {
+	tags := func(values map[string]string) *map[string]*string {
+		result := make(map[string]*string)
+		for k, v := range values {
+			value := v
+			result[k] = &value
+		}
+		return &result
+	}
+	for _, tc := range []struct {
+		tags             *map[string]*string
+		minSize, maxSize int
+	}{
+		{nil, 1, 10},
+		{tags(map[string]string{"env": "prod"}), 1, 10},
+		{tags(map[string]string{"min": "2"}), 2, 10},
+		{tags(map[string]string{"Min": "0", "MAX": "20"}), 0, 20},
+		{tags(map[string]string{"min": "3", "max": "2"}), 1, 10},
+		{tags(map[string]string{"min": "two", "max": "20"}), 1, 10},
+		{tags(map[string]string{"max": "-1"}), 1, 10},
+	} {
+		minSize, maxSize := boundsFromTags("ss", tc.tags, 1, 10)
+		assert.Equal(t, tc.minSize, minSize)
+		assert.Equal(t, tc.maxSize, maxSize)
+	}
+}
@@ -0,0 +1,711 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Provisioning states of scale set VMs.
+const (
+	vmProvisioningStateCreating = "Creating"
+	vmProvisioningStateDeleting = "Deleting"
+	vmProvisioningStateFailed   = "Failed"
+	vmProvisioningStateUpdating = "Updating"
+)
+
+// Power states of scale set VMs, reported in their instance view.
+const (
+	vmPowerStateDeallocating = "PowerState/deallocating"
+	vmPowerStateDeallocated  = "PowerState/deallocated"
+)
+
+type cachedSize struct {
+	size      int64
+	fetchedAt time.Time
+	// inFlight is true while the scale set is being resized to size, which
+	// is then returned regardless of the TTL.
+	inFlight bool
+}
+
+// GetScaleSetSize gets Scale Set size.
+func (m *AzureManager) GetScaleSetSize(ctx context.Context, asConfig *ScaleSet) (int64, error) {
+	m.log().V(5).Infof("Get scale set size: %v\n", asConfig)
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	if size, found := m.getCachedSize(asConfig); found {
+		m.log().V(5).Infof("Returning cached scale set capacity: %d\n", size)
+		return size, nil
+	}
+	clients, err := m.clientsOf(asConfig)
+	if err == nil {
+		err = m.checkBackoff(asConfig)
+	}
+	if err != nil {
+		return -1, err
+	}
+	set, err := clients.scaleSetClient.Get(m.resourceGroup(asConfig), asConfig.Name)
+	if err != nil {
+		m.backOffIfThrottled(asConfig, err)
+		return -1, err
+	}
+	m.setCachedSize(asConfig, *set.Sku.Capacity)
+	m.log().V(5).Infof("Returning scale set capacity: %d\n", *set.Sku.Capacity)
+	return *set.Sku.Capacity, nil
+}
+
+// resourceGroup returns the resource group of the scale set.
+func (m *AzureManager) resourceGroup(asConfig *ScaleSet) string {
+	if asConfig.ResourceGroup != "" {
+		return asConfig.ResourceGroup
+	}
+	return m.resourceGroupName
+}
+
+// scaleSetKey returns the key of the scale set in the caches of the manager,
+// scale sets in different resource groups or subscriptions may have the same
+// name.
+func (m *AzureManager) scaleSetKey(asConfig *ScaleSet) string {
+	if m.isOtherSubscription(asConfig.SubscriptionID) {
+		return strings.ToLower(asConfig.SubscriptionID + "/" + m.resourceGroup(asConfig) + "/" + asConfig.Name)
+	}
+	return strings.ToLower(m.resourceGroup(asConfig) + "/" + asConfig.Name)
+}
+
+// getCachedSize returns the cached size of the scale set if it's still fresh.
+func (m *AzureManager) getCachedSize(asConfig *ScaleSet) (int64, bool) {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	cached, found := m.sizeCache[m.scaleSetKey(asConfig)]
+	if !found || !cached.inFlight && time.Since(cached.fetchedAt) >= m.sizeCacheTTL {
+		return 0, false
+	}
+	return cached.size, true
+}
+
+// setCachedSize caches the size of the scale set fetched from Azure. The size
+// of a resize in progress is kept, Azure may not report it yet.
+func (m *AzureManager) setCachedSize(asConfig *ScaleSet, size int64) {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	if m.sizeCache == nil {
+		m.sizeCache = make(map[string]cachedSize)
+	}
+	key := m.scaleSetKey(asConfig)
+	if m.sizeCache[key].inFlight {
+		return
+	}
+	m.sizeCache[key] = cachedSize{size: size, fetchedAt: time.Now()}
+}
+
+func (m *AzureManager) setInFlightSize(asConfig *ScaleSet, size int64) {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	if m.sizeCache == nil {
+		m.sizeCache = make(map[string]cachedSize)
+	}
+	m.sizeCache[m.scaleSetKey(asConfig)] = cachedSize{size: size, fetchedAt: time.Now(), inFlight: true}
+}
+
+// finishInFlightSize caches the size of a completed resize, or invalidates
+// the cached size if it failed. Sizes cached since the resize started are kept.
+func (m *AzureManager) finishInFlightSize(asConfig *ScaleSet, size int64, err error) {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	key := m.scaleSetKey(asConfig)
+	cached, found := m.sizeCache[key]
+	if !found || !cached.inFlight || cached.size != size {
+		return
+	}
+	if err != nil {
+		delete(m.sizeCache, key)
+		return
+	}
+	m.sizeCache[key] = cachedSize{size: size, fetchedAt: time.Now()}
+}
+
+func (m *AzureManager) invalidateCachedSize(asConfig *ScaleSet) {
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	delete(m.sizeCache, m.scaleSetKey(asConfig))
+}
+
+// GetScaleSetForInstance returns ScaleSetConfig of the given Instance
+func (m *AzureManager) GetScaleSetForInstance(instance *AzureRef) (*ScaleSet, error) {
+	m.log().V(5).Infof("Looking for scale set for instance: %v\n", instance)
+
+	since := time.Now()
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	m.log().V(8).Infof("Cache BEFORE: %d instances\n", len(m.scaleSetCache))
+	ref := normalizeAzureRef(*instance)
+	if config, found := m.scaleSetCache[ref]; found {
+		return config, nil
+	}
+
+	if err := m.refreshCacheOnMiss(instance, since); err != nil {
+		return nil, fmt.Errorf("Error while looking for ScaleSet for instance %+v, error: %v", *instance, err)
+	}
+
+	m.log().V(8).Infof("Cache AFTER: %d instances\n", len(m.scaleSetCache))
+
+	if config, found := m.scaleSetCache[ref]; found {
+		return config, nil
+	}
+	// instance does not belong to any configured Scale Set
+	return nil, nil
+}
+
+// getScaleSetInformation returns the information of the registered scale set,
+// nil if it's not registered. The cache lock must be held.
+func (m *AzureManager) getScaleSetInformation(scaleSet *ScaleSet) *scaleSetInformation {
+	for _, sset := range m.scaleSets {
+		if sset.config == scaleSet {
+			return sset
+		}
+	}
+	return nil
+}
+
+// getInstanceID returns the scale set instance ID of the given instance. The
+// cache is refreshed once if the instance is not found in it.
+func (m *AzureManager) getInstanceID(instance *AzureRef) (string, error) {
+	since := time.Now()
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	ref := normalizeAzureRef(*instance)
+	if id, found := m.scaleSetIdCache[ref.Name]; found {
+		return id, nil
+	}
+
+	if err := m.refreshCacheOnMiss(instance, since); err != nil {
+		return "", fmt.Errorf("Error while looking for instance ID of %s, error: %v", instance.GetKey(), err)
+	}
+	if id, found := m.scaleSetIdCache[ref.Name]; found {
+		return id, nil
+	}
+	return "", fmt.Errorf("instance ID of %s not found in any known Scale Set", instance.GetKey())
+}
+
+// Refresh forces the regeneration of the cache of instances of all registered
+// scale sets. It is safe to call concurrently with the background refresh.
+// Concurrent calls share the result of a single regeneration.
+func (m *AzureManager) Refresh() error {
+	since := time.Now()
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	if m.regenerated.After(since) {
+		return m.lastRegenerationError
+	}
+	return m.regenerateCache()
+}
+
+// RefreshExpiredScaleSets refreshes the cached instances of the scale sets
+// which weren't refreshed for scaleSetCacheTTL, or were scaled since. It's
+// meant to be called from the main loop, so that new instances are known
+// without waiting for the hourly regeneration of the whole cache. The first
+// error is returned.
+func (m *AzureManager) RefreshExpiredScaleSets() error {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	ttl := m.scaleSetCacheTTL
+	if ttl <= 0 {
+		ttl = defaultScaleSetCacheTTL
+	}
+	var firstErr error
+	for _, sset := range m.scaleSets {
+		if !sset.expired && time.Since(sset.refreshed) < ttl {
+			continue
+		}
+		err := m.refreshScaleSet(sset)
+		if isNotFoundError(err) {
+			m.log().Warningf("Scale set %s not found, skipping it: %v", sset.config.Name, err)
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sset.expired = false
+	}
+	return firstErr
+}
+
+// expireScaleSet makes the next RefreshExpiredScaleSets refresh the cached
+// instances of the scale set.
+func (m *AzureManager) expireScaleSet(asConfig *ScaleSet) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	for _, sset := range m.scaleSets {
+		if sset.config == asConfig {
+			sset.expired = true
+		}
+	}
+}
+
+// refreshCacheOnMiss refreshes the cache after the given instance was not
+// found in it. If the instance ID names a registered scale set only that scale
+// set is refreshed, otherwise the whole cache is regenerated unless it already
+// was within minRegenerationInterval.
+//
+// since is the time the caller started waiting for cacheMutex. The refreshes
+// which ended after it are shared with the caller instead of being repeated,
+// so that concurrent misses result in a single call to Azure.
+func (m *AzureManager) refreshCacheOnMiss(instance *AzureRef, since time.Time) error {
+	if m.regenerated.After(since) {
+		return m.lastRegenerationError
+	}
+	if sset := m.findScaleSetInformation(instance); sset != nil {
+		if sset.refreshed.After(since) {
+			return sset.lastError
+		}
+		return m.refreshScaleSet(sset)
+	}
+	if since := time.Since(m.lastRegenerated); since < m.minRegenerationInterval {
+		m.log().V(4).Infof("Not regenerating cache for instance %s, last regenerated %v ago", instance.Name, since)
+		return nil
+	}
+	return m.regenerateCache()
+}
+
+// findScaleSetInformation returns the registered uniform scale set in the ID
+// of the instance, nil if the instance isn't a uniform scale set VM. The
+// resource group and subscription of the scale set are only matched if the ID
+// contains them.
+func (m *AzureManager) findScaleSetInformation(instance *AzureRef) *scaleSetInformation {
+	ref, err := parseAzureRef(*instance)
+	if err != nil || ref.scaleSet == "" {
+		return nil
+	}
+	for _, sset := range m.scaleSets {
+		if !strings.EqualFold(sset.config.Name, ref.scaleSet) {
+			continue
+		}
+		if ref.resourceGroup != "" && !strings.EqualFold(m.resourceGroup(sset.config), ref.resourceGroup) {
+			continue
+		}
+		if m.inSubscription(sset.config, ref.subscriptionID) {
+			return sset
+		}
+	}
+	return nil
+}
+
+// refreshScaleSet replaces the cached instances of a single scale set.
+func (m *AzureManager) refreshScaleSet(sset *scaleSetInformation) error {
+	// Instances being deleted are not in scaleSetCache, find them by their ID,
+	// or by the names listed by the previous refresh of a flexible scale set.
+	stale := make([]string, 0)
+	for name := range m.instanceStateCache {
+		if m.ownsInstance(sset, name) {
+			stale = append(stale, name)
+		}
+	}
+	vms, err := m.fetchScaleSet(sset)
+	if err != nil {
+		return err
+	}
+	if m.scaleSetCache == nil {
+		m.scaleSetCache = make(map[AzureRef]*ScaleSet)
+	}
+	if m.scaleSetIdCache == nil {
+		m.scaleSetIdCache = make(map[string]string)
+	}
+	if m.instanceStateCache == nil {
+		m.instanceStateCache = make(map[string]string)
+	}
+	for ref, config := range m.scaleSetCache {
+		if config == sset.config {
+			delete(m.scaleSetCache, ref)
+			delete(m.scaleSetIdCache, ref.Name)
+		}
+	}
+	for _, name := range stale {
+		delete(m.instanceStateCache, name)
+	}
+	cacheInstances(m.log(), sset.config, vms, m.scaleSetCache, m.scaleSetIdCache, m.instanceStateCache)
+	return nil
+}
+
+// cacheInstances adds the VMs of the scale set to the caches. VMs being
+// deleted are only added to the state cache.
+func cacheInstances(logger Logger, config *ScaleSet, vms []compute.VirtualMachineScaleSetVM, scaleSetCache map[AzureRef]*ScaleSet, idCache map[string]string, stateCache map[string]string) {
+	for _, instance := range vms {
+		name := normalizeAzureRef(AzureRef{Name: *instance.ID}).Name
+		state := vmProvisioningState(instance)
+		stateCache[name] = state
+		switch state {
+		case vmProvisioningStateDeleting:
+			logger.V(4).Infof("Skipping instance %s which is being deleted", name)
+			continue
+		case vmProvisioningStateFailed:
+			logger.Warningf("Instance %s of scale set %s is in failed provisioning state", name, config.Name)
+		}
+		scaleSetCache[AzureRef{Name: name}] = config
+		idCache[name] = *instance.InstanceID
+	}
+}
+
+// copyCachedInstances copies the cached instances of the scale set to the
+// given caches.
+func (m *AzureManager) copyCachedInstances(sset *scaleSetInformation, scaleSetCache map[AzureRef]*ScaleSet, idCache map[string]string, stateCache map[string]string) {
+	for ref, config := range m.scaleSetCache {
+		if config == sset.config {
+			scaleSetCache[ref] = config
+			if id, found := m.scaleSetIdCache[ref.Name]; found {
+				idCache[ref.Name] = id
+			}
+		}
+	}
+	for name, state := range m.instanceStateCache {
+		if m.ownsInstance(sset, name) {
+			stateCache[name] = state
+		}
+	}
+}
+
+// isDeallocated returns true if the VM is deallocated or being deallocated,
+// according to its instance view.
+func isDeallocated(vm compute.VirtualMachineScaleSetVM) bool {
+	if vm.VirtualMachineScaleSetVMProperties == nil || vm.InstanceView == nil || vm.InstanceView.Statuses == nil {
+		return false
+	}
+	for _, status := range *vm.InstanceView.Statuses {
+		if status.Code == nil {
+			continue
+		}
+		if *status.Code == vmPowerStateDeallocated || *status.Code == vmPowerStateDeallocating {
+			return true
+		}
+	}
+	return false
+}
+
+func vmProvisioningState(vm compute.VirtualMachineScaleSetVM) string {
+	if vm.VirtualMachineScaleSetVMProperties == nil || vm.VirtualMachineScaleSetVMProperties.ProvisioningState == nil {
+		return ""
+	}
+	return *vm.VirtualMachineScaleSetVMProperties.ProvisioningState
+}
+
+// GetInstanceProvisioningState returns the provisioning state of the instance
+// observed during the last cache refresh, e.g. "Succeeded", "Deleting" or
+// "Failed". The second value is false if the instance is not in the cache.
+func (m *AzureManager) GetInstanceProvisioningState(instance *AzureRef) (string, bool) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	state, found := m.instanceStateCache[normalizeAzureRef(*instance).Name]
+	return state, found
+}
+
+// LastRefreshError returns the error of the last full regeneration of the
+// cache, or nil if it succeeded.
+func (m *AzureManager) LastRefreshError() error {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	return m.lastRegenerationError
+}
+
+// HealthCheck returns an error if the last full regeneration of the cache
+// failed or if the cache wasn't successfully regenerated for longer than the
+// staleness threshold, e.g. to fail a readiness probe. It returns nil as long
+// as the cache was never regenerated.
+func (m *AzureManager) HealthCheck() error {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	if m.lastRegenerationError != nil {
+		return fmt.Errorf("last regeneration of the cache at %v failed: %v", m.lastRegenerated, m.lastRegenerationError)
+	}
+	if m.lastSuccessfulRegeneration.IsZero() {
+		return nil
+	}
+	threshold := m.cacheStalenessThreshold
+	if threshold <= 0 {
+		threshold = defaultCacheStalenessThreshold
+	}
+	if age := time.Since(m.lastSuccessfulRegeneration); age > threshold {
+		return fmt.Errorf("cache wasn't regenerated for %v", age)
+	}
+	return nil
+}
+
+func (m *AzureManager) regenerateCache() (err error) {
+	m.lastRegenerated = time.Now()
+	defer func() {
+		m.regenerated = time.Now()
+		m.lastRegenerationError = err
+		if err == nil {
+			m.lastSuccessfulRegeneration = m.lastRegenerated
+		}
+	}()
+	newCache := make(map[AzureRef]*ScaleSet)
+	newScaleSetIdCache := make(map[string]string)
+	newInstanceStateCache := make(map[string]string)
+
+	// The scale sets are fetched concurrently, the results are merged under resultMutex.
+	var resultMutex sync.Mutex
+	var firstErr error
+	workers := m.cacheConcurrency
+	if workers <= 0 {
+		workers = defaultCacheConcurrency
+	}
+	workqueue.Parallelize(workers, len(m.scaleSets), func(piece int) {
+		sset := m.scaleSets[piece]
+		vms, err := m.fetchScaleSet(sset)
+
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		if isNotFoundError(err) {
+			// The scale set was deleted out of band, don't fail the other ones.
+			m.log().Warningf("Scale set %s not found, skipping it: %v", sset.config.Name, err)
+			return
+		}
+		if _, backedOff := err.(*ScaleSetBackedOffError); backedOff {
+			// Keep the instances of the scale set until it can be fetched again.
+			m.log().V(2).Infof("Keeping the cached instances of scale set %s: %v", sset.config.Name, err)
+			m.copyCachedInstances(sset, newCache, newScaleSetIdCache, newInstanceStateCache)
+			return
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		cacheInstances(m.log(), sset.config, vms, newCache, newScaleSetIdCache, newInstanceStateCache)
+	})
+	if firstErr != nil {
+		return firstErr
+	}
+	newAvailabilitySetCache, err := m.buildAvailabilitySetCache()
+	if err != nil {
+		return err
+	}
+	newAKSAgentPoolCache, err := m.buildAKSAgentPoolCache()
+	if err != nil {
+		return err
+	}
+
+	m.log().V(2).Infof("Regenerated cache of %d scale sets, %d availability sets and %d agent pools: %d instances",
+		len(m.scaleSets), len(m.availabilitySets), len(m.aksAgentPools),
+		len(newCache)+len(newAvailabilitySetCache)+len(newAKSAgentPoolCache))
+	m.scaleSetCache = newCache
+	m.availabilitySetCache = newAvailabilitySetCache
+	m.aksAgentPoolCache = newAKSAgentPoolCache
+	m.scaleSetIdCache = newScaleSetIdCache
+	m.instanceStateCache = newInstanceStateCache
+	return nil
+}
+
+// fetchScaleSet gets the given scale set and lists its VMs, recording the
+// observed state in sset.
+func (m *AzureManager) fetchScaleSet(sset *scaleSetInformation) ([]compute.VirtualMachineScaleSetVM, error) {
+	m.log().V(4).Infof("Regenerating Scale Set information for %s", sset.config.Name)
+	sset.lastRefresh = time.Now()
+	defer func() {
+		sset.refreshed = time.Now()
+	}()
+	clients, err := m.clientsOf(sset.config)
+	if err == nil {
+		err = m.checkBackoff(sset.config)
+	}
+	if err != nil {
+		sset.lastError = err
+		return nil, err
+	}
+	scaleSet, err := clients.scaleSetClient.Get(m.resourceGroup(sset.config), sset.config.Name)
+	if err != nil {
+		m.log().Errorf("Failed to get scaleSet with name %s: %v", sset.config.Name, err)
+		m.backOffIfThrottled(sset.config, err)
+		sset.lastError = err
+		return nil, err
+	}
+	sset.basename = *scaleSet.Name
+	// The orchestration mode of a scale set can't be changed once created,
+	// nor its placement while it has VMs.
+	if sset.properties.orchestrationMode == "" {
+		properties, err := m.getScaleSetProperties(sset.config)
+		if err != nil {
+			m.log().Errorf("Failed to get the properties of scale set %s: %v", sset.config.Name, err)
+			m.backOffIfThrottled(sset.config, err)
+			sset.lastError = err
+			return nil, err
+		}
+		sset.properties = properties
+	}
+
+	flexible := sset.properties.orchestrationMode == orchestrationModeFlexible
+	vms, err := m.listVMs(sset.config, sset.basename, flexible)
+	if err != nil {
+		m.log().Errorf("Failed to list vm for scaleSet %s: %v", sset.config.Name, err)
+		m.backOffIfThrottled(sset.config, err)
+		sset.lastError = err
+		return nil, err
+	}
+	if scaleSet.Sku != nil && scaleSet.Sku.Capacity != nil {
+		sset.targetSize = *scaleSet.Sku.Capacity
+		// The size queries following the refresh don't get the scale set again.
+		m.setCachedSize(sset.config, sset.targetSize)
+	}
+	sset.zones = nil
+	if scaleSet.Zones != nil {
+		sset.zones = append([]string{}, *scaleSet.Zones...)
+	}
+	sset.currentSize = len(vms)
+	if flexible {
+		sset.instanceNames = make(map[string]bool, len(vms))
+		for _, vm := range vms {
+			sset.instanceNames[normalizeAzureRef(AzureRef{Name: *vm.ID}).Name] = true
+		}
+	}
+	if m.deallocateOnScaleDown && !flexible {
+		sset.deallocated = make(map[string]string)
+		for _, vm := range vms {
+			if isDeallocated(vm) && vm.InstanceID != nil {
+				sset.deallocated[normalizeAzureRef(AzureRef{Name: *vm.ID}).Name] = *vm.InstanceID
+			}
+		}
+	}
+	sset.lastError = nil
+	return vms, nil
+}
+
+// listScaleSetVMs lists all VMs of the given scale set, following the
+// pagination links returned by Azure. Their instance views are only listed in
+// the deallocate scale-down mode, for their power state.
+func (m *AzureManager) listScaleSetVMs(client scaleSetVMClient, resourceGroup string, name string) ([]compute.VirtualMachineScaleSetVM, error) {
+	expand := ""
+	if m.deallocateOnScaleDown {
+		expand = string(compute.InstanceView)
+	}
+	result, err := client.List(resourceGroup, name, "", "", expand)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]compute.VirtualMachineScaleSetVM, 0)
+	for {
+		if result.Value != nil {
+			vms = append(vms, *result.Value...)
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = client.ListNextResults(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vms, nil
+}
+
+// Snapshot returns the status of all registered scale sets as observed during
+// the last cache regeneration. The returned slice is a copy and may be freely
+// modified by the caller.
+func (m *AzureManager) Snapshot() []ScaleSetStatus {
+	provisioningTimes := make(map[*ScaleSet]time.Duration)
+	for _, scaleSet := range m.GetScaleSets() {
+		provisioningTimes[scaleSet], _ = m.GetProvisioningTime(scaleSet)
+	}
+
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	result := make([]ScaleSetStatus, 0, len(m.scaleSets))
+	for _, sset := range m.scaleSets {
+		result = append(result, ScaleSetStatus{
+			Name:             sset.config.Name,
+			MinSize:          sset.config.MinSize(),
+			MaxSize:          sset.config.MaxSize(),
+			TargetSize:       sset.targetSize,
+			CurrentSize:      sset.currentSize,
+			Deallocated:      len(sset.deallocated),
+			Zones:            append([]string{}, sset.zones...),
+			ProvisioningTime: provisioningTimes[sset.config],
+			Healthy:          sset.lastError == nil,
+			LastError:        sset.lastError,
+			LastRefresh:      sset.lastRefresh,
+		})
+	}
+	return result
+}
+
+// GetScaleSetZones returns the availability zones of the scale set observed
+// during its last refresh, nil if it's not zonal or wasn't refreshed yet.
+func (m *AzureManager) GetScaleSetZones(scaleSet *ScaleSet) []string {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	for _, sset := range m.scaleSets {
+		if sset.config == scaleSet && len(sset.zones) > 0 {
+			return append([]string{}, sset.zones...)
+		}
+	}
+	return nil
+}
+
+// GetScaleSetSizes returns the target sizes of all registered scale sets, keyed
+// by scale set id. The sizes which could be fetched are returned along with the
+// first error.
+func (m *AzureManager) GetScaleSetSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	var firstErr error
+	for _, scaleSet := range m.GetScaleSets() {
+		size, err := m.GetScaleSetSize(ctx, scaleSet)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to get the size of scale set %s: %v", scaleSet.Id(), err)
+			}
+			continue
+		}
+		sizes[scaleSet.Id()] = size
+	}
+	return sizes, firstErr
+}
+
+// GetScaleSetVms returns list of nodes for the given scale set, excluding the
+// ones being deleted and the deallocated ones.
+func (m *AzureManager) GetScaleSetVms(ctx context.Context, scaleSet *ScaleSet) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, err
+	}
+	instances, err := m.listVMs(scaleSet, scaleSet.Name, m.isFlexible(scaleSet))
+	if err != nil {
+		m.log().V(4).Infof("Failed AS info request for %s: %v", scaleSet.Name, err)
+		return []string{}, err
+	}
+	result := make([]string, 0)
+	for _, instance := range instances {
+		if vmProvisioningState(instance) == vmProvisioningStateDeleting || isDeallocated(instance) {
+			continue
+		}
+		name := normalizeAzureRef(AzureRef{Name: *instance.ID}).Name
+		result = append(result, name)
+	}
+	return result, nil
+
+}
@@ -0,0 +1,788 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestSnapshot(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+
+	ss1 := newTestScaleSet("ss1", 3)
+	ss1.Zones = &[]string{"1", "2"}
+	ssClient.On("Get", "rg", "ss1").Return(ss1, nil)
+	ssClient.On("Get", "rg", "ss2").Return(compute.VirtualMachineScaleSet{}, fmt.Errorf("get failed"))
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	registerTestScaleSet(t, m, "1:5:ss1")
+	registerTestScaleSet(t, m, "2:10:ss2")
+
+	err := m.regenerateCache()
+	assert.Error(t, err)
+
+	snapshot := m.Snapshot()
+	assert.Equal(t, 2, len(snapshot))
+
+	assert.Equal(t, "ss1", snapshot[0].Name)
+	assert.Equal(t, 1, snapshot[0].MinSize)
+	assert.Equal(t, 5, snapshot[0].MaxSize)
+	assert.Equal(t, int64(3), snapshot[0].TargetSize)
+	assert.Equal(t, 2, snapshot[0].CurrentSize)
+	assert.Equal(t, []string{"1", "2"}, snapshot[0].Zones)
+	assert.True(t, snapshot[0].Healthy)
+	assert.NoError(t, snapshot[0].LastError)
+	assert.False(t, snapshot[0].LastRefresh.IsZero())
+
+	assert.Equal(t, "ss2", snapshot[1].Name)
+	assert.Equal(t, 2, snapshot[1].MinSize)
+	assert.Equal(t, 10, snapshot[1].MaxSize)
+	assert.False(t, snapshot[1].Healthy)
+	assert.EqualError(t, snapshot[1].LastError, "get failed")
+	assert.Empty(t, snapshot[1].Zones)
+
+	// Modifying the snapshot must not affect the manager state.
+	snapshot[0].TargetSize = 100
+	snapshot[0].Name = "changed"
+	again := m.Snapshot()
+	assert.Equal(t, "ss1", again[0].Name)
+	assert.Equal(t, int64(3), again[0].TargetSize)
+}
+
+func TestListScaleSetVMsPagination(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+
+	nextLink := "https://management.azure.com/next"
+	firstPage := newTestVMListResult("ss1", 100)
+	firstPage.NextLink = &nextLink
+	secondPage := newTestVMListResult("ss1", 150)
+	*secondPage.Value = (*secondPage.Value)[100:]
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 150), nil)
+	vmClient.On("List", "rg", "ss1").Return(firstPage, nil)
+	vmClient.On("ListNextResults", nextLink).Return(secondPage, nil)
+
+	vms, err := m.listScaleSetVMs(m.scaleSetVmClient, "rg", "ss1")
+	assert.NoError(t, err)
+	assert.Equal(t, 150, len(vms))
+	vmClient.AssertNumberOfCalls(t, "ListNextResults", 1)
+
+	scaleSet := registerTestScaleSet(t, m, "1:200:ss1")
+	nodes, err := m.GetScaleSetVms(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, len(nodes))
+
+	// An instance from the second page must be found in the cache.
+	assert.NoError(t, m.regenerateCache())
+	ref := AzureRef{Name: "azure://" + strings.ToLower(*(*secondPage.Value)[0].ID)}
+	assert.Equal(t, scaleSet, m.scaleSetCache[ref])
+}
+
+func TestListScaleSetVMsPaginationLargeScaleSet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+
+	// 2500 instances, listed by Azure in pages of 1000.
+	all := *newTestVMListResult("ss1", 2500).Value
+	pages := make([]compute.VirtualMachineScaleSetVMListResult, 0)
+	for start := 0; start < len(all); start += 1000 {
+		end := start + 1000
+		if end > len(all) {
+			end = len(all)
+		}
+		page := all[start:end]
+		pages = append(pages, compute.VirtualMachineScaleSetVMListResult{Value: &page})
+	}
+	for i := 0; i < len(pages)-1; i++ {
+		nextLink := fmt.Sprintf("https://management.azure.com/next?page=%d", i+1)
+		pages[i].NextLink = &nextLink
+	}
+	for i := 1; i < len(pages); i++ {
+		vmClient.On("ListNextResults", *pages[i-1].NextLink).Return(pages[i], nil)
+	}
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2500), nil)
+	vmClient.On("List", "rg", "ss1").Return(pages[0], nil)
+
+	vms, err := m.listScaleSetVMs(m.scaleSetVmClient, "rg", "ss1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2500, len(vms))
+	vmClient.AssertNumberOfCalls(t, "ListNextResults", 2)
+
+	scaleSet := registerTestScaleSet(t, m, "1:3000:ss1")
+	nodes, err := m.GetScaleSetVms(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 2500, len(nodes))
+
+	assert.NoError(t, m.regenerateCache())
+	assert.Equal(t, 2500, len(m.scaleSetCache))
+	ref := AzureRef{Name: "azure://" + strings.ToLower(*all[2499].ID)}
+	assert.Equal(t, scaleSet, m.scaleSetCache[ref])
+}
+
+func TestListScaleSetVMsPaginationError(t *testing.T) {
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, vmClient)
+
+	nextLink := "https://management.azure.com/next"
+	firstPage := newTestVMListResult("ss1", 100)
+	firstPage.NextLink = &nextLink
+	vmClient.On("List", "rg", "ss1").Return(firstPage, nil)
+	vmClient.On("ListNextResults", nextLink).Return(compute.VirtualMachineScaleSetVMListResult{}, fmt.Errorf("list failed"))
+
+	_, err := m.listScaleSetVMs(m.scaleSetVmClient, "rg", "ss1")
+	assert.EqualError(t, err, "list failed")
+}
+
+func TestRefresh(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil).Once()
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 3), nil)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 1, len(m.scaleSetCache))
+
+	// Instances added out of band are picked up by the next refresh.
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 3, len(m.scaleSetCache))
+	for _, config := range m.scaleSetCache {
+		assert.Equal(t, scaleSet, config)
+	}
+	vmClient.AssertNumberOfCalls(t, "List", 2)
+}
+
+func TestGetScaleSetSizeCache(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.sizeCacheTTL = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+
+	for i := 0; i < 3; i++ {
+		size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), size)
+	}
+	ssClient.AssertNumberOfCalls(t, "Get", 1)
+
+	// Expire the cached size.
+	m.sizeCache["rg/ss1"] = cachedSize{size: 2, fetchedAt: time.Now().Add(-time.Minute)}
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 2)
+}
+
+func TestGetScaleSetSizeCacheUpdatedOnWrite(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.sizeCacheTTL = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil).Once()
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(fmt.Errorf("conflict")).Once()
+
+	_, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+
+	// A successful write updates the cached size.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 4))
+	m.resizes.Wait()
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 2)
+
+	// A failed write invalidates it, so the size is fetched again.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 5))
+	m.resizes.Wait()
+	size, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 4)
+}
+
+func TestGetScaleSetSizeCachedByRefresh(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleSetClient = &hangingScaleSetClient{ssClient}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	defer m.Cleanup()
+	m.sizeCacheTTL = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return()
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	assert.NoError(t, m.Refresh())
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 1)
+
+	// The refresh doesn't replace the size of a resize in progress.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	assert.NoError(t, m.Refresh())
+	size, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), size)
+}
+
+func TestRegenerateCacheConcurrently(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.cacheConcurrency = 3
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("ss%d", i)
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, int64(i)), nil)
+		vmClient.On("List", "rg", name).Return(newTestVMListResult(name, i), nil).Once()
+		registerTestScaleSet(t, m, fmt.Sprintf("1:10:%s", name))
+	}
+
+	assert.NoError(t, m.regenerateCache())
+	assert.Equal(t, 45, len(m.scaleSetCache))
+	assert.Equal(t, 45, len(m.scaleSetIdCache))
+	for ref, scaleSet := range m.scaleSetCache {
+		// The scale set name is part of the instance ID.
+		assert.Contains(t, ref.Name, "/virtualmachinescalesets/"+scaleSet.Name+"/")
+	}
+	for _, status := range m.Snapshot() {
+		assert.Equal(t, status.TargetSize, int64(status.CurrentSize))
+	}
+
+	// A failure of a single scale set leaves the previous cache in place.
+	vmClient.On("List", "rg", "ss5").Return(compute.VirtualMachineScaleSetVMListResult{}, fmt.Errorf("list failed"))
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("ss%d", i)
+		vmClient.On("List", "rg", name).Return(newTestVMListResult(name, 1), nil)
+	}
+	assert.EqualError(t, m.regenerateCache(), "list failed")
+	assert.Equal(t, 45, len(m.scaleSetCache))
+	assert.Equal(t, 45, len(m.scaleSetIdCache))
+}
+
+// slowScaleSetVMClient is a scaleSetVMClient simulating the latency of ARM.
+type slowScaleSetVMClient struct {
+	scaleSetVMClient
+	latency time.Duration
+}
+
+func (client *slowScaleSetVMClient) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	time.Sleep(client.latency)
+	return client.scaleSetVMClient.List(resourceGroupName, virtualMachineScaleSetName, filter, selectParameter, expand)
+}
+
+func BenchmarkRegenerateCache(b *testing.B) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleSetVmClient = &slowScaleSetVMClient{scaleSetVMClient: vmClient, latency: 5 * time.Millisecond}
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("ss%d", i)
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, 50), nil)
+		vmClient.On("List", "rg", name).Return(newTestVMListResult(name, 50), nil)
+		scaleSet, _ := buildScaleSet(fmt.Sprintf("1:100:%s", name), m)
+		m.RegisterScaleSet(scaleSet)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.regenerateCache(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetInstanceID(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	// The cache is empty, the lookup regenerates it.
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*newTestVMListResult("ss1", 2).Value)[1].ID)}
+	id, err := m.getInstanceID(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", id)
+	vmClient.AssertNumberOfCalls(t, "List", 1)
+
+	_, err = m.getInstanceID(&AzureRef{Name: "azure://unknown"})
+	assert.EqualError(t, err, "instance ID of azure://unknown not found in any known Scale Set")
+	vmClient.AssertNumberOfCalls(t, "List", 2)
+}
+
+func TestCacheMissRefreshesSingleScaleSet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+	ss2 := registerTestScaleSet(t, m, "1:5:ss2")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("Get", "rg", "ss2").Return(newTestScaleSet("ss2", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss2").Return(newTestVMListResult("ss2", 2), nil).Once()
+	vmClient.On("List", "rg", "ss2").Return(newTestVMListResult("ss2", 3), nil).Once()
+	assert.NoError(t, m.Refresh())
+
+	// The new VM of ss2 is found by refreshing only ss2.
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*newTestVMListResult("ss2", 3).Value)[2].ID)}
+	scaleSet, err := m.GetScaleSetForInstance(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, ss2, scaleSet)
+	vmClient.AssertNumberOfCalls(t, "List", 3)
+	ssClient.AssertNumberOfCalls(t, "Get", 3)
+	assert.Equal(t, 4, len(m.scaleSetCache))
+	assert.Equal(t, 4, len(m.scaleSetIdCache))
+}
+
+func TestCacheMissRegenerationRateLimited(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.minRegenerationInterval = time.Minute
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	for i := 0; i < 3; i++ {
+		scaleSet, err := m.GetScaleSetForInstance(&AzureRef{Name: fmt.Sprintf("azure://unknown-%d", i)})
+		assert.NoError(t, err)
+		assert.Nil(t, scaleSet)
+	}
+	vmClient.AssertNumberOfCalls(t, "List", 1)
+
+	// Explicit refreshes are not rate limited.
+	assert.NoError(t, m.Refresh())
+	vmClient.AssertNumberOfCalls(t, "List", 2)
+
+	// Once the interval has passed the cache is regenerated again.
+	m.lastRegenerated = time.Now().Add(-time.Minute)
+	_, err := m.GetScaleSetForInstance(&AzureRef{Name: "azure://unknown"})
+	assert.NoError(t, err)
+	vmClient.AssertNumberOfCalls(t, "List", 3)
+}
+
+func TestDeletingInstancesSkipped(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 3)
+	for i, state := range []string{"Succeeded", "Deleting", "Failed"} {
+		state := state
+		(*vms.Value)[i].VirtualMachineScaleSetVMProperties = &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: &state,
+		}
+	}
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	refs := make([]*AzureRef, 3)
+	for i, vm := range *vms.Value {
+		refs[i] = &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)}
+	}
+
+	// The deleting instance is not a valid target.
+	assert.Equal(t, 2, len(m.scaleSetCache))
+	_, found := m.scaleSetIdCache[refs[1].Name]
+	assert.False(t, found)
+	state, found := m.GetInstanceProvisioningState(refs[1])
+	assert.True(t, found)
+	assert.Equal(t, "Deleting", state)
+
+	// The failed instance is kept so that it can be deleted.
+	config, found := m.scaleSetCache[*refs[2]]
+	assert.True(t, found)
+	assert.Equal(t, scaleSet, config)
+	state, _ = m.GetInstanceProvisioningState(refs[2])
+	assert.Equal(t, "Failed", state)
+
+	names, err := m.GetScaleSetVms(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{refs[0].Name, refs[2].Name}, names)
+
+	_, found = m.GetInstanceProvisioningState(&AzureRef{Name: "azure://unknown"})
+	assert.False(t, found)
+}
+
+func TestScaleSetResourceGroup(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.sizeCacheTTL = time.Minute
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	ss2 := registerTestScaleSet(t, m, "1:5:other-rg/ss1")
+	assert.Equal(t, "other-rg", ss2.ResourceGroup)
+
+	otherVMs := newTestVMListResult("ss1", 1)
+	otherID := strings.Replace(*(*otherVMs.Value)[0].ID, "/resourceGroups/rg/", "/resourceGroups/other-rg/", 1)
+	(*otherVMs.Value)[0].ID = &otherID
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("Get", "other-rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("CreateOrUpdate", "other-rg", "ss1", mock.Anything).Return(nil)
+	ssClient.On("DeleteInstances", "other-rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	vmClient.On("List", "other-rg", "ss1").Return(otherVMs, nil)
+
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 3, len(m.scaleSetCache))
+	vmClient.AssertCalled(t, "List", "other-rg", "ss1")
+
+	// Scale sets with the same name in different resource groups have different sizes.
+	size, err := m.GetScaleSetSize(context.Background(), ss1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	size, err = m.GetScaleSetSize(context.Background(), ss2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), ss2, 3))
+	ssClient.AssertCalled(t, "CreateOrUpdate", "other-rg", "ss1", mock.Anything)
+
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(otherID)}
+	scaleSet, err := m.GetScaleSetForInstance(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, ss2, scaleSet)
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref}))
+	ssClient.AssertCalled(t, "DeleteInstances", "other-rg", "ss1", mock.Anything)
+
+	names, err := m.GetScaleSetVms(context.Background(), ss2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ref.Name}, names)
+}
+
+func TestMixedCaseInstanceLookup(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.resourceGroupName = "My-RG"
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	// LIST returns the resource group in upper case.
+	id := "/subscriptions/sub/resourceGroups/MY-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/3"
+	instanceID := "3"
+	vms := compute.VirtualMachineScaleSetVMListResult{
+		Value: &[]compute.VirtualMachineScaleSetVM{{ID: &id, InstanceID: &instanceID}},
+	}
+	ssClient.On("Get", "My-RG", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.On("List", "My-RG", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	for _, providerID := range []string{
+		"azure:///subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/3",
+		"azure:///subscriptions/SUB/resourcegroups/my-rg/providers/microsoft.compute/virtualmachinescalesets/SS1/virtualmachines/3",
+		id,
+	} {
+		ref := &AzureRef{Name: providerID}
+		config, err := m.GetScaleSetForInstance(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, scaleSet, config, providerID)
+		instance, err := m.getInstanceID(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, "3", instance)
+	}
+	// The cache was hit every time.
+	vmClient.AssertNumberOfCalls(t, "List", 1)
+
+	// The scale set of an instance is told by its parsed ID, not by a prefix.
+	m.cacheMutex.Lock()
+	sset := m.getScaleSetInformation(scaleSet)
+	assert.True(t, m.ownsInstance(sset, normalizeAzureRef(AzureRef{Name: id}).Name))
+	assert.False(t, m.ownsInstance(sset, normalizeAzureRef(AzureRef{Name: "/subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/3/extensions/ext"}).Name))
+	assert.False(t, m.ownsInstance(sset, normalizeAzureRef(AzureRef{Name: "/subscriptions/sub/resourceGroups/Other-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/3"}).Name))
+	m.cacheMutex.Unlock()
+
+	provider := testProvider(t, m)
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/SS1/virtualMachines/3",
+		},
+	}
+	group, err := provider.NodeGroupForNode(node)
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSet, group)
+	belongs, err := scaleSet.Belongs(node)
+	assert.NoError(t, err)
+	assert.True(t, belongs)
+}
+
+func TestGetScaleSetSizes(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	registerTestScaleSet(t, m, "1:5:ss1")
+	registerTestScaleSet(t, m, "2:10:other-rg/ss2")
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	ssClient.On("Get", "other-rg", "ss2").Return(newTestScaleSet("ss2", 7), nil)
+
+	sizes, err := m.GetScaleSetSizes(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"ss1": 3, "other-rg/ss2": 7}, sizes)
+
+	registerTestScaleSet(t, m, "1:5:ss3")
+	ssClient.On("Get", "rg", "ss3").Return(compute.VirtualMachineScaleSet{}, fmt.Errorf("get failed"))
+	sizes, err = m.GetScaleSetSizes(context.Background())
+	assert.EqualError(t, err, "failed to get the size of scale set ss3: get failed")
+	assert.Equal(t, map[string]int64{"ss1": 3, "other-rg/ss2": 7}, sizes)
+}
+
+func TestRegenerateCacheSkipsDeletedScaleSet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	registerTestScaleSet(t, m, "1:5:deleted")
+	ss3 := registerTestScaleSet(t, m, "1:5:ss3")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("Get", "rg", "deleted").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusNotFound))
+	ssClient.On("Get", "rg", "ss3").Return(newTestScaleSet("ss3", 1), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss3").Return(newTestVMListResult("ss3", 1), nil)
+
+	assert.NoError(t, m.regenerateCache())
+	assert.Equal(t, 3, len(m.scaleSetCache))
+	for _, vm := range *newTestVMListResult("ss1", 2).Value {
+		assert.Equal(t, ss1, m.scaleSetCache[AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)}])
+	}
+	vm := (*newTestVMListResult("ss3", 1).Value)[0]
+	assert.Equal(t, ss3, m.scaleSetCache[AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)}])
+
+	// The failure is still visible in the status of the scale set.
+	snapshot := m.Snapshot()
+	assert.False(t, snapshot[1].Healthy)
+
+	// Other errors still fail the regeneration.
+	ssClient.On("Get", "rg", "ss4").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusForbidden))
+	registerTestScaleSet(t, m, "1:5:ss4")
+	assert.Error(t, m.regenerateCache())
+}
+
+func TestHealthCheckPersistentRefreshFailure(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	// Never regenerated yet.
+	assert.NoError(t, m.HealthCheck())
+	assert.NoError(t, m.LastRefreshError())
+
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusForbidden))
+	for i := 0; i < 3; i++ {
+		assert.Error(t, m.regenerateCache())
+		assert.Error(t, m.LastRefreshError())
+		assert.Error(t, m.HealthCheck())
+	}
+	assert.True(t, m.lastSuccessfulRegeneration.IsZero())
+}
+
+func TestHealthCheckRecovery(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	m.lastRegenerationError = fmt.Errorf("failed")
+	assert.Error(t, m.HealthCheck())
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+	assert.NoError(t, m.regenerateCache())
+	assert.NoError(t, m.LastRefreshError())
+	assert.NoError(t, m.HealthCheck())
+	assert.False(t, m.lastSuccessfulRegeneration.IsZero())
+}
+
+func TestHealthCheckStaleCache(t *testing.T) {
+	m := &AzureManager{cacheStalenessThreshold: time.Hour}
+	m.lastSuccessfulRegeneration = time.Now().Add(-30 * time.Minute)
+	assert.NoError(t, m.HealthCheck())
+
+	m.lastSuccessfulRegeneration = time.Now().Add(-2 * time.Hour)
+	assert.Error(t, m.HealthCheck())
+
+	// The default threshold applies when none is set.
+	m.cacheStalenessThreshold = 0
+	m.lastSuccessfulRegeneration = time.Now().Add(-90 * time.Minute)
+	assert.NoError(t, m.HealthCheck())
+	m.lastSuccessfulRegeneration = time.Now().Add(-3 * time.Hour)
+	assert.Error(t, m.HealthCheck())
+}
+
+// blockingScaleSetVMClient is a scaleSetVMClient whose List calls block until
+// release is closed. listing is signaled when List is called.
+type blockingScaleSetVMClient struct {
+	*scaleSetVMClientMock
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (client *blockingScaleSetVMClient) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	select {
+	case client.listing <- struct{}{}:
+	default:
+	}
+	<-client.release
+	return client.scaleSetVMClientMock.List(resourceGroupName, virtualMachineScaleSetName, filter, selectParameter, expand)
+}
+
+// concurrentLookups calls lookup n times concurrently while the first call is
+// listing VMs, and returns the errors of all calls.
+func concurrentLookups(client *blockingScaleSetVMClient, n int, lookup func() error) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = lookup()
+		}(i)
+		if i == 0 {
+			<-client.listing
+		}
+	}
+	// Let the other calls wait for the cache.
+	time.Sleep(100 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+	return errs
+}
+
+func TestConcurrentCacheMissesCoalesce(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &blockingScaleSetVMClient{
+		scaleSetVMClientMock: &scaleSetVMClientMock{},
+		listing:              make(chan struct{}, 1),
+		release:              make(chan struct{}),
+	}
+	m := newTestAzureManagerWithMocks(ssClient, nil)
+	m.scaleSetVmClient = vmClient
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.scaleSetVMClientMock.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+
+	// The instance was deleted, so every lookup misses.
+	missing := &AzureRef{Name: "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/5"}
+	errs := concurrentLookups(vmClient, 10, func() error {
+		scaleSet, err := m.GetScaleSetForInstance(missing)
+		assert.Nil(t, scaleSet)
+		return err
+	})
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	vmClient.scaleSetVMClientMock.AssertNumberOfCalls(t, "List", 1)
+}
+
+func TestConcurrentCacheRegenerationsShareError(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &blockingScaleSetVMClient{
+		scaleSetVMClientMock: &scaleSetVMClientMock{},
+		listing:              make(chan struct{}, 1),
+		release:              make(chan struct{}),
+	}
+	m := newTestAzureManagerWithMocks(ssClient, nil)
+	m.scaleSetVmClient = vmClient
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.scaleSetVMClientMock.On("List", "rg", "ss1").Return(compute.VirtualMachineScaleSetVMListResult{}, fmt.Errorf("list failed"))
+
+	errs := concurrentLookups(vmClient, 10, m.Refresh)
+	for _, err := range errs {
+		assert.EqualError(t, err, "list failed")
+	}
+	vmClient.scaleSetVMClientMock.AssertNumberOfCalls(t, "List", 1)
+
+	// Later calls regenerate the cache again.
+	assert.Error(t, m.Refresh())
+	vmClient.scaleSetVMClientMock.AssertNumberOfCalls(t, "List", 2)
+}
+
+func TestRefreshExpiredScaleSets(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleSetCacheTTL = time.Minute
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	registerTestScaleSet(t, m, "1:5:ss2")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("Get", "rg", "ss2").Return(newTestScaleSet("ss2", 1), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil).Once()
+	vmClient.On("List", "rg", "ss2").Return(newTestVMListResult("ss2", 1), nil)
+
+	// The scale sets were never refreshed.
+	assert.NoError(t, m.RefreshExpiredScaleSets())
+	assert.Equal(t, 2, len(m.scaleSetCache))
+	vmClient.AssertNumberOfCalls(t, "List", 2)
+
+	// The cache is fresh.
+	assert.NoError(t, m.RefreshExpiredScaleSets())
+	vmClient.AssertNumberOfCalls(t, "List", 2)
+
+	// The new instance of the resized scale set is cached at the next refresh.
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), ss1, 2))
+	m.resizes.Wait()
+	assert.NoError(t, m.RefreshExpiredScaleSets())
+	vmClient.AssertNumberOfCalls(t, "List", 3)
+	assert.Equal(t, 3, len(m.scaleSetCache))
+
+	// The instances are refreshed once the TTL elapsed.
+	for _, sset := range m.scaleSets {
+		sset.refreshed = time.Now().Add(-time.Minute)
+	}
+	assert.NoError(t, m.RefreshExpiredScaleSets())
+	vmClient.AssertNumberOfCalls(t, "List", 5)
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	defaultBackoffRetries  = 3
+	defaultBackoffDuration = time.Second
+	backoffFactor          = 2.0
+	backoffJitter          = 1.0
+
+	defaultRateLimitQPS    = 1.0
+	defaultRateLimitBucket = 5
+)
+
+// retryBackoff retries idempotent Azure API calls with exponential backoff.
+type retryBackoff struct {
+	// Number of retries after the first failed attempt.
+	retries  int
+	duration time.Duration
+	factor   float64
+	jitter   float64
+	// sleep is time.Sleep, replaced in tests.
+	sleep func(time.Duration)
+}
+
+func newRetryBackoff(cfg *Config) *retryBackoff {
+	b := &retryBackoff{
+		retries:  defaultBackoffRetries,
+		duration: defaultBackoffDuration,
+		factor:   backoffFactor,
+		jitter:   backoffJitter,
+		sleep:    time.Sleep,
+	}
+	if cfg.CloudProviderBackoffRetries > 0 {
+		b.retries = cfg.CloudProviderBackoffRetries
+	}
+	if cfg.CloudProviderBackoffDuration > 0 {
+		b.duration = time.Duration(cfg.CloudProviderBackoffDuration) * time.Second
+	}
+	return b
+}
+
+// do calls fn until it succeeds, returns a non-retryable error or the retries are exhausted.
+func (b *retryBackoff) do(operation string, fn func() error) error {
+	duration := b.duration
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryableError(err) || attempt >= b.retries {
+			return err
+		}
+		sleep := wait.Jitter(duration, b.jitter)
+		if retryAfter, throttled := getRetryAfter(err); throttled {
+			glog.Warningf("Azure %s throttled, requested to retry after %v", operation, retryAfter)
+			if retryAfter > sleep {
+				sleep = retryAfter
+			}
+		}
+		glog.V(4).Infof("Azure %s failed (attempt %d), retrying in %v: %v", operation, attempt+1, sleep, err)
+		b.sleep(sleep)
+		duration = time.Duration(float64(duration) * b.factor)
+	}
+}
+
+// getRetryAfter returns whether the error is caused by ARM throttling the
+// requests and for how long the client was asked to wait before retrying.
+func getRetryAfter(err error) (time.Duration, bool) {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok || detailed.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if detailed.Response == nil {
+		return 0, true
+	}
+	retryAfter := detailed.Response.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return 0, true
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return date.Sub(time.Now()), true
+	}
+	glog.Warningf("Failed to parse Retry-After header %q", retryAfter)
+	return 0, true
+}
+
+// isRetryableError returns false for errors which will not go away by retrying
+// the request, e.g. the resource not being found or insufficient permissions.
+func isRetryableError(err error) bool {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok {
+		return true
+	}
+	statusCode, ok := detailed.StatusCode.(int)
+	if !ok || statusCode == autorest.UndefinedStatusCode {
+		return true
+	}
+	return statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// isNotFoundError returns true if the error is caused by a resource which
+// doesn't exist (anymore).
+func isNotFoundError(err error) bool {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok {
+		return false
+	}
+	statusCode, ok := detailed.StatusCode.(int)
+	return ok && statusCode == http.StatusNotFound
+}
+
+// retryScaleSetClient is a scaleSetClient retrying its read-only calls.
+type retryScaleSetClient struct {
+	scaleSetClient
+	backoff *retryBackoff
+}
+
+func (c *retryScaleSetClient) Get(resourceGroupName string, vmScaleSetName string) (result compute.VirtualMachineScaleSet, err error) {
+	err = c.backoff.do("get scale set", func() error {
+		result, err = c.scaleSetClient.Get(resourceGroupName, vmScaleSetName)
+		return err
+	})
+	return result, err
+}
+
+func (c *retryScaleSetClient) List(resourceGroupName string) (result compute.VirtualMachineScaleSetListResult, err error) {
+	err = c.backoff.do("list scale sets", func() error {
+		result, err = c.scaleSetClient.List(resourceGroupName)
+		return err
+	})
+	return result, err
+}
+
+func (c *retryScaleSetClient) ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (result compute.VirtualMachineScaleSetListResult, err error) {
+	err = c.backoff.do("list scale sets", func() error {
+		result, err = c.scaleSetClient.ListNextResults(lastResults)
+		return err
+	})
+	return result, err
+}
+
+// retryScaleSetVMClient is a scaleSetVMClient retrying its read-only calls.
+type retryScaleSetVMClient struct {
+	scaleSetVMClient
+	backoff *retryBackoff
+}
+
+func (c *retryScaleSetVMClient) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (result compute.VirtualMachineScaleSetVMListResult, err error) {
+	err = c.backoff.do("list scale set vms", func() error {
+		result, err = c.scaleSetVMClient.List(resourceGroupName, virtualMachineScaleSetName, filter, selectParameter, expand)
+		return err
+	})
+	return result, err
+}
+
+func (c *retryScaleSetVMClient) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (result compute.VirtualMachineScaleSetVMListResult, err error) {
+	err = c.backoff.do("list scale set vms", func() error {
+		result, err = c.scaleSetVMClient.ListNextResults(lastResults)
+		return err
+	})
+	return result, err
+}
+
+// newRateLimiter returns the rate limiter of the Azure API calls, nil if rate
+// limiting is disabled.
+func newRateLimiter(cfg *Config) flowcontrol.RateLimiter {
+	if !cfg.CloudProviderRateLimit {
+		return nil
+	}
+	qps := float32(defaultRateLimitQPS)
+	if cfg.CloudProviderRateLimitQPS > 0 {
+		qps = cfg.CloudProviderRateLimitQPS
+	}
+	bucket := defaultRateLimitBucket
+	if cfg.CloudProviderRateLimitBucket > 0 {
+		bucket = cfg.CloudProviderRateLimitBucket
+	}
+	glog.V(2).Infof("Azure API calls rate limited to %v QPS with bucket %d", qps, bucket)
+	return flowcontrol.NewTokenBucketRateLimiter(qps, bucket)
+}
+
+// rateLimitedScaleSetClient is a scaleSetClient waiting for the rate limiter
+// before every call.
+type rateLimitedScaleSetClient struct {
+	scaleSetClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedScaleSetClient) Get(resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.Get(resourceGroupName, vmScaleSetName)
+}
+
+func (c *rateLimitedScaleSetClient) CreateOrUpdate(resourceGroupName string, name string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.CreateOrUpdate(resourceGroupName, name, parameters, cancel)
+}
+
+func (c *rateLimitedScaleSetClient) DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.DeleteInstances(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+}
+
+func (c *rateLimitedScaleSetClient) Deallocate(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.Deallocate(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+}
+
+func (c *rateLimitedScaleSetClient) Start(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.Start(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+}
+
+func (c *rateLimitedScaleSetClient) List(resourceGroupName string) (compute.VirtualMachineScaleSetListResult, error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.List(resourceGroupName)
+}
+
+func (c *rateLimitedScaleSetClient) ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (compute.VirtualMachineScaleSetListResult, error) {
+	c.limiter.Accept()
+	return c.scaleSetClient.ListNextResults(lastResults)
+}
+
+// rateLimitedScaleSetVMClient is a scaleSetVMClient waiting for the rate
+// limiter before every call.
+type rateLimitedScaleSetVMClient struct {
+	scaleSetVMClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedScaleSetVMClient) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	c.limiter.Accept()
+	return c.scaleSetVMClient.List(resourceGroupName, virtualMachineScaleSetName, filter, selectParameter, expand)
+}
+
+func (c *rateLimitedScaleSetVMClient) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (compute.VirtualMachineScaleSetVMListResult, error) {
+	c.limiter.Accept()
+	return c.scaleSetVMClient.ListNextResults(lastResults)
+}
+
+// rateLimitedAvailabilitySetClient is an availabilitySetClient waiting for the
+// rate limiter before every call.
+type rateLimitedAvailabilitySetClient struct {
+	availabilitySetClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedAvailabilitySetClient) Get(resourceGroupName string, availabilitySetName string) (compute.AvailabilitySet, error) {
+	c.limiter.Accept()
+	return c.availabilitySetClient.Get(resourceGroupName, availabilitySetName)
+}
+
+// rateLimitedVirtualMachineClient is a virtualMachineClient waiting for the
+// rate limiter before every call.
+type rateLimitedVirtualMachineClient struct {
+	virtualMachineClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedVirtualMachineClient) Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error) {
+	c.limiter.Accept()
+	return c.virtualMachineClient.Get(resourceGroupName, VMName, expand)
+}
+
+func (c *rateLimitedVirtualMachineClient) CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error) {
+	c.limiter.Accept()
+	return c.virtualMachineClient.CreateOrUpdate(resourceGroupName, VMName, parameters, cancel)
+}
+
+func (c *rateLimitedVirtualMachineClient) Delete(resourceGroupName string, VMName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	c.limiter.Accept()
+	return c.virtualMachineClient.Delete(resourceGroupName, VMName, cancel)
+}
+
+// rateLimitedInterfaceClient is an interfaceClient waiting for the rate
+// limiter before every call.
+type rateLimitedInterfaceClient struct {
+	interfaceClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedInterfaceClient) Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error) {
+	c.limiter.Accept()
+	return c.interfaceClient.Get(resourceGroupName, networkInterfaceName, expand)
+}
+
+func (c *rateLimitedInterfaceClient) CreateOrUpdate(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (<-chan network.Interface, <-chan error) {
+	c.limiter.Accept()
+	return c.interfaceClient.CreateOrUpdate(resourceGroupName, networkInterfaceName, parameters, cancel)
+}
+
+func (c *rateLimitedInterfaceClient) Delete(resourceGroupName string, networkInterfaceName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error) {
+	c.limiter.Accept()
+	return c.interfaceClient.Delete(resourceGroupName, networkInterfaceName, cancel)
+}
+
+// rateLimitedDiskClient is a diskClient waiting for the rate limiter before
+// every call.
+type rateLimitedDiskClient struct {
+	diskClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedDiskClient) Delete(resourceGroupName string, diskName string, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	c.limiter.Accept()
+	return c.diskClient.Delete(resourceGroupName, diskName, cancel)
+}
+
+// rateLimitedVMSizeClient is a vmSizeClient waiting for the rate limiter
+// before every call.
+type rateLimitedVMSizeClient struct {
+	vmSizeClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedVMSizeClient) List(location string) (compute.VirtualMachineSizeListResult, error) {
+	c.limiter.Accept()
+	return c.vmSizeClient.List(location)
+}
+
+// rateLimitedResourceSkuClient is a resourceSkuClient waiting for the rate
+// limiter before every call.
+type rateLimitedResourceSkuClient struct {
+	resourceSkuClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedResourceSkuClient) List() (compute.ResourceSkusResult, error) {
+	c.limiter.Accept()
+	return c.resourceSkuClient.List()
+}
+
+func (c *rateLimitedResourceSkuClient) ListNextResults(lastResults compute.ResourceSkusResult) (compute.ResourceSkusResult, error) {
+	c.limiter.Accept()
+	return c.resourceSkuClient.ListNextResults(lastResults)
+}
+
+// rateLimitedAgentPoolClient is an agentPoolClient waiting for the rate
+// limiter before every call.
+type rateLimitedAgentPoolClient struct {
+	agentPoolClient
+	limiter flowcontrol.RateLimiter
+}
+
+func (c *rateLimitedAgentPoolClient) GetCluster(resourceGroupName string, clusterName string) (managedCluster, error) {
+	c.limiter.Accept()
+	return c.agentPoolClient.GetCluster(resourceGroupName, clusterName)
+}
+
+func (c *rateLimitedAgentPoolClient) Get(resourceGroupName string, clusterName string, agentPoolName string) (agentPool, error) {
+	c.limiter.Accept()
+	return c.agentPoolClient.Get(resourceGroupName, clusterName, agentPoolName)
+}
+
+func (c *rateLimitedAgentPoolClient) CreateOrUpdate(resourceGroupName string, clusterName string, agentPoolName string, parameters agentPool) error {
+	c.limiter.Accept()
+	return c.agentPoolClient.CreateOrUpdate(resourceGroupName, clusterName, agentPoolName, parameters)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// clientFactory creates the clients of the ARM APIs used by the manager, so
+// that the manager can be tested against fakes of the APIs.
+type clientFactory interface {
+	// scaleSetClients creates the clients of the scale sets of the
+	// subscription.
+	scaleSetClients(subscriptionID string) *subscriptionClients
+	// resourceClients creates the clients of the other resources of the
+	// subscription.
+	resourceClients(subscriptionID string) *resourceClients
+}
+
+// resourceClients are the clients of the resources other than scale sets,
+// which are only reached in the subscription of the manager.
+type resourceClients struct {
+	availabilitySetClient availabilitySetClient
+	virtualMachineClient  virtualMachineClient
+	interfaceClient       interfaceClient
+	diskClient            diskClient
+	vmSizeClient          vmSizeClient
+	resourceSkuClient     resourceSkuClient
+	agentPoolClient       agentPoolClient
+}
+
+// autorestClientFactory creates the autorest clients of the ARM APIs at the
+// endpoints of env, authorized by tokenProvider and sending their requests
+// with sender.
+type autorestClientFactory struct {
+	cfg           *Config
+	env           *azure.Environment
+	tokenProvider adal.OAuthTokenProvider
+	sender        *http.Client
+	logger        Logger
+	// sleep waits between the retries of the calls, time.Sleep if nil
+	sleep func(time.Duration)
+
+	limitersMutex sync.Mutex
+	// limiters are the rate limiters of the subscriptions, shared by all
+	// their clients.
+	limiters map[string]flowcontrol.RateLimiter
+}
+
+// rateLimiter returns the rate limiter of the subscription, nil if rate
+// limiting is disabled.
+func (f *autorestClientFactory) rateLimiter(subscriptionID string) flowcontrol.RateLimiter {
+	f.limitersMutex.Lock()
+	defer f.limitersMutex.Unlock()
+	if limiter, found := f.limiters[subscriptionID]; found {
+		return limiter
+	}
+	if f.limiters == nil {
+		f.limiters = make(map[string]flowcontrol.RateLimiter)
+	}
+	limiter := newRateLimiter(f.cfg)
+	f.limiters[subscriptionID] = limiter
+	return limiter
+}
+
+// scaleSetClients creates the clients of the scale sets of the subscription.
+// Each subscription has its own rate limiter, like the ARM limits.
+func (f *autorestClientFactory) scaleSetClients(subscriptionID string) *subscriptionClients {
+	scaleSetsClient := compute.NewVirtualMachineScaleSetsClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	scaleSetsClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	scaleSetsClient.Sender = f.sender
+
+	f.logger.Infof("Created scale set client with authorizer: %v", scaleSetsClient)
+
+	scaleSetVMsClient := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	scaleSetVMsClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	scaleSetVMsClient.Sender = f.sender
+	scaleSetVMsClient.RequestInspector = withInspection(f.logger)
+	scaleSetVMsClient.ResponseInspector = byInspecting(f.logger)
+
+	f.logger.Infof("Created scale set vm client with authorizer: %v", scaleSetVMsClient)
+
+	protectionClient := newVMProtectionClient(f.env.ResourceManagerEndpoint, subscriptionID, autorest.NewBearerAuthorizer(f.tokenProvider))
+	protectionClient.Sender = f.sender
+	flexibleClient := newFlexibleScaleSetClient(f.env.ResourceManagerEndpoint, subscriptionID, autorest.NewBearerAuthorizer(f.tokenProvider))
+	flexibleClient.Sender = f.sender
+
+	backoff := newRetryBackoff(f.cfg)
+	if f.sleep != nil {
+		backoff.sleep = f.sleep
+	}
+	var ssClient scaleSetClient = &instrumentedScaleSetClient{scaleSetsClient}
+	var vmClient scaleSetVMClient = &instrumentedScaleSetVMClient{scaleSetVMsClient}
+	if limiter := f.rateLimiter(subscriptionID); limiter != nil {
+		ssClient = &rateLimitedScaleSetClient{scaleSetClient: ssClient, limiter: limiter}
+		vmClient = &rateLimitedScaleSetVMClient{scaleSetVMClient: vmClient, limiter: limiter}
+	}
+	return &subscriptionClients{
+		scaleSetClient:   &retryScaleSetClient{scaleSetClient: ssClient, backoff: backoff},
+		scaleSetVmClient: &retryScaleSetVMClient{scaleSetVMClient: vmClient, backoff: backoff},
+		protectionClient: protectionClient,
+		flexibleClient:   flexibleClient,
+	}
+}
+
+// resourceClients creates the clients of the other resources of the
+// subscription.
+func (f *autorestClientFactory) resourceClients(subscriptionID string) *resourceClients {
+	availabilitySetsClient := compute.NewAvailabilitySetsClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	availabilitySetsClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	availabilitySetsClient.Sender = f.sender
+	virtualMachinesClient := compute.NewVirtualMachinesClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	virtualMachinesClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	virtualMachinesClient.Sender = f.sender
+	interfacesClient := network.NewInterfacesClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	interfacesClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	interfacesClient.Sender = f.sender
+	disksClient := compute.NewDisksClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	disksClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	disksClient.Sender = f.sender
+	vmSizesClient := compute.NewVirtualMachineSizesClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	vmSizesClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	vmSizesClient.Sender = f.sender
+	skusClient := compute.NewResourceSkusClientWithBaseURI(f.env.ResourceManagerEndpoint, subscriptionID)
+	skusClient.Authorizer = autorest.NewBearerAuthorizer(f.tokenProvider)
+	skusClient.Sender = f.sender
+	agentPoolsClient := newAgentPoolClient(f.env.ResourceManagerEndpoint, subscriptionID, autorest.NewBearerAuthorizer(f.tokenProvider))
+	agentPoolsClient.Sender = f.sender
+	clients := &resourceClients{
+		availabilitySetClient: availabilitySetsClient,
+		virtualMachineClient:  virtualMachinesClient,
+		interfaceClient:       interfacesClient,
+		diskClient:            disksClient,
+		vmSizeClient:          vmSizesClient,
+		resourceSkuClient:     skusClient,
+		agentPoolClient:       agentPoolsClient,
+	}
+	if limiter := f.rateLimiter(subscriptionID); limiter != nil {
+		clients.rateLimit(limiter)
+	}
+	return clients
+}
+
+// rateLimit makes the clients wait for the rate limiter before every call.
+func (c *resourceClients) rateLimit(limiter flowcontrol.RateLimiter) {
+	c.availabilitySetClient = &rateLimitedAvailabilitySetClient{availabilitySetClient: c.availabilitySetClient, limiter: limiter}
+	c.virtualMachineClient = &rateLimitedVirtualMachineClient{virtualMachineClient: c.virtualMachineClient, limiter: limiter}
+	c.interfaceClient = &rateLimitedInterfaceClient{interfaceClient: c.interfaceClient, limiter: limiter}
+	c.diskClient = &rateLimitedDiskClient{diskClient: c.diskClient, limiter: limiter}
+	c.vmSizeClient = &rateLimitedVMSizeClient{vmSizeClient: c.vmSizeClient, limiter: limiter}
+	c.resourceSkuClient = &rateLimitedResourceSkuClient{resourceSkuClient: c.resourceSkuClient, limiter: limiter}
+	c.agentPoolClient = &rateLimitedAgentPoolClient{agentPoolClient: c.agentPoolClient, limiter: limiter}
+}
+
+func withInspection(logger Logger) autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			logger.Infof("Inspecting Request: %s %s\n", r.Method, r.URL)
+			return p.Prepare(r)
+		})
+	}
+}
+
+func byInspecting(logger Logger) autorest.RespondDecorator {
+	return func(r autorest.Responder) autorest.Responder {
+		return autorest.ResponderFunc(func(resp *http.Response) error {
+			logger.Infof("Inspecting Response: %s for %s %s\n", resp.Status, resp.Request.Method, resp.Request.URL)
+			return r.Respond(resp)
+		})
+	}
+}
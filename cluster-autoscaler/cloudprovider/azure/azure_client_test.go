@@ -0,0 +1,274 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func newTestRetryBackoff(retries int) *retryBackoff {
+	return &retryBackoff{
+		retries:  retries,
+		duration: time.Millisecond,
+		factor:   backoffFactor,
+		jitter:   backoffJitter,
+		sleep:    func(time.Duration) {},
+	}
+}
+
+func newTestDetailedError(statusCode int) error {
+	return autorest.DetailedError{
+		StatusCode: statusCode,
+		Message:    http.StatusText(statusCode),
+	}
+}
+
+func TestNewRetryBackoff(t *testing.T) {
+	b := newRetryBackoff(&Config{})
+	assert.Equal(t, defaultBackoffRetries, b.retries)
+	assert.Equal(t, defaultBackoffDuration, b.duration)
+
+	b = newRetryBackoff(&Config{CloudProviderBackoffRetries: 6, CloudProviderBackoffDuration: 5})
+	assert.Equal(t, 6, b.retries)
+	assert.Equal(t, 5*time.Second, b.duration)
+}
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, isRetryableError(fmt.Errorf("connection reset")))
+	assert.True(t, isRetryableError(newTestDetailedError(autorest.UndefinedStatusCode)))
+	assert.True(t, isRetryableError(newTestDetailedError(http.StatusInternalServerError)))
+	assert.True(t, isRetryableError(newTestDetailedError(http.StatusServiceUnavailable)))
+	assert.True(t, isRetryableError(newTestDetailedError(http.StatusTooManyRequests)))
+	assert.False(t, isRetryableError(newTestDetailedError(http.StatusNotFound)))
+	assert.False(t, isRetryableError(newTestDetailedError(http.StatusForbidden)))
+	assert.False(t, isRetryableError(newTestDetailedError(http.StatusBadRequest)))
+}
+
+func TestIsNotFoundError(t *testing.T) {
+	assert.True(t, isNotFoundError(newTestDetailedError(http.StatusNotFound)))
+	assert.False(t, isNotFoundError(newTestDetailedError(http.StatusInternalServerError)))
+	assert.False(t, isNotFoundError(fmt.Errorf("not found")))
+	assert.False(t, isNotFoundError(nil))
+}
+
+func TestRetryScaleSetClientGet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusInternalServerError)).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil).Once()
+	client := &retryScaleSetClient{scaleSetClient: ssClient, backoff: newTestRetryBackoff(3)}
+
+	scaleSet, err := client.Get("rg", "ss1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), *scaleSet.Sku.Capacity)
+	ssClient.AssertNumberOfCalls(t, "Get", 3)
+}
+
+func TestRetryScaleSetClientGetExhausted(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusInternalServerError))
+	client := &retryScaleSetClient{scaleSetClient: ssClient, backoff: newTestRetryBackoff(2)}
+
+	_, err := client.Get("rg", "ss1")
+	assert.Error(t, err)
+	ssClient.AssertNumberOfCalls(t, "Get", 3)
+}
+
+func TestRetryScaleSetClientGetNotRetryable(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusNotFound))
+	client := &retryScaleSetClient{scaleSetClient: ssClient, backoff: newTestRetryBackoff(3)}
+
+	_, err := client.Get("rg", "ss1")
+	assert.Error(t, err)
+	ssClient.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestRetryScaleSetVMClientList(t *testing.T) {
+	vmClient := &scaleSetVMClientMock{}
+	vmClient.On("List", "rg", "ss1").Return(compute.VirtualMachineScaleSetVMListResult{}, fmt.Errorf("connection reset")).Times(3)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil).Once()
+	client := &retryScaleSetVMClient{scaleSetVMClient: vmClient, backoff: newTestRetryBackoff(3)}
+
+	result, err := client.List("rg", "ss1", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(*result.Value))
+	vmClient.AssertNumberOfCalls(t, "List", 4)
+}
+
+func newTestThrottledError(retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return autorest.DetailedError{
+		StatusCode: http.StatusTooManyRequests,
+		Response: &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     header,
+		},
+	}
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	_, throttled := getRetryAfter(fmt.Errorf("connection reset"))
+	assert.False(t, throttled)
+	_, throttled = getRetryAfter(newTestDetailedError(http.StatusInternalServerError))
+	assert.False(t, throttled)
+
+	retryAfter, throttled := getRetryAfter(newTestThrottledError("30"))
+	assert.True(t, throttled)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	retryAfter, throttled = getRetryAfter(newTestThrottledError(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)))
+	assert.True(t, throttled)
+	assert.True(t, retryAfter > 50*time.Second && retryAfter <= time.Minute)
+
+	retryAfter, throttled = getRetryAfter(newTestThrottledError(""))
+	assert.True(t, throttled)
+	assert.Equal(t, time.Duration(0), retryAfter)
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestThrottledError("10")).Once()
+	ssClient.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestThrottledError("")).Once()
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil).Once()
+
+	var sleeps []time.Duration
+	backoff := newTestRetryBackoff(3)
+	backoff.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	client := &retryScaleSetClient{scaleSetClient: ssClient, backoff: backoff}
+
+	_, err := client.Get("rg", "ss1")
+	assert.NoError(t, err)
+	ssClient.AssertNumberOfCalls(t, "Get", 3)
+	assert.Equal(t, 2, len(sleeps))
+	// Retry-After is longer than the backoff, so it wins.
+	assert.Equal(t, 10*time.Second, sleeps[0])
+	// Without Retry-After the exponential backoff is used.
+	assert.True(t, sleeps[1] >= 2*time.Millisecond && sleeps[1] < time.Second)
+}
+
+// fakeClock is a clock whose Sleep advances the time without blocking.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(&Config{}))
+
+	limiter := newRateLimiter(&Config{CloudProviderRateLimit: true})
+	assert.Equal(t, float32(defaultRateLimitQPS), limiter.QPS())
+
+	limiter = newRateLimiter(&Config{CloudProviderRateLimit: true, CloudProviderRateLimitQPS: 10, CloudProviderRateLimitBucket: 2})
+	assert.Equal(t, float32(10), limiter.QPS())
+}
+
+func TestRateLimitedClients(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	// A burst of 2 calls, then one call every 100ms.
+	limiter := flowcontrol.NewTokenBucketRateLimiterWithClock(10, 2, clock)
+
+	ssMock := &scaleSetClientMock{}
+	ssMock.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssMock.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmMock := &scaleSetVMClientMock{}
+	vmMock.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	ssClient := &rateLimitedScaleSetClient{scaleSetClient: ssMock, limiter: limiter}
+	vmClient := &rateLimitedScaleSetVMClient{scaleSetVMClient: vmMock, limiter: limiter}
+
+	_, err := ssClient.Get("rg", "ss1")
+	assert.NoError(t, err)
+	_, err = vmClient.List("rg", "ss1", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), clock.slept)
+
+	_, errChan := ssClient.CreateOrUpdate("rg", "ss1", newTestScaleSet("ss1", 3), nil)
+	assert.NoError(t, <-errChan)
+	_, err = vmClient.List("rg", "ss1", "", "", "")
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(200*time.Millisecond), float64(clock.slept), float64(10*time.Millisecond))
+}
+
+func TestRateLimitedResourceClients(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	// A burst of 2 calls, then one call every 100ms.
+	limiter := flowcontrol.NewTokenBucketRateLimiterWithClock(10, 2, clock)
+
+	asMock := &availabilitySetClientMock{}
+	asMock.On("Get", "rg", "as1").Return(compute.AvailabilitySet{}, nil)
+	sizeMock := &vmSizeClientMock{}
+	sizeMock.On("List", "westus").Return(compute.VirtualMachineSizeListResult{}, nil)
+	clients := &resourceClients{availabilitySetClient: asMock, vmSizeClient: sizeMock}
+	clients.rateLimit(limiter)
+
+	_, err := clients.availabilitySetClient.Get("rg", "as1")
+	assert.NoError(t, err)
+	_, err = clients.vmSizeClient.List("westus")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), clock.slept)
+
+	_, err = clients.availabilitySetClient.Get("rg", "as1")
+	assert.NoError(t, err)
+	_, err = clients.vmSizeClient.List("westus")
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(200*time.Millisecond), float64(clock.slept), float64(10*time.Millisecond))
+}
+
+func TestRateLimiterPerSubscription(t *testing.T) {
+	factory := &autorestClientFactory{
+		cfg:           &Config{CloudProviderRateLimit: true},
+		env:           &azure.PublicCloud,
+		tokenProvider: staticToken(fakeARMToken),
+		logger:        defaultLogger,
+	}
+
+	// The scale sets and the other resources of a subscription share its
+	// rate limiter.
+	limiter := factory.scaleSetClients("sub").scaleSetClient.(*retryScaleSetClient).scaleSetClient.(*rateLimitedScaleSetClient).limiter
+	resources := factory.resourceClients("sub")
+	assert.True(t, limiter == resources.agentPoolClient.(*rateLimitedAgentPoolClient).limiter)
+	assert.True(t, limiter == resources.diskClient.(*rateLimitedDiskClient).limiter)
+	assert.False(t, limiter == factory.rateLimiter("other-sub"))
+
+	factory.cfg.CloudProviderRateLimit = false
+	_, limited := factory.resourceClients("new-sub").vmSizeClient.(*rateLimitedVMSizeClient)
+	assert.False(t, limited)
+}
@@ -17,9 +17,11 @@ limitations under the License.
 package azure
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
@@ -27,32 +29,84 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	"k8s.io/client-go/kubernetes"
+	kube_record "k8s.io/client-go/tools/record"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
 	"k8s.io/kubernetes/plugin/pkg/scheduler/schedulercache"
 )
 
 const (
 	// ProviderName is the cloud provider name for Azure
 	ProviderName = "azure"
+
+	// autoDiscoveryInterval is the minimum interval between two listings of
+	// the scale sets to discover them by their tags.
+	autoDiscoveryInterval = 1 * time.Minute
 )
 
 // AzureCloudProvider provides implementation of CloudProvider interface for Azure.
 type AzureCloudProvider struct {
 	azureManager    *AzureManager
-	scaleSets       []*ScaleSet
+	nodeGroups      []azureNodeGroup
 	resourceLimiter *cloudprovider.ResourceLimiter
+
+	autoDiscoverySpecs []cloudprovider.VMSSAutoDiscoveryConfig
+	// keys of the scale sets given in --nodes, which are never autodiscovered
+	explicitlyConfigured map[string]bool
+	// autodiscovered scale sets by key, see AzureManager.scaleSetKey
+	autoDiscovered    map[string]*ScaleSet
+	lastAutoDiscovery time.Time
+}
+
+// azureNodeGroup is a node group backed by either a VM scale set or an
+// availability set.
+type azureNodeGroup interface {
+	cloudprovider.NodeGroup
+
+	// Belongs returns true if the given node belongs to the node group.
+	Belongs(node *apiv1.Node) (bool, error)
+	// register registers the node group in its AzureManager.
+	register(ctx context.Context) error
 }
 
 // BuildAzureCloudProvider creates new AzureCloudProvider
 func BuildAzureCloudProvider(azureManager *AzureManager, specs []string, resourceLimiter *cloudprovider.ResourceLimiter) (*AzureCloudProvider, error) {
+	return BuildAzureCloudProviderWithDiscovery(azureManager, cloudprovider.NodeGroupDiscoveryOptions{NodeGroupSpecs: specs}, resourceLimiter)
+}
+
+// BuildAzureCloudProviderWithDiscovery creates new AzureCloudProvider with the
+// node groups given in --nodes and the scale sets matching the
+// --node-group-auto-discovery specs, which are discovered again on Refresh.
+func BuildAzureCloudProviderWithDiscovery(azureManager *AzureManager, do cloudprovider.NodeGroupDiscoveryOptions, resourceLimiter *cloudprovider.ResourceLimiter) (*AzureCloudProvider, error) {
+	autoDiscoverySpecs, err := do.ParseVMSSAutoDiscoverySpecs()
+	if err != nil {
+		return nil, err
+	}
+	if len(autoDiscoverySpecs) > 0 && (azureManager.vmType == vmTypeStandard || azureManager.vmType == vmTypeAKS) {
+		return nil, fmt.Errorf("node group auto discovery is only supported for scale sets")
+	}
 	azure := &AzureCloudProvider{
-		azureManager:    azureManager,
-		resourceLimiter: resourceLimiter,
+		azureManager:         azureManager,
+		resourceLimiter:      resourceLimiter,
+		autoDiscoverySpecs:   autoDiscoverySpecs,
+		explicitlyConfigured: make(map[string]bool),
+		autoDiscovered:       make(map[string]*ScaleSet),
 	}
-	for _, spec := range specs {
+	for _, spec := range do.NodeGroupSpecs {
 		if err := azure.addNodeGroup(spec); err != nil {
 			return nil, err
 		}
 	}
+	for _, nodeGroup := range azure.nodeGroups {
+		if scaleSet, ok := nodeGroup.(*ScaleSet); ok {
+			azure.explicitlyConfigured[azureManager.scaleSetKey(scaleSet)] = true
+		}
+	}
+	if len(autoDiscoverySpecs) > 0 {
+		if err := azure.discoverScaleSets(); err != nil {
+			return nil, err
+		}
+	}
 
 	return azure, nil
 }
@@ -63,15 +117,51 @@ func (azure *AzureCloudProvider) Cleanup() error {
 	return nil
 }
 
+// SetEventRecorders makes the provider record the operations on the scale sets
+// as events, see AzureManager.SetEventRecorders.
+func (azure *AzureCloudProvider) SetEventRecorders(recorder kube_record.EventRecorder, status cloudprovider.StatusRecorder) {
+	azure.azureManager.SetEventRecorders(recorder, status)
+}
+
+// SetKubeClient makes the node groups wait for the nodes to be drained before
+// deleting their instances, see AzureManager.SetKubeClient.
+func (azure *AzureCloudProvider) SetKubeClient(client kubernetes.Interface) {
+	azure.azureManager.SetKubeClient(client)
+}
+
+// NodeHasGPU returns true if the node has the GPU label of the template nodes
+// of the GPU scale sets or a VM size with GPUs, so that it's treated as unready
+// until the NVIDIA device plugin makes its GPUs allocatable.
+func (azure *AzureCloudProvider) NodeHasGPU(node *apiv1.Node) bool {
+	if _, found := node.Labels[azureGPULabel]; found {
+		return true
+	}
+	size, found := azure.azureManager.lookupVMSize(node.Labels[kubeletapis.LabelInstanceType], node.Labels[kubeletapis.LabelZoneRegion])
+	return found && size.GPU > 0
+}
+
 // addNodeGroup adds node group defined in string spec. Format:
-// minNodes:maxNodes:scaleSetName
+// minNodes:maxNodes:scaleSetName. The node group is an availability set
+// instead of a scale set if the vmType of the manager is "standard", and an
+// AKS agent pool if it's "aks".
 func (azure *AzureCloudProvider) addNodeGroup(spec string) error {
-	scaleSet, err := buildScaleSet(spec, azure.azureManager)
+	var nodeGroup azureNodeGroup
+	var err error
+	switch azure.azureManager.vmType {
+	case vmTypeStandard:
+		nodeGroup, err = buildAvailabilitySet(spec, azure.azureManager)
+	case vmTypeAKS:
+		nodeGroup, err = buildAKSAgentPool(spec, azure.azureManager)
+	default:
+		nodeGroup, err = buildScaleSet(spec, azure.azureManager)
+	}
 	if err != nil {
 		return err
 	}
-	azure.scaleSets = append(azure.scaleSets, scaleSet)
-	azure.azureManager.RegisterScaleSet(scaleSet)
+	if err := nodeGroup.register(azure.azureManager.context()); err != nil {
+		return err
+	}
+	azure.nodeGroups = append(azure.nodeGroups, nodeGroup)
 	return nil
 }
 
@@ -82,9 +172,9 @@ func (azure *AzureCloudProvider) Name() string {
 
 // NodeGroups returns all node groups configured for this cloud provider.
 func (azure *AzureCloudProvider) NodeGroups() []cloudprovider.NodeGroup {
-	result := make([]cloudprovider.NodeGroup, 0, len(azure.scaleSets))
-	for _, scaleSet := range azure.scaleSets {
-		result = append(result, scaleSet)
+	result := make([]cloudprovider.NodeGroup, 0, len(azure.nodeGroups))
+	for _, nodeGroup := range azure.nodeGroups {
+		result = append(result, nodeGroup)
 	}
 	return result
 }
@@ -93,17 +183,34 @@ func (azure *AzureCloudProvider) NodeGroups() []cloudprovider.NodeGroup {
 func (azure *AzureCloudProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.NodeGroup, error) {
 	glog.V(6).Infof("Searching for node group for the node: %s, %s\n", node.Spec.ExternalID, node.Spec.ProviderID)
 	ref := &AzureRef{
-		Name: strings.ToLower(node.Spec.ProviderID),
+		Name: node.Spec.ProviderID,
 	}
 
-	scaleSet, err := azure.azureManager.GetScaleSetForInstance(ref)
+	if azure.azureManager.vmType == vmTypeStandard {
+		availabilitySet, err := azure.azureManager.GetAvailabilitySetForInstance(ref)
+		if availabilitySet == nil {
+			return nil, err
+		}
+		return availabilitySet, err
+	}
+	if azure.azureManager.vmType == vmTypeAKS {
+		agentPool, err := azure.azureManager.GetAKSAgentPoolForInstance(ref)
+		if agentPool == nil {
+			return nil, err
+		}
+		return agentPool, err
+	}
 
+	scaleSet, err := azure.azureManager.GetScaleSetForInstance(ref)
+	if scaleSet == nil {
+		return nil, err
+	}
 	return scaleSet, err
 }
 
 // Pricing returns pricing model for this cloud provider or error if not available.
 func (azure *AzureCloudProvider) Pricing() (cloudprovider.PricingModel, errors.AutoscalerError) {
-	return nil, cloudprovider.ErrNotImplemented
+	return &AzurePriceModel{}, nil
 }
 
 // GetAvailableMachineTypes get all machine types that can be requested from the cloud provider.
@@ -125,9 +232,138 @@ func (azure *AzureCloudProvider) GetResourceLimiter() (*cloudprovider.ResourceLi
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
 // In particular the list of node groups returned by NodeGroups can change as a result of CloudProvider.Refresh().
 func (azure *AzureCloudProvider) Refresh() error {
+	var err error
+	if len(azure.autoDiscoverySpecs) > 0 && time.Since(azure.lastAutoDiscovery) >= autoDiscoveryInterval {
+		err = azure.discoverScaleSets()
+	}
+	if refreshErr := azure.azureManager.RefreshExpiredScaleSets(); err == nil {
+		err = refreshErr
+	}
+	// The failed and timed out scale-ups and the stuck instances are handled
+	// from the instances cached so far even if some failed to be refreshed.
+	azure.azureManager.recordProvisioningTimes()
+	azure.azureManager.abortFailedScaleUps(azure.azureManager.context())
+	azure.azureManager.abortTimedOutScaleUps(azure.azureManager.context())
+	azure.azureManager.forceDeleteStuckInstances(azure.azureManager.context())
+	return err
+}
+
+// discoverScaleSets registers the scale sets of the resource groups matching
+// the auto discovery specs, and unregisters the previously discovered ones
+// which don't match anymore. The instances of new scale sets are cached when
+// they are looked up.
+func (azure *AzureCloudProvider) discoverScaleSets() error {
+	// The scale sets of the resource group of the manager keep an empty
+	// resource group, like the ones given in --nodes.
+	resourceGroups := append([]string{""}, azure.azureManager.discoveryResourceGroups...)
+	candidates := make([]*ScaleSet, 0)
+	tags := make(map[*ScaleSet]*map[string]*string)
+	for _, resourceGroup := range resourceGroups {
+		listed := resourceGroup
+		if listed == "" {
+			listed = azure.azureManager.resourceGroupName
+		}
+		// The resource groups of other subscriptions are prefixed by their
+		// subscription.
+		subscriptionID := ""
+		if parts := strings.SplitN(resourceGroup, "/", 2); len(parts) == 2 {
+			subscriptionID, resourceGroup, listed = parts[0], parts[1], parts[1]
+		}
+		scaleSets, err := azure.azureManager.listScaleSets(subscriptionID, listed)
+		if err != nil {
+			glog.Errorf("Failed to list scale sets of resource group %s: %v", listed, err)
+			return fmt.Errorf("cannot autodiscover scale sets: %v", err)
+		}
+		for _, set := range scaleSets {
+			if set.Name == nil {
+				continue
+			}
+			candidate := &ScaleSet{
+				AzureRef:       AzureRef{Name: *set.Name},
+				ResourceGroup:  resourceGroup,
+				SubscriptionID: subscriptionID,
+				azureManager:   azure.azureManager,
+			}
+			candidates = append(candidates, candidate)
+			tags[candidate] = set.Tags
+		}
+	}
+	azure.lastAutoDiscovery = time.Now()
+
+	discovered := make(map[string]*ScaleSet)
+	for _, candidate := range candidates {
+		key := azure.azureManager.scaleSetKey(candidate)
+		if azure.explicitlyConfigured[key] {
+			continue
+		}
+		for _, spec := range azure.autoDiscoverySpecs {
+			if !matchesTags(tags[candidate], spec.Tags) {
+				continue
+			}
+			candidate.minSize, candidate.maxSize = boundsFromTags(candidate.Id(), tags[candidate], spec.MinSize, spec.MaxSize)
+			discovered[key] = candidate
+			break
+		}
+	}
+
+	nodeGroups := make([]azureNodeGroup, 0, len(azure.nodeGroups))
+	for _, nodeGroup := range azure.nodeGroups {
+		scaleSet, ok := nodeGroup.(*ScaleSet)
+		if ok {
+			key := azure.azureManager.scaleSetKey(scaleSet)
+			if azure.autoDiscovered[key] == scaleSet {
+				found := discovered[key]
+				if found == nil || found.minSize != scaleSet.minSize || found.maxSize != scaleSet.maxSize {
+					glog.V(3).Infof("Unregistering autodiscovered scale set %s", scaleSet.Id())
+					// A scale set whose bounds changed is registered again
+					// below, keep what is known about it.
+					azure.azureManager.unregisterScaleSet(scaleSet, found == nil)
+					delete(azure.autoDiscovered, key)
+					continue
+				}
+			}
+		}
+		nodeGroups = append(nodeGroups, nodeGroup)
+	}
+	azure.nodeGroups = nodeGroups
+
+	for _, candidate := range candidates {
+		key := azure.azureManager.scaleSetKey(candidate)
+		scaleSet := discovered[key]
+		if scaleSet == nil || azure.autoDiscovered[key] != nil {
+			continue
+		}
+		if err := scaleSet.register(azure.azureManager.context()); err != nil {
+			return err
+		}
+		glog.V(3).Infof("Autodiscovered scale set %s with bounds [%d, %d]", scaleSet.Id(), scaleSet.minSize, scaleSet.maxSize)
+		azure.autoDiscovered[key] = scaleSet
+		azure.nodeGroups = append(azure.nodeGroups, scaleSet)
+	}
 	return nil
 }
 
+// matchesTags returns true if the tags of a scale set have all the given tags,
+// with the given values. Tag names are case-insensitive in Azure.
+func matchesTags(tags *map[string]*string, want map[string]string) bool {
+	if tags == nil {
+		return len(want) == 0
+	}
+	for name, value := range want {
+		found := false
+		for tagName, tagValue := range *tags {
+			if strings.EqualFold(tagName, name) && tagValue != nil && *tagValue == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // AzureRef contains a reference to some entity in Azure world.
 type AzureRef struct {
 	Name string
@@ -138,6 +374,73 @@ func (m *AzureRef) GetKey() string {
 	return m.Name
 }
 
+// normalizeAzureRef returns the reference of an instance in the form used by
+// the caches: its lowercase resource ID prefixed by azure://. The case of the
+// IDs returned by Azure differs between API calls (e.g. GET and LIST), and
+// provider IDs of nodes may differ from both.
+func normalizeAzureRef(ref AzureRef) AzureRef {
+	return AzureRef{Name: "azure:///" + strings.Join(azureRefSegments(ref), "/")}
+}
+
+// azureRefSegments returns the lowercase segments of the resource ID of the
+// referenced instance, without the azure:// prefix and empty segments.
+func azureRefSegments(ref AzureRef) []string {
+	id := strings.ToLower(ref.Name)
+	if strings.HasPrefix(id, "azure://") {
+		id = id[len("azure://"):]
+	}
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(id, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// instanceRef is the lowercase resource ID of an instance, parsed.
+type instanceRef struct {
+	// subscriptionID and resourceGroup are empty if the ID doesn't contain them.
+	subscriptionID string
+	resourceGroup  string
+	// scaleSet is the name of the scale set of uniform scale set VMs, empty
+	// for other VMs, including the ones of flexible scale sets.
+	scaleSet string
+	// name is the instance ID of uniform scale set VMs, the name of other VMs.
+	name string
+}
+
+// parseAzureRef parses the resource ID of the referenced instance, e.g.
+// azure:///subscriptions/<id>/resourceGroups/<rg>/providers/Microsoft.Compute/virtualMachineScaleSets/<name>/virtualMachines/<instance-id>
+// in any of the forms accepted by normalizeAzureRef.
+func parseAzureRef(ref AzureRef) (instanceRef, error) {
+	segments := azureRefSegments(ref)
+	var parsed instanceRef
+	for i := 0; i+1 < len(segments); i++ {
+		switch segments[i] {
+		case "subscriptions":
+			if parsed.subscriptionID == "" {
+				parsed.subscriptionID = segments[i+1]
+			}
+		case "resourcegroups":
+			if parsed.resourceGroup == "" {
+				parsed.resourceGroup = segments[i+1]
+			}
+		}
+	}
+	n := len(segments)
+	switch {
+	case n >= 4 && segments[n-4] == "virtualmachinescalesets" && segments[n-2] == "virtualmachines":
+		parsed.scaleSet = segments[n-3]
+		parsed.name = segments[n-1]
+	case n >= 2 && segments[n-2] == "virtualmachines":
+		parsed.name = segments[n-1]
+	default:
+		return instanceRef{}, fmt.Errorf("invalid instance ID %q", ref.Name)
+	}
+	return parsed, nil
+}
+
 // AzureRefFromProviderId creates InstanceConfig object from provider id which
 // must be in format: azure:///resourceGroupName/name
 func AzureRefFromProviderId(id string) (*AzureRef, error) {
@@ -157,10 +460,31 @@ type ScaleSet struct {
 	azureManager *AzureManager
 	minSize      int
 	maxSize      int
+
+	// ResourceGroup of the scale set, the one of the AzureManager if empty.
+	ResourceGroup string
+	// SubscriptionID of the scale set, the one of the AzureManager if empty.
+	// The ResourceGroup must be set too.
+	SubscriptionID string
+	// Spot is true for scale sets of spot (low-priority) VMs, which Azure may
+	// evict at any time. The vendored compute API doesn't expose the priority of
+	// a scale set, so it's set from the SpotScaleSets config.
+	Spot bool
+	// VMSize overrides the VM size of the scale set model when building
+	// template nodes, e.g. for custom images. It's set from the
+	// ScaleSetVMSizes config and ignored if unknown.
+	VMSize string
+}
+
+func (scaleSet *ScaleSet) register(ctx context.Context) error {
+	return scaleSet.azureManager.RegisterScaleSetWithValidation(ctx, scaleSet)
 }
 
 // MinSize returns minimum size of the node group.
 func (scaleSet *ScaleSet) MinSize() int {
+	if bounds, found := scaleSet.azureManager.boundsOverride(scaleSet); found {
+		return bounds.minSize
+	}
 	return scaleSet.minSize
 }
 
@@ -188,14 +512,21 @@ func (scaleSet *ScaleSet) Autoprovisioned() bool {
 
 // MaxSize returns maximum size of the node group.
 func (scaleSet *ScaleSet) MaxSize() int {
+	if bounds, found := scaleSet.azureManager.boundsOverride(scaleSet); found {
+		return bounds.maxSize
+	}
 	return scaleSet.maxSize
 }
 
 // TargetSize returns the current TARGET size of the node group. It is possible that the
 // number is different from the number of nodes registered in Kubernetes.
+// Deallocated VMs are not counted.
 func (scaleSet *ScaleSet) TargetSize() (int, error) {
-	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet)
-	return int(size), err
+	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet.azureManager.context(), scaleSet)
+	if err != nil {
+		return int(size), err
+	}
+	return int(size) - len(scaleSet.azureManager.GetDeallocatedInstances(scaleSet)), nil
 }
 
 // IncreaseSize increases Scale Set size
@@ -203,14 +534,42 @@ func (scaleSet *ScaleSet) IncreaseSize(delta int) error {
 	if delta <= 0 {
 		return fmt.Errorf("size increase must be positive")
 	}
-	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet)
+	err := scaleSet.increaseSize(delta)
+	if _, backedOff := err.(*ScaleSetBackedOffError); backedOff {
+		// Spot VMs may be unavailable for a while, fall back to the configured scale set.
+		if fallback := scaleSet.azureManager.SpotFallback(scaleSet); fallback != nil {
+			glog.Warningf("Increasing the size of scale set %s instead of %s: %v", fallback.Name, scaleSet.Name, err)
+			return fallback.increaseSize(delta)
+		}
+	}
+	return err
+}
+
+// increaseSize starts deallocated VMs of the scale set first, and increases
+// its capacity for the rest of delta.
+func (scaleSet *ScaleSet) increaseSize(delta int) error {
+	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet.azureManager.context(), scaleSet)
 	if err != nil {
 		return err
 	}
-	if int(size)+delta > scaleSet.MaxSize() {
-		return fmt.Errorf("size increase too large - desired:%d max:%d", int(size)+delta, scaleSet.MaxSize())
+	deallocated := scaleSet.azureManager.GetDeallocatedInstances(scaleSet)
+	targetSize := int(size) - len(deallocated)
+	if targetSize+delta > scaleSet.MaxSize() {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", targetSize+delta, scaleSet.MaxSize())
 	}
-	return scaleSet.azureManager.SetScaleSetSize(scaleSet, size+int64(delta))
+	if len(deallocated) > delta {
+		deallocated = deallocated[:delta]
+	}
+	if len(deallocated) > 0 {
+		if err := scaleSet.azureManager.StartInstances(scaleSet.azureManager.context(), scaleSet, deallocated); err != nil {
+			return err
+		}
+		delta -= len(deallocated)
+	}
+	if delta == 0 {
+		return nil
+	}
+	return scaleSet.azureManager.SetScaleSetSize(scaleSet.azureManager.context(), scaleSet, size+int64(delta))
 }
 
 // DecreaseTargetSize decreases the target size of the node group. This function
@@ -219,22 +578,7 @@ func (scaleSet *ScaleSet) IncreaseSize(delta int) error {
 // It is assumed that cloud provider will not delete the existing nodes if the size
 // when there is an option to just decrease the target.
 func (scaleSet *ScaleSet) DecreaseTargetSize(delta int) error {
-	if delta >= 0 {
-		return fmt.Errorf("size decrease size must be negative")
-	}
-	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet)
-	if err != nil {
-		return err
-	}
-	nodes, err := scaleSet.azureManager.GetScaleSetVms(scaleSet)
-	if err != nil {
-		return err
-	}
-	if int(size)+delta < len(nodes) {
-		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
-			size, delta, len(nodes))
-	}
-	return scaleSet.azureManager.SetScaleSetSize(scaleSet, size+int64(delta))
+	return scaleSet.azureManager.DecreaseTargetSize(scaleSet.azureManager.context(), scaleSet, delta)
 }
 
 // Belongs returns true if the given node belongs to the NodeGroup.
@@ -242,7 +586,7 @@ func (scaleSet *ScaleSet) Belongs(node *apiv1.Node) (bool, error) {
 	glog.V(6).Infof("Check if node belongs to this scale set: scaleset:%v, node:%v\n", scaleSet, node)
 
 	ref := &AzureRef{
-		Name: strings.ToLower(node.Spec.ProviderID),
+		Name: node.Spec.ProviderID,
 	}
 
 	targetAsg, err := scaleSet.azureManager.GetScaleSetForInstance(ref)
@@ -261,11 +605,11 @@ func (scaleSet *ScaleSet) Belongs(node *apiv1.Node) (bool, error) {
 // DeleteNodes deletes the nodes from the group.
 func (scaleSet *ScaleSet) DeleteNodes(nodes []*apiv1.Node) error {
 	glog.V(8).Infof("Delete nodes requested: %v\n", nodes)
-	size, err := scaleSet.azureManager.GetScaleSetSize(scaleSet)
+	size, err := scaleSet.TargetSize()
 	if err != nil {
 		return err
 	}
-	if int(size) <= scaleSet.MinSize() {
+	if size <= scaleSet.MinSize() {
 		return fmt.Errorf("min size reached, nodes will not be deleted")
 	}
 	refs := make([]*AzureRef, 0, len(nodes))
@@ -278,53 +622,114 @@ func (scaleSet *ScaleSet) DeleteNodes(nodes []*apiv1.Node) error {
 			return fmt.Errorf("%s belongs to a different asg than %s", node.Name, scaleSet.Id())
 		}
 		azureRef := &AzureRef{
-			Name: strings.ToLower(node.Spec.ProviderID),
+			Name: node.Spec.ProviderID,
 		}
 		refs = append(refs, azureRef)
 	}
-	return scaleSet.azureManager.DeleteInstances(refs)
+	scaleSet.azureManager.waitForDrain(scaleSet.azureManager.context(), nodes)
+	// The deletions are recorded as events on the nodes.
+	return scaleSet.azureManager.DeleteInstances(withNodes(scaleSet.azureManager.context(), nodes), refs)
 }
 
 // Id returns ScaleSet id.
 func (scaleSet *ScaleSet) Id() string {
+	if scaleSet.SubscriptionID != "" {
+		return scaleSet.SubscriptionID + "/" + scaleSet.ResourceGroup + "/" + scaleSet.Name
+	}
+	if scaleSet.ResourceGroup != "" {
+		return scaleSet.ResourceGroup + "/" + scaleSet.Name
+	}
 	return scaleSet.Name
 }
 
 // Debug returns a debug string for the Scale Set.
 func (scaleSet *ScaleSet) Debug() string {
+	if zones := scaleSet.Zones(); len(zones) > 0 {
+		return fmt.Sprintf("%s (%d:%d) zones %s", scaleSet.Id(), scaleSet.MinSize(), scaleSet.MaxSize(), strings.Join(zones, ","))
+	}
 	return fmt.Sprintf("%s (%d:%d)", scaleSet.Id(), scaleSet.MinSize(), scaleSet.MaxSize())
 }
 
+// Zones returns the availability zones of the scale set, nil if it's not zonal.
+func (scaleSet *ScaleSet) Zones() []string {
+	return scaleSet.azureManager.GetScaleSetZones(scaleSet)
+}
+
 // TemplateNodeInfo returns a node template for this scale set.
 func (scaleSet *ScaleSet) TemplateNodeInfo() (*schedulercache.NodeInfo, error) {
-	return nil, cloudprovider.ErrNotImplemented
+	template, err := scaleSet.azureManager.getScaleSetTemplate(scaleSet)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := scaleSet.azureManager.buildNodeFromTemplate(scaleSet.Name, template)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(scaleSet.Name))
+	nodeInfo.SetNode(node)
+	return nodeInfo, nil
+}
+
+// MaxNodeProvisionTime returns the time after which the new nodes of the
+// scale set can be considered failed to come up, derived from the time its
+// last new VMs took to be provisioned, see AzureManager.GetMaxProvisioningTime.
+// It's used instead of --max-node-provision-time for the nodes of the scale set.
+func (scaleSet *ScaleSet) MaxNodeProvisionTime() time.Duration {
+	return scaleSet.azureManager.GetMaxProvisioningTime(scaleSet)
 }
 
 // Create ScaleSet from provided spec.
-// spec is in the following format: min-size:max-size:scale-set-name.
+// spec is in the following format:
+// min-size:max-size:[[subscription-id/]resource-group/]scale-set-name.
 func buildScaleSet(spec string, azureManager *AzureManager) (*ScaleSet, error) {
+	nodeGroupSpec, err := parseNodeGroupSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &ScaleSet{
+		AzureRef:       AzureRef{Name: nodeGroupSpec.name},
+		azureManager:   azureManager,
+		minSize:        nodeGroupSpec.minSize,
+		maxSize:        nodeGroupSpec.maxSize,
+		ResourceGroup:  nodeGroupSpec.resourceGroup,
+		SubscriptionID: nodeGroupSpec.subscriptionID,
+	}, nil
+}
+
+// nodeGroupSpec is a parsed
+// min-size:max-size:[[subscription-id/]resource-group/]name spec.
+type nodeGroupSpec struct {
+	minSize        int
+	maxSize        int
+	subscriptionID string
+	resourceGroup  string
+	name           string
+}
+
+func parseNodeGroupSpec(spec string) (*nodeGroupSpec, error) {
 	tokens := strings.SplitN(spec, ":", 3)
 	if len(tokens) != 3 {
 		return nil, fmt.Errorf("wrong nodes configuration: %s", spec)
 	}
 
-	scaleSet := ScaleSet{
-		azureManager: azureManager,
-	}
+	result := nodeGroupSpec{}
 	if size, err := strconv.Atoi(tokens[0]); err == nil {
-		if size <= 0 {
-			return nil, fmt.Errorf("min size must be >= 1, got: %d", size)
+		// Node groups can scale from zero thanks to TemplateNodeInfo.
+		if size < 0 {
+			return nil, fmt.Errorf("min size must be >= 0, got: %d", size)
 		}
-		scaleSet.minSize = size
+		result.minSize = size
 	} else {
 		return nil, fmt.Errorf("failed to set min size: %s, expected integer", tokens[0])
 	}
 
 	if size, err := strconv.Atoi(tokens[1]); err == nil {
-		if size < scaleSet.minSize {
+		if size < result.minSize {
 			return nil, fmt.Errorf("max size must be greater or equal to min size")
 		}
-		scaleSet.maxSize = size
+		result.maxSize = size
 	} else {
 		return nil, fmt.Errorf("failed to set max size: %s, expected integer", tokens[1])
 	}
@@ -333,11 +738,32 @@ func buildScaleSet(spec string, azureManager *AzureManager) (*ScaleSet, error) {
 		return nil, fmt.Errorf("scale set name must not be blank, got spec: %s", spec)
 	}
 
-	scaleSet.Name = tokens[2]
-	return &scaleSet, nil
+	// The name may be prefixed by the resource group of the node group, itself
+	// prefixed by the subscription of the resource group.
+	parts := strings.Split(tokens[2], "/")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("subscription, resource group and scale set name must not be blank, got spec: %s", spec)
+		}
+	}
+	switch len(parts) {
+	case 1:
+	case 2:
+		result.resourceGroup = parts[0]
+		tokens[2] = parts[1]
+	case 3:
+		result.subscriptionID = parts[0]
+		result.resourceGroup = parts[1]
+		tokens[2] = parts[2]
+	default:
+		return nil, fmt.Errorf("too many segments in the name of the node group, got spec: %s", spec)
+	}
+
+	result.name = tokens[2]
+	return &result, nil
 }
 
 // Nodes returns a list of all nodes that belong to this node group.
 func (scaleSet *ScaleSet) Nodes() ([]string, error) {
-	return scaleSet.azureManager.GetScaleSetVms(scaleSet)
+	return scaleSet.azureManager.GetScaleSetVms(scaleSet.azureManager.context(), scaleSet)
 }
@@ -17,8 +17,11 @@ limitations under the License.
 package azure
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/go-autorest/autorest"
@@ -26,7 +29,9 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
 )
 
 // Mock for VirtualMachineScaleSetsClient
@@ -66,6 +71,34 @@ func (client *VirtualMachineScaleSetsClientMock) DeleteInstances(resourceGroupNa
 	return nil, errChan
 }
 
+func (client *VirtualMachineScaleSetsClientMock) Deallocate(resourceGroupName string, vmScaleSetName string,
+	vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	errChan := make(chan error)
+	go func() {
+		errChan <- args.Error(1)
+	}()
+	return nil, errChan
+}
+
+func (client *VirtualMachineScaleSetsClientMock) Start(resourceGroupName string, vmScaleSetName string,
+	vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	errChan := make(chan error)
+	go func() {
+		errChan <- args.Error(1)
+	}()
+	return nil, errChan
+}
+
+func (client *VirtualMachineScaleSetsClientMock) List(resourceGroupName string) (result compute.VirtualMachineScaleSetListResult, err error) {
+	return compute.VirtualMachineScaleSetListResult{Value: &[]compute.VirtualMachineScaleSet{}}, nil
+}
+
+func (client *VirtualMachineScaleSetsClientMock) ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (result compute.VirtualMachineScaleSetListResult, err error) {
+	return compute.VirtualMachineScaleSetListResult{}, nil
+}
+
 // Mock for VirtualMachineScaleSetVMsClient
 type VirtualMachineScaleSetVMsClientMock struct {
 	mock.Mock
@@ -89,12 +122,15 @@ func (m *VirtualMachineScaleSetVMsClientMock) List(resourceGroupName string, vir
 
 }
 
+func (m *VirtualMachineScaleSetVMsClientMock) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (result compute.VirtualMachineScaleSetVMListResult, err error) {
+	return compute.VirtualMachineScaleSetVMListResult{}, nil
+}
+
 var testAzureManager = &AzureManager{
 	scaleSets:        make([]*scaleSetInformation, 0),
 	scaleSetClient:   &VirtualMachineScaleSetsClientMock{},
 	scaleSetVmClient: &VirtualMachineScaleSetVMsClientMock{},
 	scaleSetCache:    make(map[AzureRef]*ScaleSet),
-	interrupt:        make(chan struct{}),
 }
 
 func testProvider(t *testing.T, m *AzureManager) *AzureCloudProvider {
@@ -122,11 +158,11 @@ func TestAddNodeGroup(t *testing.T) {
 	provider := testProvider(t, testAzureManager)
 	err := provider.addNodeGroup("bad spec")
 	assert.Error(t, err)
-	assert.Equal(t, len(provider.scaleSets), 0)
+	assert.Equal(t, len(provider.nodeGroups), 0)
 
 	err = provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	assert.Equal(t, len(provider.scaleSets), 1)
+	assert.Equal(t, len(provider.nodeGroups), 1)
 }
 
 func TestName(t *testing.T) {
@@ -162,7 +198,7 @@ func TestNodeGroupForNode(t *testing.T) {
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
 
-	assert.Equal(t, len(provider.scaleSets), 1)
+	assert.Equal(t, len(provider.nodeGroups), 1)
 
 	group, err := provider.NodeGroupForNode(node)
 
@@ -182,7 +218,8 @@ func TestNodeGroupForNode(t *testing.T) {
 
 	group, err = provider.NodeGroupForNode(nodeNotInGroup)
 	assert.NoError(t, err)
-	assert.Nil(t, group)
+	// The group is an untyped nil, not a nil *ScaleSet.
+	assert.True(t, group == nil)
 
 }
 
@@ -204,23 +241,23 @@ func TestMaxSize(t *testing.T) {
 	provider := testProvider(t, testAzureManager)
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	assert.Equal(t, len(provider.scaleSets), 1)
-	assert.Equal(t, provider.scaleSets[0].MaxSize(), 5)
+	assert.Equal(t, len(provider.nodeGroups), 1)
+	assert.Equal(t, provider.nodeGroups[0].MaxSize(), 5)
 }
 
 func TestMinSize(t *testing.T) {
 	provider := testProvider(t, testAzureManager)
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	assert.Equal(t, len(provider.scaleSets), 1)
-	assert.Equal(t, provider.scaleSets[0].MinSize(), 1)
+	assert.Equal(t, len(provider.nodeGroups), 1)
+	assert.Equal(t, provider.nodeGroups[0].MinSize(), 1)
 }
 
 func TestTargetSize(t *testing.T) {
 	provider := testProvider(t, testAzureManager)
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	targetSize, err := provider.scaleSets[0].TargetSize()
+	targetSize, err := provider.nodeGroups[0].TargetSize()
 	assert.Equal(t, targetSize, 2)
 	assert.NoError(t, err)
 }
@@ -237,9 +274,9 @@ func TestIncreaseSize(t *testing.T) {
 
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	assert.Equal(t, len(provider.scaleSets), 1)
+	assert.Equal(t, len(provider.nodeGroups), 1)
 
-	err = provider.scaleSets[0].IncreaseSize(1)
+	err = provider.nodeGroups[0].IncreaseSize(1)
 	assert.NoError(t, err)
 }
 
@@ -261,7 +298,7 @@ func TestBelongs(t *testing.T) {
 		},
 	}
 
-	_, err = provider.scaleSets[0].Belongs(invalidNode)
+	_, err = provider.nodeGroups[0].Belongs(invalidNode)
 	assert.Error(t, err)
 
 	validNode := &apiv1.Node{
@@ -269,7 +306,7 @@ func TestBelongs(t *testing.T) {
 			ProviderID: "azure://123E4567-E89B-12D3-A456-426655440000",
 		},
 	}
-	belongs, err := provider.scaleSets[0].Belongs(validNode)
+	belongs, err := provider.nodeGroups[0].Belongs(validNode)
 	assert.Equal(t, belongs, true)
 	assert.NoError(t, err)
 }
@@ -301,7 +338,7 @@ func TestDeleteNodes(t *testing.T) {
 			ProviderID: "azure://123E4567-E89B-12D3-A456-426655440000",
 		},
 	}
-	err = provider.scaleSets[0].DeleteNodes([]*apiv1.Node{node})
+	err = provider.nodeGroups[0].DeleteNodes([]*apiv1.Node{node})
 	assert.NoError(t, err)
 	scaleSetClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
 }
@@ -310,8 +347,8 @@ func TestId(t *testing.T) {
 	provider := testProvider(t, testAzureManager)
 	err := provider.addNodeGroup("1:5:test-asg")
 	assert.NoError(t, err)
-	assert.Equal(t, len(provider.scaleSets), 1)
-	assert.Equal(t, provider.scaleSets[0].Id(), "test-asg")
+	assert.Equal(t, len(provider.nodeGroups), 1)
+	assert.Equal(t, provider.nodeGroups[0].Id(), "test-asg")
 }
 
 func TestDebug(t *testing.T) {
@@ -324,6 +361,27 @@ func TestDebug(t *testing.T) {
 	assert.Equal(t, asg.Debug(), "test-scale-set (5:55)")
 }
 
+func TestScaleSetZones(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	zonal := registerTestScaleSet(t, m, "1:5:zonal")
+	regional := registerTestScaleSet(t, m, "1:5:regional")
+
+	set := newTestScaleSet("zonal", 1)
+	set.Zones = &[]string{"1", "3"}
+	ssClient.On("Get", "rg", "zonal").Return(set, nil)
+	ssClient.On("Get", "rg", "regional").Return(newTestScaleSet("regional", 1), nil)
+	vmClient.On("List", "rg", mock.Anything).Return(compute.VirtualMachineScaleSetVMListResult{}, nil)
+	assert.Nil(t, zonal.Zones())
+	assert.NoError(t, m.Refresh())
+
+	assert.Equal(t, []string{"1", "3"}, zonal.Zones())
+	assert.Equal(t, "zonal (1:5) zones 1,3", zonal.Debug())
+	assert.Nil(t, regional.Zones())
+	assert.Equal(t, "regional (1:5)", regional.Debug())
+}
+
 func TestBuildAsg(t *testing.T) {
 	_, err := buildScaleSet("a", nil)
 	assert.Error(t, err)
@@ -348,4 +406,328 @@ func TestBuildAsg(t *testing.T) {
 	assert.Equal(t, 111, asg.MinSize())
 	assert.Equal(t, 222, asg.MaxSize())
 	assert.Equal(t, "test-name", asg.Name)
+	assert.Equal(t, "", asg.ResourceGroup)
+
+	asg, err = buildScaleSet("0:3:test-name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, asg.MinSize())
+
+	asg, err = buildScaleSet("1:3:test-rg/test-name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-name", asg.Name)
+	assert.Equal(t, "test-rg", asg.ResourceGroup)
+	assert.Equal(t, "test-rg/test-name", asg.Id())
+
+	_, err = buildScaleSet("1:3:/test-name", nil)
+	assert.Error(t, err)
+}
+
+func newTestTaggedScaleSet(name string, tags map[string]string) compute.VirtualMachineScaleSet {
+	scaleSetTags := make(map[string]*string)
+	for k, v := range tags {
+		value := v
+		scaleSetTags[k] = &value
+	}
+	return compute.VirtualMachineScaleSet{Name: &name, Tags: &scaleSetTags}
+}
+
+func TestAutoDiscoverScaleSets(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	untagged := "untagged"
+	ssClient.On("Get", "rg", mock.Anything).Return(newTestScaleSet("ss", 1), nil)
+	vmClient.On("List", "rg", mock.Anything).Return(compute.VirtualMachineScaleSetVMListResult{}, nil)
+	ssClient.On("List", "rg").Return(compute.VirtualMachineScaleSetListResult{
+		Value: &[]compute.VirtualMachineScaleSet{
+			newTestTaggedScaleSet("enabled", map[string]string{"Cluster-Autoscaler-Enabled": "true"}),
+			newTestTaggedScaleSet("disabled", map[string]string{"cluster-autoscaler-enabled": "false"}),
+			newTestTaggedScaleSet("explicit", map[string]string{"cluster-autoscaler-enabled": "true"}),
+			{Name: &untagged},
+		},
+	}, nil).Once()
+
+	provider, err := BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupSpecs:              []string{"1:3:explicit"},
+		NodeGroupAutoDiscoverySpecs: []string{"label:cluster-autoscaler-enabled=true,min=1,max=10"},
+	}, nil)
+	assert.NoError(t, err)
+	nodeGroups := provider.NodeGroups()
+	if assert.Equal(t, 2, len(nodeGroups)) {
+		assert.Equal(t, "explicit", nodeGroups[0].Id())
+		assert.Equal(t, 3, nodeGroups[0].MaxSize())
+		assert.Equal(t, "enabled", nodeGroups[1].Id())
+		assert.Equal(t, 1, nodeGroups[1].MinSize())
+		assert.Equal(t, 10, nodeGroups[1].MaxSize())
+	}
+	assert.Equal(t, 2, len(m.GetScaleSets()))
+
+	// Nothing is listed until the next discovery.
+	assert.NoError(t, provider.Refresh())
+	ssClient.AssertNumberOfCalls(t, "List", 1)
+
+	// The tags changed.
+	ssClient.On("List", "rg").Return(compute.VirtualMachineScaleSetListResult{
+		Value: &[]compute.VirtualMachineScaleSet{
+			newTestTaggedScaleSet("enabled", map[string]string{"cluster-autoscaler-enabled": "false"}),
+			newTestTaggedScaleSet("disabled", map[string]string{"cluster-autoscaler-enabled": "true", "max": "4"}),
+			newTestTaggedScaleSet("explicit", map[string]string{"cluster-autoscaler-enabled": "false"}),
+		},
+	}, nil).Once()
+	provider.lastAutoDiscovery = time.Time{}
+	assert.NoError(t, provider.Refresh())
+	nodeGroups = provider.NodeGroups()
+	if assert.Equal(t, 2, len(nodeGroups)) {
+		assert.Equal(t, "explicit", nodeGroups[0].Id())
+		assert.Equal(t, "disabled", nodeGroups[1].Id())
+		assert.Equal(t, 1, nodeGroups[1].MinSize())
+		assert.Equal(t, 4, nodeGroups[1].MaxSize())
+	}
+	scaleSets := m.GetScaleSets()
+	if assert.Equal(t, 2, len(scaleSets)) {
+		assert.Equal(t, "explicit", scaleSets[0].Name)
+		assert.Equal(t, "disabled", scaleSets[1].Name)
+	}
+
+	// Listing errors are returned.
+	ssClient.On("List", "rg").Return(compute.VirtualMachineScaleSetListResult{}, fmt.Errorf("list failed")).Once()
+	provider.lastAutoDiscovery = time.Time{}
+	assert.Error(t, provider.Refresh())
+	assert.Equal(t, 2, len(provider.NodeGroups()))
+}
+
+func TestAutoDiscoverScaleSetsInResourceGroups(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.discoveryResourceGroups = []string{"rg2"}
+	ssClient.On("Get", mock.Anything, mock.Anything).Return(newTestScaleSet("ss", 1), nil)
+	vmClient.On("List", mock.Anything, mock.Anything).Return(compute.VirtualMachineScaleSetVMListResult{}, nil)
+	tags := map[string]string{"cluster-autoscaler-enabled": "true"}
+	ssClient.On("List", "rg").Return(compute.VirtualMachineScaleSetListResult{
+		Value: &[]compute.VirtualMachineScaleSet{newTestTaggedScaleSet("pool", tags)},
+	}, nil)
+	ssClient.On("List", "rg2").Return(compute.VirtualMachineScaleSetListResult{
+		Value: &[]compute.VirtualMachineScaleSet{
+			newTestTaggedScaleSet("pool", tags),
+			newTestTaggedScaleSet("explicit", tags),
+		},
+	}, nil)
+
+	provider, err := BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupSpecs:              []string{"1:3:RG2/explicit"},
+		NodeGroupAutoDiscoverySpecs: []string{"label:cluster-autoscaler-enabled=true,min=1,max=10"},
+	}, nil)
+	assert.NoError(t, err)
+	ids := make([]string, 0)
+	for _, nodeGroup := range provider.NodeGroups() {
+		ids = append(ids, nodeGroup.Id())
+	}
+	// The scale sets with the same name in both resource groups are distinct
+	// node groups, the explicit one is not discovered again.
+	assert.Equal(t, []string{"RG2/explicit", "pool", "rg2/pool"}, ids)
+	ssClient.AssertCalled(t, "Get", "rg2", "pool")
+
+	// Nothing changes on the next discovery.
+	provider.lastAutoDiscovery = time.Time{}
+	assert.NoError(t, provider.Refresh())
+	assert.Equal(t, 3, len(provider.NodeGroups()))
+	assert.Equal(t, 3, len(m.GetScaleSets()))
+}
+
+func TestAutoDiscoveryInvalidSpecs(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	_, err := BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"asg:tag=foo"},
+	}, nil)
+	assert.Error(t, err)
+
+	m.vmType = vmTypeStandard
+	_, err = BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:foo=bar,max=10"},
+	}, nil)
+	assert.EqualError(t, err, "node group auto discovery is only supported for scale sets")
+}
+
+func TestUnregisterScaleSet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	ss2 := registerTestScaleSet(t, m, "1:5:ss2")
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("Get", "rg", "ss2").Return(newTestScaleSet("ss2", 1), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss2").Return(newTestVMListResult("ss2", 1), nil)
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 2, len(m.scaleSetCache))
+	m.provisioningTimes = make(map[string][]time.Duration)
+	for _, scaleSet := range []*ScaleSet{ss1, ss2} {
+		m.setScaleUp(scaleSet, 1, 2)
+		m.backOff(scaleSet, time.Minute, "test")
+		m.provisioningTimes[m.scaleSetKey(scaleSet)] = []time.Duration{time.Minute}
+	}
+
+	assert.True(t, m.UnregisterScaleSet(ss1))
+	assert.False(t, m.UnregisterScaleSet(ss1))
+	assert.Equal(t, []*ScaleSet{ss2}, m.GetScaleSets())
+	assert.Equal(t, 1, len(m.scaleSetCache))
+	assert.Equal(t, 1, len(m.instanceStateCache))
+	// Nothing is kept about the unregistered scale set.
+	assert.Equal(t, 1, len(m.scaleUps))
+	assert.Equal(t, 1, len(m.backoffs))
+	assert.Equal(t, 1, len(m.provisioningTimes))
+	assert.NoError(t, m.checkBackoff(ss1))
+
+	// A scale set registered again with other bounds keeps its state.
+	assert.True(t, m.unregisterScaleSet(ss2, false))
+	assert.Equal(t, 0, len(m.scaleSetCache))
+	assert.Equal(t, 1, len(m.scaleUps))
+	assert.Equal(t, 1, len(m.provisioningTimes))
+	assert.Error(t, m.checkBackoff(ss2))
+}
+
+func TestSpotScaleSetFallback(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.spotScaleSets = parseSpotScaleSets("spot")
+	m.spotFallbackScaleSets = map[string]string{"spot": "ondemand"}
+	ssClient.On("Get", "rg", "spot").Return(newTestScaleSet("spot", 0), nil)
+	ssClient.On("Get", "rg", "ondemand").Return(newTestScaleSet("ondemand", 0), nil)
+	provider := testProvider(t, m)
+	assert.NoError(t, provider.addNodeGroup("0:5:spot"))
+	assert.NoError(t, provider.addNodeGroup("0:5:ondemand"))
+	spot := provider.nodeGroups[0].(*ScaleSet)
+	ondemand := provider.nodeGroups[1].(*ScaleSet)
+	assert.Equal(t, ondemand, m.SpotFallback(spot))
+	assert.Nil(t, m.SpotFallback(ondemand))
+
+	// Azure fails to allocate the spot VMs.
+	ssClient.On("CreateOrUpdate", "rg", "spot", mock.Anything).Return(fmt.Errorf("Code=\"AllocationFailed\""))
+	ssClient.On("CreateOrUpdate", "rg", "ondemand", mock.Anything).Return(nil)
+	assert.NoError(t, spot.IncreaseSize(2))
+	m.resizes.Wait()
+	_, err := m.GetScaleSetSize(context.Background(), spot)
+	backoffErr, ok := err.(*ScaleSetBackedOffError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, "failed to allocate spot VMs", backoffErr.Reason)
+	}
+
+	// The on-demand scale set is scaled up instead.
+	assert.NoError(t, spot.IncreaseSize(2))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 2)
+	size, err := m.GetScaleSetSize(context.Background(), ondemand)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	m.resizes.Wait()
+
+	// Without fallback the backoff is returned.
+	m.spotFallbackScaleSets = nil
+	assert.Equal(t, backoffErr, spot.IncreaseSize(2))
+}
+
+func TestPinnedScaleSetAllocationBackoff(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	flexibleClient := &flexibleScaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.flexibleClient = flexibleClient
+	for _, name := range []string{"hosts", "ppg", "unpinned"} {
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, 0), nil)
+		vmClient.On("List", "rg", name).Return(newTestVMListResult(name, 0), nil)
+		ssClient.On("CreateOrUpdate", "rg", name, mock.Anything).Return(fmt.Errorf("Code=\"AllocationFailed\""))
+	}
+	flexibleClient.On("GetProperties", "rg", "hosts").Return(scaleSetProperties{orchestrationMode: orchestrationModeUniform, hostGroupID: "/hostGroups/hg"}, nil)
+	flexibleClient.On("GetProperties", "rg", "ppg").Return(scaleSetProperties{orchestrationMode: orchestrationModeUniform, proximityPlacementGroupID: "/proximityPlacementGroups/ppg"}, nil)
+	flexibleClient.On("GetProperties", "rg", "unpinned").Return(scaleSetProperties{orchestrationMode: orchestrationModeUniform}, nil)
+	provider := testProvider(t, m)
+	for _, name := range []string{"hosts", "ppg", "unpinned"} {
+		assert.NoError(t, provider.addNodeGroup("0:5:"+name))
+	}
+	assert.NoError(t, m.Refresh())
+
+	// The scale sets pinned to placement groups Azure failed to allocate VMs
+	// in are backed off, so that other node groups are scaled up.
+	for i, reason := range []string{"failed to allocate VMs in its dedicated host group", "failed to allocate VMs in its proximity placement group", ""} {
+		scaleSet := provider.nodeGroups[i].(*ScaleSet)
+		assert.NoError(t, scaleSet.IncreaseSize(2))
+		m.resizes.Wait()
+		err := scaleSet.IncreaseSize(2)
+		if reason == "" {
+			assert.NoError(t, err)
+			m.resizes.Wait()
+			continue
+		}
+		backoffErr, ok := err.(*ScaleSetBackedOffError)
+		if assert.True(t, ok, "unexpected error %v", err) {
+			assert.Equal(t, reason, backoffErr.Reason)
+		}
+	}
+}
+
+func TestRefreshFailureAbortsTimedOutScaleUps(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleUpTimeout = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+	failing := registerTestScaleSet(t, m, "1:5:ss2")
+	provider := testProvider(t, m)
+
+	for _, name := range []string{"ss1", "ss2"} {
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, 1), nil)
+		ssClient.On("CreateOrUpdate", "rg", name, mock.Anything).Return(nil)
+	}
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss2").Return(newTestVMListResult("ss2", 1), nil).Once()
+	assert.NoError(t, provider.Refresh())
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	m.resizes.Wait()
+
+	// The scale-up of ss1 timed out while ss2 can't be refreshed.
+	pending := m.scaleUps["rg/ss1"]
+	pending.requestedAt = time.Now().Add(-2 * time.Minute)
+	m.scaleUps["rg/ss1"] = pending
+	vmClient.On("List", "rg", "ss2").Return(compute.VirtualMachineScaleSetVMListResult{}, newTestDetailedError(http.StatusInternalServerError))
+	m.expireScaleSet(failing)
+	assert.Error(t, provider.Refresh())
+	assert.Empty(t, m.scaleUps)
+	_, backedOff := m.checkBackoff(scaleSet).(*ScaleSetBackedOffError)
+	assert.True(t, backedOff)
+}
+
+func TestSpotScaleSetTemplateLabel(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.spotScaleSets = parseSpotScaleSets("spot")
+	spot := registerTestScaleSet(t, m, "0:5:spot")
+	ondemand := registerTestScaleSet(t, m, "0:5:ondemand")
+
+	skuName := "Standard_D2_v2"
+	for _, name := range []string{"spot", "ondemand"} {
+		set := newTestScaleSet(name, 0)
+		set.Sku.Name = &skuName
+		ssClient.On("Get", "rg", name).Return(set, nil)
+	}
+	nodeInfo, err := spot.TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "spot", nodeInfo.Node().Labels["kubernetes.azure.com/scalesetpriority"])
+	nodeInfo, err = ondemand.TemplateNodeInfo()
+	assert.NoError(t, err)
+	_, found := nodeInfo.Node().Labels["kubernetes.azure.com/scalesetpriority"]
+	assert.False(t, found)
+}
+
+func TestNodeHasGPU(t *testing.T) {
+	provider := testProvider(t, newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{}))
+	newNode := func(labels map[string]string) *apiv1.Node {
+		return &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: labels}}
+	}
+
+	assert.True(t, provider.NodeHasGPU(newNode(map[string]string{azureGPULabel: "nvidia"})))
+	assert.True(t, provider.NodeHasGPU(newNode(map[string]string{kubeletapis.LabelInstanceType: "Standard_NC6"})))
+	assert.False(t, provider.NodeHasGPU(newNode(map[string]string{kubeletapis.LabelInstanceType: "Standard_D2_v2"})))
+	assert.False(t, provider.NodeHasGPU(newNode(nil)))
+
+	var _ cloudprovider.CloudProviderWithGPUNodes = provider
 }
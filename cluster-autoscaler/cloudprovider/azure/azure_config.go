@@ -0,0 +1,431 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/ghodss/yaml"
+	"gopkg.in/gcfg.v1"
+)
+
+// Types of the VMs of the node groups.
+const (
+	vmTypeVMSS     = "vmss"
+	vmTypeStandard = "standard"
+	vmTypeAKS      = "aks"
+)
+
+// What is done with the VMs of the removed nodes.
+const (
+	scaleDownModeDelete     = "delete"
+	scaleDownModeDeallocate = "deallocate"
+)
+
+// Config holds the configuration parsed from the --cloud-config flag
+type Config struct {
+	Cloud                      string `json:"cloud" yaml:"cloud"`
+	TenantID                   string `json:"tenantId" yaml:"tenantId"`
+	SubscriptionID             string `json:"subscriptionId" yaml:"subscriptionId"`
+	ResourceGroup              string `json:"resourceGroup" yaml:"resourceGroup"`
+	Location                   string `json:"location" yaml:"location"`
+	VnetName                   string `json:"vnetName" yaml:"vnetName"`
+	SubnetName                 string `json:"subnetName" yaml:"subnetName"`
+	SecurityGroupName          string `json:"securityGroupName" yaml:"securityGroupName"`
+	RouteTableName             string `json:"routeTableName" yaml:"routeTableName"`
+	PrimaryAvailabilitySetName string `json:"primaryAvailabilitySetName" yaml:"primaryAvailabilitySetName"`
+	// Type of the node groups: "vmss" for scale sets (the default),
+	// "standard" for availability sets or "aks" for AKS agent pools.
+	VMType string `json:"vmType" yaml:"vmType"`
+	// Name of the AKS cluster in ResourceGroup whose agent pools are the
+	// node groups, required if VMType is "aks".
+	AKSClusterName string `json:"aksClusterName" yaml:"aksClusterName"`
+
+	AADClientID     string `json:"aadClientId" yaml:"aadClientId"`
+	AADClientSecret string `json:"aadClientSecret" yaml:"aadClientSecret"`
+	AADTenantID     string `json:"aadTenantId" yaml:"aadTenantId"`
+	// URL of a Key Vault secret holding the client secret, used instead of
+	// AADClientSecret. It's read with the managed identity of the VM, the
+	// one of UserAssignedIdentityID if set.
+	AADClientSecretKeyVaultURI string `json:"aadClientSecretKeyVaultURI" yaml:"aadClientSecretKeyVaultURI"`
+	// Path to a PFX file with the client certificate, used instead of AADClientSecret.
+	AADClientCertPath     string `json:"aadClientCertPath" yaml:"aadClientCertPath"`
+	AADClientCertPassword string `json:"aadClientCertPassword" yaml:"aadClientCertPassword"`
+
+	// Endpoints overriding the ones of the cloud, e.g. for Azure Stack.
+	ResourceManagerEndpoint string `json:"resourceManagerEndpoint" yaml:"resourceManagerEndpoint"`
+	ActiveDirectoryEndpoint string `json:"activeDirectoryEndpoint" yaml:"activeDirectoryEndpoint"`
+	// Resource the access tokens are requested for, the audience of the
+	// Resource Manager of an Azure Stack.
+	ServiceManagementEndpoint string `json:"serviceManagementEndpoint" yaml:"serviceManagementEndpoint"`
+
+	// Proxy of the requests to Azure, overriding HTTPS_PROXY and HTTP_PROXY.
+	HTTPProxy string `json:"httpProxy" yaml:"httpProxy"`
+	// Path to a PEM bundle of CA certificates trusted in addition to the ones
+	// of the system, e.g. the one of a TLS intercepting proxy.
+	CACertFile string `json:"caCertFile" yaml:"caCertFile"`
+	// Minimum TLS version of the connections to Azure: "1.2" or "1.3".
+	TLSMinVersion string `json:"tlsMinVersion" yaml:"tlsMinVersion"`
+
+	// Use the managed identity of the VM instead of a service principal.
+	UseManagedIdentityExtension bool `json:"useManagedIdentityExtension" yaml:"useManagedIdentityExtension"`
+	// Client ID of the user-assigned identity to use. The system-assigned identity is used if empty.
+	UserAssignedIdentityID string `json:"userAssignedIdentityID" yaml:"userAssignedIdentityID"`
+
+	// Number of scale sets fetched concurrently when regenerating the cache.
+	CacheRegenerationConcurrency int `json:"cacheRegenerationConcurrency" yaml:"cacheRegenerationConcurrency"`
+	// Maximum number of instances deleted by a single call to Azure, 100 if not set.
+	MaxDeletionBatchSize int `json:"maxDeletionBatchSize" yaml:"maxDeletionBatchSize"`
+	// What is done with the VMs of the removed nodes of scale sets: "delete"
+	// (the default) or "deallocate", so that scale-ups start them again.
+	ScaleDownMode string `json:"scaleDownMode" yaml:"scaleDownMode"`
+	// Comma separated names of the scale sets of spot (low-priority) VMs.
+	SpotScaleSets string `json:"spotScaleSets" yaml:"spotScaleSets"`
+	// Time in seconds a spot scale set, or one pinned to a dedicated host
+	// group or a proximity placement group, is backed off for after Azure
+	// failed to allocate its VMs, 10 minutes if not set.
+	SpotAllocationBackoff int `json:"spotAllocationBackoff" yaml:"spotAllocationBackoff"`
+	// Comma separated <spot-scale-set>=<scale-set> pairs of the scale sets
+	// scaled up instead of backed off spot scale sets, e.g. on-demand ones.
+	SpotFallbackScaleSets string `json:"spotFallbackScaleSets" yaml:"spotFallbackScaleSets"`
+	// Comma separated resource groups searched for scale sets by the node
+	// group auto discovery, in addition to ResourceGroup. The resource groups
+	// of other subscriptions are prefixed by their subscription ID and a /.
+	DiscoveryResourceGroups string `json:"discoveryResourceGroups" yaml:"discoveryResourceGroups"`
+	// Comma separated <min>:<max>:[<resource-group>/]<scale-set-name> specs
+	// overriding the bounds of the node groups, reloaded with the credentials.
+	NodeGroupBounds string `json:"nodeGroupBounds" yaml:"nodeGroupBounds"`
+	// Comma separated <scale-set-name>=<vm-size> pairs overriding the VM sizes
+	// of the scale set models when building template nodes.
+	ScaleSetVMSizes string `json:"scaleSetVMSizes" yaml:"scaleSetVMSizes"`
+
+	// Minimum time in seconds between two full cache regenerations caused by
+	// unknown instances, 30 seconds if not set.
+	CacheMinRegenerationInterval int `json:"cacheMinRegenerationInterval" yaml:"cacheMinRegenerationInterval"`
+	// Time in seconds after which a cache which failed to be regenerated is
+	// reported unhealthy, 2 hours if not set.
+	CacheStalenessThreshold int `json:"cacheStalenessThreshold" yaml:"cacheStalenessThreshold"`
+	// Time in seconds after which a scale-up whose VMs didn't come up is
+	// reported as failed, 15 minutes if not set. It's shortened for the scale
+	// sets whose provisioning time is known, see GetMaxProvisioningTime.
+	ScaleUpTimeout int `json:"scaleUpTimeout" yaml:"scaleUpTimeout"`
+	// Time in seconds after which the instances of scale sets stuck in the
+	// Failed or Updating provisioning state are force-deleted, never if not set.
+	StuckInstanceTimeout int `json:"stuckInstanceTimeout" yaml:"stuckInstanceTimeout"`
+	// Maximum time in seconds DeleteNodes waits for the pods of the nodes to
+	// terminate before deleting their instances, not waited for if not set.
+	NodeDrainTimeout int `json:"nodeDrainTimeout" yaml:"nodeDrainTimeout"`
+	// Time in seconds the scale set sizes are cached for, 5 seconds if not set.
+	SizeCacheTTL int `json:"sizeCacheTTL" yaml:"sizeCacheTTL"`
+	// Time in seconds the instances of a scale set are cached for, 5 minutes
+	// if not set.
+	ScaleSetCacheTTL int `json:"scaleSetCacheTTL" yaml:"scaleSetCacheTTL"`
+
+	// Number of retries of failed read-only API calls.
+	CloudProviderBackoffRetries int `json:"cloudProviderBackoffRetries" yaml:"cloudProviderBackoffRetries"`
+	// Initial delay in seconds between retries, doubled after every retry.
+	CloudProviderBackoffDuration int `json:"cloudProviderBackoffDuration" yaml:"cloudProviderBackoffDuration"`
+	// Minimum time in seconds the calls to a scale set are suspended for once
+	// Azure throttled them, 5 minutes if not set. A longer Retry-After
+	// returned by Azure takes precedence.
+	CloudProviderThrottlingBackoff int `json:"cloudProviderThrottlingBackoff" yaml:"cloudProviderThrottlingBackoff"`
+	// Time in seconds after which an asynchronous operation, e.g. a resize or
+	// a deletion, is canceled, 15 minutes if not set.
+	CloudProviderOperationTimeout int `json:"cloudProviderOperationTimeout" yaml:"cloudProviderOperationTimeout"`
+	// Time in seconds after which a single request to Azure is canceled, 1
+	// minute if not set.
+	CloudProviderRequestTimeout int `json:"cloudProviderRequestTimeout" yaml:"cloudProviderRequestTimeout"`
+
+	// Enable the client side rate limiting of the API calls.
+	CloudProviderRateLimit bool `json:"cloudProviderRateLimit" yaml:"cloudProviderRateLimit"`
+	// Sustained rate of API calls per second, 1 if not set.
+	CloudProviderRateLimitQPS float32 `json:"cloudProviderRateLimitQPS" yaml:"cloudProviderRateLimitQPS"`
+	// Maximum burst of API calls, 5 if not set.
+	CloudProviderRateLimitBucket int `json:"cloudProviderRateLimitBucket" yaml:"cloudProviderRateLimitBucket"`
+}
+
+// applyEnvironmentFallback fills the fields not set in the cloud-config with
+// the values of the corresponding ARM_* environment variables.
+func applyEnvironmentFallback(cfg *Config) error {
+	for _, field := range []struct {
+		value *string
+		env   string
+	}{
+		{&cfg.Cloud, "ARM_CLOUD"},
+		{&cfg.ResourceManagerEndpoint, "ARM_RESOURCE_MANAGER_ENDPOINT"},
+		{&cfg.ActiveDirectoryEndpoint, "ARM_ACTIVE_DIRECTORY_ENDPOINT"},
+		{&cfg.ServiceManagementEndpoint, "ARM_SERVICE_MANAGEMENT_ENDPOINT"},
+		{&cfg.SubscriptionID, "ARM_SUBSCRIPTION_ID"},
+		{&cfg.ResourceGroup, "ARM_RESOURCE_GROUP"},
+		{&cfg.AADTenantID, "ARM_TENANT_ID"},
+		{&cfg.AADClientID, "ARM_CLIENT_ID"},
+		{&cfg.AADClientSecret, "ARM_CLIENT_SECRET"},
+		{&cfg.AADClientSecretKeyVaultURI, "ARM_CLIENT_SECRET_KEY_VAULT_URI"},
+		{&cfg.AADClientCertPath, "ARM_CLIENT_CERT_PATH"},
+		{&cfg.AADClientCertPassword, "ARM_CLIENT_CERT_PASSWORD"},
+		{&cfg.UserAssignedIdentityID, "ARM_USER_ASSIGNED_IDENTITY_ID"},
+		{&cfg.SpotScaleSets, "ARM_SPOT_SCALE_SETS"},
+		{&cfg.SpotFallbackScaleSets, "ARM_SPOT_FALLBACK_SCALE_SETS"},
+		{&cfg.ScaleSetVMSizes, "ARM_SCALE_SET_VM_SIZES"},
+		{&cfg.DiscoveryResourceGroups, "ARM_DISCOVERY_RESOURCE_GROUPS"},
+		{&cfg.VMType, "ARM_VM_TYPE"},
+		{&cfg.AKSClusterName, "ARM_AKS_CLUSTER_NAME"},
+		{&cfg.ScaleDownMode, "ARM_SCALE_DOWN_MODE"},
+	} {
+		if *field.value == "" {
+			*field.value = os.Getenv(field.env)
+		}
+	}
+	if msi := os.Getenv("ARM_USE_MANAGED_IDENTITY_EXTENSION"); msi != "" && !cfg.UseManagedIdentityExtension {
+		useMSI, err := strconv.ParseBool(msi)
+		if err != nil {
+			return fmt.Errorf("azure: failed to parse ARM_USE_MANAGED_IDENTITY_EXTENSION %q: %v", msi, err)
+		}
+		cfg.UseManagedIdentityExtension = useMSI
+	}
+	return nil
+}
+
+// validateConfig checks that all the fields required to talk to Azure are set.
+// All the missing fields are reported together.
+func validateConfig(cfg *Config) error {
+	var missing []string
+	if cfg.ResourceGroup == "" {
+		missing = append(missing, "resourceGroup not set in cloud-config or ARM_RESOURCE_GROUP")
+	}
+	if cfg.SubscriptionID == "" {
+		missing = append(missing, "subscriptionId not set in cloud-config or ARM_SUBSCRIPTION_ID")
+	}
+	if cfg.VMType != "" && cfg.VMType != vmTypeVMSS && cfg.VMType != vmTypeStandard && cfg.VMType != vmTypeAKS {
+		missing = append(missing, fmt.Sprintf("vmType must be %q, %q or %q, got %q", vmTypeVMSS, vmTypeStandard, vmTypeAKS, cfg.VMType))
+	}
+	if cfg.VMType == vmTypeAKS && cfg.AKSClusterName == "" {
+		missing = append(missing, "aksClusterName not set in cloud-config or ARM_AKS_CLUSTER_NAME")
+	}
+	if cfg.ScaleDownMode != "" && cfg.ScaleDownMode != scaleDownModeDelete && cfg.ScaleDownMode != scaleDownModeDeallocate {
+		missing = append(missing, fmt.Sprintf("scaleDownMode must be %q or %q, got %q", scaleDownModeDelete, scaleDownModeDeallocate, cfg.ScaleDownMode))
+	}
+	if cfg.CloudProviderRateLimitQPS < 0 || cfg.CloudProviderRateLimitBucket < 0 {
+		missing = append(missing, "cloudProviderRateLimitQPS and cloudProviderRateLimitBucket must not be negative")
+	}
+	if !cfg.UseManagedIdentityExtension {
+		if cfg.AADTenantID == "" {
+			missing = append(missing, "aadTenantId not set in cloud-config or ARM_TENANT_ID")
+		}
+		if cfg.AADClientID == "" {
+			missing = append(missing, "aadClientId not set in cloud-config or ARM_CLIENT_ID")
+		}
+		secrets := 0
+		for _, value := range []string{cfg.AADClientSecret, cfg.AADClientCertPath, cfg.AADClientSecretKeyVaultURI} {
+			if value != "" {
+				secrets++
+			}
+		}
+		if secrets == 0 {
+			missing = append(missing, "none of aadClientSecret, aadClientCertPath and aadClientSecretKeyVaultURI set in cloud-config or ARM_CLIENT_SECRET/ARM_CLIENT_CERT_PATH/ARM_CLIENT_SECRET_KEY_VAULT_URI")
+		}
+		if secrets > 1 {
+			missing = append(missing, "only one of aadClientSecret, aadClientCertPath and aadClientSecretKeyVaultURI can be set")
+		}
+		if cfg.AADClientSecretKeyVaultURI != "" {
+			if err := validateKeyVaultSecretURI(cfg.AADClientSecretKeyVaultURI); err != nil {
+				missing = append(missing, fmt.Sprintf("invalid aadClientSecretKeyVaultURI: %v", err))
+			}
+		}
+		// The identity would be silently ignored in favor of the service
+		// principal, unless it reads the client secret from Key Vault.
+		if cfg.UserAssignedIdentityID != "" && cfg.AADClientSecretKeyVaultURI == "" {
+			missing = append(missing, "userAssignedIdentityID requires useManagedIdentityExtension or aadClientSecretKeyVaultURI")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("azure: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// readConfig reads the cloud-config, falling back to the environment for the
+// settings it doesn't have, and validates it. configReader may be nil.
+func readConfig(configReader io.Reader) (Config, error) {
+	var cfg Config
+	if configReader != nil {
+		data, err := ioutil.ReadAll(configReader)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := parseConfig(data, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := applyEnvironmentFallback(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := validateConfig(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// parseConfig parses the cloud-config, either in the INI format of the other
+// cloud providers with its settings in the [global] section, or in the JSON or
+// YAML format of the azure.json file of the Azure cloud provider of the kubelet
+// and the controller manager, whose unknown settings are ignored.
+func parseConfig(data []byte, cfg *Config) error {
+	if !isINIConfig(data) {
+		return yaml.Unmarshal(data, cfg)
+	}
+	var file struct {
+		Global Config
+	}
+	if err := gcfg.ReadStringInto(&file, string(data)); err != nil {
+		return err
+	}
+	*cfg = file.Global
+	return nil
+}
+
+// isINIConfig returns true unless the first line of the cloud-config which
+// isn't blank or a comment is something else than a section header, e.g. the
+// opening brace of a JSON object.
+func isINIConfig(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		return line[0] == '['
+	}
+	return true
+}
+
+// parseSpotScaleSets returns the set of lowercase scale set names of the
+// comma separated list.
+func parseSpotScaleSets(names string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			result[strings.ToLower(name)] = true
+		}
+	}
+	return result
+}
+
+// parseDiscoveryResourceGroups returns the resource groups of the comma
+// separated list other than the one of the manager, without duplicates.
+func parseDiscoveryResourceGroups(names string, resourceGroup string) []string {
+	result := make([]string, 0)
+	seen := map[string]bool{strings.ToLower(resourceGroup): true}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		result = append(result, name)
+	}
+	return result
+}
+
+// parseSpotFallbackScaleSets returns the fallback scale set names of the comma
+// separated list of <spot-scale-set>=<scale-set> pairs, by lowercase spot
+// scale set name.
+func parseSpotFallbackScaleSets(fallbacks string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(fallbacks, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" || strings.TrimSpace(tokens[1]) == "" {
+			return nil, fmt.Errorf("wrong spot fallback scale set: %s, expected <spot-scale-set>=<scale-set>", pair)
+		}
+		result[strings.ToLower(strings.TrimSpace(tokens[0]))] = strings.TrimSpace(tokens[1])
+	}
+	return result, nil
+}
+
+// parseScaleSetVMSizes returns the VM sizes of the comma separated list of
+// <scale-set-name>=<vm-size> pairs, by lowercase scale set name.
+func parseScaleSetVMSizes(sizes string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(sizes, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" || strings.TrimSpace(tokens[1]) == "" {
+			return nil, fmt.Errorf("wrong scale set VM size: %s, expected <scale-set-name>=<vm-size>", pair)
+		}
+		result[strings.ToLower(strings.TrimSpace(tokens[0]))] = strings.TrimSpace(tokens[1])
+	}
+	return result, nil
+}
+
+// getAzureEnvironment returns the Azure environment with the given name,
+// defaulting to the public cloud if the name is empty.
+func getAzureEnvironment(cloud string) (azure.Environment, error) {
+	if cloud == "" {
+		return azure.PublicCloud, nil
+	}
+	env, err := azure.EnvironmentFromName(cloud)
+	if err != nil {
+		return env, fmt.Errorf("azure: unknown cloud %q: %v", cloud, err)
+	}
+	return env, nil
+}
+
+// overrideEndpoints replaces the endpoints of the environment with the ones
+// set in the config, if any.
+func overrideEndpoints(cfg *Config, env *azure.Environment) error {
+	if cfg.ResourceManagerEndpoint != "" {
+		if err := validateEndpoint(cfg.ResourceManagerEndpoint); err != nil {
+			return fmt.Errorf("azure: invalid resourceManagerEndpoint: %v", err)
+		}
+		env.ResourceManagerEndpoint = cfg.ResourceManagerEndpoint
+	}
+	if cfg.ActiveDirectoryEndpoint != "" {
+		if err := validateEndpoint(cfg.ActiveDirectoryEndpoint); err != nil {
+			return fmt.Errorf("azure: invalid activeDirectoryEndpoint: %v", err)
+		}
+		env.ActiveDirectoryEndpoint = cfg.ActiveDirectoryEndpoint
+	}
+	if cfg.ServiceManagementEndpoint != "" {
+		if err := validateEndpoint(cfg.ServiceManagementEndpoint); err != nil {
+			return fmt.Errorf("azure: invalid serviceManagementEndpoint: %v", err)
+		}
+		env.ServiceManagementEndpoint = cfg.ServiceManagementEndpoint
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	err := validateConfig(&Config{})
+	assert.Error(t, err)
+	for _, field := range []string{"resourceGroup", "subscriptionId", "aadTenantId", "aadClientId", "aadClientSecret"} {
+		assert.Contains(t, err.Error(), field)
+	}
+
+	err = validateConfig(&Config{
+		ResourceGroup:   "rg",
+		SubscriptionID:  "sub",
+		AADTenantID:     "tenant",
+		AADClientSecret: "secret",
+	})
+	assert.EqualError(t, err, "azure: aadClientId not set in cloud-config or ARM_CLIENT_ID")
+
+	err = validateConfig(&Config{
+		ResourceGroup:   "rg",
+		SubscriptionID:  "sub",
+		AADTenantID:     "tenant",
+		AADClientID:     "client",
+		AADClientSecret: "secret",
+	})
+	assert.NoError(t, err)
+
+	err = validateConfig(&Config{
+		ResourceGroup:     "rg",
+		SubscriptionID:    "sub",
+		AADTenantID:       "tenant",
+		AADClientID:       "client",
+		AADClientCertPath: "/etc/kubernetes/client.pfx",
+	})
+	assert.NoError(t, err)
+
+	err = validateConfig(&Config{
+		ResourceGroup:                "rg",
+		SubscriptionID:               "sub",
+		UseManagedIdentityExtension:  true,
+		CloudProviderRateLimit:       true,
+		CloudProviderRateLimitQPS:    -1,
+		CloudProviderRateLimitBucket: 5,
+	})
+	assert.EqualError(t, err, "azure: cloudProviderRateLimitQPS and cloudProviderRateLimitBucket must not be negative")
+
+	err = validateConfig(&Config{
+		ResourceGroup:     "rg",
+		SubscriptionID:    "sub",
+		AADTenantID:       "tenant",
+		AADClientID:       "client",
+		AADClientSecret:   "secret",
+		AADClientCertPath: "/etc/kubernetes/client.pfx",
+	})
+	assert.EqualError(t, err, "azure: only one of aadClientSecret, aadClientCertPath and aadClientSecretKeyVaultURI can be set")
+
+	err = validateConfig(&Config{
+		ResourceGroup:          "rg",
+		SubscriptionID:         "sub",
+		AADTenantID:            "tenant",
+		AADClientID:            "client",
+		AADClientSecret:        "secret",
+		UserAssignedIdentityID: "user-assigned-id",
+	})
+	assert.EqualError(t, err, "azure: userAssignedIdentityID requires useManagedIdentityExtension or aadClientSecretKeyVaultURI")
+
+	err = validateConfig(&Config{
+		ResourceGroup:               "rg",
+		SubscriptionID:              "sub",
+		UseManagedIdentityExtension: true,
+		VMType:                      vmTypeAKS,
+	})
+	assert.EqualError(t, err, "azure: aksClusterName not set in cloud-config or ARM_AKS_CLUSTER_NAME")
+
+	// The client secret is read from Key Vault with the user-assigned identity.
+	err = validateConfig(&Config{
+		ResourceGroup:              "rg",
+		SubscriptionID:             "sub",
+		AADTenantID:                "tenant",
+		AADClientID:                "client",
+		AADClientSecretKeyVaultURI: "https://vault.vault.azure.net/secrets/client-secret",
+		UserAssignedIdentityID:     "user-assigned-id",
+	})
+	assert.NoError(t, err)
+
+	err = validateConfig(&Config{
+		ResourceGroup:              "rg",
+		SubscriptionID:             "sub",
+		AADTenantID:                "tenant",
+		AADClientID:                "client",
+		AADClientSecretKeyVaultURI: "https://vault.vault.azure.net/keys/client-secret",
+	})
+	assert.EqualError(t, err, `azure: invalid aadClientSecretKeyVaultURI: "https://vault.vault.azure.net/keys/client-secret" is not the URL of a Key Vault secret`)
+}
+
+func TestParseConfig(t *testing.T) {
+	expected := Config{
+		SubscriptionID:              "sub",
+		ResourceGroup:               "rg",
+		UseManagedIdentityExtension: true,
+		CloudProviderRateLimitQPS:   1.5,
+	}
+	for name, data := range map[string]string{
+		"ini": `; the cloud-config of the autoscaler
+[global]
+subscriptionId = sub
+resourceGroup = rg
+useManagedIdentityExtension = true
+cloudProviderRateLimitQPS = 1.5
+`,
+		// the azure.json file of the kubelet, with settings unknown to the autoscaler
+		"json": `{
+	"subscriptionId": "sub",
+	"resourceGroup": "rg",
+	"useManagedIdentityExtension": true,
+	"cloudProviderRateLimitQPS": 1.5,
+	"cloudProviderBackoff": true,
+	"useInstanceMetadata": true
+}`,
+		"yaml": `# the cloud-config of the autoscaler
+subscriptionId: sub
+resourceGroup: rg
+useManagedIdentityExtension: true
+cloudProviderRateLimitQPS: 1.5
+`,
+	} {
+		var cfg Config
+		assert.NoError(t, parseConfig([]byte(data), &cfg), name)
+		assert.Equal(t, expected, cfg, name)
+	}
+
+	var cfg Config
+	assert.NoError(t, parseConfig(nil, &cfg))
+	assert.Equal(t, Config{}, cfg)
+	assert.Error(t, parseConfig([]byte(`{"subscriptionId": "sub",`), &cfg))
+	assert.Error(t, parseConfig([]byte("[global]\nunknownSetting = 1\n"), &cfg))
+}
+
+func TestApplyEnvironmentFallback(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_CLIENT_SECRET", "ARM_USE_MANAGED_IDENTITY_EXTENSION"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	os.Setenv("ARM_RESOURCE_GROUP", "env-rg")
+	os.Setenv("ARM_CLIENT_SECRET", "env-secret")
+
+	// Fields set in the cloud-config take precedence over the environment.
+	cfg := &Config{
+		SubscriptionID: "sub",
+		ResourceGroup:  "rg",
+		AADTenantID:    "tenant",
+		AADClientID:    "client",
+	}
+	assert.NoError(t, applyEnvironmentFallback(cfg))
+	assert.Equal(t, "rg", cfg.ResourceGroup)
+	assert.Equal(t, "sub", cfg.SubscriptionID)
+	assert.Equal(t, "env-secret", cfg.AADClientSecret)
+	assert.NoError(t, validateConfig(cfg))
+
+	os.Setenv("ARM_USE_MANAGED_IDENTITY_EXTENSION", "not-a-bool")
+	assert.Error(t, applyEnvironmentFallback(&Config{}))
+	assert.NoError(t, applyEnvironmentFallback(&Config{UseManagedIdentityExtension: true}))
+}
+
+func TestOverrideEndpoints(t *testing.T) {
+	env := azure.PublicCloud
+	assert.NoError(t, overrideEndpoints(&Config{}, &env))
+	assert.Equal(t, azure.PublicCloud, env)
+
+	cfg := &Config{
+		AADTenantID:             "tenant",
+		AADClientID:             "client",
+		AADClientSecret:         "secret",
+		ResourceManagerEndpoint: "https://management.local.azurestack.external/",
+		ActiveDirectoryEndpoint: "https://adfs.local.azurestack.external/",
+	}
+	assert.NoError(t, overrideEndpoints(cfg, &env))
+	assert.Equal(t, "https://management.local.azurestack.external/", env.ResourceManagerEndpoint)
+	assert.Equal(t, "https://adfs.local.azurestack.external/", env.ActiveDirectoryEndpoint)
+	assert.Equal(t, azure.PublicCloud.ServiceManagementEndpoint, env.ServiceManagementEndpoint)
+
+	spt, err := newServicePrincipalToken(cfg, &env, defaultLogger)
+	assert.NoError(t, err)
+	req := captureTokenRequest(t, spt)
+	assert.Equal(t, "adfs.local.azurestack.external", req.URL.Host)
+
+	// The tokens are requested for the audience of the Azure Stack.
+	cfg.ServiceManagementEndpoint = "https://management.adfs.azurestack.local/1234"
+	assert.NoError(t, overrideEndpoints(cfg, &env))
+	spt, err = newServicePrincipalToken(cfg, &env, defaultLogger)
+	assert.NoError(t, err)
+	req = captureTokenRequest(t, spt)
+	assert.Equal(t, "https://management.adfs.azurestack.local/1234", req.PostForm.Get("resource"))
+
+	env = azure.PublicCloud
+	err = overrideEndpoints(&Config{ResourceManagerEndpoint: "management.local"}, &env)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "resourceManagerEndpoint")
+	err = overrideEndpoints(&Config{ActiveDirectoryEndpoint: "://adfs"}, &env)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "activeDirectoryEndpoint")
+	err = overrideEndpoints(&Config{ServiceManagementEndpoint: "management"}, &env)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "serviceManagementEndpoint")
+	assert.Equal(t, azure.PublicCloud, env)
+}
+
+func TestGetAzureEnvironment(t *testing.T) {
+	env, err := getAzureEnvironment("")
+	assert.NoError(t, err)
+	assert.Equal(t, azure.PublicCloud.Name, env.Name)
+
+	env, err = getAzureEnvironment("AzureChinaCloud")
+	assert.NoError(t, err)
+	assert.Equal(t, azure.ChinaCloud.Name, env.Name)
+
+	_, err = getAzureEnvironment("AzureMoonCloud")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown cloud "AzureMoonCloud"`)
+}
+
+func TestValidateScaleDownMode(t *testing.T) {
+	cfg := &Config{SubscriptionID: "sub", ResourceGroup: "rg", UseManagedIdentityExtension: true}
+	for _, mode := range []string{"", scaleDownModeDelete, scaleDownModeDeallocate} {
+		cfg.ScaleDownMode = mode
+		assert.NoError(t, validateConfig(cfg), mode)
+	}
+	cfg.ScaleDownMode = "stop"
+	assert.EqualError(t, validateConfig(cfg), `azure: scaleDownMode must be "delete" or "deallocate", got "stop"`)
+}
+
+func TestParseDiscoveryResourceGroups(t *testing.T) {
+	assert.Equal(t, []string{}, parseDiscoveryResourceGroups("", "rg"))
+	assert.Equal(t, []string{"rg2", "rg3"}, parseDiscoveryResourceGroups(" rg2, RG,rg3,Rg2,", "rg"))
+}
+
+func TestParseSpotFallbackScaleSets(t *testing.T) {
+	fallbacks, err := parseSpotFallbackScaleSets("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, fallbacks)
+
+	fallbacks, err = parseSpotFallbackScaleSets("Spot1=ondemand1, spot2 = OnDemand2,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"spot1": "ondemand1", "spot2": "OnDemand2"}, fallbacks)
+
+	_, err = parseSpotFallbackScaleSets("spot1")
+	assert.Error(t, err)
+}
+
+func TestParseScaleSetVMSizes(t *testing.T) {
+	sizes, err := parseScaleSetVMSizes("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, sizes)
+
+	sizes, err = parseScaleSetVMSizes("SS1=Standard_D2_v2, ss2 = Standard_NC6,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"ss1": "Standard_D2_v2", "ss2": "Standard_NC6"}, sizes)
+
+	_, err = parseScaleSetVMSizes("ss1")
+	assert.Error(t, err)
+	_, err = parseScaleSetVMSizes("ss1=")
+	assert.Error(t, err)
+}
+
+func TestParseSpotScaleSets(t *testing.T) {
+	assert.Equal(t, map[string]bool{}, parseSpotScaleSets(""))
+	assert.Equal(t, map[string]bool{"ss1": true, "ss2": true}, parseSpotScaleSets("SS1, ss2,"))
+}
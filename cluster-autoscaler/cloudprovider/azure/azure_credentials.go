@@ -0,0 +1,296 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"golang.org/x/crypto/pkcs12"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// credentialsReloadInterval is how often the cloud-config is read again to
+// pick up rotated credentials and new node group bounds.
+const credentialsReloadInterval = time.Minute
+
+// aadCredentials are the fields of the config the access tokens are issued
+// for, with the content of the client certificate so that a certificate
+// replaced at the same path is picked up too.
+type aadCredentials struct {
+	tenantID                    string
+	clientID                    string
+	clientSecret                string
+	clientCertPath              string
+	clientCertPassword          string
+	clientCert                  string
+	useManagedIdentityExtension bool
+	userAssignedIdentityID      string
+}
+
+// getAADCredentials returns the credentials of the config.
+func getAADCredentials(cfg *Config) (aadCredentials, error) {
+	credentials := aadCredentials{
+		tenantID:                    cfg.AADTenantID,
+		clientID:                    cfg.AADClientID,
+		clientSecret:                cfg.AADClientSecret,
+		clientCertPath:              cfg.AADClientCertPath,
+		clientCertPassword:          cfg.AADClientCertPassword,
+		useManagedIdentityExtension: cfg.UseManagedIdentityExtension,
+		userAssignedIdentityID:      cfg.UserAssignedIdentityID,
+	}
+	if cfg.AADClientCertPath != "" && !cfg.UseManagedIdentityExtension {
+		pfx, err := ioutil.ReadFile(cfg.AADClientCertPath)
+		if err != nil {
+			return aadCredentials{}, fmt.Errorf("azure: failed to read client certificate %s: %v", cfg.AADClientCertPath, err)
+		}
+		credentials.clientCert = string(pfx)
+	}
+	return credentials, nil
+}
+
+// reloadableTokenProvider is the token provider of the authorizers of all the
+// Azure clients, it switches to a new service principal token when the
+// credentials of the cloud-config change.
+type reloadableTokenProvider struct {
+	env azure.Environment
+	// sender sends the token requests of the service principals, nil for the
+	// default one
+	sender *http.Client
+	logger Logger
+
+	mutex       sync.Mutex
+	credentials aadCredentials
+	token       *adal.ServicePrincipalToken
+	// keyVaultSecret is the client secret last read from Key Vault
+	keyVaultSecret keyVaultSecret
+}
+
+// newReloadableTokenProvider creates a token provider for the credentials of
+// the config, whose token requests are sent with sender if it's not nil.
+func newReloadableTokenProvider(cfg *Config, env azure.Environment, sender *http.Client, logger Logger) (*reloadableTokenProvider, error) {
+	p := &reloadableTokenProvider{env: env, sender: sender, logger: logger}
+	if _, err := p.update(cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// update creates a new service principal token if the credentials of the
+// config differ from the current ones, and returns whether it did. The current
+// token is kept if the new one can't be created. A client secret referenced in
+// Key Vault is read first, see clientSecretFromKeyVault.
+func (p *reloadableTokenProvider) update(cfg *Config) (bool, error) {
+	if cfg.AADClientSecretKeyVaultURI != "" && !cfg.UseManagedIdentityExtension {
+		secret, err := p.clientSecretFromKeyVault(cfg)
+		if err != nil {
+			return false, err
+		}
+		withSecret := *cfg
+		withSecret.AADClientSecret = secret
+		cfg = &withSecret
+	}
+	credentials, err := getAADCredentials(cfg)
+	if err != nil {
+		return false, err
+	}
+	p.mutex.Lock()
+	unchanged := p.token != nil && credentials == p.credentials
+	p.mutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	token, err := newServicePrincipalToken(cfg, &p.env, p.logger)
+	if err != nil {
+		return false, fmt.Errorf("azure: failed to create service principal token: %v", err)
+	}
+	// The managed identity endpoint is local to the VM, never behind a proxy.
+	if p.sender != nil && !cfg.UseManagedIdentityExtension {
+		token.SetSender(p.sender)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.credentials = credentials
+	p.token = token
+	return true, nil
+}
+
+// current returns the current service principal token.
+func (p *reloadableTokenProvider) current() *adal.ServicePrincipalToken {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.token
+}
+
+// OAuthToken implements adal.OAuthTokenProvider.
+func (p *reloadableTokenProvider) OAuthToken() string {
+	return p.current().OAuthToken()
+}
+
+// Refresh implements adal.Refresher.
+func (p *reloadableTokenProvider) Refresh() error {
+	return p.current().Refresh()
+}
+
+// RefreshExchange implements adal.Refresher.
+func (p *reloadableTokenProvider) RefreshExchange(resource string) error {
+	return p.current().RefreshExchange(resource)
+}
+
+// EnsureFresh implements adal.Refresher.
+func (p *reloadableTokenProvider) EnsureFresh() error {
+	return p.current().EnsureFresh()
+}
+
+// reloadCloudConfig reads the cloud-config returned by readCloudConfig,
+// switches to its credentials if they changed and applies its node group
+// bounds. The other settings need a restart.
+func (m *AzureManager) reloadCloudConfig(readCloudConfig func() ([]byte, error)) error {
+	config, err := readCloudConfig()
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfig(bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+	updated, err := m.tokenProvider.update(&cfg)
+	if err != nil {
+		return err
+	}
+	if updated {
+		m.log().Infof("Reloaded the Azure credentials of the cloud-config")
+	}
+	bounds, err := m.parseNodeGroupBounds(cfg.NodeGroupBounds)
+	if err != nil {
+		return err
+	}
+	m.setBoundsOverrides(bounds)
+	return nil
+}
+
+// watchCloudConfig reloads the cloud-config returned by readCloudConfig until
+// Cleanup is called.
+func (m *AzureManager) watchCloudConfig(readCloudConfig func() ([]byte, error)) {
+	go wait.Until(func() {
+		if err := m.reloadCloudConfig(readCloudConfig); err != nil {
+			m.log().Errorf("Failed to reload the Azure cloud-config: %v", err)
+		}
+	}, credentialsReloadInterval, m.ctx.Done())
+}
+
+// getMSIEndpoint returns the endpoint of the MSI extension, it's a variable for testing.
+var getMSIEndpoint = adal.GetMSIVMEndpoint
+
+// newServicePrincipalToken creates a ServicePrincipalToken using either the
+// managed identity of the VM or the service principal credentials from config.
+func newServicePrincipalToken(cfg *Config, env *azure.Environment, logger Logger) (*adal.ServicePrincipalToken, error) {
+	if cfg.UseManagedIdentityExtension {
+		logger.V(2).Infof("Using managed identity extension to retrieve access token")
+		if cfg.AADClientSecret != "" || cfg.AADClientCertPath != "" || cfg.AADClientSecretKeyVaultURI != "" {
+			// A secret left mounted would give a false sense of which identity is used.
+			logger.Warningf("Ignoring the service principal credentials, the managed identity is used instead")
+		}
+		return newServicePrincipalTokenFromMSI(cfg.UserAssignedIdentityID, env.ServiceManagementEndpoint)
+	}
+	if cfg.AADClientCertPath != "" {
+		logger.V(2).Infof("Using client certificate %s to retrieve access token", cfg.AADClientCertPath)
+		return newServicePrincipalTokenFromCertificate(cfg.AADTenantID, cfg.AADClientID, cfg.AADClientCertPath, cfg.AADClientCertPassword, env, logger)
+	}
+	return NewServicePrincipalTokenFromCredentials(cfg.AADTenantID, cfg.AADClientID, cfg.AADClientSecret, env)
+}
+
+// newServicePrincipalTokenFromMSI creates a ServicePrincipalToken using the MSI extension.
+// If userAssignedIdentityID is empty the system-assigned identity is used.
+func newServicePrincipalTokenFromMSI(userAssignedIdentityID string, scope string) (*adal.ServicePrincipalToken, error) {
+	msiEndpoint, err := getMSIEndpoint()
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to get the managed identity endpoint: %v", err)
+	}
+	if userAssignedIdentityID == "" {
+		return adal.NewServicePrincipalTokenFromMSI(msiEndpoint, scope)
+	}
+
+	// The MSI extension picks the user-assigned identity by the client_id sent with the token request.
+	oauthConfig, err := adal.NewOAuthConfig(msiEndpoint, "")
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to create OAuth config for managed identity: %v", err)
+	}
+	return adal.NewServicePrincipalTokenWithSecret(*oauthConfig, userAssignedIdentityID, scope, &adal.ServicePrincipalMSISecret{})
+}
+
+// NewServicePrincipalTokenFromCredentials creates a new ServicePrincipalToken using values of the
+// passed credentials map. The token is issued by the active directory of the given environment
+// for its service management endpoint.
+func NewServicePrincipalTokenFromCredentials(tenantID string, clientID string, clientSecret string, env *azure.Environment) (*adal.ServicePrincipalToken, error) {
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to create OAuth config for tenant %q: %v", tenantID, err)
+	}
+	return adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, env.ServiceManagementEndpoint)
+}
+
+// newServicePrincipalTokenFromCertificate creates a token authenticated with
+// the client certificate stored in the PFX file at certPath.
+func newServicePrincipalTokenFromCertificate(tenantID, clientID, certPath, certPassword string, env *azure.Environment, logger Logger) (*adal.ServicePrincipalToken, error) {
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to create OAuth config for tenant %q: %v", tenantID, err)
+	}
+	pfx, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to read client certificate %s: %v", certPath, err)
+	}
+	certificate, privateKey, err := decodePkcs12(pfx, certPassword)
+	if err != nil {
+		return nil, fmt.Errorf("azure: failed to decode client certificate %s: %v", certPath, err)
+	}
+	checkCertificateExpiry(logger, certPath, certificate, time.Now())
+	return adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, clientID, certificate, privateKey, env.ServiceManagementEndpoint)
+}
+
+// checkCertificateExpiry warns when the client certificate expired or is about
+// to, since AAD then rejects the token requests.
+func checkCertificateExpiry(logger Logger, certPath string, certificate *x509.Certificate, now time.Time) {
+	if now.After(certificate.NotAfter) {
+		logger.Errorf("Client certificate %s expired on %v", certPath, certificate.NotAfter)
+	} else if now.Add(certificateExpiryWarning).After(certificate.NotAfter) {
+		logger.Warningf("Client certificate %s expires on %v", certPath, certificate.NotAfter)
+	}
+}
+
+// decodePkcs12 decodes a PKCS#12 client certificate, the private key must be RSA.
+func decodePkcs12(pfx []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	privateKey, certificate, err := pkcs12.Decode(pfx, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsaPrivateKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("PKCS#12 certificate must contain an RSA private key")
+	}
+	return certificate, rsaPrivateKey, nil
+}
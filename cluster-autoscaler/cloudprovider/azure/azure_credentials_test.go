@@ -0,0 +1,320 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testCloudConfig = `[global]
+subscriptionId = sub
+resourceGroup = rg
+aadTenantId = tenant
+aadClientId = client
+aadClientSecret = %s
+`
+
+func testCloudConfigWithSecret(secret string) []byte {
+	return []byte(fmt.Sprintf(testCloudConfig, secret))
+}
+
+func TestReloadableTokenProviderUpdate(t *testing.T) {
+	env := azure.PublicCloud
+	cfg := Config{AADTenantID: "tenant", AADClientID: "client", AADClientSecret: "secret"}
+	p, err := newReloadableTokenProvider(&cfg, env, nil, defaultLogger)
+	assert.NoError(t, err)
+	token := p.current()
+
+	// Same credentials, the token is kept.
+	updated, err := p.update(&cfg)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+	assert.True(t, token == p.current())
+
+	cfg.AADClientSecret = "rotated"
+	updated, err = p.update(&cfg)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.False(t, token == p.current())
+
+	// The current token is kept if the new credentials are unusable.
+	token = p.current()
+	cfg.AADClientSecret = ""
+	cfg.AADClientCertPath = "/nonexistent/client-cert.pfx"
+	_, err = p.update(&cfg)
+	assert.Error(t, err)
+	assert.True(t, token == p.current())
+}
+
+func TestReloadCredentialsFromSecret(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "azure-cloud-config"},
+		Data: map[string][]byte{
+			cloudConfigSecretKey: testCloudConfigWithSecret("secret"),
+		},
+	}
+	client := fake.NewSimpleClientset(secret)
+	m, err := CreateAzureManagerFromSecret(client, "kube-system", "azure-cloud-config")
+	assert.NoError(t, err)
+	defer m.Cleanup()
+	token := m.tokenProvider.current()
+
+	readSecret := func() ([]byte, error) {
+		s, err := client.CoreV1().Secrets("kube-system").Get("azure-cloud-config", metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return s.Data[cloudConfigSecretKey], nil
+	}
+	assert.NoError(t, m.reloadCloudConfig(readSecret))
+	assert.True(t, token == m.tokenProvider.current())
+
+	secret.Data[cloudConfigSecretKey] = testCloudConfigWithSecret("rotated")
+	_, err = client.CoreV1().Secrets("kube-system").Update(secret)
+	assert.NoError(t, err)
+	assert.NoError(t, m.reloadCloudConfig(readSecret))
+	assert.False(t, token == m.tokenProvider.current())
+	token = m.tokenProvider.current()
+
+	// An invalid cloud-config doesn't replace the credentials.
+	secret.Data[cloudConfigSecretKey] = []byte("[global]\nsubscriptionId = sub\n")
+	_, err = client.CoreV1().Secrets("kube-system").Update(secret)
+	assert.NoError(t, err)
+	assert.Error(t, m.reloadCloudConfig(readSecret))
+	assert.True(t, token == m.tokenProvider.current())
+}
+
+func TestCreateAzureManagerFromFile(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	f, err := ioutil.TempFile("", "cloud-config")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(testCloudConfigWithSecret("secret"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	m, err := CreateAzureManagerFromFile(f.Name())
+	assert.NoError(t, err)
+	defer m.Cleanup()
+	assert.Equal(t, "sub", m.subscription)
+	token := m.tokenProvider.current()
+
+	rotated := testCloudConfigWithSecret("rotated")
+	assert.NoError(t, ioutil.WriteFile(f.Name(), rotated, 0600))
+	assert.NoError(t, m.reloadCloudConfig(func() ([]byte, error) { return rotated, nil }))
+	assert.False(t, token == m.tokenProvider.current())
+
+	_, err = CreateAzureManagerFromFile("/nonexistent/cloud-config")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to read cloud-config /nonexistent/cloud-config")
+}
+
+// captureTokenRequest refreshes the token and returns the request sent to the token endpoint.
+func captureTokenRequest(t *testing.T, spt *adal.ServicePrincipalToken) *http.Request {
+	var captured *http.Request
+	spt.SetSender(autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		captured = r
+		return nil, fmt.Errorf("not sending requests in tests")
+	}))
+	assert.Error(t, spt.Refresh())
+	if assert.NotNil(t, captured) {
+		assert.NoError(t, captured.ParseForm())
+	}
+	return captured
+}
+
+func TestNewServicePrincipalTokenFromMSI(t *testing.T) {
+	defer func(f func() (string, error)) { getMSIEndpoint = f }(getMSIEndpoint)
+	getMSIEndpoint = func() (string, error) {
+		return "http://localhost:50342/oauth2/token", nil
+	}
+
+	cfg := &Config{
+		UseManagedIdentityExtension: true,
+	}
+	assert.NoError(t, validateConfig(&Config{ResourceGroup: "rg", SubscriptionID: "sub", UseManagedIdentityExtension: true}))
+
+	spt, err := newServicePrincipalToken(cfg, &azure.PublicCloud, defaultLogger)
+	assert.NoError(t, err)
+	req := captureTokenRequest(t, spt)
+	assert.Equal(t, "localhost:50342", req.URL.Host)
+	assert.Equal(t, "true", req.Header.Get("Metadata"))
+	assert.Equal(t, "", req.PostForm.Get("client_id"))
+
+	cfg.UserAssignedIdentityID = "user-assigned-id"
+	spt, err = newServicePrincipalToken(cfg, &azure.PublicCloud, defaultLogger)
+	assert.NoError(t, err)
+	req = captureTokenRequest(t, spt)
+	assert.Equal(t, "localhost:50342", req.URL.Host)
+	assert.Equal(t, "true", req.Header.Get("Metadata"))
+	assert.Equal(t, "user-assigned-id", req.PostForm.Get("client_id"))
+
+	// Service principal credentials are ignored.
+	logger := &fakeLogger{}
+	cfg.AADClientSecret = "secret"
+	spt, err = newServicePrincipalToken(cfg, &azure.PublicCloud, logger)
+	assert.NoError(t, err)
+	req = captureTokenRequest(t, spt)
+	assert.Equal(t, "localhost:50342", req.URL.Host)
+	assert.Equal(t, "", req.PostForm.Get("client_secret"))
+	assert.True(t, logger.contains("W: Ignoring the service principal credentials"))
+
+	getMSIEndpoint = func() (string, error) {
+		return "", fmt.Errorf("no MSI extension")
+	}
+	_, err = newServicePrincipalToken(cfg, &azure.PublicCloud, defaultLogger)
+	assert.Error(t, err)
+}
+
+func TestNewServicePrincipalTokenFromCredentials(t *testing.T) {
+	spt, err := newServicePrincipalToken(&Config{
+		AADTenantID:     "tenant",
+		AADClientID:     "client",
+		AADClientSecret: "secret",
+	}, &azure.PublicCloud, defaultLogger)
+	assert.NoError(t, err)
+	req := captureTokenRequest(t, spt)
+	assert.Equal(t, "login.microsoftonline.com", req.URL.Host)
+	assert.Equal(t, "", req.Header.Get("Metadata"))
+	assert.Equal(t, "client", req.PostForm.Get("client_id"))
+	assert.Equal(t, "secret", req.PostForm.Get("client_secret"))
+}
+
+// testClientCertificate is a self-signed certificate with a 1024 bit RSA key,
+// stored as base64 encoded PKCS#12 protected with the password "test".
+const testClientCertificate = "" +
+	"MIIGGQIBAzCCBd8GCSqGSIb3DQEHAaCCBdAEggXMMIIFyDCCAscGCSqGSIb3DQEHBqCCArgwggK0" +
+	"AgEAMIICrQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQIXv8ap1Cm9AcCAggAgIICgLDFYxsn" +
+	"R5O+X6d2DJmp3Onpk4owOrelbcswdh94Oze/gpN/ebN5hJxMM3GwknQpxnHDwkQqU11DkTt7WAur" +
+	"DPk0myf7Bn7sWd2DLD21FuP0I923Dy6aIWdGQXb7YI67hAG6FFty62VduaYgVbu1Bj7fnIMrYZTF" +
+	"u/uB+bPsNFwv3hWck4HfPJOB2WfFmY/B1YGmqe6JM2abWQ880722f9XR92vJldoFmhFgxj3R49OU" +
+	"aRTu9gtpLK8QbKcvL9lrmt42ZHPa8sh7Jd1MZ9a2Z+mE7XwSYOiJxOTx8ghriBGpfLGJJI16hr6J" +
+	"OUBQPqcha7zPoD3pHdn9rpq4jx27bJBZ4PikxksuldrTIdjGnNa69WZykB5OTe5aeEVs1Hj6OJPZ" +
+	"UYpFhkQpNZ7TEpoLsQqzSch+5FeG5Z23iD/M0e5BAjaVlOjWFPwCVyLZlfZiYyQ7ZZHDZR1P425h" +
+	"t25e5uVD8kczCM2cu6ZCGbPevUMXbS7R+tX5Iv8WDQA55Rhmrzqi2YVY3lQq9PFVOxcokHbk/uuX" +
+	"Zjc4GhxQcmVFXyyeuHP1T7a1GlEJ2BKip3GNbXkPBKN5fhWL0yh7+SsdPLsrSvQv02BSzeABnhiN" +
+	"hXR8r9mjL5ws+zocL2dq9VVMPze0iM7euIJXYXecLZ382uk61ul50yUi8SxgwIdpWvV/2jnamW+v" +
+	"1ntogXtyqZK+bt4I+j+QgJ6hlM5OgEjtd9CVHSyiMWV+mvRtVSKO0ta1StP0K/3D/vNZoH6+Q4H2" +
+	"2YPl/S8EG+e7LqpecruH5RuhpSoUZDKg+w7bHmxR87OxbgyCh3yzD+w3TIELZW7N2zCNPJkFjPwg" +
+	"iHAKJvhCIIAwggL5BgkqhkiG9w0BBwGgggLqBIIC5jCCAuIwggLeBgsqhkiG9w0BDAoBAqCCAqYw" +
+	"ggKiMBwGCiqGSIb3DQEMAQMwDgQI9gplyZd4zQoCAggABIICgHqnAlKyHheedtDPFIOheJStpqhL" +
+	"WN/XJ6GcKvqS6oc2dMY3m+77uokMxdfaE1QesH4uhzw5Zpik1VZjv7adfRnwBYqDcnoP50y/F5DY" +
+	"nYhESLGs+5oBGGtnBwGwmsal1Um88/TAj3GZBbDuGuLSLjNktYbsnPQynz00P8DSW030L/0iMD8A" +
+	"4zMuMgh7VolQ/5Pr43h/lHu5tFnzDP50WQWFBTlmIJ8vdXvKTh1t1Dqzl71m5ZjojLNtBTbmo5IJ" +
+	"vhkHf7A1CvloD8jKinrRQkwmklFPhGRUpr1dA+pPSPigG6ELPOJeKIanoEdn4D38/4KDacb744Q9" +
+	"NxSQqj6Bg8RYdc3hfnnwNUdYBDW7d+iVqPDFzEfX5LUfGbCdpihbStzyeUwnQe8q2cgaxmaghvoe" +
+	"pVMQMQAC+24F1T3GF5/1brDYoPAGlhpqpE1NjBlZgg5ODzX6kdbPbXospOZr7sGhMSkDY/c2uJix" +
+	"iNSIc0x0gY+KJEexfyHPdmQ3f6b/QLQignu+2A3BHQoMI6hos9ZLohm8i5o/M4vytwGYS+U3dNAT" +
+	"zVRBtKXZ9OvC3g0WvCG+marjazUxkgoQ7v53QnNrK3A9IynHJX7LNU8H1i2shx+8UvCQu7ZdLwHa" +
+	"5FSG+iuey9WjGqA9vpax9JcqkDQhjVjnvTVt7xkvlJcejOUbeBqAeq4nmZdtU4mNC0SJ7i4Aq8Bs" +
+	"uJoEsjVAYLK3rmTqZ/uBYpVMFdn2pYTA+qAlaa9NeY1Eb0KNElYFwJ5NeeUhV80z10ZuP8TaB65g" +
+	"cgyH1UWZi0HnN687s//Ux4pYx3Puiom+bLakxLiWEyukWhxPIKfAS7LdUCReCiGjLj8xJTAjBgkq" +
+	"hkiG9w0BCRUxFgQUTfd8OXvosPiZkjdmlZTRbtZbNCcwMTAhMAkGBSsOAwIaBQAEFP4mSagFbf/H" +
+	"ZyvpnFDKol2gyUqwBAjmAvb6jo7RJAICCAA="
+
+func TestNewServicePrincipalTokenFromCertificate(t *testing.T) {
+	pfx, err := base64.StdEncoding.DecodeString(testClientCertificate)
+	assert.NoError(t, err)
+	certificate, privateKey, err := decodePkcs12(pfx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster-autoscaler-test", certificate.Subject.CommonName)
+	assert.NotNil(t, privateKey)
+
+	_, _, err = decodePkcs12(pfx, "wrong")
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "client-cert")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(pfx)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	spt, err := newServicePrincipalToken(&Config{
+		AADTenantID:           "tenant",
+		AADClientID:           "client",
+		AADClientCertPath:     f.Name(),
+		AADClientCertPassword: "test",
+	}, &azure.PublicCloud, defaultLogger)
+	assert.NoError(t, err)
+	req := captureTokenRequest(t, spt)
+	assert.Equal(t, "login.microsoftonline.com", req.URL.Host)
+	assert.Equal(t, "client", req.PostForm.Get("client_id"))
+	assert.Equal(t, "", req.PostForm.Get("client_secret"))
+	assert.NotEmpty(t, req.PostForm.Get("client_assertion"))
+
+	_, err = newServicePrincipalToken(&Config{
+		AADTenantID:       "tenant",
+		AADClientID:       "client",
+		AADClientCertPath: f.Name() + ".missing",
+	}, &azure.PublicCloud, defaultLogger)
+	assert.Error(t, err)
+}
+
+func TestCheckCertificateExpiry(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		notAfter time.Time
+		message  string
+	}{
+		{now.Add(365 * 24 * time.Hour), ""},
+		{now.Add(7 * 24 * time.Hour), "W: Client certificate client.pfx expires on"},
+		{now.Add(-time.Hour), "E: Client certificate client.pfx expired on"},
+	} {
+		logger := &fakeLogger{}
+		checkCertificateExpiry(logger, "client.pfx", &x509.Certificate{NotAfter: tc.notAfter}, now)
+		if tc.message == "" {
+			assert.Empty(t, logger.messages)
+		} else {
+			assert.True(t, logger.contains(tc.message), "%v", logger.messages)
+		}
+	}
+}
+
+func TestNewServicePrincipalTokenSovereignCloud(t *testing.T) {
+	spt, err := newServicePrincipalToken(&Config{
+		AADTenantID:     "tenant",
+		AADClientID:     "client",
+		AADClientSecret: "secret",
+	}, &azure.ChinaCloud, defaultLogger)
+	assert.NoError(t, err)
+	req := captureTokenRequest(t, spt)
+	assert.Equal(t, "login.chinacloudapi.cn", req.URL.Host)
+	assert.Equal(t, azure.ChinaCloud.ServiceManagementEndpoint, req.PostForm.Get("resource"))
+}
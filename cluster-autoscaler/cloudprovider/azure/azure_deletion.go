@@ -0,0 +1,503 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// removal is a removal of instances of a scale set requested by a
+// DeleteInstances call.
+type removal struct {
+	instanceIds   []string
+	instancesByID map[string]*AzureRef
+	// nodes of the instances, recording the removal as events
+	nodes map[string]*apiv1.Node
+
+	// turn is closed when the caller is the one to issue the pending
+	// removals of the scale set, granted is then true.
+	turn    chan struct{}
+	granted bool
+	// done is closed once the removal was issued, with its result in failed
+	// and err.
+	done   chan struct{}
+	failed map[string]error
+	err    error
+}
+
+// removalQueue holds the removals of instances of a scale set requested while
+// another removal from the scale set is in progress. The core removes the
+// nodes one by one and concurrently, so they are merged into a single call
+// once the one in progress completes.
+type removalQueue struct {
+	inProgress bool
+	pending    []*removal
+}
+
+// queueRemoval removes the instances with the given IDs from the scale set
+// together with the other removals queued meanwhile, and returns the reasons
+// of the instances which weren't removed, keyed by instance name. The removal
+// is dropped if ctx is done before it is issued.
+func (m *AzureManager) queueRemoval(ctx context.Context, scaleSet *ScaleSet, instanceIds []string, instancesByID map[string]*AzureRef) (map[string]error, error) {
+	r := &removal{
+		instanceIds:   instanceIds,
+		instancesByID: instancesByID,
+		nodes:         nodesOf(ctx),
+		turn:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	key := m.scaleSetKey(scaleSet)
+
+	m.removalMutex.Lock()
+	if m.removalQueues == nil {
+		m.removalQueues = make(map[string]*removalQueue)
+	}
+	queue, found := m.removalQueues[key]
+	if !found {
+		queue = &removalQueue{}
+		m.removalQueues[key] = queue
+	}
+	queue.pending = append(queue.pending, r)
+	if !queue.inProgress {
+		queue.inProgress = true
+		r.grant()
+	}
+	m.removalMutex.Unlock()
+
+	select {
+	case <-r.turn:
+	case <-r.done:
+		return r.failed, r.err
+	case <-ctx.Done():
+		if m.dropRemoval(queue, r) {
+			return nil, ctx.Err()
+		}
+		// The removal was issued meanwhile, or it's its turn.
+		select {
+		case <-r.turn:
+		case <-r.done:
+			return r.failed, r.err
+		}
+	}
+
+	m.removalMutex.Lock()
+	removals := queue.pending
+	queue.pending = nil
+	m.removalMutex.Unlock()
+
+	m.issueRemovals(ctx, scaleSet, removals)
+
+	// The first removal queued meanwhile issues the next ones.
+	m.removalMutex.Lock()
+	if len(queue.pending) > 0 {
+		queue.pending[0].grant()
+	} else {
+		delete(m.removalQueues, key)
+	}
+	m.removalMutex.Unlock()
+	return r.failed, r.err
+}
+
+// grant gives the removal the turn to issue the pending removals. The removal
+// lock must be held.
+func (r *removal) grant() {
+	r.granted = true
+	close(r.turn)
+}
+
+// dropRemoval removes the removal from the queue and returns true, unless it
+// was issued or granted the turn meanwhile.
+func (m *AzureManager) dropRemoval(queue *removalQueue, r *removal) bool {
+	m.removalMutex.Lock()
+	defer m.removalMutex.Unlock()
+	if r.granted {
+		return false
+	}
+	for i, pending := range queue.pending {
+		if pending == r {
+			queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// issueRemovals removes the instances of all the given removals with a single
+// removal from the scale set, and sets the result of each of them.
+func (m *AzureManager) issueRemovals(ctx context.Context, scaleSet *ScaleSet, removals []*removal) {
+	instanceIds := make([]string, 0)
+	instancesByID := make(map[string]*AzureRef)
+	nodes := make(map[string]*apiv1.Node)
+	for _, r := range removals {
+		for name, node := range r.nodes {
+			nodes[name] = node
+		}
+		for _, id := range r.instanceIds {
+			// The same instance may be removed by several callers.
+			if _, found := instancesByID[id]; !found {
+				instanceIds = append(instanceIds, id)
+				instancesByID[id] = r.instancesByID[id]
+			}
+		}
+	}
+	if len(removals) > 1 {
+		m.log().V(2).Infof("Merged %d removals of %d instances of scale set %s", len(removals), len(instanceIds), scaleSet.Name)
+	}
+
+	ctx = context.WithValue(ctx, nodesContextKey{}, nodes)
+	failed, err := m.removeScaleSetInstances(ctx, scaleSet, instanceIds, instancesByID)
+	for _, r := range removals {
+		r.failed = make(map[string]error)
+		for _, id := range r.instanceIds {
+			// The instance of the caller may be another reference to the same VM.
+			if reason, found := failed[instancesByID[id].Name]; found {
+				r.failed[r.instancesByID[id].Name] = reason
+			}
+		}
+		r.err = err
+		close(r.done)
+	}
+}
+
+// DeleteInstancesError is returned by DeleteInstances when some of the
+// instances were not deleted. The other instances were deleted.
+type DeleteInstancesError struct {
+	// Failed maps the names of the instances which were not deleted to the reason.
+	Failed map[string]error
+}
+
+func (e *DeleteInstancesError) Error() string {
+	reasons := make([]string, 0, len(e.Failed))
+	for name, err := range e.Failed {
+		reasons = append(reasons, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("failed to delete %d instance(s): %s", len(e.Failed), strings.Join(reasons, "; "))
+}
+
+// DeleteInstances deletes the given instances. The instances of different
+// scale sets are deleted concurrently, and the deletions requested for a scale
+// set while instances of it are being deleted are merged into a single call,
+// see queueRemoval. The instances are deleted in batches of at most
+// maxDeletionBatchSize instances.
+// Instances which can't be deleted are skipped and reported in a *DeleteInstancesError.
+func (m *AzureManager) DeleteInstances(ctx context.Context, instances []*AzureRef) error {
+	if len(instances) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	failed := make(map[string]error)
+	scaleSets := make([]*ScaleSet, 0)
+	instancesByScaleSet := make(map[*ScaleSet][]*AzureRef)
+	for _, instance := range instances {
+		asg, err := m.GetScaleSetForInstance(instance)
+		if err != nil {
+			return err
+		}
+		if asg == nil {
+			if m.isEvictedSpotInstance(instance) {
+				m.log().V(2).Infof("Instance %s of a spot scale set was already evicted, skipping it", instance.Name)
+				continue
+			}
+			m.log().Warningf("Skipping deletion of instance %s which doesn't belong to any known Scale Set", instance.Name)
+			failed[instance.Name] = fmt.Errorf("doesn't belong to any known Scale Set")
+			continue
+		}
+		if _, found := instancesByScaleSet[asg]; !found {
+			scaleSets = append(scaleSets, asg)
+		}
+		instancesByScaleSet[asg] = append(instancesByScaleSet[asg], instance)
+	}
+
+	var resultMutex sync.Mutex
+	var firstErr error
+	workqueue.Parallelize(len(scaleSets), len(scaleSets), func(piece int) {
+		scaleSet := scaleSets[piece]
+		scaleSetFailed, err := m.removeInstances(ctx, scaleSet, instancesByScaleSet[scaleSet])
+
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		for name, err := range scaleSetFailed {
+			failed[name] = err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	if len(failed) > 0 {
+		return &DeleteInstancesError{Failed: failed}
+	}
+	return firstErr
+}
+
+// removeInstances deletes, or deallocates, the given instances of the scale
+// set and returns the reasons of the instances which weren't removed, keyed by
+// instance name. The error is set when the removal failed as a whole.
+func (m *AzureManager) removeInstances(ctx context.Context, scaleSet *ScaleSet, instances []*AzureRef) (map[string]error, error) {
+	failed := make(map[string]error)
+	instanceIds := make([]string, 0, len(instances))
+	instancesByID := make(map[string]*AzureRef)
+	for _, instance := range instances {
+		id, err := m.getInstanceID(instance)
+		if err == nil && id == "" {
+			err = fmt.Errorf("empty instance ID")
+		}
+		if err != nil {
+			m.log().Warningf("Skipping deletion of instance %s: %v", instance.Name, err)
+			failed[instance.Name] = err
+			continue
+		}
+		instanceIds = append(instanceIds, id)
+		instancesByID[id] = instance
+	}
+	// Protected instances are reported as failed, the other ones are still removed.
+	instanceIds, protected := m.filterProtectedInstances(scaleSet, instanceIds, instancesByID)
+	for name, err := range protected {
+		failed[name] = err
+	}
+	for id, instance := range instancesByID {
+		if _, found := protected[instance.Name]; found {
+			delete(instancesByID, id)
+		}
+	}
+	if len(instanceIds) == 0 {
+		return failed, nil
+	}
+
+	removalFailed, err := m.queueRemoval(ctx, scaleSet, instanceIds, instancesByID)
+	for name, err := range removalFailed {
+		failed[name] = err
+	}
+	return failed, err
+}
+
+// removeScaleSetInstances removes the instances with the given IDs from the
+// scale set, deallocating them in the deallocate scale-down mode unless the
+// scale set is flexible, and returns the reasons of the instances which
+// weren't removed, keyed by instance name.
+func (m *AzureManager) removeScaleSetInstances(ctx context.Context, scaleSet *ScaleSet, instanceIds []string, instancesByID map[string]*AzureRef) (map[string]error, error) {
+	if m.deallocateOnScaleDown && !m.isFlexible(scaleSet) {
+		return m.deallocateScaleSetInstances(ctx, scaleSet, instanceIds, instancesByID), nil
+	}
+
+	// Azure may recreate the deleted instances if the capacity of the scale
+	// set isn't decremented, it's checked once they are deleted.
+	capacity, err := m.getCapacity(scaleSet)
+	if err != nil {
+		m.log().Warningf("Failed to get the capacity of scale set %s, it won't be checked after the deletion: %v", scaleSet.Name, err)
+	}
+	failed := make(map[string]error)
+	deleted := 0
+	batchSize := m.maxDeletionBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMaxDeletionBatchSize
+	}
+	for start := 0; start < len(instanceIds); start += batchSize {
+		end := start + batchSize
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+		batch := instanceIds[start:end]
+		batchByID := make(map[string]*AzureRef, len(batch))
+		for _, id := range batch {
+			batchByID[id] = instancesByID[id]
+		}
+		batchFailed := m.deleteScaleSetInstances(ctx, scaleSet, batch, batchByID)
+		for name, err := range batchFailed {
+			failed[name] = err
+		}
+		deleted += len(batch) - len(batchFailed)
+	}
+
+	if capacity >= 0 && deleted > 0 {
+		if err := m.decrementCapacity(ctx, scaleSet, capacity-int64(deleted)); err != nil {
+			m.log().Errorf("Failed to decrement the capacity of scale set %s to %d: %v", scaleSet.Name, capacity-int64(deleted), err)
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// deleteScaleSetInstances deletes the instances with the given IDs from the
+// scale set and returns the reasons of the instances which failed to be
+// deleted, keyed by instance name.
+func (m *AzureManager) deleteScaleSetInstances(ctx context.Context, scaleSet *ScaleSet, instanceIds []string, instancesByID map[string]*AzureRef) map[string]error {
+	failed := make(map[string]error)
+	clients, err := m.clientsOf(scaleSet)
+	if err == nil {
+		err = m.checkBackoff(scaleSet)
+	}
+	if err != nil {
+		for _, instance := range instancesByID {
+			failed[instance.Name] = err
+		}
+		return failed
+	}
+	requiredIds := &compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &instanceIds,
+	}
+	m.log().Infof("Deleting instances %v of scale set %s", instanceIds, scaleSet.Name)
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	resultChan, errChan := clients.scaleSetClient.DeleteInstances(m.resourceGroup(scaleSet), scaleSet.Name, *requiredIds, opCtx.Done())
+	// Deleting instances decreases the capacity of the scale set.
+	defer m.invalidateCachedSize(scaleSet)
+	defer m.expireScaleSet(scaleSet)
+	err = waitForOperation(opCtx, errChan)
+	// The result is sent before the error.
+	var result compute.OperationStatusResponse
+	select {
+	case result = <-resultChan:
+	default:
+	}
+	id := operationID(result.Response)
+	if err != nil {
+		m.backOffIfThrottled(scaleSet, err)
+		for _, instance := range instancesByID {
+			failed[instance.Name] = err
+		}
+		m.recordInstanceEvents(ctx, scaleSet, instanceDeletion, id, instancesByID, failed)
+		return failed
+	}
+
+	// Azure may report instances it rejected as targets of the error details.
+	if result.Error != nil && result.Error.Details != nil {
+		for _, detail := range *result.Error.Details {
+			if detail.Target == nil {
+				continue
+			}
+			if instance, found := instancesByID[*detail.Target]; found {
+				failed[instance.Name] = fmt.Errorf("%s: %s", stringOrEmpty(detail.Code), stringOrEmpty(detail.Message))
+			}
+		}
+	}
+
+	deleted := make([]*AzureRef, 0, len(instancesByID))
+	for _, instance := range instancesByID {
+		if _, found := failed[instance.Name]; !found {
+			deleted = append(deleted, instance)
+		}
+	}
+	m.removeInstancesFromCache(deleted)
+	m.recordInstanceEvents(ctx, scaleSet, instanceDeletion, id, instancesByID, failed)
+	return failed
+}
+
+// deallocateScaleSetInstances deallocates the instances with the given IDs of
+// the scale set, which keep their disks and are part of its capacity, and
+// returns the reasons of the instances which failed to be deallocated, keyed
+// by instance name.
+func (m *AzureManager) deallocateScaleSetInstances(ctx context.Context, scaleSet *ScaleSet, instanceIds []string, instancesByID map[string]*AzureRef) map[string]error {
+	failed := make(map[string]error)
+	clients, err := m.clientsOf(scaleSet)
+	if err == nil {
+		err = m.checkBackoff(scaleSet)
+	}
+	if err != nil {
+		for _, instance := range instancesByID {
+			failed[instance.Name] = err
+		}
+		return failed
+	}
+	m.log().Infof("Deallocating instances %v of scale set %s", instanceIds, scaleSet.Name)
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	resultChan, errChan := clients.scaleSetClient.Deallocate(m.resourceGroup(scaleSet), scaleSet.Name, &compute.VirtualMachineScaleSetVMInstanceIDs{InstanceIds: &instanceIds}, opCtx.Done())
+	defer m.expireScaleSet(scaleSet)
+	err = waitForOperation(opCtx, errChan)
+	var result compute.OperationStatusResponse
+	select {
+	case result = <-resultChan:
+	default:
+	}
+	if err != nil {
+		m.backOffIfThrottled(scaleSet, err)
+		for _, instance := range instancesByID {
+			failed[instance.Name] = err
+		}
+		m.recordInstanceEvents(ctx, scaleSet, instanceDeallocation, operationID(result.Response), instancesByID, failed)
+		return failed
+	}
+	m.recordInstanceEvents(ctx, scaleSet, instanceDeallocation, operationID(result.Response), instancesByID, failed)
+
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	if sset := m.getScaleSetInformation(scaleSet); sset != nil {
+		if sset.deallocated == nil {
+			sset.deallocated = make(map[string]string)
+		}
+		for id, instance := range instancesByID {
+			sset.deallocated[normalizeAzureRef(*instance).Name] = id
+		}
+	}
+	return failed
+}
+
+// GetDeallocatedInstances returns the sorted instance IDs of the deallocated
+// VMs of the scale set observed during its last refresh, always empty unless
+// the VMs are deallocated on scale-down.
+func (m *AzureManager) GetDeallocatedInstances(scaleSet *ScaleSet) []string {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	ids := make([]string, 0)
+	if sset := m.getScaleSetInformation(scaleSet); sset != nil {
+		for _, id := range sset.deallocated {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// isEvictedSpotInstance returns true if the instance, which isn't listed by
+// Azure anymore, belongs to a spot scale set and so was likely evicted.
+func (m *AzureManager) isEvictedSpotInstance(instance *AzureRef) bool {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	sset := m.findScaleSetInformation(instance)
+	return sset != nil && sset.config.Spot
+}
+
+// removeInstancesFromCache removes deleted instances from the cache so that
+// they are not found before the next regeneration.
+func (m *AzureManager) removeInstancesFromCache(instances []*AzureRef) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	for _, instance := range instances {
+		ref := normalizeAzureRef(*instance)
+		delete(m.scaleSetCache, ref)
+		delete(m.scaleSetIdCache, ref.Name)
+		delete(m.instanceStateCache, ref.Name)
+	}
+}
@@ -0,0 +1,508 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// blockingDeleteScaleSetClient is a scaleSetClient whose first deletion of
+// instances completes once release is closed.
+type blockingDeleteScaleSetClient struct {
+	*scaleSetClientMock
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (client *blockingDeleteScaleSetClient) DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	resultChan, errChan := client.scaleSetClientMock.DeleteInstances(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	client.once.Do(func() {
+		close(client.started)
+		<-client.release
+	})
+	return resultChan, errChan
+}
+
+func deletedInstanceIds(ssClient *scaleSetClientMock) [][]string {
+	deleted := make([][]string, 0)
+	for _, call := range ssClient.Calls {
+		if call.Method == "DeleteInstances" {
+			ids := append([]string{}, *call.Arguments.Get(2).(compute.VirtualMachineScaleSetVMInstanceRequiredIDs).InstanceIds...)
+			sort.Strings(ids)
+			deleted = append(deleted, ids)
+		}
+	}
+	return deleted
+}
+
+func TestDeleteInstancesMergesQueuedRemovals(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	client := &blockingDeleteScaleSetClient{
+		scaleSetClientMock: ssClient,
+		started:            make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+	m.scaleSetClient = client
+	registerTestScaleSet(t, m, "1:10:ss1")
+
+	vms := newTestVMListResult("ss1", 6)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 6), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	refs := make([]*AzureRef, 0)
+	for _, vm := range *vms.Value {
+		refs = append(refs, &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)})
+	}
+	pending := func(count int) func() (bool, error) {
+		return func() (bool, error) {
+			m.removalMutex.Lock()
+			defer m.removalMutex.Unlock()
+			queue := m.removalQueues[m.scaleSetKey(m.scaleSets[0].config)]
+			return queue != nil && len(queue.pending) == count, nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	deleteInstance := func(ctx context.Context, ref *AzureRef) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, m.DeleteInstances(ctx, []*AzureRef{ref}))
+		}()
+	}
+	deleteInstance(context.Background(), refs[0])
+	<-client.started
+
+	// The removals requested during the deletion of the first instance are queued.
+	for _, ref := range refs[1:4] {
+		deleteInstance(context.Background(), ref)
+	}
+	// The same instance requested twice is deleted once.
+	deleteInstance(context.Background(), refs[3])
+	assert.NoError(t, wait.PollImmediate(time.Millisecond, 5*time.Second, pending(4)))
+
+	// A removal whose context is done before it's issued is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		canceled <- m.DeleteInstances(ctx, []*AzureRef{refs[4]})
+	}()
+	assert.NoError(t, wait.PollImmediate(time.Millisecond, 5*time.Second, pending(5)))
+	cancel()
+	assert.Equal(t, context.Canceled, <-canceled)
+
+	close(client.release)
+	wg.Wait()
+	assert.Equal(t, [][]string{{"0"}, {"1", "2", "3"}}, deletedInstanceIds(ssClient))
+	m.removalMutex.Lock()
+	assert.Empty(t, m.removalQueues)
+	m.removalMutex.Unlock()
+}
+
+func TestDeleteInstancesOfSeveralScaleSets(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:10:ss1")
+	registerTestScaleSet(t, m, "1:10:ss2")
+
+	refs := make([]*AzureRef, 0)
+	for _, name := range []string{"ss1", "ss2"} {
+		vms := newTestVMListResult(name, 3)
+		ssClient.On("Get", "rg", name).Return(newTestScaleSet(name, 3), nil)
+		vmClient.On("List", "rg", name).Return(vms, nil)
+		ssClient.On("DeleteInstances", "rg", name, mock.Anything).Return(nil)
+		ssClient.On("CreateOrUpdate", "rg", name, mock.Anything).Return(nil)
+		for _, vm := range (*vms.Value)[:2] {
+			refs = append(refs, &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)})
+		}
+	}
+	assert.NoError(t, m.Refresh())
+
+	assert.NoError(t, m.DeleteInstances(context.Background(), refs))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 2)
+	for _, name := range []string{"ss1", "ss2"} {
+		ssClient.AssertCalled(t, "DeleteInstances", "rg", name, mock.MatchedBy(func(ids compute.VirtualMachineScaleSetVMInstanceRequiredIDs) bool {
+			return len(*ids.InstanceIds) == 2
+		}))
+	}
+}
+
+func TestDeleteInstancesUnknownInstance(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	unknown := &AzureRef{Name: "azure:///subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachines/unknown"}
+	err := m.DeleteInstances(context.Background(), []*AzureRef{unknown})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), unknown.Name)
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDeleteInstancesRemovesFromCache(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil).Once()
+	assert.NoError(t, m.Refresh())
+
+	deleted := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	kept := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[1].ID)}
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{deleted}))
+
+	_, found := m.scaleSetCache[*deleted]
+	assert.False(t, found)
+	_, found = m.scaleSetIdCache[deleted.Name]
+	assert.False(t, found)
+	config, err := m.GetScaleSetForInstance(kept)
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSet, config)
+	vmClient.AssertNumberOfCalls(t, "List", 1)
+
+	// Azure doesn't list the deleted instance anymore.
+	remaining := compute.VirtualMachineScaleSetVMListResult{Value: &[]compute.VirtualMachineScaleSetVM{(*vms.Value)[1]}}
+	vmClient.On("List", "rg", "ss1").Return(remaining, nil)
+	config, err = m.GetScaleSetForInstance(deleted)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+}
+
+func TestDeleteInstancesFailureKeepsCache(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 1)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(fmt.Errorf("delete failed"))
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	assert.Error(t, m.DeleteInstances(context.Background(), []*AzureRef{ref}))
+	_, found := m.scaleSetCache[*ref]
+	assert.True(t, found)
+}
+
+func TestDeleteInstancesTimeout(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleSetClient = &hangingScaleSetClient{ssClient}
+	m.operationTimeout = 10 * time.Millisecond
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 1)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return()
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	err := m.DeleteInstances(context.Background(), []*AzureRef{ref})
+	if assert.IsType(t, &DeleteInstancesError{}, err) {
+		assert.Equal(t, context.DeadlineExceeded, err.(*DeleteInstancesError).Failed[ref.Name])
+	}
+}
+
+func TestSpotScaleSetEvictedInstances(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.spotScaleSets = parseSpotScaleSets("spot")
+	spot := registerTestScaleSet(t, m, "0:5:spot")
+	regular := registerTestScaleSet(t, m, "0:5:regular")
+	assert.True(t, spot.Spot)
+	assert.False(t, regular.Spot)
+
+	// The first VM of each scale set was evicted or deleted by someone else.
+	spotVMs := newTestVMListResult("spot", 2)
+	regularVMs := newTestVMListResult("regular", 2)
+	ssClient.On("Get", "rg", "spot").Return(newTestScaleSet("spot", 1), nil).Times(4)
+	ssClient.On("Get", "rg", "spot").Return(newTestScaleSet("spot", 0), nil)
+	ssClient.On("Get", "rg", "regular").Return(newTestScaleSet("regular", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "spot", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"1"},
+	}).Return(nil)
+	vmClient.On("List", "rg", "spot").Return(compute.VirtualMachineScaleSetVMListResult{
+		Value: &[]compute.VirtualMachineScaleSetVM{(*spotVMs.Value)[1]},
+	}, nil)
+	vmClient.On("List", "rg", "regular").Return(compute.VirtualMachineScaleSetVMListResult{
+		Value: &[]compute.VirtualMachineScaleSetVM{(*regularVMs.Value)[1]},
+	}, nil)
+	assert.NoError(t, m.Refresh())
+
+	ref := func(vms compute.VirtualMachineScaleSetVMListResult, i int) *AzureRef {
+		return &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[i].ID)}
+	}
+
+	// Evicted spot instances are skipped.
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref(spotVMs, 0)}))
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref(spotVMs, 0), ref(spotVMs, 1)}))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+
+	// Missing instances of regular scale sets are still an error.
+	err := m.DeleteInstances(context.Background(), []*AzureRef{ref(regularVMs, 0)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't belong to any known Scale Set")
+}
+
+func TestDeleteInstancesPartialFailure(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 3)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil).Times(3)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// Azure rejects the instance 1.
+	code, target, message := "NotFound", "1", "instance not found"
+	ssClient.On("DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"0", "1"},
+	}).Return(nil, compute.OperationStatusResponse{
+		Error: &compute.APIError{
+			Details: &[]compute.APIErrorBase{{Code: &code, Target: &target, Message: &message}},
+		},
+	})
+
+	refs := make([]*AzureRef, 3)
+	for i, vm := range *vms.Value {
+		refs[i] = &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)}
+	}
+	unknown := &AzureRef{Name: "azure://unknown"}
+	err := m.DeleteInstances(context.Background(), []*AzureRef{refs[0], unknown, refs[1]})
+
+	deleteErr, ok := err.(*DeleteInstancesError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, 2, len(deleteErr.Failed))
+		assert.EqualError(t, deleteErr.Failed[unknown.Name], "doesn't belong to any known Scale Set")
+		assert.EqualError(t, deleteErr.Failed[refs[1].Name], "NotFound: instance not found")
+		assert.Contains(t, err.Error(), "failed to delete 2 instance(s)")
+	}
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+
+	// Only the deleted instance is removed from the cache.
+	_, found := m.scaleSetIdCache[refs[0].Name]
+	assert.False(t, found)
+	_, found = m.scaleSetIdCache[refs[1].Name]
+	assert.True(t, found)
+}
+
+func TestDeleteInstancesEmptyInstanceID(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 2)
+	empty := ""
+	(*vms.Value)[1].InstanceID = &empty
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"0"},
+	}).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	refs := []*AzureRef{
+		{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)},
+		{Name: "azure://" + strings.ToLower(*(*vms.Value)[1].ID)},
+	}
+	err := m.DeleteInstances(context.Background(), refs)
+	assert.EqualError(t, err, fmt.Sprintf("failed to delete 1 instance(s): %s: empty instance ID", refs[1].Name))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+}
+
+func TestDeleteInstancesInBatches(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.maxDeletionBatchSize = 2
+	registerTestScaleSet(t, m, "1:10:ss1")
+
+	vms := newTestVMListResult("ss1", 5)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 5), nil).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"0", "1"},
+	}).Return(nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"2", "3"},
+	}).Return(fmt.Errorf("delete failed"))
+	ssClient.On("DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &[]string{"4"},
+	}).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	refs := make([]*AzureRef, 0, 5)
+	for _, vm := range *vms.Value {
+		refs = append(refs, &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)})
+	}
+	err := m.DeleteInstances(context.Background(), refs)
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 3)
+
+	// The failure of a batch doesn't prevent the deletion of the next ones.
+	deleteErr, ok := err.(*DeleteInstancesError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, 2, len(deleteErr.Failed))
+		assert.EqualError(t, deleteErr.Failed[refs[2].Name], "delete failed")
+		assert.EqualError(t, deleteErr.Failed[refs[3].Name], "delete failed")
+	}
+}
+
+func TestDeleteInstancesDecrementsCapacity(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	// Azure deletes the instances but recreates them, keeping the capacity.
+	vms := newTestVMListResult("ss1", 3)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	refs := []*AzureRef{
+		{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)},
+		{Name: "azure://" + strings.ToLower(*(*vms.Value)[1].ID)},
+	}
+	assert.NoError(t, m.DeleteInstances(context.Background(), refs))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+	scaleSet := ssClient.Calls[len(ssClient.Calls)-1].Arguments.Get(2).(compute.VirtualMachineScaleSet)
+	assert.Equal(t, int64(1), *scaleSet.Sku.Capacity)
+}
+
+func TestDeallocateScaleDownMode(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.deallocateOnScaleDown = true
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 3)
+	deallocated := vmPowerStateDeallocated
+	(*vms.Value)[2].VirtualMachineScaleSetVMProperties = &compute.VirtualMachineScaleSetVMProperties{
+		InstanceView: &compute.VirtualMachineInstanceView{
+			Statuses: &[]compute.InstanceViewStatus{{Code: &deallocated}},
+		},
+	}
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// The deallocated VM is part of the capacity but not a node.
+	assert.Equal(t, []string{"2"}, m.GetDeallocatedInstances(scaleSet))
+	assert.Equal(t, 1, m.Snapshot()[0].Deallocated)
+	size, err := scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+	nodes, err := scaleSet.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodes))
+
+	// Scale-downs deallocate the VMs instead of deleting them.
+	ssClient.On("Deallocate", "rg", "ss1", []string{"0"}).Return(nil)
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref}))
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, []string{"0", "2"}, m.GetDeallocatedInstances(scaleSet))
+	size, err = scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	// Scale-ups start the deallocated VMs first.
+	assert.Error(t, scaleSet.IncreaseSize(5))
+	ssClient.On("Start", "rg", "ss1", []string{"0", "2"}).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	assert.NoError(t, scaleSet.IncreaseSize(3))
+	m.resizes.Wait()
+	ssClient.AssertCalled(t, "Start", "rg", "ss1", []string{"0", "2"})
+	assert.Empty(t, m.GetDeallocatedInstances(scaleSet))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+	for _, call := range ssClient.Calls {
+		if call.Method == "CreateOrUpdate" {
+			assert.Equal(t, int64(4), *call.Arguments.Get(2).(compute.VirtualMachineScaleSet).Sku.Capacity)
+		}
+	}
+}
+
+func TestDeleteInstancesDefaultBatchSize(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:500:ss1")
+
+	vms := newTestVMListResult("ss1", 250)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 250), nil).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 0), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	refs := make([]*AzureRef, 0, 250)
+	for _, vm := range *vms.Value {
+		refs = append(refs, &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)})
+	}
+	assert.NoError(t, m.DeleteInstances(context.Background(), refs))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 3)
+	var sizes []int
+	for _, call := range ssClient.Calls {
+		if call.Method == "DeleteInstances" {
+			ids := call.Arguments.Get(2).(compute.VirtualMachineScaleSetVMInstanceRequiredIDs)
+			sizes = append(sizes, len(*ids.InstanceIds))
+		}
+	}
+	assert.Equal(t, []int{100, 100, 50}, sizes)
+}
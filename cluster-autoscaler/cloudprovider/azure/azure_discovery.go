@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+// listScaleSets lists all scale sets of the resource group of the subscription,
+// the one of the manager if empty, following the pagination links returned by
+// Azure.
+func (m *AzureManager) listScaleSets(subscriptionID string, resourceGroup string) ([]compute.VirtualMachineScaleSet, error) {
+	clients, err := m.subscriptionClientsOf(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := clients.scaleSetClient.List(resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	scaleSets := make([]compute.VirtualMachineScaleSet, 0)
+	for {
+		if result.Value != nil {
+			scaleSets = append(scaleSets, *result.Value...)
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = clients.scaleSetClient.ListNextResults(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scaleSets, nil
+}
+
+// RegisterScaleSet registers scale set in Azure Manager.
+func (m *AzureManager) RegisterScaleSet(scaleSet *ScaleSet) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	if m.spotScaleSets[strings.ToLower(scaleSet.Name)] {
+		scaleSet.Spot = true
+	}
+	if size, found := m.scaleSetVMSizes[strings.ToLower(scaleSet.Name)]; found && scaleSet.VMSize == "" {
+		scaleSet.VMSize = size
+	}
+	if scaleSet.VMSize != "" {
+		if _, found := getVMSize(scaleSet.VMSize); !found {
+			m.log().Warningf("Unknown VM size %s of scale set %s, using the VM size of its model", scaleSet.VMSize, scaleSet.Name)
+		}
+	}
+	m.scaleSets = append(m.scaleSets,
+		&scaleSetInformation{
+			config:   scaleSet,
+			basename: scaleSet.Name,
+		})
+
+}
+
+// UnregisterScaleSet removes the scale set and its instances from the Azure
+// Manager, along with its pending scale-up, backoff and provisioning times so
+// that nothing is kept about it until restart. It returns false if the scale
+// set was not registered.
+func (m *AzureManager) UnregisterScaleSet(scaleSet *ScaleSet) bool {
+	return m.unregisterScaleSet(scaleSet, true)
+}
+
+// unregisterScaleSet removes the scale set and its instances from the Azure
+// Manager. The state kept by key, see scaleSetKey, is only dropped if forget
+// is true, so that a scale set registered again with other bounds keeps it.
+func (m *AzureManager) unregisterScaleSet(scaleSet *ScaleSet, forget bool) bool {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	for i, sset := range m.scaleSets {
+		if sset.config != scaleSet {
+			continue
+		}
+		m.scaleSets = append(m.scaleSets[:i:i], m.scaleSets[i+1:]...)
+		for ref, config := range m.scaleSetCache {
+			if config == scaleSet {
+				delete(m.scaleSetCache, ref)
+				delete(m.scaleSetIdCache, ref.Name)
+			}
+		}
+		for name := range m.instanceStateCache {
+			if m.ownsInstance(sset, name) {
+				delete(m.instanceStateCache, name)
+			}
+		}
+		m.invalidateCachedSize(scaleSet)
+		if forget {
+			m.forgetScaleSet(scaleSet)
+		}
+		return true
+	}
+	return false
+}
+
+// forgetScaleSet drops the state kept by key about the scale set.
+func (m *AzureManager) forgetScaleSet(scaleSet *ScaleSet) {
+	key := m.scaleSetKey(scaleSet)
+	m.sizeMutex.Lock()
+	delete(m.scaleUps, key)
+	delete(m.backoffs, key)
+	delete(m.provisioningTimes, key)
+	m.sizeMutex.Unlock()
+	scaleSetProvisioningDuration.DeleteLabelValues(scaleSet.Id())
+	m.log().V(2).Infof("Unregistered scale set %s", scaleSet.Id())
+}
+
+// RegisterScaleSetWithValidation checks the bounds of the scale set and that
+// it exists before registering it. A warning is logged if the current capacity
+// of the scale set is outside of the bounds, or if it can't be read for another
+// reason than the scale set not existing.
+func (m *AzureManager) RegisterScaleSetWithValidation(ctx context.Context, scaleSet *ScaleSet) error {
+	if scaleSet.MinSize() < 0 {
+		return fmt.Errorf("min size of scale set %s must not be negative, got: %d", scaleSet.Name, scaleSet.MinSize())
+	}
+	if scaleSet.MinSize() > scaleSet.MaxSize() {
+		return fmt.Errorf("min size of scale set %s (%d) is greater than its max size (%d)", scaleSet.Name, scaleSet.MinSize(), scaleSet.MaxSize())
+	}
+
+	size, err := m.GetScaleSetSize(ctx, scaleSet)
+	if isNotFoundError(err) {
+		return fmt.Errorf("scale set %s not found in resource group %s of subscription %s, check its name and resource group: %v",
+			scaleSet.Name, m.resourceGroup(scaleSet), m.subscription, err)
+	}
+	if err != nil {
+		m.log().Warningf("Failed to get the capacity of scale set %s: %v", scaleSet.Name, err)
+	} else if size < int64(scaleSet.MinSize()) || size > int64(scaleSet.MaxSize()) {
+		m.log().Warningf("Capacity %d of scale set %s is outside of its bounds [%d, %d]", size, scaleSet.Name, scaleSet.MinSize(), scaleSet.MaxSize())
+	}
+
+	m.RegisterScaleSet(scaleSet)
+	return nil
+}
+
+// GetScaleSets returns the registered scale sets. The returned slice is a copy
+// and may be freely modified by the caller.
+func (m *AzureManager) GetScaleSets() []*ScaleSet {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	result := make([]*ScaleSet, 0, len(m.scaleSets))
+	for _, sset := range m.scaleSets {
+		result = append(result, sset.config)
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRegisterScaleSetWithValidation(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	ssClient.On("Get", "rg", "ss2").Return(newTestScaleSet("ss2", 10), nil)
+	ssClient.On("Get", "rg", "ss3").Return(compute.VirtualMachineScaleSet{}, fmt.Errorf("get failed"))
+
+	assert.NoError(t, m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "ss1", minSize: 1, maxSize: 5}))
+	// Capacity out of bounds and failures to get it are only logged.
+	assert.NoError(t, m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "ss2", minSize: 1, maxSize: 5}))
+	assert.NoError(t, m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "ss3", minSize: 1, maxSize: 5}))
+	assert.Equal(t, 3, len(m.scaleSets))
+}
+
+func TestRegisterScaleSetWithValidationInvalidBounds(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+
+	err := m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "ss1", minSize: -1, maxSize: 5})
+	assert.EqualError(t, err, "min size of scale set ss1 must not be negative, got: -1")
+	err = m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "ss1", minSize: 6, maxSize: 5})
+	assert.EqualError(t, err, "min size of scale set ss1 (6) is greater than its max size (5)")
+
+	assert.Equal(t, 0, len(m.scaleSets))
+	ssClient.AssertNotCalled(t, "Get", mock.Anything, mock.Anything)
+}
+
+func TestRegisterScaleSetWithValidationNotFound(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.subscription = "sub"
+
+	// A typo in the name of the scale set fails the registration.
+	ssClient.On("Get", "rg", "sss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusNotFound))
+	err := m.RegisterScaleSetWithValidation(context.Background(), &ScaleSet{Name: "sss1", minSize: 1, maxSize: 5})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "scale set sss1 not found in resource group rg of subscription sub")
+	}
+	assert.Equal(t, 0, len(m.scaleSets))
+}
+
+func TestGetScaleSets(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	ss2 := registerTestScaleSet(t, m, "2:10:other-rg/ss2")
+
+	scaleSets := m.GetScaleSets()
+	assert.Equal(t, []*ScaleSet{ss1, ss2}, scaleSets)
+
+	// Modifying the returned slice must not affect the registered scale sets.
+	scaleSets[0] = nil
+	assert.Equal(t, []*ScaleSet{ss1, ss2}, m.GetScaleSets())
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	kube_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/drain"
+	"k8s.io/client-go/kubernetes"
+)
+
+// drainPollInterval is the interval between two checks of the nodes waited
+// for to be drained.
+var drainPollInterval = 5 * time.Second
+
+// SetKubeClient makes the node groups wait for the nodes to be drained before
+// deleting their instances, see waitForDrain.
+func (m *AzureManager) SetKubeClient(client kubernetes.Interface) {
+	m.drainMutex.Lock()
+	defer m.drainMutex.Unlock()
+	m.kubeClient = client
+}
+
+// waitForDrain waits until each of the nodes was unregistered or has no pod
+// still running or terminating, so that deleting its instance doesn't kill
+// pods which didn't finish terminating. The pods of DaemonSets and the mirror
+// pods are ignored, they are not evicted. The instances are deleted anyway
+// once the drain timeout elapsed, or right away without a kube client or
+// drain timeout.
+func (m *AzureManager) waitForDrain(ctx context.Context, nodes []*apiv1.Node) {
+	m.drainMutex.Lock()
+	client := m.kubeClient
+	m.drainMutex.Unlock()
+	timeout := m.drainTimeout
+	if client == nil || timeout <= 0 || len(nodes) == 0 {
+		return
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pending := nodes
+	check := func() (bool, error) {
+		remaining := make([]*apiv1.Node, 0, len(pending))
+		for _, node := range pending {
+			drained, err := nodeDrained(client, node)
+			if err != nil {
+				m.log().Warningf("Failed to check whether node %s is drained: %v", node.Name, err)
+			}
+			if !drained {
+				remaining = append(remaining, node)
+			}
+		}
+		pending = remaining
+		return len(pending) == 0, nil
+	}
+	if done, _ := check(); done {
+		return
+	}
+	if err := wait.PollUntil(drainPollInterval, check, waitCtx.Done()); err != nil {
+		for _, node := range pending {
+			m.log().Warningf("Node %s not drained after %v, deleting its instance anyway", node.Name, timeout)
+		}
+	}
+}
+
+// nodeDrained returns true if the node was unregistered, or if none of its
+// pods is still running or terminating apart from the mirror and DaemonSet
+// pods.
+func nodeDrained(client kubernetes.Interface, node *apiv1.Node) (bool, error) {
+	if _, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); kube_errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	pods, err := client.CoreV1().Pods(apiv1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node.Name}).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != node.Name || pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+		if drain.IsMirrorPod(pod) {
+			continue
+		}
+		if ref := drain.ControllerRef(pod); ref != nil && ref.Kind == "DaemonSet" {
+			continue
+		}
+		return false, nil
+	}
+	return true, nil
+}
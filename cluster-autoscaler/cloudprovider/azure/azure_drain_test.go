@@ -0,0 +1,110 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/kubelet/types"
+)
+
+func newTestPod(name string, nodeName string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       apiv1.PodSpec{NodeName: nodeName},
+		Status:     apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+}
+
+func TestNodeDrained(t *testing.T) {
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	controller := true
+	daemonSetPod := newTestPod("ds", "node")
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "ds", Controller: &controller}}
+	mirrorPod := newTestPod("mirror", "node")
+	mirrorPod.Annotations = map[string]string{types.ConfigMirrorAnnotationKey: "mirror"}
+	completedPod := newTestPod("completed", "node")
+	completedPod.Status.Phase = apiv1.PodSucceeded
+	client := fake.NewSimpleClientset(node, daemonSetPod, mirrorPod, completedPod, newTestPod("other", "other-node"))
+
+	drained, err := nodeDrained(client, node)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+
+	// A pod still terminating.
+	terminating := newTestPod("terminating", "node")
+	now := metav1.Now()
+	terminating.DeletionTimestamp = &now
+	_, err = client.CoreV1().Pods("default").Create(terminating)
+	assert.NoError(t, err)
+	drained, err = nodeDrained(client, node)
+	assert.NoError(t, err)
+	assert.False(t, drained)
+
+	// The node was unregistered.
+	assert.NoError(t, client.CoreV1().Nodes().Delete("node", &metav1.DeleteOptions{}))
+	drained, err = nodeDrained(client, node)
+	assert.NoError(t, err)
+	assert.True(t, drained)
+}
+
+func TestWaitForDrain(t *testing.T) {
+	defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+	drainPollInterval = 10 * time.Millisecond
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-0"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+	client := fake.NewSimpleClientset(nodes[0], nodes[1], newTestPod("pod", "node-1"))
+
+	// Without kube client the nodes aren't waited for.
+	start := time.Now()
+	m.drainTimeout = time.Hour
+	m.waitForDrain(context.Background(), nodes)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Nor without drain timeout.
+	m.SetKubeClient(client)
+	m.drainTimeout = 0
+	m.waitForDrain(context.Background(), nodes)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The pod of node-1 terminates.
+	m.drainTimeout = time.Hour
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.CoreV1().Pods("default").Delete("pod", &metav1.DeleteOptions{})
+	}()
+	m.waitForDrain(context.Background(), nodes)
+	_, err := client.CoreV1().Pods("default").Get("pod", metav1.GetOptions{})
+	assert.Error(t, err)
+
+	// The instances are deleted anyway once the timeout elapsed.
+	_, err = client.CoreV1().Pods("default").Create(newTestPod("stuck", "node-0"))
+	assert.NoError(t, err)
+	m.drainTimeout = 50 * time.Millisecond
+	start = time.Now()
+	m.waitForDrain(context.Background(), nodes)
+	assert.True(t, time.Since(start) >= m.drainTimeout)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded for the resizes of the scale sets.
+const (
+	scaleSetResizedReason      = "ScaleSetResized"
+	scaleSetResizeFailedReason = "FailedToResizeScaleSet"
+)
+
+// instanceOperation is an operation on the instances of a scale set, as told
+// by its events.
+type instanceOperation struct {
+	reason       string
+	failedReason string
+	// verb is e.g. "delete", past "Deleted"
+	verb string
+	past string
+}
+
+var (
+	instanceDeletion     = instanceOperation{"ScaleSetInstanceDeleted", "FailedToDeleteScaleSetInstance", "delete", "Deleted"}
+	instanceDeallocation = instanceOperation{"ScaleSetInstanceDeallocated", "FailedToDeallocateScaleSetInstance", "deallocate", "Deallocated"}
+)
+
+// SetEventRecorders makes the manager record the operations on the scale sets
+// as events on the status ConfigMap, and on the nodes of the instances deleted
+// or deallocated by DeleteNodes. Either recorder may be nil.
+func (m *AzureManager) SetEventRecorders(recorder kube_record.EventRecorder, status cloudprovider.StatusRecorder) {
+	m.eventsMutex.Lock()
+	defer m.eventsMutex.Unlock()
+	m.eventRecorder = recorder
+	m.statusRecorder = status
+}
+
+// recordEvent records an event on the status ConfigMap.
+func (m *AzureManager) recordEvent(eventtype, reason, message string, args ...interface{}) {
+	m.eventsMutex.Lock()
+	status := m.statusRecorder
+	m.eventsMutex.Unlock()
+	if status != nil {
+		status.Eventf(eventtype, reason, message, args...)
+	}
+}
+
+// recordInstanceEvents records the outcome of the operation with the given ARM
+// operation ID on the instances of the scale set, keyed by instance ID, given
+// the reasons of the instances which failed, keyed by instance name. The
+// instances which succeeded and the ones which failed are each told by an
+// event on the status ConfigMap, and each instance whose node is in ctx by an
+// event on its node.
+func (m *AzureManager) recordInstanceEvents(ctx context.Context, scaleSet *ScaleSet, operation instanceOperation, operationID string, instancesByID map[string]*AzureRef, failed map[string]error) {
+	m.eventsMutex.Lock()
+	recorder := m.eventRecorder
+	m.eventsMutex.Unlock()
+	nodes := nodesOf(ctx)
+
+	succeededIDs := make([]string, 0, len(instancesByID))
+	failedIDs := make([]string, 0, len(failed))
+	for id, instance := range instancesByID {
+		err, instanceFailed := failed[instance.Name]
+		if instanceFailed {
+			failedIDs = append(failedIDs, id)
+		} else {
+			succeededIDs = append(succeededIDs, id)
+		}
+		node, found := nodes[normalizeAzureRef(*instance).Name]
+		if !found || recorder == nil {
+			continue
+		}
+		if instanceFailed {
+			recorder.Eventf(node, apiv1.EventTypeWarning, operation.failedReason, "Failed to %s instance %s of scale set %s, operation %s: %v", operation.verb, id, scaleSet.Name, operationID, err)
+		} else {
+			recorder.Eventf(node, apiv1.EventTypeNormal, operation.reason, "%s instance %s of scale set %s, operation %s", operation.past, id, scaleSet.Name, operationID)
+		}
+	}
+	sort.Strings(succeededIDs)
+	sort.Strings(failedIDs)
+	if len(succeededIDs) > 0 {
+		m.recordEvent(apiv1.EventTypeNormal, operation.reason, "%s instances %v of scale set %s, operation %s", operation.past, succeededIDs, scaleSet.Name, operationID)
+	}
+	if len(failedIDs) > 0 {
+		m.recordEvent(apiv1.EventTypeWarning, operation.failedReason, "Failed to %s instances %v of scale set %s, operation %s", operation.verb, failedIDs, scaleSet.Name, operationID)
+	}
+}
+
+type nodesContextKey struct{}
+
+// withNodes returns a context with the nodes of the instances operated on, so
+// that the operations are recorded as events on them.
+func withNodes(ctx context.Context, nodes []*apiv1.Node) context.Context {
+	byInstance := make(map[string]*apiv1.Node, len(nodes))
+	for _, node := range nodes {
+		byInstance[normalizeAzureRef(AzureRef{Name: node.Spec.ProviderID}).Name] = node
+	}
+	return context.WithValue(ctx, nodesContextKey{}, byInstance)
+}
+
+// nodesOf returns the nodes of the instances operated on in ctx, keyed by
+// normalized instance name.
+func nodesOf(ctx context.Context) map[string]*apiv1.Node {
+	nodes, _ := ctx.Value(nodesContextKey{}).(map[string]*apiv1.Node)
+	return nodes
+}
+
+// operationID returns the ID of the ARM operation of the response, the last
+// segment of the Azure-AsyncOperation URL polled for the result of an
+// asynchronous operation, or else the x-ms-request-id of the request. It's
+// "unknown" if the response has neither.
+func operationID(resp autorest.Response) string {
+	if resp.Response == nil {
+		return "unknown"
+	}
+	if req := resp.Request; req != nil && req.URL != nil {
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if n := len(segments); n >= 2 && strings.EqualFold(segments[n-2], "operations") {
+			return segments[n-1]
+		}
+	}
+	if id := resp.Header.Get("x-ms-request-id"); id != "" {
+		return id
+	}
+	return "unknown"
+}
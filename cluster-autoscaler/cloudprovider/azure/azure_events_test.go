@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+// statusRecorderMock is a cloudprovider.StatusRecorder keeping the events it records.
+type statusRecorderMock struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *statusRecorderMock) Eventf(eventtype, reason, message string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, eventtype+" "+reason+" "+fmt.Sprintf(message, args...))
+}
+
+func TestOperationID(t *testing.T) {
+	polled, _ := url.Parse("https://management.azure.com/subscriptions/sub/providers/Microsoft.Compute/locations/westus/operations/op-1?api-version=2017-03-30")
+	resp := &http.Response{Request: &http.Request{URL: polled}, Header: http.Header{}}
+	resp.Header.Set("x-ms-request-id", "request-1")
+	assert.Equal(t, "op-1", operationID(autorest.Response{Response: resp}))
+
+	requested, _ := url.Parse("https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1")
+	resp.Request.URL = requested
+	assert.Equal(t, "request-1", operationID(autorest.Response{Response: resp}))
+
+	assert.Equal(t, "unknown", operationID(autorest.Response{Response: &http.Response{}}))
+	assert.Equal(t, "unknown", operationID(autorest.Response{}))
+}
+
+func TestScaleSetOperationEvents(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	recorder := kube_record.NewFakeRecorder(10)
+	status := &statusRecorderMock{}
+	vms := newTestVMListResult("ss1", 3)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	provider := testProvider(t, m)
+	// The core sets the recorders of the providers recording events.
+	var withRecorders cloudprovider.CloudProviderWithEventRecorders = provider
+	withRecorders.SetEventRecorders(recorder, status)
+	assert.NoError(t, provider.addNodeGroup("1:5:ss1"))
+	scaleSet := provider.nodeGroups[0].(*ScaleSet)
+	assert.NoError(t, m.Refresh())
+
+	// Azure rejects the instance 1.
+	code, target, message := "NotFound", "1", "instance not found"
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("x-ms-request-id", "op-1")
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil, compute.OperationStatusResponse{
+		Response: autorest.Response{Response: resp},
+		Error: &compute.APIError{
+			Details: &[]compute.APIErrorBase{{Code: &code, Target: &target, Message: &message}},
+		},
+	})
+	// The capacity isn't decremented by the deletion.
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	nodes := make([]*apiv1.Node, 2)
+	for i := range nodes {
+		nodes[i] = &apiv1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%d", i)},
+			Spec:       apiv1.NodeSpec{ProviderID: "azure://" + *(*vms.Value)[i].ID},
+		}
+	}
+	assert.Error(t, scaleSet.DeleteNodes(nodes))
+
+	// The operations are recorded on the nodes and on the status ConfigMap.
+	nodeEvents := []string{<-recorder.Events, <-recorder.Events}
+	assert.Contains(t, nodeEvents, "Normal ScaleSetInstanceDeleted Deleted instance 0 of scale set ss1, operation op-1")
+	assert.Contains(t, nodeEvents, "Warning FailedToDeleteScaleSetInstance Failed to delete instance 1 of scale set ss1, operation op-1: NotFound: instance not found")
+	assert.Equal(t, []string{
+		"Normal ScaleSetInstanceDeleted Deleted instances [0] of scale set ss1, operation op-1",
+		"Warning FailedToDeleteScaleSetInstance Failed to delete instances [1] of scale set ss1, operation op-1",
+		"Normal ScaleSetResized Resized scale set ss1 from 3 to 2, operation unknown",
+	}, status.events)
+
+	// The resizes are only recorded on the status ConfigMap.
+	status.events = nil
+	assert.NoError(t, scaleSet.IncreaseSize(1))
+	m.resizes.Wait()
+	assert.Equal(t, []string{"Normal ScaleSetResized Resized scale set ss1 from 3 to 4, operation unknown"}, status.events)
+	assert.Empty(t, recorder.Events)
+}
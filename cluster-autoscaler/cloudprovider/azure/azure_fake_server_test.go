@@ -0,0 +1,444 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+const fakeARMToken = "fake-arm-token"
+
+// fakeResponse is a response recorded for a request to the fake ARM server.
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+// fakeScaleSet is a scale set of the fake ARM server.
+type fakeScaleSet struct {
+	scaleSet compute.VirtualMachineScaleSet
+	// VMs by instance ID
+	vms            map[int]compute.VirtualMachineScaleSetVM
+	nextInstanceID int
+}
+
+// fakeARMServer is a fake of the ARM APIs of the scale sets. It serves its
+// scale sets and their VMs like Azure would, resizing them and deleting their
+// VMs, unless responses were recorded for the requests or it was asked to
+// throttle them. The requests must be authorized with fakeARMToken.
+type fakeARMServer struct {
+	*httptest.Server
+
+	mutex sync.Mutex
+	// scale sets by lowercase <subscription>/<resource-group>/<name>
+	scaleSets map[string]*fakeScaleSet
+	// recorded responses by "<METHOD> <lowercase path>", served in order
+	// before the state
+	recorded map[string][]fakeResponse
+	// number of the next requests answered with 429 Too Many Requests
+	throttled  int
+	retryAfter time.Duration
+	// provisioning state of the VMs added by scale-ups
+	newVMState string
+	// number of VMs per page of the VM lists, unlimited if zero
+	pageSize int
+	// requests received, as "<METHOD> <path>"
+	received []string
+}
+
+func newFakeARMServer() *fakeARMServer {
+	s := &fakeARMServer{
+		scaleSets:  make(map[string]*fakeScaleSet),
+		recorded:   make(map[string][]fakeResponse),
+		newVMState: "Succeeded",
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// newFakeARMManager returns a manager of the scale sets of the fake server,
+// in its subscription "sub" and resource group "rg". The calls are retried
+// without waiting.
+func newFakeARMManager(t *testing.T, s *fakeARMServer, cfg Config) *AzureManager {
+	cfg.SubscriptionID = "sub"
+	cfg.ResourceGroup = "rg"
+	factory := &autorestClientFactory{
+		cfg:           &cfg,
+		env:           &azure.Environment{ResourceManagerEndpoint: s.URL},
+		tokenProvider: staticToken(fakeARMToken),
+		sender:        s.Client(),
+		logger:        defaultLogger,
+		sleep:         func(time.Duration) {},
+	}
+	m, err := newAzureManager(cfg, factory, defaultLogger)
+	assert.NoError(t, err)
+	return m
+}
+
+func fakeScaleSetKey(subscriptionID, resourceGroup, name string) string {
+	return strings.ToLower(subscriptionID + "/" + resourceGroup + "/" + name)
+}
+
+// addScaleSet adds a scale set of capacity VMs with the given tags.
+func (s *fakeARMServer) addScaleSet(subscriptionID, resourceGroup, name string, capacity int64, tags map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s", subscriptionID, resourceGroup, name)
+	state := "Succeeded"
+	scaleSetTags := make(map[string]*string)
+	for key, value := range tags {
+		value := value
+		scaleSetTags[key] = &value
+	}
+	set := &fakeScaleSet{
+		scaleSet: compute.VirtualMachineScaleSet{
+			ID:   &id,
+			Name: &name,
+			Tags: &scaleSetTags,
+			Sku:  &compute.Sku{Capacity: &capacity},
+			VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+				ProvisioningState: &state,
+			},
+		},
+		vms: make(map[int]compute.VirtualMachineScaleSetVM),
+	}
+	for i := int64(0); i < capacity; i++ {
+		set.addVM("Succeeded")
+	}
+	s.scaleSets[fakeScaleSetKey(subscriptionID, resourceGroup, name)] = set
+}
+
+// addVM adds a VM in the given provisioning state to the scale set.
+func (set *fakeScaleSet) addVM(state string) {
+	instanceID := strconv.Itoa(set.nextInstanceID)
+	set.nextInstanceID++
+	id := *set.scaleSet.ID + "/virtualMachines/" + instanceID
+	name := *set.scaleSet.Name + "_" + instanceID
+	set.vms[set.nextInstanceID-1] = compute.VirtualMachineScaleSetVM{
+		ID:         &id,
+		Name:       &name,
+		InstanceID: &instanceID,
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: &state,
+		},
+	}
+}
+
+// instanceIDs returns the instance IDs of the VMs of the scale set, in order.
+func (set *fakeScaleSet) instanceIDs() []int {
+	ids := make([]int, 0, len(set.vms))
+	for id := range set.vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// capacity returns the capacity of the scale set, -1 if it doesn't exist.
+func (s *fakeARMServer) capacity(subscriptionID, resourceGroup, name string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set, found := s.scaleSets[fakeScaleSetKey(subscriptionID, resourceGroup, name)]
+	if !found {
+		return -1
+	}
+	return *set.scaleSet.Sku.Capacity
+}
+
+// record makes the server answer the next request of the given method and
+// path with the given response, after the responses recorded before.
+func (s *fakeARMServer) record(method, path string, status int, body string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := method + " " + strings.ToLower(path)
+	s.recorded[key] = append(s.recorded[key], fakeResponse{status: status, body: body})
+}
+
+// throttle makes the server answer the next n requests with 429 Too Many
+// Requests, asking to retry after retryAfter.
+func (s *fakeARMServer) throttle(n int, retryAfter time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.throttled, s.retryAfter = n, retryAfter
+}
+
+// requests returns the requests the server received, as "<METHOD> <path>".
+func (s *fakeARMServer) requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.received...)
+}
+
+func (s *fakeARMServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("Authorization") != "Bearer "+fakeARMToken {
+		writeARMError(w, http.StatusUnauthorized, "AuthenticationFailed", "invalid token")
+		return
+	}
+	if s.throttled > 0 {
+		s.throttled--
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.retryAfter.Seconds())))
+		writeARMError(w, http.StatusTooManyRequests, "TooManyRequests", "throttled")
+		return
+	}
+	key := r.Method + " " + strings.ToLower(r.URL.Path)
+	if responses := s.recorded[key]; len(responses) > 0 {
+		s.recorded[key] = responses[1:]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(responses[0].status)
+		fmt.Fprint(w, responses[0].body)
+		return
+	}
+
+	// /subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/virtualMachineScaleSets[/{name}[/...]]
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 7 || !strings.EqualFold(segments[6], "virtualMachineScaleSets") {
+		writeARMError(w, http.StatusNotFound, "InvalidResourceType", "unsupported resource "+r.URL.Path)
+		return
+	}
+	subscriptionID, resourceGroup := segments[1], segments[3]
+	if len(segments) == 7 && r.Method == http.MethodGet {
+		s.listScaleSets(w, subscriptionID, resourceGroup)
+		return
+	}
+	set, found := s.scaleSets[fakeScaleSetKey(subscriptionID, resourceGroup, segments[7])]
+	if !found {
+		writeARMError(w, http.StatusNotFound, "ResourceNotFound", "scale set "+segments[7]+" not found")
+		return
+	}
+	switch {
+	case len(segments) == 8 && r.Method == http.MethodGet:
+		writeARMResponse(w, set.scaleSet)
+	case len(segments) == 8 && r.Method == http.MethodPut:
+		s.resize(w, r, set)
+	case len(segments) == 9 && strings.EqualFold(segments[8], "delete") && r.Method == http.MethodPost:
+		s.deleteInstances(w, r, set)
+	case len(segments) == 9 && strings.EqualFold(segments[8], "virtualMachines") && r.Method == http.MethodGet:
+		s.listVMs(w, r, set)
+	case len(segments) == 10 && strings.EqualFold(segments[8], "virtualMachines") && r.Method == http.MethodGet:
+		instanceID, _ := strconv.Atoi(segments[9])
+		if vm, found := set.vms[instanceID]; found {
+			writeARMResponse(w, vm)
+		} else {
+			writeARMError(w, http.StatusNotFound, "NotFound", "VM "+segments[9]+" not found")
+		}
+	default:
+		writeARMError(w, http.StatusMethodNotAllowed, "UnsupportedOperation", r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *fakeARMServer) listScaleSets(w http.ResponseWriter, subscriptionID, resourceGroup string) {
+	prefix := fakeScaleSetKey(subscriptionID, resourceGroup, "")
+	keys := make([]string, 0)
+	for key := range s.scaleSets {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	scaleSets := make([]compute.VirtualMachineScaleSet, 0, len(keys))
+	for _, key := range keys {
+		scaleSets = append(scaleSets, s.scaleSets[key].scaleSet)
+	}
+	writeARMResponse(w, compute.VirtualMachineScaleSetListResult{Value: &scaleSets})
+}
+
+// resize sets the capacity of the scale set, adding VMs in newVMState or
+// removing the last ones.
+func (s *fakeARMServer) resize(w http.ResponseWriter, r *http.Request, set *fakeScaleSet) {
+	var parameters compute.VirtualMachineScaleSet
+	if err := json.NewDecoder(r.Body).Decode(&parameters); err != nil || parameters.Sku == nil || parameters.Sku.Capacity == nil {
+		writeARMError(w, http.StatusBadRequest, "InvalidParameter", "the capacity is missing")
+		return
+	}
+	capacity := *parameters.Sku.Capacity
+	for int64(len(set.vms)) < capacity {
+		set.addVM(s.newVMState)
+	}
+	ids := set.instanceIDs()
+	for int64(len(ids)) > capacity {
+		delete(set.vms, ids[len(ids)-1])
+		ids = ids[:len(ids)-1]
+	}
+	set.scaleSet.Sku.Capacity = &capacity
+	writeARMResponse(w, set.scaleSet)
+}
+
+// deleteInstances deletes the VMs of the scale set and decrements its
+// capacity.
+func (s *fakeARMServer) deleteInstances(w http.ResponseWriter, r *http.Request, set *fakeScaleSet) {
+	var parameters compute.VirtualMachineScaleSetVMInstanceRequiredIDs
+	if err := json.NewDecoder(r.Body).Decode(&parameters); err != nil || parameters.InstanceIds == nil {
+		writeARMError(w, http.StatusBadRequest, "InvalidParameter", "the instance IDs are missing")
+		return
+	}
+	for _, instanceID := range *parameters.InstanceIds {
+		id, _ := strconv.Atoi(instanceID)
+		if _, found := set.vms[id]; !found {
+			writeARMError(w, http.StatusBadRequest, "InvalidParameter", "VM "+instanceID+" not found")
+			return
+		}
+	}
+	for _, instanceID := range *parameters.InstanceIds {
+		id, _ := strconv.Atoi(instanceID)
+		delete(set.vms, id)
+	}
+	capacity := int64(len(set.vms))
+	set.scaleSet.Sku.Capacity = &capacity
+	writeARMResponse(w, struct{}{})
+}
+
+// listVMs lists the VMs of the scale set, by pages of pageSize VMs linked by
+// a skip token.
+func (s *fakeARMServer) listVMs(w http.ResponseWriter, r *http.Request, set *fakeScaleSet) {
+	vms := make([]compute.VirtualMachineScaleSetVM, 0, len(set.vms))
+	for _, id := range set.instanceIDs() {
+		vms = append(vms, set.vms[id])
+	}
+	result := compute.VirtualMachineScaleSetVMListResult{}
+	skip, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+	if skip < len(vms) {
+		vms = vms[skip:]
+	}
+	if s.pageSize > 0 && len(vms) > s.pageSize {
+		next := fmt.Sprintf("%s%s?$skiptoken=%d", s.URL, r.URL.Path, skip+s.pageSize)
+		result.NextLink = &next
+		vms = vms[:s.pageSize]
+	}
+	result.Value = &vms
+	writeARMResponse(w, result)
+}
+
+func writeARMResponse(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeARMError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %q, "message": %q}}`, code, message)
+}
+
+func TestFakeARMScaleSet(t *testing.T) {
+	s := newFakeARMServer()
+	defer s.Close()
+	s.addScaleSet("sub", "rg", "ss", 2, nil)
+	s.pageSize = 2
+	m := newFakeARMManager(t, s, Config{})
+	defer m.Cleanup()
+
+	scaleSet, err := buildScaleSet("1:5:ss", m)
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterScaleSetWithValidation(context.Background(), scaleSet))
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 2, len(m.scaleSetCache))
+
+	// The VMs of a scale-up are listed on several pages.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	m.resizes.Wait()
+	assert.Equal(t, int64(3), s.capacity("sub", "rg", "ss"))
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 3, len(m.scaleSetCache))
+	vms, err := m.GetScaleSetVms(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(vms))
+
+	instance := &AzureRef{Name: "azure://" + strings.ToLower(*s.scaleSets["sub/rg/ss"].vms[0].ID)}
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{instance}))
+	assert.Equal(t, int64(2), s.capacity("sub", "rg", "ss"))
+	assert.Contains(t, s.requests(), "POST /subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss/delete")
+}
+
+func TestFakeARMThrottling(t *testing.T) {
+	s := newFakeARMServer()
+	defer s.Close()
+	s.addScaleSet("sub", "rg", "ss", 1, nil)
+	m := newFakeARMManager(t, s, Config{CloudProviderBackoffRetries: 2})
+	defer m.Cleanup()
+	m.sizeCacheTTL = 0
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss")
+
+	// The throttled calls are retried.
+	s.throttle(2, time.Second)
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+	assert.Equal(t, 3, len(s.requests()))
+
+	// Once the retries are exhausted the scale set is backed off.
+	s.throttle(3, time.Second)
+	_, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.Error(t, err)
+	_, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	_, backedOff := err.(*ScaleSetBackedOffError)
+	assert.True(t, backedOff, "%v", err)
+	assert.Equal(t, 6, len(s.requests()))
+}
+
+func TestFakeARMRecordedResponses(t *testing.T) {
+	s := newFakeARMServer()
+	defer s.Close()
+	s.addScaleSet("sub", "rg", "ss", 1, map[string]string{"cluster-autoscaler-enabled": "true"})
+	m := newFakeARMManager(t, s, Config{})
+	defer m.Cleanup()
+
+	// A scale set deleted out of band can't be registered.
+	scaleSetPath := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss"
+	s.record(http.MethodGet, scaleSetPath, http.StatusNotFound, `{"error": {"code": "ResourceNotFound", "message": "gone"}}`)
+	scaleSet, err := buildScaleSet("1:5:ss", m)
+	assert.NoError(t, err)
+	err = m.RegisterScaleSetWithValidation(context.Background(), scaleSet)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not found in resource group rg")
+
+	// A server error is retried, then the state is served again.
+	s.record(http.MethodGet, scaleSetPath+"/virtualMachines", http.StatusInternalServerError, `{"error": {"code": "InternalError", "message": "try again"}}`)
+	provider, err := BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:cluster-autoscaler-enabled=true,min=1,max=10"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(provider.NodeGroups()))
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 1, len(m.scaleSetCache))
+	listed := 0
+	for _, request := range s.requests() {
+		if request == "GET "+scaleSetPath+"/virtualMachines" {
+			listed++
+		}
+	}
+	assert.Equal(t, 2, listed)
+}
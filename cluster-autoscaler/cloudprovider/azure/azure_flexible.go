@@ -0,0 +1,258 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// flexibleOrchestrationAPIVersion is the first compute API version supporting
+// the flexible orchestration mode of scale sets, which the vendored compute
+// API predates along with the dedicated host groups.
+const flexibleOrchestrationAPIVersion = "2021-03-01"
+
+// Orchestration modes of scale sets. The VMs of flexible scale sets are
+// regular VMs, listed through the VirtualMachines API.
+const (
+	orchestrationModeUniform  = "Uniform"
+	orchestrationModeFlexible = "Flexible"
+)
+
+// scaleSetProperties are the properties of a scale set missing from the
+// vendored compute API.
+type scaleSetProperties struct {
+	orchestrationMode string
+	// IDs of the dedicated host group and of the proximity placement group
+	// the VMs of the scale set are pinned to, empty if none
+	hostGroupID               string
+	proximityPlacementGroupID string
+}
+
+type flexibleScaleSetClient interface {
+	GetProperties(resourceGroupName string, vmScaleSetName string) (scaleSetProperties, error)
+	ListVMs(resourceGroupName string, vmScaleSetName string) ([]compute.VirtualMachineScaleSetVM, error)
+}
+
+// azureFlexibleScaleSetClient gets the properties of scale sets and lists the
+// VMs of the flexible ones from Azure with flexibleOrchestrationAPIVersion.
+type azureFlexibleScaleSetClient struct {
+	autorest.Client
+	baseURI        string
+	subscriptionID string
+}
+
+func newFlexibleScaleSetClient(baseURI string, subscriptionID string, authorizer autorest.Authorizer) *azureFlexibleScaleSetClient {
+	client := &azureFlexibleScaleSetClient{
+		Client:         autorest.NewClientWithUserAgent(""),
+		baseURI:        baseURI,
+		subscriptionID: subscriptionID,
+	}
+	client.Authorizer = authorizer
+	return client
+}
+
+// flexibleVM is a VM as listed by the VirtualMachines API.
+type flexibleVM struct {
+	ID         *string `json:"id"`
+	Name       *string `json:"name"`
+	Properties struct {
+		ProvisioningState      *string                 `json:"provisioningState"`
+		VirtualMachineScaleSet *compute.SubResource    `json:"virtualMachineScaleSet"`
+		StorageProfile         *compute.StorageProfile `json:"storageProfile"`
+		NetworkProfile         *compute.NetworkProfile `json:"networkProfile"`
+	} `json:"properties"`
+}
+
+// scaleSetVM returns the VM as a scale set VM whose instance ID is its name,
+// which identifies the VMs of flexible scale sets in the scale set API.
+func (vm flexibleVM) scaleSetVM() compute.VirtualMachineScaleSetVM {
+	return compute.VirtualMachineScaleSetVM{
+		ID:         vm.ID,
+		Name:       vm.Name,
+		InstanceID: vm.Name,
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: vm.Properties.ProvisioningState,
+			StorageProfile:    vm.Properties.StorageProfile,
+			NetworkProfile:    vm.Properties.NetworkProfile,
+		},
+	}
+}
+
+// GetProperties gets the properties of the scale set, its orchestration mode
+// defaulting to uniform.
+func (c *azureFlexibleScaleSetClient) GetProperties(resourceGroupName string, vmScaleSetName string) (scaleSetProperties, error) {
+	pathParameters := map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resourceGroupName),
+		"subscriptionId":    autorest.Encode("path", c.subscriptionID),
+		"vmScaleSetName":    autorest.Encode("path", vmScaleSetName),
+	}
+	queryParameters := map[string]interface{}{
+		"api-version": flexibleOrchestrationAPIVersion,
+	}
+	req, err := autorest.CreatePreparer(
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachineScaleSets/{vmScaleSetName}", pathParameters),
+		autorest.WithQueryParameters(queryParameters)).Prepare(&http.Request{})
+	if err != nil {
+		return scaleSetProperties{}, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "GetProperties", nil, "Failure preparing request")
+	}
+	resp, err := autorest.SendWithSender(c, req)
+	if err != nil {
+		return scaleSetProperties{}, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "GetProperties", resp, "Failure sending request")
+	}
+
+	var scaleSet struct {
+		Properties struct {
+			OrchestrationMode       string               `json:"orchestrationMode"`
+			HostGroup               *compute.SubResource `json:"hostGroup"`
+			ProximityPlacementGroup *compute.SubResource `json:"proximityPlacementGroup"`
+		} `json:"properties"`
+	}
+	err = autorest.Respond(
+		resp,
+		c.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&scaleSet),
+		autorest.ByClosing())
+	if err != nil {
+		return scaleSetProperties{}, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "GetProperties", resp, "Failure responding to request")
+	}
+	properties := scaleSetProperties{orchestrationMode: scaleSet.Properties.OrchestrationMode}
+	if properties.orchestrationMode == "" {
+		properties.orchestrationMode = orchestrationModeUniform
+	}
+	if group := scaleSet.Properties.HostGroup; group != nil && group.ID != nil {
+		properties.hostGroupID = *group.ID
+	}
+	if group := scaleSet.Properties.ProximityPlacementGroup; group != nil && group.ID != nil {
+		properties.proximityPlacementGroupID = *group.ID
+	}
+	return properties, nil
+}
+
+// ListVMs lists the VMs of the resource group which belong to the given
+// flexible scale set.
+func (c *azureFlexibleScaleSetClient) ListVMs(resourceGroupName string, vmScaleSetName string) ([]compute.VirtualMachineScaleSetVM, error) {
+	pathParameters := map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resourceGroupName),
+		"subscriptionId":    autorest.Encode("path", c.subscriptionID),
+	}
+	queryParameters := map[string]interface{}{
+		"api-version": flexibleOrchestrationAPIVersion,
+	}
+	req, err := autorest.CreatePreparer(
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachines", pathParameters),
+		autorest.WithQueryParameters(queryParameters)).Prepare(&http.Request{})
+	if err != nil {
+		return nil, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "ListVMs", nil, "Failure preparing request")
+	}
+
+	suffix := strings.ToLower("/providers/Microsoft.Compute/virtualMachineScaleSets/" + vmScaleSetName)
+	vms := make([]compute.VirtualMachineScaleSetVM, 0)
+	for {
+		resp, err := autorest.SendWithSender(c, req)
+		if err != nil {
+			return nil, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "ListVMs", resp, "Failure sending request")
+		}
+		var result struct {
+			Value    []flexibleVM `json:"value"`
+			NextLink *string      `json:"nextLink"`
+		}
+		err = autorest.Respond(
+			resp,
+			c.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK),
+			autorest.ByUnmarshallingJSON(&result),
+			autorest.ByClosing())
+		if err != nil {
+			return nil, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "ListVMs", resp, "Failure responding to request")
+		}
+		for _, vm := range result.Value {
+			scaleSet := vm.Properties.VirtualMachineScaleSet
+			if vm.ID == nil || scaleSet == nil || scaleSet.ID == nil || !strings.HasSuffix(strings.ToLower(*scaleSet.ID), suffix) {
+				continue
+			}
+			vms = append(vms, vm.scaleSetVM())
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			return vms, nil
+		}
+		req, err = autorest.CreatePreparer(
+			autorest.AsGet(),
+			autorest.WithBaseURL(*result.NextLink)).Prepare(&http.Request{})
+		if err != nil {
+			return nil, autorest.NewErrorWithError(err, "azure.azureFlexibleScaleSetClient", "ListVMs", nil, "Failure preparing next results request")
+		}
+	}
+}
+
+// getScaleSetProperties returns the properties of the scale set, those of an
+// unpinned uniform scale set when the manager has no flexibleClient.
+func (m *AzureManager) getScaleSetProperties(scaleSet *ScaleSet) (scaleSetProperties, error) {
+	clients, err := m.clientsOf(scaleSet)
+	if err != nil {
+		return scaleSetProperties{}, err
+	}
+	if clients.flexibleClient == nil {
+		return scaleSetProperties{orchestrationMode: orchestrationModeUniform}, nil
+	}
+	return clients.flexibleClient.GetProperties(m.resourceGroup(scaleSet), scaleSet.Name)
+}
+
+// isFlexible returns true if the registered scale set is in the flexible
+// orchestration mode according to its last refresh.
+func (m *AzureManager) isFlexible(scaleSet *ScaleSet) bool {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	sset := m.getScaleSetInformation(scaleSet)
+	return sset != nil && sset.properties.orchestrationMode == orchestrationModeFlexible
+}
+
+// listVMs lists the VMs of the scale set with the given name, in the
+// subscription and resource group of scaleSet, through the API of its
+// orchestration mode.
+func (m *AzureManager) listVMs(scaleSet *ScaleSet, name string, flexible bool) ([]compute.VirtualMachineScaleSetVM, error) {
+	clients, err := m.clientsOf(scaleSet)
+	if err != nil {
+		return nil, err
+	}
+	if flexible {
+		return clients.flexibleClient.ListVMs(m.resourceGroup(scaleSet), name)
+	}
+	return m.listScaleSetVMs(clients.scaleSetVmClient, m.resourceGroup(scaleSet), name)
+}
+
+// ownsInstance returns true if the instance with the given normalized name
+// belongs to the scale set. The IDs of the VMs of flexible scale sets don't
+// tell their scale set, the ones listed by its last refresh are used instead.
+// The cache lock must be held.
+func (m *AzureManager) ownsInstance(sset *scaleSetInformation, name string) bool {
+	if sset.properties.orchestrationMode == orchestrationModeFlexible {
+		return sset.instanceNames[name]
+	}
+	ref, err := parseAzureRef(AzureRef{Name: name})
+	return err == nil && strings.EqualFold(ref.scaleSet, sset.basename) && strings.EqualFold(ref.resourceGroup, m.resourceGroup(sset.config)) &&
+		m.inSubscription(sset.config, ref.subscriptionID)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// flexibleScaleSetClientMock is a flexibleScaleSetClient whose responses are set up per test.
+type flexibleScaleSetClientMock struct {
+	mock.Mock
+}
+
+func (client *flexibleScaleSetClientMock) GetProperties(resourceGroupName string, vmScaleSetName string) (scaleSetProperties, error) {
+	args := client.Called(resourceGroupName, vmScaleSetName)
+	return args.Get(0).(scaleSetProperties), args.Error(1)
+}
+
+func (client *flexibleScaleSetClientMock) ListVMs(resourceGroupName string, vmScaleSetName string) ([]compute.VirtualMachineScaleSetVM, error) {
+	args := client.Called(resourceGroupName, vmScaleSetName)
+	return args.Get(0).([]compute.VirtualMachineScaleSetVM), args.Error(1)
+}
+
+func newTestFlexibleVM(name string, state string) compute.VirtualMachineScaleSetVM {
+	id := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name
+	return compute.VirtualMachineScaleSetVM{
+		ID:         &id,
+		Name:       &name,
+		InstanceID: &name,
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: &state,
+		},
+	}
+}
+
+func TestGetScaleSetProperties(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, flexibleOrchestrationAPIVersion, r.URL.Query().Get("api-version"))
+		switch r.URL.Path {
+		case "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/flex":
+			fmt.Fprint(w, `{"properties": {"orchestrationMode": "Flexible", "hostGroup": {"id": "/hostGroups/hg"}}}`)
+		case "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/uniform":
+			fmt.Fprint(w, `{"properties": {"proximityPlacementGroup": {"id": "/proximityPlacementGroups/ppg"}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "NotFound"}}`)
+		}
+	}))
+	defer server.Close()
+	client := newFlexibleScaleSetClient(server.URL, "sub", autorest.NullAuthorizer{})
+
+	properties, err := client.GetProperties("rg", "flex")
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSetProperties{orchestrationMode: orchestrationModeFlexible, hostGroupID: "/hostGroups/hg"}, properties)
+
+	properties, err = client.GetProperties("rg", "uniform")
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSetProperties{orchestrationMode: orchestrationModeUniform, proximityPlacementGroupID: "/proximityPlacementGroups/ppg"}, properties)
+
+	_, err = client.GetProperties("rg", "missing")
+	assert.True(t, isNotFoundError(err))
+}
+
+func TestListFlexibleVMs(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines", r.URL.Path)
+		assert.Equal(t, flexibleOrchestrationAPIVersion, r.URL.Query().Get("api-version"))
+		vmss := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/"
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"value": [
+				{"id": "/vms/flex-1", "name": "flex-1", "properties": {"provisioningState": "Succeeded", "virtualMachineScaleSet": {"id": "%sFlex"}}},
+				{"id": "/vms/other-1", "name": "other-1", "properties": {"virtualMachineScaleSet": {"id": "%sother"}}},
+				{"id": "/vms/standalone", "name": "standalone", "properties": {}}
+			], "nextLink": "%s%s?api-version=%s&page=2"}`, vmss, vmss, server.URL, r.URL.Path, flexibleOrchestrationAPIVersion)
+			return
+		}
+		fmt.Fprintf(w, `{"value": [
+			{"id": "/vms/flex-2", "name": "flex-2", "properties": {"provisioningState": "Failed", "virtualMachineScaleSet": {"id": "%sflex"}}}
+		]}`, vmss)
+	}))
+	defer server.Close()
+	client := newFlexibleScaleSetClient(server.URL, "sub", autorest.NullAuthorizer{})
+
+	vms, err := client.ListVMs("rg", "flex")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(vms)) {
+		assert.Equal(t, "/vms/flex-1", *vms[0].ID)
+		assert.Equal(t, "flex-1", *vms[0].InstanceID)
+		assert.Equal(t, "Succeeded", vmProvisioningState(vms[0]))
+		assert.Equal(t, "flex-2", *vms[1].InstanceID)
+		assert.Equal(t, vmProvisioningStateFailed, vmProvisioningState(vms[1]))
+	}
+}
+
+func TestFlexibleScaleSet(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	flexibleClient := &flexibleScaleSetClientMock{}
+	protectionClient := &vmProtectionClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.flexibleClient = flexibleClient
+	m.protectionClient = protectionClient
+	m.deallocateOnScaleDown = true
+	scaleSet := registerTestScaleSet(t, m, "1:5:flex")
+
+	vms := []compute.VirtualMachineScaleSetVM{
+		newTestFlexibleVM("flex-1", "Succeeded"),
+		newTestFlexibleVM("flex-2", vmProvisioningStateDeleting),
+	}
+	ssClient.On("Get", "rg", "flex").Return(newTestScaleSet("flex", 2), nil)
+	flexibleClient.On("GetProperties", "rg", "flex").Return(scaleSetProperties{orchestrationMode: orchestrationModeFlexible}, nil).Once()
+	flexibleClient.On("ListVMs", "rg", "flex").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// The VMs are cached by their ID, which doesn't contain the scale set name.
+	ref := &AzureRef{Name: "azure://" + *vms[0].ID}
+	found, err := m.GetScaleSetForInstance(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, scaleSet, found)
+	state, ok := m.GetInstanceProvisioningState(&AzureRef{Name: "azure://" + *vms[1].ID})
+	assert.True(t, ok)
+	assert.Equal(t, vmProvisioningStateDeleting, state)
+	names, err := m.GetScaleSetVms(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{normalizeAzureRef(*ref).Name}, names)
+	vmClient.AssertNotCalled(t, "List", mock.Anything, mock.Anything)
+
+	// The VMs are deleted by name without checking their protection policy,
+	// even in the deallocate scale-down mode.
+	ssClient.On("DeleteInstances", "rg", "flex", mock.Anything).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "flex", mock.Anything).Return(nil)
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref}))
+	ssClient.AssertCalled(t, "DeleteInstances", "rg", "flex", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &[]string{"flex-1"}})
+	protectionClient.AssertNotCalled(t, "GetProtectionPolicy", mock.Anything, mock.Anything, mock.Anything)
+
+	// The properties are only fetched once.
+	assert.NoError(t, m.Refresh())
+	flexibleClient.AssertNumberOfCalls(t, "GetProperties", 1)
+}
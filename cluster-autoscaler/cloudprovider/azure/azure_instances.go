@@ -0,0 +1,136 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"time"
+)
+
+// failedProvisioningBackoff is how long a scale set whose new VMs failed to
+// be provisioned is backed off for.
+const failedProvisioningBackoff = 5 * time.Minute
+
+// cachedInstanceNames returns the names of the cached instances of the scale
+// set.
+func (m *AzureManager) cachedInstanceNames(scaleSet *ScaleSet) map[string]bool {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	names := make(map[string]bool)
+	for ref, config := range m.scaleSetCache {
+		if config == scaleSet {
+			names[ref.Name] = true
+		}
+	}
+	return names
+}
+
+// abortFailedScaleUps deletes the instances created by the pending scale-ups
+// which failed to be provisioned according to the last refresh, forgets the
+// scale-ups and backs their scale sets off for failedProvisioningBackoff.
+// The target size of the node group drops at once, and the next scale-up of
+// the node group fails so that the core autoscaler backs it off in turn,
+// instead of waiting for the instances until max-node-provision-time.
+// The instances which were already failed before the scale-up are kept.
+func (m *AzureManager) abortFailedScaleUps(ctx context.Context) {
+	m.sizeMutex.Lock()
+	pending := make(map[string]scaleUp, len(m.scaleUps))
+	for key, s := range m.scaleUps {
+		pending[key] = s
+	}
+	m.sizeMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	m.cacheMutex.Lock()
+	scaleSets := make([]*ScaleSet, 0)
+	failed := make(map[*ScaleSet][]*AzureRef)
+	for _, sset := range m.scaleSets {
+		s, found := pending[m.scaleSetKey(sset.config)]
+		if !found {
+			continue
+		}
+		for name, state := range m.instanceStateCache {
+			if state != vmProvisioningStateFailed || !m.ownsInstance(sset, name) || s.existing[name] {
+				continue
+			}
+			if _, found := failed[sset.config]; !found {
+				scaleSets = append(scaleSets, sset.config)
+			}
+			failed[sset.config] = append(failed[sset.config], &AzureRef{Name: name})
+		}
+	}
+	m.cacheMutex.Unlock()
+
+	for _, scaleSet := range scaleSets {
+		instances := failed[scaleSet]
+		m.log().Warningf("%d new instance(s) of scale set %s failed to be provisioned, deleting them and aborting the scale-up", len(instances), scaleSet.Name)
+		m.sizeMutex.Lock()
+		delete(m.scaleUps, m.scaleSetKey(scaleSet))
+		m.sizeMutex.Unlock()
+		if err := m.DeleteInstances(ctx, instances); err != nil {
+			m.log().Errorf("Failed to delete the instances of scale set %s which failed to be provisioned: %v", scaleSet.Name, err)
+		}
+		m.backOff(scaleSet, failedProvisioningBackoff, "new instances failed to be provisioned")
+	}
+}
+
+// abortTimedOutScaleUps forgets the pending scale-ups whose VMs are still
+// missing after the maximum provisioning time of their scale sets, see
+// CheckScaleUp, and backs their scale sets off for failedProvisioningBackoff,
+// so that the next scale-up of the node group fails and the core autoscaler
+// tries the other node groups. The capacity of the scale sets is kept, the
+// core autoscaler decreases the target size of the node group in turn.
+func (m *AzureManager) abortTimedOutScaleUps(ctx context.Context) {
+	m.sizeMutex.Lock()
+	pending := make(map[string]bool, len(m.scaleUps))
+	for key := range m.scaleUps {
+		pending[key] = true
+	}
+	m.sizeMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	m.cacheMutex.Lock()
+	scaleSets := make([]*ScaleSet, 0, len(pending))
+	for _, sset := range m.scaleSets {
+		if pending[m.scaleSetKey(sset.config)] {
+			scaleSets = append(scaleSets, sset.config)
+		}
+	}
+	m.cacheMutex.Unlock()
+
+	for _, scaleSet := range scaleSets {
+		err := m.CheckScaleUp(ctx, scaleSet)
+		timeoutErr, timedOut := err.(*ScaleUpTimeoutError)
+		if !timedOut {
+			if err != nil {
+				m.log().Warningf("Failed to check the scale-up of scale set %s: %v", scaleSet.Name, err)
+			}
+			continue
+		}
+		m.log().Warningf("Aborting the scale-up of scale set %s: %v", scaleSet.Name, timeoutErr)
+		m.sizeMutex.Lock()
+		if current, found := m.scaleUps[m.scaleSetKey(scaleSet)]; found && current.requestedAt.Equal(timeoutErr.Since) {
+			delete(m.scaleUps, m.scaleSetKey(scaleSet))
+		}
+		m.sizeMutex.Unlock()
+		m.backOff(scaleSet, failedProvisioningBackoff, "new instances didn't come up in time")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestVMListResultWithStates returns the VMs of the scale set with the
+// given provisioning states.
+func newTestVMListResultWithStates(scaleSetName string, states ...string) compute.VirtualMachineScaleSetVMListResult {
+	result := newTestVMListResult(scaleSetName, len(states))
+	for i := range *result.Value {
+		state := states[i]
+		(*result.Value)[i].VirtualMachineScaleSetVMProperties = &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: &state,
+		}
+	}
+	return result
+}
+
+func TestAbortFailedScaleUps(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	// The second instance failed before the scale-up.
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Failed"), nil).Once()
+	assert.NoError(t, m.Refresh())
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 4))
+	m.resizes.Wait()
+
+	// Nothing is aborted while the new instances are being created.
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Failed", "Creating", "Creating"), nil).Once()
+	assert.NoError(t, m.Refresh())
+	m.abortFailedScaleUps(context.Background())
+	assert.NoError(t, m.checkBackoff(scaleSet))
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+
+	// Only the new instance which failed is deleted.
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Failed", "Failed", "Succeeded"), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	assert.NoError(t, m.Refresh())
+	m.abortFailedScaleUps(context.Background())
+	ssClient.AssertCalled(t, "DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &[]string{"2"}})
+	assert.Empty(t, m.scaleUps)
+	_, backedOff := m.checkBackoff(scaleSet).(*ScaleSetBackedOffError)
+	assert.True(t, backedOff)
+
+	// The next scale-up of the node group fails.
+	assert.Error(t, m.SetScaleSetSize(context.Background(), scaleSet, 5))
+}
+
+func TestAbortTimedOutScaleUps(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleUpTimeout = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	// Azure accepts the new capacity but the VMs never come up.
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	m.resizes.Wait()
+
+	// Nothing is aborted before the timeout.
+	m.abortTimedOutScaleUps(context.Background())
+	assert.NotEmpty(t, m.scaleUps)
+	assert.NoError(t, m.checkBackoff(scaleSet))
+
+	pending := m.scaleUps["rg/ss1"]
+	pending.requestedAt = time.Now().Add(-2 * time.Minute)
+	m.scaleUps["rg/ss1"] = pending
+	m.abortTimedOutScaleUps(context.Background())
+	assert.Empty(t, m.scaleUps)
+	_, backedOff := m.checkBackoff(scaleSet).(*ScaleSetBackedOffError)
+	assert.True(t, backedOff)
+
+	// The next scale-up of the node group fails.
+	assert.Error(t, m.SetScaleSetSize(context.Background(), scaleSet, 4))
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	keyVaultAPIVersion = "7.0"
+	// Time after which a secret read from Key Vault is read again, so that a
+	// new version of the secret is picked up.
+	keyVaultSecretRefreshInterval = time.Hour
+	// A secret read from Key Vault is read again this long before it expires.
+	keyVaultSecretExpiryMargin = 10 * time.Minute
+)
+
+// newKeyVaultToken creates the token of the requests to Key Vault, issued for
+// the managed identity of the VM. It's a variable for testing.
+var newKeyVaultToken = func(userAssignedIdentityID string, resource string) (adal.OAuthTokenProvider, error) {
+	return newServicePrincipalTokenFromMSI(userAssignedIdentityID, resource)
+}
+
+// keyVaultSecret is a secret read from Key Vault.
+type keyVaultSecret struct {
+	uri        string
+	identityID string
+	value      string
+	// expires is zero if the secret doesn't expire
+	expires time.Time
+	read    time.Time
+}
+
+// stale returns true if the secret must be read again at now.
+func (s keyVaultSecret) stale(now time.Time) bool {
+	if now.Sub(s.read) >= keyVaultSecretRefreshInterval {
+		return true
+	}
+	return !s.expires.IsZero() && s.expires.Sub(now) <= keyVaultSecretExpiryMargin
+}
+
+// validateKeyVaultSecretURI checks that uri is the URL of a Key Vault secret,
+// e.g. https://myvault.vault.azure.net/secrets/mysecret, optionally followed
+// by the version of the secret.
+func validateKeyVaultSecretURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Scheme != "https" || u.Host == "" || len(segments) < 2 || len(segments) > 3 || segments[0] != "secrets" {
+		return fmt.Errorf("%q is not the URL of a Key Vault secret", uri)
+	}
+	return nil
+}
+
+// clientSecretFromKeyVault returns the client secret referenced by
+// cfg.AADClientSecretKeyVaultURI. The secret is read with the managed identity
+// of the VM, and read again once it's stale so that a rotated or expiring
+// secret is replaced before the token requests start failing.
+func (p *reloadableTokenProvider) clientSecretFromKeyVault(cfg *Config) (string, error) {
+	now := time.Now()
+	p.mutex.Lock()
+	cached := p.keyVaultSecret
+	p.mutex.Unlock()
+	if cached.uri == cfg.AADClientSecretKeyVaultURI && cached.identityID == cfg.UserAssignedIdentityID && !cached.stale(now) {
+		return cached.value, nil
+	}
+
+	token, err := newKeyVaultToken(cfg.UserAssignedIdentityID, strings.TrimSuffix(p.env.KeyVaultEndpoint, "/"))
+	if err != nil {
+		return "", fmt.Errorf("azure: failed to create Key Vault token: %v", err)
+	}
+	var sender autorest.Sender = http.DefaultClient
+	if p.sender != nil {
+		sender = p.sender
+	}
+	secret, err := readKeyVaultSecret(cfg.AADClientSecretKeyVaultURI, token, sender)
+	if err != nil {
+		return "", fmt.Errorf("azure: failed to read client secret from Key Vault: %v", err)
+	}
+	secret.identityID = cfg.UserAssignedIdentityID
+	secret.read = now
+	if !secret.expires.IsZero() && secret.expires.Sub(now) <= keyVaultSecretExpiryMargin {
+		p.logger.Warningf("The client secret %s expires at %v", secret.uri, secret.expires)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keyVaultSecret = secret
+	return secret.value, nil
+}
+
+// readKeyVaultSecret reads the secret at secretURI from Key Vault.
+func readKeyVaultSecret(secretURI string, token adal.OAuthTokenProvider, sender autorest.Sender) (keyVaultSecret, error) {
+	queryParameters := map[string]interface{}{
+		"api-version": keyVaultAPIVersion,
+	}
+	req, err := autorest.CreatePreparer(
+		autorest.AsGet(),
+		autorest.WithBaseURL(secretURI),
+		autorest.WithQueryParameters(queryParameters),
+		autorest.NewBearerAuthorizer(token).WithAuthorization()).Prepare(&http.Request{})
+	if err != nil {
+		return keyVaultSecret{}, autorest.NewErrorWithError(err, "azure.keyVault", "GetSecret", nil, "Failure preparing request")
+	}
+	resp, err := autorest.SendWithSender(sender, req)
+	if err != nil {
+		return keyVaultSecret{}, autorest.NewErrorWithError(err, "azure.keyVault", "GetSecret", resp, "Failure sending request")
+	}
+
+	var bundle struct {
+		Value      *string `json:"value"`
+		Attributes struct {
+			Enabled *bool  `json:"enabled"`
+			Expires *int64 `json:"exp"`
+		} `json:"attributes"`
+	}
+	err = autorest.Respond(
+		resp,
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&bundle),
+		autorest.ByClosing())
+	if err != nil {
+		return keyVaultSecret{}, autorest.NewErrorWithError(err, "azure.keyVault", "GetSecret", resp, "Failure responding to request")
+	}
+	if bundle.Attributes.Enabled != nil && !*bundle.Attributes.Enabled {
+		return keyVaultSecret{}, fmt.Errorf("secret %s is disabled", secretURI)
+	}
+	if bundle.Value == nil || *bundle.Value == "" {
+		return keyVaultSecret{}, fmt.Errorf("secret %s has no value", secretURI)
+	}
+	secret := keyVaultSecret{uri: secretURI, value: *bundle.Value}
+	if bundle.Attributes.Expires != nil {
+		secret.expires = time.Unix(*bundle.Attributes.Expires, 0)
+	}
+	return secret, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticToken is a token provider of a fixed access token.
+type staticToken string
+
+func (t staticToken) OAuthToken() string {
+	return string(t)
+}
+
+func TestValidateKeyVaultSecretURI(t *testing.T) {
+	assert.NoError(t, validateKeyVaultSecretURI("https://vault.vault.azure.net/secrets/client-secret"))
+	assert.NoError(t, validateKeyVaultSecretURI("https://vault.vault.azure.net/secrets/client-secret/0123456789abcdef"))
+	for _, uri := range []string{
+		"http://vault.vault.azure.net/secrets/client-secret",
+		"https://vault.vault.azure.net/secrets",
+		"https://vault.vault.azure.net/certificates/client-cert",
+		"/secrets/client-secret",
+	} {
+		assert.Error(t, validateKeyVaultSecretURI(uri), uri)
+	}
+}
+
+func TestClientSecretFromKeyVault(t *testing.T) {
+	var mutex sync.Mutex
+	value, expires, status, reads := "secret", int64(0), http.StatusOK, 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reads++
+		assert.Equal(t, "/secrets/client-secret", r.URL.Path)
+		assert.Equal(t, keyVaultAPIVersion, r.URL.Query().Get("api-version"))
+		assert.Equal(t, "Bearer vault-token", r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+		if expires != 0 {
+			fmt.Fprintf(w, `{"value": %q, "attributes": {"enabled": true, "exp": %d}}`, value, expires)
+		} else {
+			fmt.Fprintf(w, `{"value": %q, "attributes": {"enabled": true}}`, value)
+		}
+	}))
+	defer server.Close()
+
+	defer func(f func(string, string) (adal.OAuthTokenProvider, error)) { newKeyVaultToken = f }(newKeyVaultToken)
+	var identities, resources []string
+	newKeyVaultToken = func(userAssignedIdentityID string, resource string) (adal.OAuthTokenProvider, error) {
+		identities = append(identities, userAssignedIdentityID)
+		resources = append(resources, resource)
+		return staticToken("vault-token"), nil
+	}
+
+	cfg := Config{
+		AADTenantID:                "tenant",
+		AADClientID:                "client",
+		AADClientSecretKeyVaultURI: server.URL + "/secrets/client-secret",
+		UserAssignedIdentityID:     "user-assigned-id",
+	}
+	p, err := newReloadableTokenProvider(&cfg, azure.PublicCloud, server.Client(), defaultLogger)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", p.credentials.clientSecret)
+	assert.Equal(t, []string{"user-assigned-id"}, identities)
+	assert.Equal(t, []string{"https://vault.azure.net"}, resources)
+	token := p.current()
+
+	// The secret isn't read again until it's stale.
+	updated, err := p.update(&cfg)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+	assert.Equal(t, 1, reads)
+
+	// A rotated secret is picked up once the refresh interval elapsed.
+	mutex.Lock()
+	value = "rotated"
+	mutex.Unlock()
+	p.keyVaultSecret.read = time.Now().Add(-keyVaultSecretRefreshInterval)
+	updated, err = p.update(&cfg)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, "rotated", p.credentials.clientSecret)
+	assert.False(t, token == p.current())
+
+	// A secret about to expire is read again at each update.
+	mutex.Lock()
+	expires = time.Now().Add(keyVaultSecretExpiryMargin / 2).Unix()
+	mutex.Unlock()
+	p.keyVaultSecret.read = time.Time{}
+	_, err = p.update(&cfg)
+	assert.NoError(t, err)
+	_, err = p.update(&cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, reads)
+
+	// The current token is kept if the secret can't be read.
+	token = p.current()
+	mutex.Lock()
+	status = http.StatusForbidden
+	mutex.Unlock()
+	_, err = p.update(&cfg)
+	assert.Error(t, err)
+	assert.True(t, token == p.current())
+	assert.Equal(t, "rotated", p.credentials.clientSecret)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Logger is the logger used by the AzureManager. It can be replaced to send the
+// logs of the Azure cloud provider somewhere else than glog.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// V returns a logger logging only if the verbosity is at least level.
+	V(level int) VerboseLogger
+}
+
+// VerboseLogger logs informational messages of a given verbosity.
+type VerboseLogger interface {
+	Infof(format string, args ...interface{})
+}
+
+// glogLogger is the default Logger, writing to glog.
+type glogLogger struct{}
+
+var defaultLogger Logger = glogLogger{}
+
+// The depth of 1 attributes the messages to the callers of the logger.
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) V(level int) VerboseLogger {
+	return glog.V(glog.Level(level))
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeLogger is a Logger recording the logged messages.
+type fakeLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *fakeLogger) log(level string, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *fakeLogger) Infof(format string, args ...interface{}) {
+	l.log("I", format, args...)
+}
+
+func (l *fakeLogger) Warningf(format string, args ...interface{}) {
+	l.log("W", format, args...)
+}
+
+func (l *fakeLogger) Errorf(format string, args ...interface{}) {
+	l.log("E", format, args...)
+}
+
+func (l *fakeLogger) V(level int) VerboseLogger {
+	return &fakeVerboseLogger{logger: l, level: level}
+}
+
+type fakeVerboseLogger struct {
+	logger *fakeLogger
+	level  int
+}
+
+func (l *fakeVerboseLogger) Infof(format string, args ...interface{}) {
+	l.logger.log(fmt.Sprintf("V%d", l.level), format, args...)
+}
+
+// contains returns true if a message starting with prefix was logged.
+func (l *fakeLogger) contains(prefix string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestManagerLogger(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	logger := &fakeLogger{}
+	m.logger = logger
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 2)
+	// The capacity is decremented by the deletion.
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Times(2)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+	assert.True(t, logger.contains("V2: Regenerated cache of 1 scale sets, 0 availability sets and 0 agent pools: 2 instances"), "%v", logger.messages)
+
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	assert.NoError(t, m.DeleteInstances(context.Background(), []*AzureRef{ref}))
+	assert.True(t, logger.contains("I: Deleting instances [0] of scale set ss1"), "%v", logger.messages)
+
+	unknown := &AzureRef{Name: "azure://unknown"}
+	assert.Error(t, m.DeleteInstances(context.Background(), []*AzureRef{unknown}))
+	assert.True(t, logger.contains("W: Skipping deletion of instance azure://unknown"), "%v", logger.messages)
+}
+
+func TestManagerDefaultLogger(t *testing.T) {
+	m := &AzureManager{}
+	assert.Equal(t, defaultLogger, m.log())
+}
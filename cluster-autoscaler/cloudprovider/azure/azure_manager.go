@@ -17,37 +17,127 @@ limitations under the License.
 package azure
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
-	"strings"
+	"io/ioutil"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/adal"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/golang/glog"
-
-	"gopkg.in/gcfg.v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/kubernetes"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+const (
+	defaultCacheConcurrency = 5
+	defaultSizeCacheTTL     = 5 * time.Second
+	// Time after which the cached instances of a scale set are refreshed by
+	// RefreshExpiredScaleSets.
+	defaultScaleSetCacheTTL = 5 * time.Minute
+	// Maximum number of instances deleted by a single call to Azure.
+	defaultMaxDeletionBatchSize = 100
+	// Minimum interval between two full cache regenerations caused by lookups
+	// of unknown instances.
+	defaultMinRegenerationInterval = 30 * time.Second
+	// Age of the last successful cache regeneration after which the manager is
+	// reported unhealthy. The cache is regenerated every hour in background.
+	defaultCacheStalenessThreshold = 2 * time.Hour
+	// Time after which a scale-up whose VMs didn't come up is reported as failed.
+	defaultScaleUpTimeout = 15 * time.Minute
+	// Time after which an asynchronous operation, e.g. a resize or a deletion,
+	// is canceled.
+	defaultOperationTimeout = 15 * time.Minute
+	// Time after which a request to Azure is canceled.
+	defaultRequestTimeout = time.Minute
+	// Minimum time the calls to a scale set are suspended for once Azure
+	// throttled them.
+	defaultThrottlingBackoff = 5 * time.Minute
+	// Time a spot or pinned scale set is backed off for after Azure failed to
+	// allocate its VMs.
+	defaultSpotAllocationBackoff = 10 * time.Minute
+	// Time before the expiry of the client certificate from which it's
+	// logged as expiring.
+	certificateExpiryWarning = 30 * 24 * time.Hour
 )
 
 type scaleSetInformation struct {
 	config   *ScaleSet
 	basename string
+
+	// State observed during the last cache regeneration.
+	targetSize  int64
+	currentSize int
+	zones       []string
+	lastRefresh time.Time
+	lastError   error
+	// end of the last refresh, whose result is shared with the callers which
+	// waited for it
+	refreshed time.Time
+	// expired is set by the scale operations so that the instances are
+	// refreshed before scaleSetCacheTTL elapses.
+	expired bool
+	// instance IDs of the deallocated VMs by instance name, only tracked in
+	// the deallocate scale-down mode
+	deallocated map[string]string
+	// properties of the scale set missing from the vendored compute API,
+	// fetched by its first refresh
+	properties scaleSetProperties
+	// names of the instances, only tracked for the flexible scale sets whose
+	// VM IDs don't tell their scale set
+	instanceNames map[string]bool
+}
+
+// ScaleSetStatus is a point-in-time view of a registered scale set.
+type ScaleSetStatus struct {
+	Name    string
+	MinSize int
+	MaxSize int
+	// TargetSize is the capacity requested from the scale set.
+	TargetSize int64
+	// CurrentSize is the number of VMs listed in the scale set.
+	CurrentSize int
+	// Deallocated is the number of deallocated VMs, which are part of the
+	// capacity, in the deallocate scale-down mode.
+	Deallocated int
+	// Zones are the availability zones of the scale set, empty if it's not
+	// zonal.
+	Zones []string
+	// ProvisioningTime is the usual time its new VMs take to be provisioned,
+	// zero if unknown, see GetProvisioningTime.
+	ProvisioningTime time.Duration
+	// Healthy is false if the last refresh of the scale set failed.
+	Healthy     bool
+	LastError   error
+	LastRefresh time.Time
 }
 
 type scaleSetClient interface {
 	Get(resourceGroupName string, vmScaleSetName string) (result compute.VirtualMachineScaleSet, err error)
 	CreateOrUpdate(resourceGroupName string, name string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error)
 	DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+	Deallocate(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+	Start(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+	List(resourceGroupName string) (result compute.VirtualMachineScaleSetListResult, err error)
+	ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (result compute.VirtualMachineScaleSetListResult, err error)
+}
+
+type vmSizeClient interface {
+	List(location string) (result compute.VirtualMachineSizeListResult, err error)
+}
+
+type resourceSkuClient interface {
+	List() (result compute.ResourceSkusResult, err error)
+	ListNextResults(lastResults compute.ResourceSkusResult) (result compute.ResourceSkusResult, err error)
 }
 
 type scaleSetVMClient interface {
 	List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (result compute.VirtualMachineScaleSetVMListResult, err error)
+	ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (result compute.VirtualMachineScaleSetVMListResult, err error)
 }
 
 // AzureManager handles Azure communication and data caching.
@@ -56,304 +146,418 @@ type AzureManager struct {
 	subscription      string
 	scaleSetClient    scaleSetClient
 	scaleSetVmClient  scaleSetVMClient
+	// other resource groups searched for scale sets by auto discovery,
+	// prefixed by their subscription if it's not the one of the manager
+	discoveryResourceGroups []string
+	// newSubscriptionClients creates the clients of the scale sets of the
+	// other subscriptions, which aren't supported if it's nil
+	newSubscriptionClients func(subscriptionID string) *subscriptionClients
+	// clients of the scale sets of the other subscriptions, by lowercase
+	// subscription ID
+	otherSubscriptionClients map[string]*subscriptionClients
+	subscriptionsMutex       sync.Mutex
 
 	scaleSets     []*scaleSetInformation
 	scaleSetCache map[AzureRef]*ScaleSet
 
+	// vmType is vmTypeStandard if the node groups are availability sets and
+	// vmTypeAKS if they are AKS agent pools.
+	vmType                string
+	availabilitySetClient availabilitySetClient
+	virtualMachineClient  virtualMachineClient
+	interfaceClient       interfaceClient
+	diskClient            diskClient
+	availabilitySets      []*AvailabilitySet
+	// cache of mapping from VM to availability set
+	availabilitySetCache map[AzureRef]*AvailabilitySet
+
+	// aksClusterName is the AKS cluster in resourceGroupName whose agent pools
+	// are the node groups if vmType is vmTypeAKS.
+	aksClusterName  string
+	agentPoolClient agentPoolClient
+	aksAgentPools   []*AKSAgentPool
+	// cache of mapping from VM to agent pool
+	aksAgentPoolCache map[AzureRef]*AKSAgentPool
+	// aksCluster is fetched the first time it's needed, guarded by aksMutex
+	aksCluster *managedCluster
+	aksMutex   sync.Mutex
+
 	// cache of mapping from instance id to the scale set id
 	scaleSetIdCache map[string]string
+	// cache of the provisioning states of the instances, including the ones being deleted
+	instanceStateCache map[string]string
+	// times since which the instances are stuck in a failed or updating
+	// state, guarded by cacheMutex
+	stuckInstances map[string]time.Time
+	// time after which the stuck instances are force-deleted, never if zero
+	stuckInstanceTimeout time.Duration
+	// time after which the asynchronous operations are canceled,
+	// defaultOperationTimeout if zero
+	operationTimeout time.Duration
+	// number of scale sets fetched concurrently when regenerating the cache
+	cacheConcurrency int
+	// maximum number of instances deleted by a single call to Azure
+	maxDeletionBatchSize int
+	// bounds of the scale sets overriding the ones they were registered with,
+	// keyed like sizeCache and reloaded with the cloud-config
+	boundsOverrides map[string]scaleSetBounds
+	boundsMutex     sync.Mutex
+	// queues of the instances to remove, keyed like sizeCache
+	removalQueues map[string]*removalQueue
+	removalMutex  sync.Mutex
+	// protectionClient gets the protection policies of the instances before
+	// they are deleted, nil to not check them
+	protectionClient vmProtectionClient
+	// flexibleClient gets the orchestration mode of the scale sets and lists
+	// the VMs of the flexible ones, nil to only support uniform scale sets
+	flexibleClient flexibleScaleSetClient
+	// deallocateOnScaleDown is true if the VMs of the removed nodes are
+	// deallocated instead of deleted, and started again by scale-ups
+	deallocateOnScaleDown bool
+	// lowercase names of the scale sets of spot VMs
+	spotScaleSets map[string]bool
+	// VM sizes of the scale sets overriding the ones of their models, by
+	// lowercase scale set name
+	scaleSetVMSizes map[string]string
+	// vmSizeClient lists the VM sizes missing from VMSizes, nil to only use VMSizes
+	vmSizeClient vmSizeClient
+	// VM sizes listed by vmSizeClient, by lowercase location and lowercase name
+	locationVMSizes map[string]map[string]*vmSize
+	// resourceSkuClient lists the GPUs of the VM sizes listed by vmSizeClient,
+	// nil to assume they have none
+	resourceSkuClient resourceSkuClient
+	// GPUs of the VM sizes listed by resourceSkuClient, by lowercase name, nil
+	// until listed
+	skuGPUs      map[string]int64
+	vmSizesMutex sync.Mutex
+	// time of the last full regeneration of the cache
+	lastRegenerated time.Time
+	// minimum interval between full regenerations caused by cache misses
+	minRegenerationInterval time.Duration
+	// error of the last full regeneration of the cache, nil if it succeeded
+	lastRegenerationError error
+	// time of the last successful full regeneration of the cache
+	lastSuccessfulRegeneration time.Time
+	// end of the last full regeneration of the cache, whose result is shared
+	// with the callers which waited for it
+	regenerated time.Time
+	// age of the cache after which HealthCheck fails
+	cacheStalenessThreshold time.Duration
+	// age of the cached instances of a scale set after which they are
+	// refreshed by RefreshExpiredScaleSets
+	scaleSetCacheTTL time.Duration
 
 	cacheMutex sync.Mutex
-	interrupt  chan struct{}
-}
 
-// Config holds the configuration parsed from the --cloud-config flag
-type Config struct {
-	Cloud                      string `json:"cloud" yaml:"cloud"`
-	TenantID                   string `json:"tenantId" yaml:"tenantId"`
-	SubscriptionID             string `json:"subscriptionId" yaml:"subscriptionId"`
-	ResourceGroup              string `json:"resourceGroup" yaml:"resourceGroup"`
-	Location                   string `json:"location" yaml:"location"`
-	VnetName                   string `json:"vnetName" yaml:"vnetName"`
-	SubnetName                 string `json:"subnetName" yaml:"subnetName"`
-	SecurityGroupName          string `json:"securityGroupName" yaml:"securityGroupName"`
-	RouteTableName             string `json:"routeTableName" yaml:"routeTableName"`
-	PrimaryAvailabilitySetName string `json:"primaryAvailabilitySetName" yaml:"primaryAvailabilitySetName"`
-
-	AADClientID     string `json:"aadClientId" yaml:"aadClientId"`
-	AADClientSecret string `json:"aadClientSecret" yaml:"aadClientSecret"`
-	AADTenantID     string `json:"aadTenantId" yaml:"aadTenantId"`
+	// short-lived cache of the scale set target sizes, keyed by scale set name
+	sizeCache    map[string]cachedSize
+	sizeCacheTTL time.Duration
+	sizeMutex    sync.Mutex
+	// pending scale-ups of the scale sets, keyed like sizeCache and guarded by
+	// sizeMutex
+	scaleUps       map[string]scaleUp
+	scaleUpTimeout time.Duration
+	// last provisioning times of the new instances of the scale sets, keyed
+	// like sizeCache and guarded by sizeMutex
+	provisioningTimes map[string][]time.Duration
+	// backoffs of the scale sets, keyed like sizeCache and guarded by
+	// sizeMutex
+	backoffs          map[string]*ScaleSetBackedOffError
+	throttlingBackoff time.Duration
+	// time a spot or pinned scale set is backed off for after failing to
+	// allocate VMs
+	spotAllocationBackoff time.Duration
+	// fallback scale sets of the spot ones, by lowercase scale set name
+	spotFallbackScaleSets map[string]string
+
+	// logger of the manager, glog if nil
+	logger Logger
+	// recorders of the events of the operations on the scale sets, nil to
+	// not record them
+	eventRecorder  kube_record.EventRecorder
+	statusRecorder cloudprovider.StatusRecorder
+	eventsMutex    sync.Mutex
+	// kubeClient checks that the nodes are drained before their instances
+	// are deleted, nil or a zero drainTimeout to not check it
+	kubeClient   kubernetes.Interface
+	drainMutex   sync.Mutex
+	drainTimeout time.Duration
+	// provider of the access tokens of the clients, reloaded with the
+	// credentials of the cloud-config
+	tokenProvider *reloadableTokenProvider
+
+	// ctx is canceled by Cleanup to stop the background cache regeneration
+	// and the tracking of the resizes.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// resizes waits for the resizes in progress
+	resizes sync.WaitGroup
 }
 
 // CreateAzureManager creates Azure Manager object to work with Azure.
 func CreateAzureManager(configReader io.Reader) (*AzureManager, error) {
-	subscriptionId := string("")
-	resourceGroup := string("")
-	tenantId := string("")
-	clientId := string("")
-	clientSecret := string("")
-	var scaleSetAPI scaleSetClient
-	var scaleSetVmAPI scaleSetVMClient
-	if configReader != nil {
-		var cfg Config
-		if err := gcfg.ReadInto(&cfg, configReader); err != nil {
-			glog.Errorf("Couldn't read config: %v", err)
-			return nil, err
+	return CreateAzureManagerWithLogger(configReader, nil)
+}
+
+// cloudConfigSecretKey is the key of the cloud-config in the secret read by
+// CreateAzureManagerFromSecret.
+const cloudConfigSecretKey = "cloud-config"
+
+// CreateAzureManagerFromSecret creates Azure Manager object with the cloud-config
+// stored in the given secret, so that the credentials never touch the
+// filesystem of the node.
+// The credentials are reloaded when the secret changes.
+func CreateAzureManagerFromSecret(client kubernetes.Interface, namespace string, name string) (*AzureManager, error) {
+	readSecret := func() ([]byte, error) {
+		secret, err := client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("azure: failed to get cloud-config secret %s/%s: %v", namespace, name, err)
 		}
-		subscriptionId = cfg.SubscriptionID
-		resourceGroup = cfg.ResourceGroup
-		tenantId = cfg.AADTenantID
-		clientId = cfg.AADClientID
-		clientSecret = cfg.AADClientSecret
-
-	} else {
-		subscriptionId = os.Getenv("ARM_SUBSCRIPTION_ID")
-		resourceGroup = os.Getenv("ARM_RESOURCE_GROUP")
-		tenantId = os.Getenv("ARM_TENANT_ID")
-		clientId = os.Getenv("ARM_CLIENT_ID")
-		clientSecret = os.Getenv("ARM_CLIENT_SECRET")
+		config, found := secret.Data[cloudConfigSecretKey]
+		if !found {
+			return nil, fmt.Errorf("azure: secret %s/%s has no %s key", namespace, name, cloudConfigSecretKey)
+		}
+		return config, nil
 	}
+	return createAzureManagerWithReload(readSecret)
+}
 
-	if resourceGroup == "" {
-		panic("Resource group not found")
+// CreateAzureManagerFromFile creates Azure Manager object with the cloud-config
+// file at the given path, e.g. a mounted secret. The credentials are reloaded
+// when the file changes.
+func CreateAzureManagerFromFile(path string) (*AzureManager, error) {
+	readFile := func() ([]byte, error) {
+		config, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("azure: failed to read cloud-config %s: %v", path, err)
+		}
+		return config, nil
 	}
+	return createAzureManagerWithReload(readFile)
+}
 
-	if subscriptionId == "" {
-		panic("Subscription ID not found")
+// createAzureManagerWithReload creates Azure Manager object with the
+// cloud-config returned by readCloudConfig, and reads it again periodically
+// to reload the credentials.
+func createAzureManagerWithReload(readCloudConfig func() ([]byte, error)) (*AzureManager, error) {
+	config, err := readCloudConfig()
+	if err != nil {
+		return nil, err
 	}
-
-	if tenantId == "" {
-		panic("Tenant ID not found.")
+	manager, err := CreateAzureManager(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
 	}
+	manager.watchCloudConfig(readCloudConfig)
+	return manager, nil
+}
 
-	if clientId == "" {
-		panic("ARM Client  ID not found")
+// CreateAzureManagerWithLogger creates Azure Manager object logging with the
+// given logger, or glog if it's nil.
+func CreateAzureManagerWithLogger(configReader io.Reader, logger Logger) (*AzureManager, error) {
+	if logger == nil {
+		logger = defaultLogger
 	}
-
-	if clientSecret == "" {
-		panic("ARM Client Secret not found.")
+	cfg, err := readConfig(configReader)
+	if err != nil {
+		logger.Errorf("Couldn't read config: %v", err)
+		return nil, err
 	}
 
-	glog.Infof("read configuration: %v", subscriptionId)
+	logger.Infof("read configuration: %v", cfg.SubscriptionID)
 
-	spt, err := NewServicePrincipalTokenFromCredentials(tenantId, clientId, clientSecret, azure.PublicCloud.ServiceManagementEndpoint)
+	env, err := getAzureEnvironment(cfg.Cloud)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := overrideEndpoints(&cfg, &env); err != nil {
+		return nil, err
 	}
 
-	scaleSetAPI = compute.NewVirtualMachineScaleSetsClient(subscriptionId)
-	scaleSetsClient := scaleSetAPI.(compute.VirtualMachineScaleSetsClient)
-	scaleSetsClient.Authorizer = autorest.NewBearerAuthorizer(spt)
-	scaleSetsClient.Sender = autorest.CreateSender()
-
-	glog.Infof("Created scale set client with authorizer: %v", scaleSetsClient)
-
-	scaleSetVmAPI = compute.NewVirtualMachineScaleSetVMsClient(subscriptionId)
-	scaleSetVMsClient := scaleSetVmAPI.(compute.VirtualMachineScaleSetVMsClient)
-	scaleSetVMsClient.Authorizer = autorest.NewBearerAuthorizer(spt)
-	scaleSetVMsClient.RequestInspector = withInspection()
-	scaleSetVMsClient.ResponseInspector = byInspecting()
-
-	glog.Infof("Created scale set vm client with authorizer: %v", scaleSetVMsClient)
+	sender, err := newHTTPSender(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	tokenProvider, err := newReloadableTokenProvider(&cfg, env, sender, logger)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create Availability Sets Azure Client.
-	manager := &AzureManager{
-		subscription:      subscriptionId,
-		resourceGroupName: resourceGroup,
-		scaleSetClient:    scaleSetsClient,
-		scaleSetVmClient:  scaleSetVMsClient,
-		scaleSets:         make([]*scaleSetInformation, 0),
-		scaleSetCache:     make(map[AzureRef]*ScaleSet),
-		interrupt:         make(chan struct{}),
+	factory := &autorestClientFactory{cfg: &cfg, env: &env, tokenProvider: tokenProvider, sender: sender, logger: logger}
+	manager, err := newAzureManager(cfg, factory, logger)
+	if err != nil {
+		return nil, err
 	}
+	manager.tokenProvider = tokenProvider
 
 	go wait.Until(func() {
 		manager.cacheMutex.Lock()
 		defer manager.cacheMutex.Unlock()
 		if err := manager.regenerateCache(); err != nil {
-			glog.Errorf("Error while regenerating AS cache: %v", err)
+			manager.log().Errorf("Error while regenerating AS cache: %v", err)
 		}
-	}, time.Hour, manager.interrupt)
+	}, time.Hour, manager.ctx.Done())
 
 	return manager, nil
 }
 
-// NewServicePrincipalTokenFromCredentials creates a new ServicePrincipalToken using values of the
-// passed credentials map.
-func NewServicePrincipalTokenFromCredentials(tenantID string, clientID string, clientSecret string, scope string) (*adal.ServicePrincipalToken, error) {
-	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, tenantID)
-	if err != nil {
-		panic(err)
-	}
-	return adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, scope)
-}
-
-func withInspection() autorest.PrepareDecorator {
-	return func(p autorest.Preparer) autorest.Preparer {
-		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
-			glog.Infof("Inspecting Request: %s %s\n", r.Method, r.URL)
-			return p.Prepare(r)
-		})
-	}
-}
-
-func byInspecting() autorest.RespondDecorator {
-	return func(r autorest.Responder) autorest.Responder {
-		return autorest.ResponderFunc(func(resp *http.Response) error {
-			glog.Infof("Inspecting Response: %s for %s %s\n", resp.Status, resp.Request.Method, resp.Request.URL)
-			return r.Respond(resp)
-		})
-	}
-}
-
-// RegisterScaleSet registers scale set in Azure Manager.
-func (m *AzureManager) RegisterScaleSet(scaleSet *ScaleSet) {
-	m.cacheMutex.Lock()
-	defer m.cacheMutex.Unlock()
-
-	m.scaleSets = append(m.scaleSets,
-		&scaleSetInformation{
-			config:   scaleSet,
-			basename: scaleSet.Name,
-		})
-
-}
+// newAzureManager creates an Azure Manager of the given configuration whose
+// clients are created by factory. Its cache isn't regenerated in the
+// background.
+func newAzureManager(cfg Config, factory clientFactory, logger Logger) (*AzureManager, error) {
+	clients := factory.scaleSetClients(cfg.SubscriptionID)
+	resources := factory.resourceClients(cfg.SubscriptionID)
 
-// GetScaleSetSize gets Scale Set size.
-func (m *AzureManager) GetScaleSetSize(asConfig *ScaleSet) (int64, error) {
-	glog.V(5).Infof("Get scale set size: %v\n", asConfig)
-	set, err := m.scaleSetClient.Get(m.resourceGroupName, asConfig.Name)
+	scaleSetVMSizes, err := parseScaleSetVMSizes(cfg.ScaleSetVMSizes)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	glog.V(5).Infof("Returning scale set capacity: %d\n", *set.Sku.Capacity)
-	return *set.Sku.Capacity, nil
-}
-
-// SetScaleSetSize sets ScaleSet size.
-func (m *AzureManager) SetScaleSetSize(asConfig *ScaleSet, size int64) error {
-	op, err := m.scaleSetClient.Get(m.resourceGroupName, asConfig.Name)
+	spotFallbackScaleSets, err := parseSpotFallbackScaleSets(cfg.SpotFallbackScaleSets)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	op.Sku.Capacity = &size
-	op.VirtualMachineScaleSetProperties.ProvisioningState = nil
-	cancel := make(chan struct{})
-
-	_, errChan := m.scaleSetClient.CreateOrUpdate(m.resourceGroupName, asConfig.Name, op, cancel)
-	return <-errChan
-}
-
-// GetScaleSetForInstance returns ScaleSetConfig of the given Instance
-func (m *AzureManager) GetScaleSetForInstance(instance *AzureRef) (*ScaleSet, error) {
-	glog.V(5).Infof("Looking for scale set for instance: %v\n", instance)
-
-	glog.V(8).Infof("Cache BEFORE: %v\n", m.scaleSetCache)
-
-	m.cacheMutex.Lock()
-	defer m.cacheMutex.Unlock()
-	if config, found := m.scaleSetCache[*instance]; found {
-		return config, nil
+	spotAllocationBackoff := defaultSpotAllocationBackoff
+	if cfg.SpotAllocationBackoff > 0 {
+		spotAllocationBackoff = time.Duration(cfg.SpotAllocationBackoff) * time.Second
 	}
 
-	if err := m.regenerateCache(); err != nil {
-		return nil, fmt.Errorf("Error while looking for ScaleSet for instance %+v, error: %v", *instance, err)
+	sizeCacheTTL := defaultSizeCacheTTL
+	if cfg.SizeCacheTTL > 0 {
+		sizeCacheTTL = time.Duration(cfg.SizeCacheTTL) * time.Second
 	}
-
-	glog.V(8).Infof("Cache AFTER: %v\n", m.scaleSetCache)
-
-	if config, found := m.scaleSetCache[*instance]; found {
-		return config, nil
+	scaleSetCacheTTL := defaultScaleSetCacheTTL
+	if cfg.ScaleSetCacheTTL > 0 {
+		scaleSetCacheTTL = time.Duration(cfg.ScaleSetCacheTTL) * time.Second
 	}
-	// instance does not belong to any configured Scale Set
-	return nil, nil
-}
-
-// DeleteInstances deletes the given instances. All instances must be controlled by the same ASG.
-func (m *AzureManager) DeleteInstances(instances []*AzureRef) error {
-	if len(instances) == 0 {
-		return nil
+	minRegenerationInterval := defaultMinRegenerationInterval
+	if cfg.CacheMinRegenerationInterval > 0 {
+		minRegenerationInterval = time.Duration(cfg.CacheMinRegenerationInterval) * time.Second
 	}
-	commonAsg, err := m.GetScaleSetForInstance(instances[0])
-	if err != nil {
-		return err
+	cacheStalenessThreshold := defaultCacheStalenessThreshold
+	if cfg.CacheStalenessThreshold > 0 {
+		cacheStalenessThreshold = time.Duration(cfg.CacheStalenessThreshold) * time.Second
 	}
-	for _, instance := range instances {
-		asg, err := m.GetScaleSetForInstance(instance)
-		if err != nil {
-			return err
-		}
-		if asg != commonAsg {
-			return fmt.Errorf("cannot delete instance (%s) which don't belong to the same Scale Set", instance.GetKey())
-		}
+	scaleUpTimeout := defaultScaleUpTimeout
+	if cfg.ScaleUpTimeout > 0 {
+		scaleUpTimeout = time.Duration(cfg.ScaleUpTimeout) * time.Second
+	}
+	throttlingBackoff := defaultThrottlingBackoff
+	if cfg.CloudProviderThrottlingBackoff > 0 {
+		throttlingBackoff = time.Duration(cfg.CloudProviderThrottlingBackoff) * time.Second
 	}
 
-	instanceIds := make([]string, len(instances))
-	for i, instance := range instances {
-		instanceIds[i] = m.scaleSetIdCache[instance.Name]
+	manager := &AzureManager{
+		subscription:      cfg.SubscriptionID,
+		resourceGroupName: cfg.ResourceGroup,
+		scaleSetClient:    clients.scaleSetClient,
+		scaleSetVmClient:  clients.scaleSetVmClient,
+		scaleSets:         make([]*scaleSetInformation, 0),
+		scaleSetCache:     make(map[AzureRef]*ScaleSet),
+		cacheConcurrency:  cfg.CacheRegenerationConcurrency,
+
+		discoveryResourceGroups: parseDiscoveryResourceGroups(cfg.DiscoveryResourceGroups, cfg.ResourceGroup),
+
+		maxDeletionBatchSize: cfg.MaxDeletionBatchSize,
+		protectionClient:     clients.protectionClient,
+		flexibleClient:       clients.flexibleClient,
+
+		// The scale sets of other subscriptions are reached with the same
+		// credentials, which must be granted access to them.
+		newSubscriptionClients: factory.scaleSetClients,
+		deallocateOnScaleDown:  cfg.ScaleDownMode == scaleDownModeDeallocate,
+		sizeCache:              make(map[string]cachedSize),
+		sizeCacheTTL:           sizeCacheTTL,
+		scaleUps:               make(map[string]scaleUp),
+		scaleUpTimeout:         scaleUpTimeout,
+		stuckInstanceTimeout:   time.Duration(cfg.StuckInstanceTimeout) * time.Second,
+		drainTimeout:           time.Duration(cfg.NodeDrainTimeout) * time.Second,
+		operationTimeout:       time.Duration(cfg.CloudProviderOperationTimeout) * time.Second,
+		backoffs:               make(map[string]*ScaleSetBackedOffError),
+		throttlingBackoff:      throttlingBackoff,
+
+		spotAllocationBackoff: spotAllocationBackoff,
+		spotFallbackScaleSets: spotFallbackScaleSets,
+
+		minRegenerationInterval: minRegenerationInterval,
+		cacheStalenessThreshold: cacheStalenessThreshold,
+		scaleSetCacheTTL:        scaleSetCacheTTL,
+		spotScaleSets:           parseSpotScaleSets(cfg.SpotScaleSets),
+		scaleSetVMSizes:         scaleSetVMSizes,
+		vmSizeClient:            resources.vmSizeClient,
+		resourceSkuClient:       resources.resourceSkuClient,
+		locationVMSizes:         make(map[string]map[string]*vmSize),
+
+		vmType:                cfg.VMType,
+		availabilitySetClient: resources.availabilitySetClient,
+		virtualMachineClient:  resources.virtualMachineClient,
+		interfaceClient:       resources.interfaceClient,
+		diskClient:            resources.diskClient,
+		availabilitySetCache:  make(map[AzureRef]*AvailabilitySet),
+		aksClusterName:        cfg.AKSClusterName,
+		agentPoolClient:       resources.agentPoolClient,
+		aksAgentPoolCache:     make(map[AzureRef]*AKSAgentPool),
+		logger:                logger,
 	}
-	requiredIds := &compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
-		InstanceIds: &instanceIds,
+	bounds, err := manager.parseNodeGroupBounds(cfg.NodeGroupBounds)
+	if err != nil {
+		return nil, err
 	}
-	cancel := make(chan struct{})
-	_, errChan := m.scaleSetClient.DeleteInstances(m.resourceGroupName, commonAsg.Name, *requiredIds, cancel)
-	return <-errChan
+	manager.setBoundsOverrides(bounds)
+	manager.ctx, manager.cancel = context.WithCancel(context.Background())
+	return manager, nil
 }
 
-func (m *AzureManager) regenerateCache() error {
-	newCache := make(map[AzureRef]*ScaleSet)
-	newScaleSetIdCache := make(map[string]string)
-
-	for _, sset := range m.scaleSets {
-		glog.V(4).Infof("Regenerating Scale Set information for %s", sset.config.Name)
-		scaleSet, err := m.scaleSetClient.Get(m.resourceGroupName, sset.config.Name)
-		if err != nil {
-			glog.Errorf("Failed to get scaleSet with name %s: %v", sset.config.Name, err)
-			return err
-		}
-		sset.basename = *scaleSet.Name
-
-		result, err := m.scaleSetVmClient.List(m.resourceGroupName, sset.basename, "", "", "")
-		if err != nil {
-			glog.Errorf("Failed to list vm for scaleSet %s: %v", sset.config.Name, err)
-			return err
-		}
-
-		for _, instance := range *result.Value {
-			// Convert to lower because instance.ID is in different in different API calls (e.g. GET and LIST).
-			name := "azure://" + strings.ToLower(*instance.ID)
-			ref := AzureRef{
-				Name: name,
-			}
-			newCache[ref] = sset.config
-			newScaleSetIdCache[name] = *instance.InstanceID
-		}
+// log returns the logger of the manager.
+func (m *AzureManager) log() Logger {
+	if m.logger == nil {
+		return defaultLogger
 	}
-
-	m.scaleSetCache = newCache
-	m.scaleSetIdCache = newScaleSetIdCache
-	return nil
+	return m.logger
 }
 
-// GetScaleSetVms returns list of nodes for the given scale set.
-func (m *AzureManager) GetScaleSetVms(scaleSet *ScaleSet) ([]string, error) {
-	instances, err := m.scaleSetVmClient.List(m.resourceGroupName, scaleSet.Name, "", "", "")
-
-	if err != nil {
-		glog.V(4).Infof("Failed AS info request for %s: %v", scaleSet.Name, err)
-		return []string{}, err
+// context returns the context of the manager, canceled by Cleanup.
+func (m *AzureManager) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
 	}
-	result := make([]string, 0)
-	for _, instance := range *instances.Value {
-		// Convert to lower because instance.ID is in different in different API calls (e.g. GET and LIST).
-		name := "azure://" + strings.ToLower(*instance.ID)
-		result = append(result, name)
+	return m.ctx
+}
+
+// operationContext returns the context of an asynchronous operation started
+// with ctx, canceled once the operation timed out or when Cleanup is called.
+// The returned cancel function must be called once the operation completed.
+func (m *AzureManager) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.operationTimeout
+	if timeout <= 0 {
+		timeout = defaultOperationTimeout
 	}
-	return result, nil
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	managerCtx := m.context()
+	go func() {
+		select {
+		case <-managerCtx.Done():
+			cancel()
+		case <-opCtx.Done():
+		}
+	}()
+	return opCtx, cancel
+}
 
+// waitForOperation waits for the result of an asynchronous Azure operation,
+// returning early if the context is done first.
+func waitForOperation(ctx context.Context, errChan <-chan error) error {
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Cleanup closes the channel to signal the go routine to stop that is handling the cache
+// Cleanup cancels the context of the manager to stop the go routine that is
+// handling the cache and the operations in progress, and waits for the
+// tracking of the resizes to stop.
 func (m *AzureManager) Cleanup() {
-	close(m.interrupt)
+	m.cancel()
+	m.resizes.Wait()
 }
@@ -0,0 +1,336 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// scaleSetClientMock is a scaleSetClient whose responses are set up per test.
+type scaleSetClientMock struct {
+	mock.Mock
+}
+
+func (client *scaleSetClientMock) List(resourceGroupName string) (compute.VirtualMachineScaleSetListResult, error) {
+	args := client.Called(resourceGroupName)
+	return args.Get(0).(compute.VirtualMachineScaleSetListResult), args.Error(1)
+}
+
+func (client *scaleSetClientMock) ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (compute.VirtualMachineScaleSetListResult, error) {
+	args := client.Called(*lastResults.NextLink)
+	return args.Get(0).(compute.VirtualMachineScaleSetListResult), args.Error(1)
+}
+
+func (client *scaleSetClientMock) Get(resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	args := client.Called(resourceGroupName, vmScaleSetName)
+	scaleSet := args.Get(0).(compute.VirtualMachineScaleSet)
+	// Like the real client return a new object for every call, callers modify it.
+	if scaleSet.Sku != nil {
+		sku := *scaleSet.Sku
+		if sku.Capacity != nil {
+			capacity := *sku.Capacity
+			sku.Capacity = &capacity
+		}
+		scaleSet.Sku = &sku
+	}
+	return scaleSet, args.Error(1)
+}
+
+func (client *scaleSetClientMock) CreateOrUpdate(resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, parameters)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+func (client *scaleSetClientMock) DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, vmInstanceIDs)
+	resultChan := make(chan compute.OperationStatusResponse, 1)
+	if len(args) > 1 {
+		resultChan <- args.Get(1).(compute.OperationStatusResponse)
+	}
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return resultChan, errChan
+}
+
+func (client *scaleSetClientMock) Deallocate(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, *vmInstanceIDs.InstanceIds)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+func (client *scaleSetClientMock) Start(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, *vmInstanceIDs.InstanceIds)
+	errChan := make(chan error, 1)
+	errChan <- args.Error(0)
+	return nil, errChan
+}
+
+// scaleSetVMClientMock is a scaleSetVMClient whose responses are set up per test.
+type scaleSetVMClientMock struct {
+	mock.Mock
+}
+
+func (client *scaleSetVMClientMock) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	args := client.Called(resourceGroupName, virtualMachineScaleSetName)
+	return args.Get(0).(compute.VirtualMachineScaleSetVMListResult), args.Error(1)
+}
+
+func (client *scaleSetVMClientMock) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (compute.VirtualMachineScaleSetVMListResult, error) {
+	args := client.Called(*lastResults.NextLink)
+	return args.Get(0).(compute.VirtualMachineScaleSetVMListResult), args.Error(1)
+}
+
+func newTestScaleSet(name string, capacity int64) compute.VirtualMachineScaleSet {
+	return compute.VirtualMachineScaleSet{
+		Name: &name,
+		Sku: &compute.Sku{
+			Capacity: &capacity,
+		},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{},
+	}
+}
+
+func newTestVMListResult(scaleSetName string, count int) compute.VirtualMachineScaleSetVMListResult {
+	vms := make([]compute.VirtualMachineScaleSetVM, count)
+	for i := range vms {
+		id := fmt.Sprintf("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%d", scaleSetName, i)
+		instanceID := fmt.Sprintf("%d", i)
+		vms[i] = compute.VirtualMachineScaleSetVM{
+			ID:         &id,
+			InstanceID: &instanceID,
+		}
+	}
+	return compute.VirtualMachineScaleSetVMListResult{
+		Value: &vms,
+	}
+}
+
+func newTestAzureManagerWithMocks(ssClient *scaleSetClientMock, vmClient *scaleSetVMClientMock) *AzureManager {
+	return &AzureManager{
+		resourceGroupName: "rg",
+		scaleSets:         make([]*scaleSetInformation, 0),
+		scaleSetClient:    ssClient,
+		scaleSetVmClient:  vmClient,
+		scaleSetCache:     make(map[AzureRef]*ScaleSet),
+	}
+}
+
+// hangingScaleSetClient is a scaleSetClient whose asynchronous operations never complete.
+type hangingScaleSetClient struct {
+	*scaleSetClientMock
+}
+
+func (client *hangingScaleSetClient) CreateOrUpdate(resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error) {
+	client.Called(resourceGroupName, vmScaleSetName, parameters)
+	return nil, make(chan error)
+}
+
+func (client *hangingScaleSetClient) DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	client.Called(resourceGroupName, vmScaleSetName, vmInstanceIDs)
+	return nil, make(chan error)
+}
+
+func registerTestScaleSet(t *testing.T, m *AzureManager, spec string) *ScaleSet {
+	scaleSet, err := buildScaleSet(spec, m)
+	assert.NoError(t, err)
+	m.RegisterScaleSet(scaleSet)
+	return scaleSet
+}
+
+func TestCreateAzureManagerMissingConfig(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	os.Setenv("ARM_RESOURCE_GROUP", "rg")
+
+	_, err := CreateAzureManager(nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "subscriptionId not set")
+	assert.NotContains(t, err.Error(), "resourceGroup not set")
+}
+
+func TestCreateAzureManagerEnvironmentFallback(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	os.Setenv("ARM_RESOURCE_GROUP", "rg")
+
+	// The environment is used even if a cloud-config is given.
+	_, err := CreateAzureManager(strings.NewReader("; empty cloud-config\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "subscriptionId not set")
+	assert.NotContains(t, err.Error(), "resourceGroup not set")
+}
+
+func TestCreateAzureManagerFromSecret(t *testing.T) {
+	for _, env := range []string{"ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "ARM_TENANT_ID", "ARM_CLIENT_ID", "ARM_CLIENT_SECRET"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	os.Setenv("ARM_SUBSCRIPTION_ID", "sub")
+	os.Setenv("ARM_RESOURCE_GROUP", "rg")
+	os.Setenv("ARM_TENANT_ID", "tenant")
+	os.Setenv("ARM_CLIENT_ID", "client")
+	os.Setenv("ARM_CLIENT_SECRET", "secret")
+
+	client := fake.NewSimpleClientset(
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "azure-cloud-config"},
+			Data: map[string][]byte{
+				cloudConfigSecretKey: []byte("; cloud-config\n"),
+			},
+		},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "other"},
+			Data: map[string][]byte{
+				"azure.json": []byte("{}"),
+			},
+		},
+	)
+
+	m, err := CreateAzureManagerFromSecret(client, "kube-system", "azure-cloud-config")
+	assert.NoError(t, err)
+	assert.Equal(t, "sub", m.subscription)
+	assert.Equal(t, "rg", m.resourceGroupName)
+	m.Cleanup()
+
+	_, err = CreateAzureManagerFromSecret(client, "kube-system", "missing")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get cloud-config secret kube-system/missing")
+
+	_, err = CreateAzureManagerFromSecret(client, "kube-system", "other")
+	assert.EqualError(t, err, "azure: secret kube-system/other has no cloud-config key")
+}
+
+func TestCleanup(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.Cleanup()
+	assert.Equal(t, context.Canceled, m.ctx.Err())
+}
+
+func TestParseAzureRef(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected instanceRef
+	}{
+		// as returned by the GET of a scale set VM
+		{"/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Compute/virtualMachineScaleSets/SS1/virtualMachines/0", instanceRef{subscriptionID: "sub", resourceGroup: "rg", scaleSet: "ss1", name: "0"}},
+		// as returned by the LIST of the scale set VMs
+		{"/subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachinescalesets/ss1/virtualmachines/0", instanceRef{subscriptionID: "sub", resourceGroup: "rg", scaleSet: "ss1", name: "0"}},
+		// as the provider ID of a node
+		{"azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0", instanceRef{subscriptionID: "sub", resourceGroup: "rg", scaleSet: "ss1", name: "0"}},
+		{"azure://subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0/", instanceRef{subscriptionID: "sub", resourceGroup: "rg", scaleSet: "ss1", name: "0"}},
+		{"azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/VM", instanceRef{subscriptionID: "sub", resourceGroup: "rg", name: "vm"}},
+		{"azure://virtualMachineScaleSets/ss1/virtualMachines/0", instanceRef{scaleSet: "ss1", name: "0"}},
+	} {
+		ref, err := parseAzureRef(AzureRef{Name: test.name})
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, ref, test.name)
+	}
+
+	for _, name := range []string{"", "azure://", "azure://virtualMachineScaleSets/ss1", "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk"} {
+		_, err := parseAzureRef(AzureRef{Name: name})
+		assert.Error(t, err, name)
+	}
+}
+
+// vmSizeClientMock is a vmSizeClient whose responses are set up per test.
+type vmSizeClientMock struct {
+	mock.Mock
+}
+
+func (client *vmSizeClientMock) List(location string) (compute.VirtualMachineSizeListResult, error) {
+	args := client.Called(location)
+	return args.Get(0).(compute.VirtualMachineSizeListResult), args.Error(1)
+}
+
+// resourceSkuClientMock is a resourceSkuClient whose responses are set up per test.
+type resourceSkuClientMock struct {
+	mock.Mock
+}
+
+func (client *resourceSkuClientMock) List() (compute.ResourceSkusResult, error) {
+	args := client.Called()
+	return args.Get(0).(compute.ResourceSkusResult), args.Error(1)
+}
+
+func (client *resourceSkuClientMock) ListNextResults(lastResults compute.ResourceSkusResult) (compute.ResourceSkusResult, error) {
+	args := client.Called(*lastResults.NextLink)
+	return args.Get(0).(compute.ResourceSkusResult), args.Error(1)
+}
+
+func TestCleanupCancelsOperations(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleSetClient = &hangingScaleSetClient{ssClient}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 1)
+	deleting := make(chan struct{})
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return().Run(func(mock.Arguments) { close(deleting) })
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// The deletion is canceled although the context of the call isn't.
+	errs := make(chan error)
+	go func() {
+		ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+		errs <- m.DeleteInstances(context.Background(), []*AzureRef{ref})
+	}()
+	<-deleting
+	m.Cleanup()
+	err := <-errs
+	if assert.IsType(t, &DeleteInstancesError{}, err) {
+		for _, err := range err.(*DeleteInstancesError).Failed {
+			assert.Equal(t, context.Canceled, err)
+		}
+	}
+}
+
+func TestNormalizeAzureRef(t *testing.T) {
+	expected := AzureRef{Name: "azure:///subscriptions/sub/resourcegroups/my-rg/providers/microsoft.compute/virtualmachinescalesets/ss1/virtualmachines/0"}
+	for _, name := range []string{
+		"azure:///subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0",
+		"AZURE:///subscriptions/SUB/resourcegroups/MY-RG/providers/microsoft.compute/virtualmachinescalesets/SS1/virtualmachines/0",
+		"/subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0",
+		"subscriptions/sub/resourceGroups/My-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0",
+		"azure:////subscriptions/sub/resourceGroups/My-RG//providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/0/",
+		expected.Name,
+	} {
+		assert.Equal(t, expected, normalizeAzureRef(AzureRef{Name: name}), name)
+	}
+}
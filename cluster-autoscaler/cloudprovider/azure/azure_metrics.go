@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	azureNamespace = "cluster_autoscaler_azure"
+
+	successLabel = "success"
+	errorLabel   = "error"
+
+	// unknownErrorCode is the code of the errors without HTTP status code,
+	// e.g. network errors.
+	unknownErrorCode = "unknown"
+)
+
+// Names of the instrumented Azure API operations.
+const (
+	getOperation             = "get"
+	listOperation            = "list"
+	createOrUpdateOperation  = "createOrUpdate"
+	deleteInstancesOperation = "deleteInstances"
+	deallocateOperation      = "deallocate"
+	startOperation           = "start"
+)
+
+var (
+	apiCallsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: azureNamespace,
+			Name:      "api_calls_total",
+			Help:      "Number of Azure API calls.",
+		}, []string{"operation", "result"},
+	)
+
+	apiCallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: azureNamespace,
+			Name:      "api_call_duration_seconds",
+			Help:      "Time taken by Azure API calls, including waiting for asynchronous operations.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0, 600.0},
+		}, []string{"operation"},
+	)
+
+	apiErrorsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: azureNamespace,
+			Name:      "api_errors_total",
+			Help:      "Number of failed Azure API calls, by HTTP status code.",
+		}, []string{"operation", "code"},
+	)
+
+	scaleSetProvisioningDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: azureNamespace,
+			Name:      "scale_set_provisioning_duration_seconds",
+			Help:      "Time taken by the new VMs of the scale sets to be provisioned, from the request of the scale-up.",
+			Buckets:   []float64{30.0, 60.0, 90.0, 120.0, 180.0, 240.0, 300.0, 450.0, 600.0, 900.0, 1200.0, 1800.0},
+		}, []string{"scale_set"},
+	)
+
+	apiThrottledCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: azureNamespace,
+			Name:      "api_throttled_total",
+			Help:      "Number of Azure API calls rejected because the requests were throttled.",
+		}, []string{"operation"},
+	)
+)
+
+// RegisterMetrics registers the metrics of the Azure cloud provider.
+func RegisterMetrics() {
+	registerMetrics(prometheus.DefaultRegisterer)
+}
+
+func registerMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(apiCallsCount)
+	registerer.MustRegister(apiCallDuration)
+	registerer.MustRegister(apiErrorsCount)
+	registerer.MustRegister(apiThrottledCount)
+	registerer.MustRegister(scaleSetProvisioningDuration)
+}
+
+// observeAPICall records the result and duration of an Azure API call.
+func observeAPICall(operation string, start time.Time, err error) {
+	result := successLabel
+	if err != nil {
+		result = errorLabel
+	}
+	apiCallsCount.WithLabelValues(operation, result).Inc()
+	apiCallDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		code := apiErrorCode(err)
+		apiErrorsCount.WithLabelValues(operation, code).Inc()
+		if code == strconv.Itoa(http.StatusTooManyRequests) {
+			apiThrottledCount.WithLabelValues(operation).Inc()
+		}
+	}
+}
+
+// apiErrorCode returns the HTTP status code of the error of an Azure API call,
+// or unknownErrorCode if there is none.
+func apiErrorCode(err error) string {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok {
+		return unknownErrorCode
+	}
+	statusCode, ok := detailed.StatusCode.(int)
+	if !ok || statusCode == autorest.UndefinedStatusCode {
+		return unknownErrorCode
+	}
+	return strconv.Itoa(statusCode)
+}
+
+// observeAsyncAPICall records the result of an asynchronous Azure API call once
+// it completes. The returned channel receives the error of errChan.
+func observeAsyncAPICall(operation string, start time.Time, errChan <-chan error) <-chan error {
+	observed := make(chan error, 1)
+	go func() {
+		err := <-errChan
+		observeAPICall(operation, start, err)
+		observed <- err
+		close(observed)
+	}()
+	return observed
+}
+
+// instrumentedScaleSetClient is a scaleSetClient recording metrics of its calls.
+type instrumentedScaleSetClient struct {
+	scaleSetClient
+}
+
+func (c *instrumentedScaleSetClient) Get(resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	start := time.Now()
+	result, err := c.scaleSetClient.Get(resourceGroupName, vmScaleSetName)
+	observeAPICall(getOperation, start, err)
+	return result, err
+}
+
+func (c *instrumentedScaleSetClient) CreateOrUpdate(resourceGroupName string, name string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error) {
+	start := time.Now()
+	resultChan, errChan := c.scaleSetClient.CreateOrUpdate(resourceGroupName, name, parameters, cancel)
+	return resultChan, observeAsyncAPICall(createOrUpdateOperation, start, errChan)
+}
+
+func (c *instrumentedScaleSetClient) DeleteInstances(resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	start := time.Now()
+	resultChan, errChan := c.scaleSetClient.DeleteInstances(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	return resultChan, observeAsyncAPICall(deleteInstancesOperation, start, errChan)
+}
+
+func (c *instrumentedScaleSetClient) Deallocate(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	start := time.Now()
+	resultChan, errChan := c.scaleSetClient.Deallocate(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	return resultChan, observeAsyncAPICall(deallocateOperation, start, errChan)
+}
+
+func (c *instrumentedScaleSetClient) Start(resourceGroupName string, vmScaleSetName string, vmInstanceIDs *compute.VirtualMachineScaleSetVMInstanceIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	start := time.Now()
+	resultChan, errChan := c.scaleSetClient.Start(resourceGroupName, vmScaleSetName, vmInstanceIDs, cancel)
+	return resultChan, observeAsyncAPICall(startOperation, start, errChan)
+}
+
+func (c *instrumentedScaleSetClient) List(resourceGroupName string) (compute.VirtualMachineScaleSetListResult, error) {
+	start := time.Now()
+	result, err := c.scaleSetClient.List(resourceGroupName)
+	observeAPICall(listOperation, start, err)
+	return result, err
+}
+
+func (c *instrumentedScaleSetClient) ListNextResults(lastResults compute.VirtualMachineScaleSetListResult) (compute.VirtualMachineScaleSetListResult, error) {
+	start := time.Now()
+	result, err := c.scaleSetClient.ListNextResults(lastResults)
+	observeAPICall(listOperation, start, err)
+	return result, err
+}
+
+// instrumentedScaleSetVMClient is a scaleSetVMClient recording metrics of its calls.
+type instrumentedScaleSetVMClient struct {
+	scaleSetVMClient
+}
+
+func (c *instrumentedScaleSetVMClient) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	start := time.Now()
+	result, err := c.scaleSetVMClient.List(resourceGroupName, virtualMachineScaleSetName, filter, selectParameter, expand)
+	observeAPICall(listOperation, start, err)
+	return result, err
+}
+
+func (c *instrumentedScaleSetVMClient) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (compute.VirtualMachineScaleSetVMListResult, error) {
+	start := time.Now()
+	result, err := c.scaleSetVMClient.ListNextResults(lastResults)
+	observeAPICall(listOperation, start, err)
+	return result, err
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// gatherMetrics returns the metrics of the registry, keyed by metric name and label values.
+func gatherMetrics(t *testing.T, registry *prometheus.Registry) map[string]*dto.Metric {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	metrics := make(map[string]*dto.Metric)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			key := family.GetName()
+			for _, label := range metric.Label {
+				key += fmt.Sprintf(",%s=%s", label.GetName(), label.GetValue())
+			}
+			metrics[key] = metric
+		}
+	}
+	return metrics
+}
+
+func TestAPIErrorCode(t *testing.T) {
+	assert.Equal(t, "429", apiErrorCode(newTestDetailedError(http.StatusTooManyRequests)))
+	assert.Equal(t, "404", apiErrorCode(newTestDetailedError(http.StatusNotFound)))
+	assert.Equal(t, unknownErrorCode, apiErrorCode(fmt.Errorf("connection reset")))
+}
+
+func TestInstrumentedClients(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registerMetrics(registry)
+	before := gatherMetrics(t, registry)
+	counter := func(metrics map[string]*dto.Metric, operation, result string) float64 {
+		metric, found := metrics[fmt.Sprintf("cluster_autoscaler_azure_api_calls_total,operation=%s,result=%s", operation, result)]
+		if !found {
+			return 0
+		}
+		return metric.Counter.GetValue()
+	}
+
+	ssMock := &scaleSetClientMock{}
+	ssMock.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Once()
+	ssMock.On("Get", "rg", "ss1").Return(compute.VirtualMachineScaleSet{}, newTestDetailedError(http.StatusTooManyRequests)).Once()
+	ssMock.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	ssMock.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(fmt.Errorf("delete failed"))
+	vmMock := &scaleSetVMClientMock{}
+	vmMock.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	ssClient := &instrumentedScaleSetClient{ssMock}
+	vmClient := &instrumentedScaleSetVMClient{vmMock}
+
+	_, err := ssClient.Get("rg", "ss1")
+	assert.NoError(t, err)
+	_, err = ssClient.Get("rg", "ss1")
+	assert.Error(t, err)
+	_, errChan := ssClient.CreateOrUpdate("rg", "ss1", newTestScaleSet("ss1", 3), nil)
+	assert.NoError(t, <-errChan)
+	_, errChan = ssClient.DeleteInstances("rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{}, nil)
+	assert.EqualError(t, <-errChan, "delete failed")
+	_, err = vmClient.List("rg", "ss1", "", "", "")
+	assert.NoError(t, err)
+
+	after := gatherMetrics(t, registry)
+	for _, tc := range []struct {
+		operation string
+		result    string
+		delta     float64
+	}{
+		{getOperation, successLabel, 1},
+		{getOperation, errorLabel, 1},
+		{createOrUpdateOperation, successLabel, 1},
+		{deleteInstancesOperation, errorLabel, 1},
+		{listOperation, successLabel, 1},
+		{listOperation, errorLabel, 0},
+	} {
+		assert.Equal(t, tc.delta, counter(after, tc.operation, tc.result)-counter(before, tc.operation, tc.result), "%s %s", tc.operation, tc.result)
+	}
+	for _, tc := range []struct {
+		key   string
+		delta float64
+	}{
+		{"cluster_autoscaler_azure_api_errors_total,code=429,operation=get", 1},
+		{"cluster_autoscaler_azure_api_errors_total,code=unknown,operation=deleteInstances", 1},
+		{"cluster_autoscaler_azure_api_throttled_total,operation=get", 1},
+		{"cluster_autoscaler_azure_api_throttled_total,operation=deleteInstances", 0},
+	} {
+		value := func(metrics map[string]*dto.Metric) float64 {
+			if metric, found := metrics[tc.key]; found {
+				return metric.Counter.GetValue()
+			}
+			return 0
+		}
+		assert.Equal(t, tc.delta, value(after)-value(before), tc.key)
+	}
+	histogram := after["cluster_autoscaler_azure_api_call_duration_seconds,operation=get"]
+	if assert.NotNil(t, histogram) {
+		assert.True(t, histogram.Histogram.GetSampleCount() >= 2)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"math"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// AzurePriceModel implements the PricingModel interface for Azure, with the
+// pay-as-you-go prices of the Linux VMs in East US.
+type AzurePriceModel struct {
+}
+
+const (
+	// Prices of the resources of the VM sizes missing from instancePrices,
+	// such that the price of a Standard_D2_v3 is matched.
+	cpuPricePerHour         = 0.036
+	memoryPricePerHourPerGb = 0.003
+	gpuPricePerHour         = 0.900
+	// spotDiscount is the typical ratio of the price of spot VMs to the
+	// pay-as-you-go one, which varies with the region and the demand.
+	spotDiscount = 0.2
+
+	gigabyte = 1024.0 * 1024.0 * 1024.0
+)
+
+// instancePrices are the prices per hour in USD of the VM sizes of VMSizes,
+// GPUs included.
+var instancePrices = map[string]float64{
+	"Standard_A0":       0.020,
+	"Standard_A1":       0.060,
+	"Standard_A2":       0.120,
+	"Standard_A3":       0.240,
+	"Standard_A4":       0.480,
+	"Standard_A5":       0.250,
+	"Standard_A6":       0.500,
+	"Standard_A7":       1.000,
+	"Standard_A1_v2":    0.043,
+	"Standard_A2_v2":    0.091,
+	"Standard_A4_v2":    0.191,
+	"Standard_A8_v2":    0.400,
+	"Standard_A2m_v2":   0.119,
+	"Standard_A4m_v2":   0.249,
+	"Standard_A8m_v2":   0.524,
+	"Standard_B1s":      0.0104,
+	"Standard_B1ms":     0.0207,
+	"Standard_B2s":      0.0416,
+	"Standard_B2ms":     0.0832,
+	"Standard_B4ms":     0.166,
+	"Standard_B8ms":     0.333,
+	"Standard_D1_v2":    0.057,
+	"Standard_D2_v2":    0.114,
+	"Standard_D3_v2":    0.228,
+	"Standard_D4_v2":    0.456,
+	"Standard_D5_v2":    0.912,
+	"Standard_D11_v2":   0.148,
+	"Standard_D12_v2":   0.296,
+	"Standard_D13_v2":   0.592,
+	"Standard_D14_v2":   1.184,
+	"Standard_D15_v2":   1.480,
+	"Standard_DS1_v2":   0.057,
+	"Standard_DS2_v2":   0.114,
+	"Standard_DS3_v2":   0.228,
+	"Standard_DS4_v2":   0.456,
+	"Standard_DS5_v2":   0.912,
+	"Standard_DS11_v2":  0.148,
+	"Standard_DS12_v2":  0.296,
+	"Standard_DS13_v2":  0.592,
+	"Standard_DS14_v2":  1.184,
+	"Standard_DS15_v2":  1.480,
+	"Standard_D2_v3":    0.096,
+	"Standard_D4_v3":    0.192,
+	"Standard_D8_v3":    0.384,
+	"Standard_D16_v3":   0.768,
+	"Standard_D32_v3":   1.536,
+	"Standard_D64_v3":   3.072,
+	"Standard_D2s_v3":   0.096,
+	"Standard_D4s_v3":   0.192,
+	"Standard_D8s_v3":   0.384,
+	"Standard_D16s_v3":  0.768,
+	"Standard_D32s_v3":  1.536,
+	"Standard_D64s_v3":  3.072,
+	"Standard_E2_v3":    0.126,
+	"Standard_E4_v3":    0.252,
+	"Standard_E8_v3":    0.504,
+	"Standard_E16_v3":   1.008,
+	"Standard_E32_v3":   2.016,
+	"Standard_E64_v3":   3.629,
+	"Standard_E2s_v3":   0.126,
+	"Standard_E4s_v3":   0.252,
+	"Standard_E8s_v3":   0.504,
+	"Standard_E16s_v3":  1.008,
+	"Standard_E32s_v3":  2.016,
+	"Standard_E64s_v3":  3.629,
+	"Standard_F1":       0.050,
+	"Standard_F2":       0.100,
+	"Standard_F4":       0.199,
+	"Standard_F8":       0.398,
+	"Standard_F16":      0.796,
+	"Standard_F1s":      0.050,
+	"Standard_F2s":      0.100,
+	"Standard_F4s":      0.199,
+	"Standard_F8s":      0.398,
+	"Standard_F16s":     0.796,
+	"Standard_F2s_v2":   0.085,
+	"Standard_F4s_v2":   0.169,
+	"Standard_F8s_v2":   0.338,
+	"Standard_F16s_v2":  0.677,
+	"Standard_F32s_v2":  1.353,
+	"Standard_F64s_v2":  2.706,
+	"Standard_F72s_v2":  3.045,
+	"Standard_NC6":      0.900,
+	"Standard_NC12":     1.800,
+	"Standard_NC24":     3.600,
+	"Standard_NV6":      1.140,
+	"Standard_NV12":     2.280,
+	"Standard_NV24":     4.560,
+	"Standard_NC6s_v2":  2.070,
+	"Standard_NC12s_v2": 4.140,
+	"Standard_NC24s_v2": 8.280,
+	"Standard_NC6s_v3":  3.060,
+	"Standard_NC12s_v3": 6.120,
+	"Standard_NC24s_v3": 12.240,
+	"Standard_ND6s":     2.070,
+	"Standard_ND12s":    4.140,
+	"Standard_ND24s":    8.280,
+}
+
+// NodePrice returns a price of running the given node for a given period of time.
+// All prices are in USD. The nodes of spot scale sets are priced at
+// spotDiscount of the pay-as-you-go price.
+func (model *AzurePriceModel) NodePrice(node *apiv1.Node, startTime time.Time, endTime time.Time) (float64, error) {
+	var price float64
+	if basePricePerHour, found := instancePrices[node.Labels[kubeletapis.LabelInstanceType]]; found {
+		price = basePricePerHour * getHours(startTime, endTime)
+	} else {
+		price = getBasePrice(node.Status.Capacity, startTime, endTime) + getGPUPrice(node.Status.Capacity, startTime, endTime)
+	}
+	if node.Labels[scaleSetPriorityLabel] == scaleSetPrioritySpot {
+		price = price * spotDiscount
+	}
+	return price, nil
+}
+
+func getHours(startTime time.Time, endTime time.Time) float64 {
+	minutes := math.Ceil(float64(endTime.Sub(startTime)) / float64(time.Minute))
+	hours := minutes / 60.0
+	return hours
+}
+
+// PodPrice returns a theoretical minimum price of running a pod for a given
+// period of time on a perfectly matching machine.
+func (model *AzurePriceModel) PodPrice(pod *apiv1.Pod, startTime time.Time, endTime time.Time) (float64, error) {
+	price := 0.0
+	for _, container := range pod.Spec.Containers {
+		price += getBasePrice(container.Resources.Requests, startTime, endTime)
+		price += getGPUPrice(container.Resources.Requests, startTime, endTime)
+	}
+	return price, nil
+}
+
+func getBasePrice(resources apiv1.ResourceList, startTime time.Time, endTime time.Time) float64 {
+	if len(resources) == 0 {
+		return 0
+	}
+	hours := getHours(startTime, endTime)
+	price := 0.0
+	cpu := resources[apiv1.ResourceCPU]
+	mem := resources[apiv1.ResourceMemory]
+	price += float64(cpu.MilliValue()) / 1000.0 * cpuPricePerHour * hours
+	price += float64(mem.Value()) / gigabyte * memoryPricePerHourPerGb * hours
+	return price
+}
+
+// getGPUPrice prices the nvidia.com/gpu resource, or the alpha GPU resource
+// of the older clusters.
+func getGPUPrice(resources apiv1.ResourceList, startTime time.Time, endTime time.Time) float64 {
+	if len(resources) == 0 {
+		return 0
+	}
+	gpus, found := resources[gpu.ResourceNvidiaGPU]
+	if !found {
+		gpus = resources[apiv1.ResourceNvidiaGPU]
+	}
+	return float64(gpus.MilliValue()) / 1000.0 * gpuPricePerHour * getHours(startTime, endTime)
+}
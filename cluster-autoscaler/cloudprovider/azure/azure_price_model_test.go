@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	. "k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVMSizesArePriced(t *testing.T) {
+	for name := range VMSizes {
+		_, found := instancePrices[name]
+		assert.True(t, found, "no price for VM size %s", name)
+	}
+}
+
+func TestGetNodePrice(t *testing.T) {
+	model := &AzurePriceModel{}
+	now := time.Now()
+
+	// regular
+	node1 := BuildTestNode("node1", 2000, 8*1024*1024*1024)
+	node1.Labels = map[string]string{kubeletapis.LabelInstanceType: "Standard_D2_v3"}
+	price1, err := model.NodePrice(node1, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.096, price1, 1e-9)
+
+	// spot
+	node2 := BuildTestNode("node2", 2000, 8*1024*1024*1024)
+	node2.Labels = map[string]string{kubeletapis.LabelInstanceType: "Standard_D2_v3", scaleSetPriorityLabel: scaleSetPrioritySpot}
+	price2, err := model.NodePrice(node2, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, price1 > 3*price2)
+
+	// unknown VM size, priced by its resources like a Standard_D2_v3
+	node3 := BuildTestNode("node3", 2000, 8*1024*1024*1024)
+	node3.Labels = map[string]string{kubeletapis.LabelInstanceType: "Standard_D2_v9"}
+	price3, err := model.NodePrice(node3, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, price1, price3, 1e-9)
+
+	// unknown VM size with a GPU
+	node4 := BuildTestNode("node4", 2000, 8*1024*1024*1024)
+	node4.Status.Capacity[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(1, resource.DecimalSI)
+	price4, err := model.NodePrice(node4, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, price3+gpuPricePerHour, price4, 1e-9)
+
+	// the GPU is included in the price of GPU VM sizes
+	node5 := BuildTestNode("node5", 6000, 56*1024*1024*1024)
+	node5.Status.Capacity[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(1, resource.DecimalSI)
+	node5.Labels = map[string]string{kubeletapis.LabelInstanceType: "Standard_NC6"}
+	price5, err := model.NodePrice(node5, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.9, price5, 1e-9)
+
+	// the period is rounded up to the minute
+	price6, err := model.NodePrice(node1, now, now.Add(90*time.Second))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.096*2/60, price6, 1e-9)
+}
+
+func TestGetPodPrice(t *testing.T) {
+	pod1 := BuildTestPod("a1", 100, 500*1024*1024)
+	pod2 := BuildTestPod("a2", 2*100, 2*500*1024*1024)
+	pod3 := BuildTestPod("a3", 100, 500*1024*1024)
+	pod3.Spec.Containers[0].Resources.Requests[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(1, resource.DecimalSI)
+
+	model := &AzurePriceModel{}
+	now := time.Now()
+
+	price1, err := model.PodPrice(pod1, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	price2, err := model.PodPrice(pod2, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	// 2 times bigger pod should cost twice as much.
+	assert.True(t, math.Abs(price1*2-price2) < 1e-9)
+	price3, err := model.PodPrice(pod3, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, price1+gpuPricePerHour, price3, 1e-9)
+
+	// the nvidia.com/gpu resource of the device plugin
+	pod4 := BuildTestPod("a4", 100, 500*1024*1024)
+	pod4.Spec.Containers[0].Resources.Requests[gpu.ResourceNvidiaGPU] = *resource.NewQuantity(1, resource.DecimalSI)
+	price4, err := model.PodPrice(pod4, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, price3, price4, 1e-9)
+}
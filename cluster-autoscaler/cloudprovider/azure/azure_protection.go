@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// protectionPolicyAPIVersion is the first compute API version returning the
+// protection policy of scale set VMs, which the vendored compute API predates.
+const protectionPolicyAPIVersion = "2019-03-01"
+
+// ErrInstanceProtected is the reason reported by DeleteInstances for the
+// instances protected from scale-in or from scale set actions, which are not
+// deleted.
+var ErrInstanceProtected = errors.New("instance is protected from scale-in")
+
+// vmProtectionPolicy is the protection policy of a scale set VM.
+type vmProtectionPolicy struct {
+	ProtectFromScaleIn         bool `json:"protectFromScaleIn"`
+	ProtectFromScaleSetActions bool `json:"protectFromScaleSetActions"`
+}
+
+// protected returns true if the VM must not be removed by the autoscaler.
+func (p vmProtectionPolicy) protected() bool {
+	return p.ProtectFromScaleIn || p.ProtectFromScaleSetActions
+}
+
+type vmProtectionClient interface {
+	GetProtectionPolicy(resourceGroupName string, vmScaleSetName string, instanceID string) (vmProtectionPolicy, error)
+}
+
+// azureVMProtectionClient gets the protection policies of scale set VMs from
+// Azure with protectionPolicyAPIVersion.
+type azureVMProtectionClient struct {
+	autorest.Client
+	baseURI        string
+	subscriptionID string
+}
+
+func newVMProtectionClient(baseURI string, subscriptionID string, authorizer autorest.Authorizer) *azureVMProtectionClient {
+	client := &azureVMProtectionClient{
+		Client:         autorest.NewClientWithUserAgent(""),
+		baseURI:        baseURI,
+		subscriptionID: subscriptionID,
+	}
+	client.Authorizer = authorizer
+	return client
+}
+
+func (c *azureVMProtectionClient) GetProtectionPolicy(resourceGroupName string, vmScaleSetName string, instanceID string) (vmProtectionPolicy, error) {
+	pathParameters := map[string]interface{}{
+		"instanceId":        autorest.Encode("path", instanceID),
+		"resourceGroupName": autorest.Encode("path", resourceGroupName),
+		"subscriptionId":    autorest.Encode("path", c.subscriptionID),
+		"vmScaleSetName":    autorest.Encode("path", vmScaleSetName),
+	}
+	queryParameters := map[string]interface{}{
+		"api-version": protectionPolicyAPIVersion,
+	}
+	req, err := autorest.CreatePreparer(
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachineScaleSets/{vmScaleSetName}/virtualmachines/{instanceId}", pathParameters),
+		autorest.WithQueryParameters(queryParameters)).Prepare(&http.Request{})
+	if err != nil {
+		return vmProtectionPolicy{}, autorest.NewErrorWithError(err, "azure.azureVMProtectionClient", "GetProtectionPolicy", nil, "Failure preparing request")
+	}
+	resp, err := autorest.SendWithSender(c, req)
+	if err != nil {
+		return vmProtectionPolicy{}, autorest.NewErrorWithError(err, "azure.azureVMProtectionClient", "GetProtectionPolicy", resp, "Failure sending request")
+	}
+
+	var vm struct {
+		Properties struct {
+			ProtectionPolicy *vmProtectionPolicy `json:"protectionPolicy"`
+		} `json:"properties"`
+	}
+	err = autorest.Respond(
+		resp,
+		c.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&vm),
+		autorest.ByClosing())
+	if err != nil {
+		return vmProtectionPolicy{}, autorest.NewErrorWithError(err, "azure.azureVMProtectionClient", "GetProtectionPolicy", resp, "Failure responding to request")
+	}
+	if vm.Properties.ProtectionPolicy == nil {
+		return vmProtectionPolicy{}, nil
+	}
+	return *vm.Properties.ProtectionPolicy, nil
+}
+
+// filterProtectedInstances returns the instance IDs of the scale set which
+// aren't protected, and the reasons of the other ones keyed by instance name.
+// An instance whose protection policy can't be read isn't deleted either.
+// The VMs of flexible scale sets have no protection policy.
+func (m *AzureManager) filterProtectedInstances(scaleSet *ScaleSet, instanceIds []string, instancesByID map[string]*AzureRef) ([]string, map[string]error) {
+	failed := make(map[string]error)
+	clients, err := m.clientsOf(scaleSet)
+	if err != nil {
+		for _, id := range instanceIds {
+			failed[instancesByID[id].Name] = err
+		}
+		return nil, failed
+	}
+	if clients.protectionClient == nil || m.isFlexible(scaleSet) {
+		return instanceIds, failed
+	}
+	unprotected := make([]string, 0, len(instanceIds))
+	for _, id := range instanceIds {
+		instance := instancesByID[id]
+		policy, err := clients.protectionClient.GetProtectionPolicy(m.resourceGroup(scaleSet), scaleSet.Name, id)
+		if err != nil {
+			m.log().Warningf("Skipping deletion of instance %s whose protection policy can't be read: %v", instance.Name, err)
+			failed[instance.Name] = err
+			continue
+		}
+		if policy.protected() {
+			m.log().Infof("Skipping deletion of instance %s which is protected from scale-in", instance.Name)
+			failed[instance.Name] = ErrInstanceProtected
+			continue
+		}
+		unprotected = append(unprotected, id)
+	}
+	return unprotected, failed
+}
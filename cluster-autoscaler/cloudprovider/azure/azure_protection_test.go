@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// vmProtectionClientMock is a vmProtectionClient whose responses are set up per test.
+type vmProtectionClientMock struct {
+	mock.Mock
+}
+
+func (client *vmProtectionClientMock) GetProtectionPolicy(resourceGroupName string, vmScaleSetName string, instanceID string) (vmProtectionPolicy, error) {
+	args := client.Called(resourceGroupName, vmScaleSetName, instanceID)
+	return args.Get(0).(vmProtectionPolicy), args.Error(1)
+}
+
+func TestGetProtectionPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, protectionPolicyAPIVersion, r.URL.Query().Get("api-version"))
+		switch r.URL.Path {
+		case "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualmachines/1":
+			fmt.Fprint(w, `{"properties": {"protectionPolicy": {"protectFromScaleIn": true}}}`)
+		case "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualmachines/2":
+			fmt.Fprint(w, `{"properties": {}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "NotFound"}}`)
+		}
+	}))
+	defer server.Close()
+	client := newVMProtectionClient(server.URL, "sub", autorest.NullAuthorizer{})
+
+	policy, err := client.GetProtectionPolicy("rg", "ss1", "1")
+	assert.NoError(t, err)
+	assert.True(t, policy.ProtectFromScaleIn)
+	assert.True(t, policy.protected())
+
+	policy, err = client.GetProtectionPolicy("rg", "ss1", "2")
+	assert.NoError(t, err)
+	assert.False(t, policy.protected())
+
+	_, err = client.GetProtectionPolicy("rg", "ss1", "3")
+	assert.Error(t, err)
+	assert.True(t, isNotFoundError(err))
+}
+
+func TestDeleteInstancesSkipsProtectedInstances(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	protectionClient := &vmProtectionClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.protectionClient = protectionClient
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 3)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	protectionClient.On("GetProtectionPolicy", "rg", "ss1", "0").Return(vmProtectionPolicy{ProtectFromScaleIn: true}, nil)
+	protectionClient.On("GetProtectionPolicy", "rg", "ss1", "1").Return(vmProtectionPolicy{ProtectFromScaleSetActions: true}, nil)
+	protectionClient.On("GetProtectionPolicy", "rg", "ss1", "2").Return(vmProtectionPolicy{}, nil)
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+
+	refs := make([]*AzureRef, 0)
+	for _, vm := range *vms.Value {
+		refs = append(refs, &AzureRef{Name: "azure://" + strings.ToLower(*vm.ID)})
+	}
+	err := m.DeleteInstances(context.Background(), refs)
+	deleteErr, ok := err.(*DeleteInstancesError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, 2, len(deleteErr.Failed))
+		for _, ref := range refs[:2] {
+			assert.Equal(t, ErrInstanceProtected, deleteErr.Failed[ref.Name])
+		}
+	}
+	// Only the unprotected instance is deleted.
+	ssClient.AssertCalled(t, "DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &[]string{"2"}})
+}
+
+func TestDeleteInstancesUnknownProtection(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	protectionClient := &vmProtectionClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.protectionClient = protectionClient
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	vms := newTestVMListResult("ss1", 1)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss1").Return(vms, nil)
+	assert.NoError(t, m.Refresh())
+
+	// An instance whose protection is unknown isn't deleted.
+	protectionClient.On("GetProtectionPolicy", "rg", "ss1", "0").Return(vmProtectionPolicy{}, fmt.Errorf("get failed"))
+	ref := &AzureRef{Name: "azure://" + strings.ToLower(*(*vms.Value)[0].ID)}
+	err := m.DeleteInstances(context.Background(), []*AzureRef{ref})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "get failed")
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Number of provisioning times kept per scale set.
+	provisioningTimeSamples = 20
+	// Number of provisioning times of a scale set below which its
+	// provisioning time is unknown.
+	minProvisioningTimeSamples = 3
+	// The maximum provisioning time of a scale set is its usual provisioning
+	// time, the 90th percentile of its provisioning times, times this margin.
+	provisioningTimeMargin = 2
+	// Lower bound of the maximum provisioning time of a scale set, so that a
+	// few fast scale-ups don't make a slower one time out.
+	minMaxProvisioningTime = 5 * time.Minute
+)
+
+// recordProvisioningTimes records the time the new instances of the pending
+// scale-ups took to be provisioned according to the last refresh, from the
+// request of the scale-up. The scale sets of VMs with ephemeral OS disks or
+// cached images, which boot faster, thus get shorter provisioning times. An
+// instance is only timed once, and the instances which existed before the
+// scale-up are ignored.
+func (m *AzureManager) recordProvisioningTimes() {
+	m.sizeMutex.Lock()
+	pending := make(map[string]scaleUp, len(m.scaleUps))
+	for key, s := range m.scaleUps {
+		pending[key] = s
+	}
+	m.sizeMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	now := time.Now()
+	provisioned := make(map[string][]string)
+	scaleSets := make(map[string]*ScaleSet)
+	m.cacheMutex.Lock()
+	for _, sset := range m.scaleSets {
+		key := m.scaleSetKey(sset.config)
+		s, found := pending[key]
+		if !found {
+			continue
+		}
+		for name, state := range m.instanceStateCache {
+			switch state {
+			case vmProvisioningStateCreating, vmProvisioningStateDeleting, vmProvisioningStateFailed:
+				continue
+			}
+			if !s.existing[name] && !s.provisioned[name] && m.ownsInstance(sset, name) {
+				provisioned[key] = append(provisioned[key], name)
+				scaleSets[key] = sset.config
+			}
+		}
+	}
+	m.cacheMutex.Unlock()
+
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	if m.provisioningTimes == nil {
+		m.provisioningTimes = make(map[string][]time.Duration)
+	}
+	for key, names := range provisioned {
+		s, found := m.scaleUps[key]
+		// The scale-up was replaced by another one in the meantime.
+		if !found || !s.requestedAt.Equal(pending[key].requestedAt) || s.provisioned == nil {
+			continue
+		}
+		elapsed := now.Sub(s.requestedAt)
+		times := m.provisioningTimes[key]
+		for _, name := range names {
+			s.provisioned[name] = true
+			times = append(times, elapsed)
+			scaleSetProvisioningDuration.WithLabelValues(scaleSets[key].Id()).Observe(elapsed.Seconds())
+		}
+		if len(times) > provisioningTimeSamples {
+			times = times[len(times)-provisioningTimeSamples:]
+		}
+		m.provisioningTimes[key] = times
+		m.log().V(4).Infof("%d new instance(s) of scale set %s provisioned in %v", len(names), scaleSets[key].Name, elapsed)
+	}
+}
+
+// GetProvisioningTime returns the usual time the new instances of the scale
+// set take to be provisioned, the 90th percentile of its last provisioning
+// times. The second value is false if too few instances were timed yet.
+func (m *AzureManager) GetProvisioningTime(scaleSet *ScaleSet) (time.Duration, bool) {
+	m.sizeMutex.Lock()
+	times := append([]time.Duration{}, m.provisioningTimes[m.scaleSetKey(scaleSet)]...)
+	m.sizeMutex.Unlock()
+	if len(times) < minProvisioningTimeSamples {
+		return 0, false
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[(len(times)*9-1)/10], true
+}
+
+// GetMaxProvisioningTime returns the time after which the new instances of the
+// scale set can be considered failed to be provisioned, derived from its
+// provisioning times and bounded by the scale-up timeout. It's the scale-up
+// timeout if the provisioning time of the scale set is unknown.
+func (m *AzureManager) GetMaxProvisioningTime(scaleSet *ScaleSet) time.Duration {
+	timeout := m.scaleUpTimeout
+	if timeout <= 0 {
+		timeout = defaultScaleUpTimeout
+	}
+	usual, found := m.GetProvisioningTime(scaleSet)
+	if !found {
+		return timeout
+	}
+	max := usual * provisioningTimeMargin
+	if max < minMaxProvisioningTime {
+		max = minMaxProvisioningTime
+	}
+	if max > timeout {
+		max = timeout
+	}
+	return max
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+func TestRecordProvisioningTimes(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleUpTimeout = 20 * time.Minute
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil).Once()
+	scaleSet := registerTestScaleSet(t, m, "1:10:ss1")
+	assert.NoError(t, m.Refresh())
+
+	// Unknown until enough instances were timed.
+	_, found := m.GetProvisioningTime(scaleSet)
+	assert.False(t, found)
+	assert.Equal(t, 20*time.Minute, scaleSet.MaxNodeProvisionTime())
+	var nodeGroup cloudprovider.NodeGroup = scaleSet
+	_, ok := nodeGroup.(cloudprovider.NodeGroupWithMaxNodeProvisionTime)
+	assert.True(t, ok)
+
+	// The scale-up to 4 instances was requested 4 minutes ago, one of the new
+	// instances is still being created.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 4))
+	m.resizes.Wait()
+	pending := m.scaleUps["rg/ss1"]
+	pending.requestedAt = time.Now().Add(-4 * time.Minute)
+	m.scaleUps["rg/ss1"] = pending
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Succeeded", "Succeeded", vmProvisioningStateCreating), nil).Once()
+	assert.NoError(t, m.Refresh())
+	m.recordProvisioningTimes()
+	assert.Equal(t, 2, len(m.provisioningTimes["rg/ss1"]))
+	_, found = m.GetProvisioningTime(scaleSet)
+	assert.False(t, found)
+
+	// The last one comes up 2 minutes later, the others aren't timed again.
+	pending.requestedAt = time.Now().Add(-6 * time.Minute)
+	m.scaleUps["rg/ss1"] = pending
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Succeeded", "Succeeded", "Succeeded"), nil)
+	assert.NoError(t, m.Refresh())
+	m.recordProvisioningTimes()
+	m.recordProvisioningTimes()
+	assert.Equal(t, 3, len(m.provisioningTimes["rg/ss1"]))
+	usual, found := m.GetProvisioningTime(scaleSet)
+	assert.True(t, found)
+	assert.InDelta(t, float64(6*time.Minute), float64(usual), float64(time.Second))
+	assert.InDelta(t, float64(12*time.Minute), float64(scaleSet.MaxNodeProvisionTime()), float64(2*time.Second))
+	assert.InDelta(t, float64(6*time.Minute), float64(m.Snapshot()[0].ProvisioningTime), float64(time.Second))
+
+	// The maximum provisioning time is bounded.
+	m.provisioningTimes["rg/ss1"] = []time.Duration{time.Minute, time.Minute, time.Minute}
+	assert.Equal(t, minMaxProvisioningTime, scaleSet.MaxNodeProvisionTime())
+	m.provisioningTimes["rg/ss1"] = []time.Duration{time.Hour, time.Hour, time.Hour}
+	assert.Equal(t, 20*time.Minute, scaleSet.MaxNodeProvisionTime())
+}
+
+func TestProvisioningTimePercentile(t *testing.T) {
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:10:ss1")
+	times := make([]time.Duration, 0)
+	for i := 20; i > 0; i-- {
+		times = append(times, time.Duration(i)*time.Minute)
+	}
+	m.provisioningTimes = map[string][]time.Duration{"rg/ss1": times}
+	usual, found := m.GetProvisioningTime(scaleSet)
+	assert.True(t, found)
+	assert.Equal(t, 18*time.Minute, usual)
+	// The provisioning times aren't reordered.
+	assert.Equal(t, 20*time.Minute, m.provisioningTimes["rg/ss1"][0])
+}
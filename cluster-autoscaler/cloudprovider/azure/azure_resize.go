@@ -0,0 +1,362 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ScaleUpTimeoutError is returned by CheckScaleUp when the VMs of a scale set
+// didn't come up within the scale-up timeout, e.g. because of quota
+// exhaustion or lack of capacity in the region.
+type ScaleUpTimeoutError struct {
+	ScaleSet string
+	// Target is the requested capacity of the scale set.
+	Target int64
+	// Current is the number of VMs of the scale set.
+	Current int
+	// Since is the time the capacity was increased.
+	Since time.Time
+}
+
+func (e *ScaleUpTimeoutError) Error() string {
+	return fmt.Sprintf("scale set %s has %d VMs out of %d requested since %v", e.ScaleSet, e.Current, e.Target, e.Since)
+}
+
+// ErrScaleSetUpdating is returned by SetScaleSetSize when a previous update of
+// the scale set is still in progress.
+var ErrScaleSetUpdating = errors.New("scale set is being updated")
+
+// scaleSetSizePollInterval is the interval between two checks of the size of
+// a scale set in SetScaleSetSizeAndWait, it's a variable for testing.
+var scaleSetSizePollInterval = 10 * time.Second
+
+// scaleUp is an increase of the capacity of a scale set whose VMs may not
+// have come up yet.
+type scaleUp struct {
+	target      int64
+	requestedAt time.Time
+	// existing are the names of the cached instances of the scale set when
+	// the scale-up was requested, which weren't created by it.
+	existing map[string]bool
+	// provisioned are the names of the instances created by the scale-up
+	// whose provisioning time was recorded, guarded by sizeMutex.
+	provisioned map[string]bool
+}
+
+// setScaleUp records the new capacity of the scale set if it was increased,
+// and forgets the pending scale-up otherwise.
+func (m *AzureManager) setScaleUp(asConfig *ScaleSet, previous int64, size int64) {
+	var existing map[string]bool
+	if size > previous {
+		existing = m.cachedInstanceNames(asConfig)
+	}
+	m.sizeMutex.Lock()
+	defer m.sizeMutex.Unlock()
+	if m.scaleUps == nil {
+		m.scaleUps = make(map[string]scaleUp)
+	}
+	if size > previous {
+		m.scaleUps[m.scaleSetKey(asConfig)] = scaleUp{target: size, requestedAt: time.Now(), existing: existing, provisioned: make(map[string]bool)}
+	} else {
+		delete(m.scaleUps, m.scaleSetKey(asConfig))
+	}
+}
+
+// CheckScaleUp compares the number of VMs of the scale set with the capacity
+// requested by the last SetScaleSetSize. It returns a *ScaleUpTimeoutError if
+// the VMs are still missing after the maximum provisioning time of the scale
+// set, see GetMaxProvisioningTime. The refreshes abort such scale-ups, see
+// abortTimedOutScaleUps.
+func (m *AzureManager) CheckScaleUp(ctx context.Context, asConfig *ScaleSet) error {
+	m.sizeMutex.Lock()
+	pending, found := m.scaleUps[m.scaleSetKey(asConfig)]
+	m.sizeMutex.Unlock()
+	if !found {
+		return nil
+	}
+	vms, err := m.GetScaleSetVms(ctx, asConfig)
+	if err != nil {
+		return err
+	}
+	if int64(len(vms)) >= pending.target {
+		m.sizeMutex.Lock()
+		if current, found := m.scaleUps[m.scaleSetKey(asConfig)]; found && current.requestedAt.Equal(pending.requestedAt) {
+			delete(m.scaleUps, m.scaleSetKey(asConfig))
+		}
+		m.sizeMutex.Unlock()
+		return nil
+	}
+	timeout := m.GetMaxProvisioningTime(asConfig)
+	if time.Since(pending.requestedAt) < timeout {
+		m.log().V(4).Infof("Scale set %s has %d VMs out of %d requested", asConfig.Name, len(vms), pending.target)
+		return nil
+	}
+	return &ScaleUpTimeoutError{
+		ScaleSet: asConfig.Name,
+		Target:   pending.target,
+		Current:  len(vms),
+		Since:    pending.requestedAt,
+	}
+}
+
+// SetScaleSetSize sets ScaleSet size. Sizes outside of the bounds of the scale
+// set are rejected. The scale-ups are tracked by CheckScaleUp.
+//
+// It returns once the resize is issued, without waiting for Azure to complete
+// it. Until then GetScaleSetSize returns the new size. A failed resize is
+// logged and the size is fetched from Azure again, as when ctx is done before
+// the resize completed.
+func (m *AzureManager) SetScaleSetSize(ctx context.Context, asConfig *ScaleSet, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if size < int64(asConfig.MinSize()) || size > int64(asConfig.MaxSize()) {
+		return fmt.Errorf("size %d of scale set %s is outside of its bounds [%d, %d]", size, asConfig.Name, asConfig.MinSize(), asConfig.MaxSize())
+	}
+	clients, err := m.clientsOf(asConfig)
+	if err == nil {
+		err = m.checkBackoff(asConfig)
+	}
+	if err != nil {
+		return err
+	}
+	op, err := clients.scaleSetClient.Get(m.resourceGroup(asConfig), asConfig.Name)
+	if err != nil {
+		m.backOffIfThrottled(asConfig, err)
+		return err
+	}
+	if op.Sku == nil || op.Sku.Capacity == nil {
+		return fmt.Errorf("scale set %s has no capacity", asConfig.Name)
+	}
+	if op.VirtualMachineScaleSetProperties == nil {
+		return fmt.Errorf("scale set %s has no properties", asConfig.Name)
+	}
+	if op.VirtualMachineScaleSetProperties.ProvisioningState != nil {
+		state := *op.VirtualMachineScaleSetProperties.ProvisioningState
+		if state != "Succeeded" && state != "Failed" {
+			m.log().Warningf("Scale set %s is in provisioning state %s, not resizing it", asConfig.Name, state)
+			return ErrScaleSetUpdating
+		}
+	}
+	previous := *op.Sku.Capacity
+	op.Sku.Capacity = &size
+	op.VirtualMachineScaleSetProperties.ProvisioningState = nil
+
+	// The resize outlives the call, it's waited for until ctx is done,
+	// Cleanup is called or it timed out.
+	opCtx, cancel := m.operationContext(ctx)
+	resultChan, errChan := clients.scaleSetClient.CreateOrUpdate(m.resourceGroup(asConfig), asConfig.Name, op, opCtx.Done())
+	m.setInFlightSize(asConfig, size)
+	m.setScaleUp(asConfig, previous, size)
+
+	m.resizes.Add(1)
+	go func() {
+		defer m.resizes.Done()
+		defer cancel()
+		err := waitForOperation(opCtx, errChan)
+		var result compute.VirtualMachineScaleSet
+		select {
+		case result = <-resultChan:
+		default:
+		}
+		if err != nil {
+			m.log().Errorf("Failed to resize scale set %s to %d: %v", asConfig.Name, size, err)
+			m.recordEvent(apiv1.EventTypeWarning, scaleSetResizeFailedReason, "Failed to resize scale set %s to %d, operation %s: %v", asConfig.Name, size, operationID(result.Response), err)
+			m.backOffIfThrottled(asConfig, err)
+			m.backOffIfAllocationFailed(asConfig, err)
+		} else {
+			m.log().V(4).Infof("Resized scale set %s to %d", asConfig.Name, size)
+			m.recordEvent(apiv1.EventTypeNormal, scaleSetResizedReason, "Resized scale set %s from %d to %d, operation %s", asConfig.Name, previous, size, operationID(result.Response))
+			m.expireScaleSet(asConfig)
+		}
+		m.finishInFlightSize(asConfig, size, err)
+	}()
+	return nil
+}
+
+// SetScaleSetSizeAndWait sets the size of the scale set and waits until its
+// capacity reaches size, or returns an error once timeout has elapsed.
+func (m *AzureManager) SetScaleSetSizeAndWait(ctx context.Context, asConfig *ScaleSet, size int64, timeout time.Duration) error {
+	if err := m.SetScaleSetSize(ctx, asConfig, size); err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := wait.PollUntil(scaleSetSizePollInterval, func() (bool, error) {
+		// The cached size is the target just set, ask Azure for the actual one.
+		m.invalidateCachedSize(asConfig)
+		current, err := m.GetScaleSetSize(waitCtx, asConfig)
+		if err != nil {
+			if waitCtx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		m.log().V(4).Infof("Waiting for scale set %s to reach size %d, current size %d", asConfig.Name, size, current)
+		return current == size, nil
+	}, waitCtx.Done())
+	if err == wait.ErrWaitTimeout {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("timed out after %v waiting for scale set %s to reach size %d", timeout, asConfig.Name, size)
+	}
+	return err
+}
+
+// DecreaseTargetSize decreases the target size of the scale set by delta without
+// deleting any existing VM. Delta should be negative.
+func (m *AzureManager) DecreaseTargetSize(ctx context.Context, asConfig *ScaleSet, delta int) error {
+	if delta >= 0 {
+		return fmt.Errorf("size decrease size must be negative")
+	}
+	size, err := m.GetScaleSetSize(ctx, asConfig)
+	if err != nil {
+		return err
+	}
+	nodes, err := m.GetScaleSetVms(ctx, asConfig)
+	if err != nil {
+		return err
+	}
+	// The deallocated VMs are part of the capacity but not nodes.
+	targetSize := size - int64(len(m.GetDeallocatedInstances(asConfig)))
+	if int(targetSize)+delta < len(nodes) {
+		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
+			targetSize, delta, len(nodes))
+	}
+	return m.SetScaleSetSize(ctx, asConfig, size+int64(delta))
+}
+
+// StartInstances starts the deallocated instances with the given IDs of the
+// scale set. Like SetScaleSetSize it returns once the start is accepted and
+// waits for it until ctx is done, the instances are no longer reported as
+// deallocated meanwhile.
+func (m *AzureManager) StartInstances(ctx context.Context, scaleSet *ScaleSet, instanceIds []string) error {
+	clients, err := m.clientsOf(scaleSet)
+	if err == nil {
+		err = m.checkBackoff(scaleSet)
+	}
+	if err != nil {
+		return err
+	}
+	m.log().Infof("Starting deallocated instances %v of scale set %s", instanceIds, scaleSet.Name)
+	opCtx, cancel := m.operationContext(ctx)
+	_, errChan := clients.scaleSetClient.Start(m.resourceGroup(scaleSet), scaleSet.Name, &compute.VirtualMachineScaleSetVMInstanceIDs{InstanceIds: &instanceIds}, opCtx.Done())
+
+	m.cacheMutex.Lock()
+	if sset := m.getScaleSetInformation(scaleSet); sset != nil {
+		started := make(map[string]bool, len(instanceIds))
+		for _, id := range instanceIds {
+			started[id] = true
+		}
+		for name, id := range sset.deallocated {
+			if started[id] {
+				delete(sset.deallocated, name)
+			}
+		}
+	}
+	m.cacheMutex.Unlock()
+
+	m.resizes.Add(1)
+	go func() {
+		defer m.resizes.Done()
+		defer cancel()
+		// The refresh reports the instances which failed to start as
+		// deallocated again.
+		defer m.expireScaleSet(scaleSet)
+		if err := waitForOperation(opCtx, errChan); err != nil {
+			m.log().Errorf("Failed to start instances %v of scale set %s: %v", instanceIds, scaleSet.Name, err)
+			m.backOffIfThrottled(scaleSet, err)
+			m.backOffIfAllocationFailed(scaleSet, err)
+		}
+	}()
+	return nil
+}
+
+// getCapacity gets the capacity of the scale set from Azure, bypassing the
+// size cache.
+func (m *AzureManager) getCapacity(scaleSet *ScaleSet) (int64, error) {
+	clients, err := m.clientsOf(scaleSet)
+	if err == nil {
+		err = m.checkBackoff(scaleSet)
+	}
+	if err != nil {
+		return -1, err
+	}
+	op, err := clients.scaleSetClient.Get(m.resourceGroup(scaleSet), scaleSet.Name)
+	if err != nil {
+		m.backOffIfThrottled(scaleSet, err)
+		return -1, err
+	}
+	if op.Sku == nil || op.Sku.Capacity == nil {
+		return -1, fmt.Errorf("scale set %s has no capacity", scaleSet.Name)
+	}
+	return *op.Sku.Capacity, nil
+}
+
+// decrementCapacity sets the capacity of the scale set to expected if it's
+// still higher once its instances were deleted, e.g. because Azure recreated
+// some of them, so that the scale-down isn't undone.
+func (m *AzureManager) decrementCapacity(ctx context.Context, scaleSet *ScaleSet, expected int64) error {
+	clients, err := m.clientsOf(scaleSet)
+	if err == nil {
+		err = m.checkBackoff(scaleSet)
+	}
+	if err != nil {
+		return err
+	}
+	op, err := clients.scaleSetClient.Get(m.resourceGroup(scaleSet), scaleSet.Name)
+	if err != nil {
+		m.backOffIfThrottled(scaleSet, err)
+		return err
+	}
+	if op.Sku == nil || op.Sku.Capacity == nil || *op.Sku.Capacity <= expected {
+		return nil
+	}
+	m.log().Warningf("Capacity %d of scale set %s wasn't decremented by the deletion of its instances, setting it to %d", *op.Sku.Capacity, scaleSet.Name, expected)
+	previous := *op.Sku.Capacity
+	op.Sku.Capacity = &expected
+	if op.VirtualMachineScaleSetProperties != nil {
+		op.VirtualMachineScaleSetProperties.ProvisioningState = nil
+	}
+	defer m.invalidateCachedSize(scaleSet)
+	opCtx, cancel := m.operationContext(ctx)
+	defer cancel()
+	resultChan, errChan := clients.scaleSetClient.CreateOrUpdate(m.resourceGroup(scaleSet), scaleSet.Name, op, opCtx.Done())
+	err = waitForOperation(opCtx, errChan)
+	var result compute.VirtualMachineScaleSet
+	select {
+	case result = <-resultChan:
+	default:
+	}
+	if err != nil {
+		m.recordEvent(apiv1.EventTypeWarning, scaleSetResizeFailedReason, "Failed to resize scale set %s to %d, operation %s: %v", scaleSet.Name, expected, operationID(result.Response), err)
+		m.backOffIfThrottled(scaleSet, err)
+		return err
+	}
+	m.recordEvent(apiv1.EventTypeNormal, scaleSetResizedReason, "Resized scale set %s from %d to %d, operation %s", scaleSet.Name, previous, expected, operationID(result.Response))
+	return nil
+}
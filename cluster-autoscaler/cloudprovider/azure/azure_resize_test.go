@@ -0,0 +1,270 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCanceledContext(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := m.GetScaleSetSize(ctx, scaleSet)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, m.SetScaleSetSize(ctx, scaleSet, 3))
+	_, err = m.GetScaleSetVms(ctx, scaleSet)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, m.DeleteInstances(ctx, []*AzureRef{{Name: "azure://vm"}}))
+
+	ssClient.AssertNotCalled(t, "Get", "rg", "ss1")
+	vmClient.AssertNotCalled(t, "List", "rg", "ss1")
+}
+
+func TestSetScaleSetSizeInFlight(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.scaleSetClient = &hangingScaleSetClient{ssClient}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return()
+
+	// The call doesn't wait for the resize, whose size is returned until it completes.
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, m.SetScaleSetSize(ctx, scaleSet, 3))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+	size, err := m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 1)
+
+	// Canceling the context of the call stops waiting for the resize, the
+	// size is fetched again.
+	cancel()
+	m.resizes.Wait()
+	size, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 2)
+
+	// So does Cleanup.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	m.Cleanup()
+	m.resizes.Wait()
+	size, err = m.GetScaleSetSize(context.Background(), scaleSet)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	ssClient.AssertNumberOfCalls(t, "Get", 4)
+}
+
+func TestSetScaleSetSizeUpdating(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	updating := newTestScaleSet("ss1", 2)
+	state := "Updating"
+	updating.VirtualMachineScaleSetProperties.ProvisioningState = &state
+	ssClient.On("Get", "rg", "ss1").Return(updating, nil)
+
+	assert.Equal(t, ErrScaleSetUpdating, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetScaleSetSizeWithoutCapacity(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	withoutSku := newTestScaleSet("ss1", 2)
+	withoutSku.Sku = nil
+	ssClient.On("Get", "rg", "ss1").Return(withoutSku, nil)
+
+	assert.EqualError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3), "scale set ss1 has no capacity")
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetScaleSetSizeWithoutProperties(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	withoutProperties := newTestScaleSet("ss1", 2)
+	withoutProperties.VirtualMachineScaleSetProperties = nil
+	ssClient.On("Get", "rg", "ss1").Return(withoutProperties, nil)
+
+	assert.EqualError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3), "scale set ss1 has no properties")
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetScaleSetSizeOutOfBounds(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "2:5:ss1")
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 3), nil)
+
+	err := m.SetScaleSetSize(context.Background(), scaleSet, 1)
+	assert.EqualError(t, err, "size 1 of scale set ss1 is outside of its bounds [2, 5]")
+	err = m.SetScaleSetSize(context.Background(), scaleSet, 6)
+	assert.EqualError(t, err, "size 6 of scale set ss1 is outside of its bounds [2, 5]")
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetScaleSetSizeSucceeded(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	succeeded := newTestScaleSet("ss1", 2)
+	state := "Succeeded"
+	succeeded.VirtualMachineScaleSetProperties.ProvisioningState = &state
+	ssClient.On("Get", "rg", "ss1").Return(succeeded, nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+}
+
+func TestSetScaleSetSizeAndWait(t *testing.T) {
+	defer func(interval time.Duration) { scaleSetSizePollInterval = interval }(scaleSetSizePollInterval)
+	scaleSetSizePollInterval = time.Millisecond
+
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.sizeCacheTTL = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	// The first Get is done by SetScaleSetSize, the size converges on the fourth poll.
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil).Times(4)
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 4), nil).Once()
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+
+	assert.NoError(t, m.SetScaleSetSizeAndWait(context.Background(), scaleSet, 4, time.Minute))
+	ssClient.AssertNumberOfCalls(t, "Get", 5)
+}
+
+func TestSetScaleSetSizeAndWaitTimeout(t *testing.T) {
+	defer func(interval time.Duration) { scaleSetSizePollInterval = interval }(scaleSetSizePollInterval)
+	scaleSetSizePollInterval = time.Millisecond
+
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+
+	err := m.SetScaleSetSizeAndWait(context.Background(), scaleSet, 4, 20*time.Millisecond)
+	assert.EqualError(t, err, "timed out after 20ms waiting for scale set ss1 to reach size 4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, m.SetScaleSetSizeAndWait(ctx, scaleSet, 4, time.Minute))
+}
+
+func TestDecreaseTargetSize(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 4), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.MatchedBy(func(ss compute.VirtualMachineScaleSet) bool {
+		return *ss.Sku.Capacity == 2
+	})).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+
+	assert.NoError(t, m.DecreaseTargetSize(context.Background(), scaleSet, -2))
+	ssClient.AssertNumberOfCalls(t, "CreateOrUpdate", 1)
+}
+
+func TestDecreaseTargetSizeRejected(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 4), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 3), nil)
+
+	err := m.DecreaseTargetSize(context.Background(), scaleSet, -2)
+	assert.EqualError(t, err, "attempt to delete existing nodes targetSize:4 delta:-2 existingNodes: 3")
+	assert.Error(t, m.DecreaseTargetSize(context.Background(), scaleSet, 1))
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckScaleUpTimeout(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.scaleUpTimeout = time.Minute
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	// Azure accepts the new capacity but the VMs never come up.
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 1), nil)
+
+	assert.NoError(t, m.CheckScaleUp(context.Background(), scaleSet))
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	assert.NoError(t, m.CheckScaleUp(context.Background(), scaleSet))
+
+	pending := m.scaleUps["rg/ss1"]
+	pending.requestedAt = time.Now().Add(-2 * time.Minute)
+	m.scaleUps["rg/ss1"] = pending
+	err := m.CheckScaleUp(context.Background(), scaleSet)
+	timeoutErr, ok := err.(*ScaleUpTimeoutError)
+	assert.True(t, ok)
+	assert.Equal(t, &ScaleUpTimeoutError{ScaleSet: "ss1", Target: 3, Current: 1, Since: pending.requestedAt}, timeoutErr)
+
+	// Aborting the scale-up forgets it.
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 1))
+	assert.NoError(t, m.CheckScaleUp(context.Background(), scaleSet))
+	assert.Empty(t, m.scaleUps)
+}
+
+func TestCheckScaleUpCompleted(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	scaleSet := registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 3), nil)
+
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), scaleSet, 3))
+	m.scaleUps["rg/ss1"] = scaleUp{target: 3, requestedAt: time.Now().Add(-time.Hour)}
+	assert.NoError(t, m.CheckScaleUp(context.Background(), scaleSet))
+	assert.Empty(t, m.scaleUps)
+}
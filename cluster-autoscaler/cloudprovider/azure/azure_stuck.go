@@ -0,0 +1,194 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+// stuckInstanceStates are the provisioning states of the instances which are
+// force-deleted once they stayed in them for longer than stuckInstanceTimeout.
+var stuckInstanceStates = map[string]bool{
+	vmProvisioningStateFailed:   true,
+	vmProvisioningStateUpdating: true,
+}
+
+// leftoverResources are the resources of a VM which may be left behind once
+// it is deleted.
+type leftoverResources struct {
+	// IDs of the managed OS disk and of the network interfaces which aren't
+	// resources of the scale set.
+	disks      []string
+	interfaces []string
+}
+
+// vmLeftoverResources returns the resources of the scale set VM which may be
+// left behind by its deletion. The data disks are never returned, they may be
+// persistent volumes attached to the node.
+func vmLeftoverResources(vm compute.VirtualMachineScaleSetVM) leftoverResources {
+	var resources leftoverResources
+	props := vm.VirtualMachineScaleSetVMProperties
+	if props == nil {
+		return resources
+	}
+	if props.StorageProfile != nil && props.StorageProfile.OsDisk != nil && props.StorageProfile.OsDisk.ManagedDisk != nil {
+		if id := props.StorageProfile.OsDisk.ManagedDisk.ID; id != nil {
+			resources.disks = append(resources.disks, *id)
+		}
+	}
+	if props.NetworkProfile != nil && props.NetworkProfile.NetworkInterfaces != nil {
+		for _, nic := range *props.NetworkProfile.NetworkInterfaces {
+			// The network interfaces of the scale set are deleted with its VMs.
+			if nic.ID != nil && strings.Contains(strings.ToLower(*nic.ID), "/providers/microsoft.network/networkinterfaces/") {
+				resources.interfaces = append(resources.interfaces, *nic.ID)
+			}
+		}
+	}
+	return resources
+}
+
+// expiredStuckInstances records since when the cached instances are stuck in
+// one of stuckInstanceStates and returns the ones stuck for longer than
+// stuckInstanceTimeout, by scale set.
+func (m *AzureManager) expiredStuckInstances(now time.Time) ([]*ScaleSet, map[*ScaleSet][]*AzureRef) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	if m.stuckInstances == nil {
+		m.stuckInstances = make(map[string]time.Time)
+	}
+	for name := range m.stuckInstances {
+		if !stuckInstanceStates[m.instanceStateCache[name]] {
+			delete(m.stuckInstances, name)
+		}
+	}
+
+	scaleSets := make([]*ScaleSet, 0)
+	expired := make(map[*ScaleSet][]*AzureRef)
+	for name, state := range m.instanceStateCache {
+		if !stuckInstanceStates[state] {
+			continue
+		}
+		since, found := m.stuckInstances[name]
+		if !found {
+			m.stuckInstances[name] = now
+			continue
+		}
+		scaleSet := m.scaleSetCache[AzureRef{Name: name}]
+		if scaleSet == nil || now.Sub(since) < m.stuckInstanceTimeout {
+			continue
+		}
+		if _, found := expired[scaleSet]; !found {
+			scaleSets = append(scaleSets, scaleSet)
+		}
+		expired[scaleSet] = append(expired[scaleSet], &AzureRef{Name: name})
+	}
+	sort.Slice(scaleSets, func(i, j int) bool { return scaleSets[i].Id() < scaleSets[j].Id() })
+	return scaleSets, expired
+}
+
+// forceDeleteStuckInstances deletes the instances of the scale sets which
+// stayed in the Failed or Updating provisioning state for longer than
+// stuckInstanceTimeout according to the refreshes, along with the OS disks and
+// network interfaces they leave behind. It does nothing unless
+// stuckInstanceTimeout is set.
+// Such instances never become ready nodes, or stop being ones, and keep
+// counting in the size of their node group until they are deleted.
+func (m *AzureManager) forceDeleteStuckInstances(ctx context.Context) {
+	if m.stuckInstanceTimeout <= 0 {
+		return
+	}
+	scaleSets, expired := m.expiredStuckInstances(time.Now())
+	for _, scaleSet := range scaleSets {
+		m.forceDeleteScaleSetInstances(ctx, scaleSet, expired[scaleSet])
+	}
+}
+
+// forceDeleteScaleSetInstances deletes the given stuck instances of the scale
+// set which are still stuck, then their leftover resources.
+func (m *AzureManager) forceDeleteScaleSetInstances(ctx context.Context, scaleSet *ScaleSet, instances []*AzureRef) {
+	// The VMs are listed again for their disks and network interfaces, which
+	// aren't cached, and to skip the ones which recovered meanwhile.
+	vms, err := m.listVMs(scaleSet, scaleSet.Name, m.isFlexible(scaleSet))
+	if err != nil {
+		m.log().Errorf("Failed to list the VMs of scale set %s to delete its stuck instances: %v", scaleSet.Name, err)
+		return
+	}
+	expired := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		expired[instance.Name] = true
+	}
+	stuck := make([]*AzureRef, 0, len(instances))
+	leftovers := make(map[string]leftoverResources, len(instances))
+	for _, vm := range vms {
+		name := normalizeAzureRef(AzureRef{Name: *vm.ID}).Name
+		if !expired[name] || !stuckInstanceStates[vmProvisioningState(vm)] {
+			continue
+		}
+		stuck = append(stuck, &AzureRef{Name: name})
+		leftovers[name] = vmLeftoverResources(vm)
+	}
+	if len(stuck) == 0 {
+		return
+	}
+
+	m.log().Warningf("Force-deleting %d instance(s) of scale set %s stuck in the Failed or Updating provisioning state for more than %v",
+		len(stuck), scaleSet.Name, m.stuckInstanceTimeout)
+	failed := make(map[string]error)
+	if err := m.DeleteInstances(ctx, stuck); err != nil {
+		deleteErr, ok := err.(*DeleteInstancesError)
+		if !ok {
+			m.log().Errorf("Failed to force-delete the stuck instances of scale set %s: %v", scaleSet.Name, err)
+			return
+		}
+		failed = deleteErr.Failed
+	}
+	for _, instance := range stuck {
+		if err, found := failed[instance.Name]; found {
+			m.log().Errorf("Failed to force-delete stuck instance %s: %v", instance.Name, err)
+			continue
+		}
+		m.deleteLeftoverResources(ctx, instance.Name, leftovers[instance.Name])
+	}
+}
+
+// deleteLeftoverResources deletes the resources left behind by the deleted
+// instance. Failures are only logged, the resources may already be gone.
+func (m *AzureManager) deleteLeftoverResources(ctx context.Context, instanceName string, resources leftoverResources) {
+	for _, id := range resources.interfaces {
+		resourceGroup, name, err := parseResourceID(id)
+		if err != nil {
+			m.log().Warningf("Failed to parse the ID of a network interface of instance %s: %v", instanceName, err)
+			continue
+		}
+		m.log().V(2).Infof("Deleting network interface %s of instance %s", name, instanceName)
+		m.deleteInterface(ctx, resourceGroup, name)
+	}
+	for _, id := range resources.disks {
+		resourceGroup, name, err := parseResourceID(id)
+		if err != nil {
+			m.log().Warningf("Failed to parse the ID of the OS disk of instance %s: %v", instanceName, err)
+			continue
+		}
+		m.log().V(2).Infof("Deleting OS disk %s of instance %s", name, instanceName)
+		m.deleteDisk(ctx, resourceGroup, name)
+	}
+}
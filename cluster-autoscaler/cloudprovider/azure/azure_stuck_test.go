@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestStuckVMListResult returns the VMs of the scale set with the given
+// provisioning states, the second one with an OS disk and network interfaces.
+func newTestStuckVMListResult(states ...string) compute.VirtualMachineScaleSetVMListResult {
+	result := newTestVMListResultWithStates("ss1", states...)
+	diskID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/ss1_osdisk_1"
+	nicID := "/subscriptions/sub/resourceGroups/rg-net/providers/Microsoft.Network/networkInterfaces/nic1"
+	scaleSetNicID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss1/virtualMachines/1/networkInterfaces/nic"
+	props := (*result.Value)[1].VirtualMachineScaleSetVMProperties
+	props.StorageProfile = &compute.StorageProfile{
+		OsDisk: &compute.OSDisk{ManagedDisk: &compute.ManagedDiskParameters{ID: &diskID}},
+	}
+	props.NetworkProfile = &compute.NetworkProfile{
+		NetworkInterfaces: &[]compute.NetworkInterfaceReference{{ID: &nicID}, {ID: &scaleSetNicID}},
+	}
+	return result
+}
+
+func TestForceDeleteStuckInstances(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	interfaceClient := &interfaceClientMock{}
+	diskClient := &diskClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	m.interfaceClient = interfaceClient
+	m.diskClient = diskClient
+	m.stuckInstanceTimeout = time.Minute
+	registerTestScaleSet(t, m, "1:5:ss1")
+
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 4), nil)
+	vms := newTestStuckVMListResult("Succeeded", "Failed", "Updating", "Failed")
+	vmClient.On("List", "rg", "ss1").Return(vms, nil).Once()
+	assert.NoError(t, m.Refresh())
+
+	// Nothing is deleted before the timeout.
+	m.forceDeleteStuckInstances(context.Background())
+	assert.Equal(t, 3, len(m.stuckInstances))
+	ssClient.AssertNotCalled(t, "DeleteInstances", mock.Anything, mock.Anything, mock.Anything)
+
+	// The updating instance recovered meanwhile, and the last one isn't stuck
+	// for long enough.
+	for name := range m.stuckInstances {
+		if name != normalizeAzureRef(AzureRef{Name: *(*vms.Value)[3].ID}).Name {
+			m.stuckInstances[name] = time.Now().Add(-2 * time.Minute)
+		}
+	}
+	vmClient.On("List", "rg", "ss1").Return(newTestStuckVMListResult("Succeeded", "Failed", "Succeeded", "Failed"), nil).Once()
+	ssClient.On("DeleteInstances", "rg", "ss1", mock.Anything).Return(nil)
+	ssClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	interfaceClient.On("Delete", "rg-net", "nic1").Return(nil)
+	diskClient.On("Delete", "rg", "ss1_osdisk_1").Return(nil)
+	m.forceDeleteStuckInstances(context.Background())
+	ssClient.AssertCalled(t, "DeleteInstances", "rg", "ss1", compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &[]string{"1"}})
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+	interfaceClient.AssertNumberOfCalls(t, "Delete", 1)
+	diskClient.AssertNumberOfCalls(t, "Delete", 1)
+
+	// The stuck times of the instances which aren't stuck anymore are forgotten.
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Succeeded", "Succeeded", "Succeeded", "Failed"), nil).Once()
+	assert.NoError(t, m.Refresh())
+	m.forceDeleteStuckInstances(context.Background())
+	assert.Equal(t, 1, len(m.stuckInstances))
+	ssClient.AssertNumberOfCalls(t, "DeleteInstances", 1)
+}
+
+func TestForceDeleteStuckInstancesDisabled(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	registerTestScaleSet(t, m, "1:5:ss1")
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResultWithStates("ss1", "Failed"), nil)
+	assert.NoError(t, m.Refresh())
+
+	m.forceDeleteStuckInstances(context.Background())
+	assert.Empty(t, m.stuckInstances)
+	vmClient.AssertNumberOfCalls(t, "List", 1)
+}
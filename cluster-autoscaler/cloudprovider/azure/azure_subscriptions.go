@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+)
+
+// subscriptionClients are the clients of the scale sets of a subscription.
+type subscriptionClients struct {
+	scaleSetClient   scaleSetClient
+	scaleSetVmClient scaleSetVMClient
+	// protectionClient and flexibleClient may be nil, see AzureManager.
+	protectionClient vmProtectionClient
+	flexibleClient   flexibleScaleSetClient
+}
+
+// isOtherSubscription returns true if the subscription isn't the one of the
+// manager. An empty subscription is the one of the manager.
+func (m *AzureManager) isOtherSubscription(subscriptionID string) bool {
+	return subscriptionID != "" && !strings.EqualFold(subscriptionID, m.subscription)
+}
+
+// subscriptionOf returns the subscription of the scale set.
+func (m *AzureManager) subscriptionOf(scaleSet *ScaleSet) string {
+	if scaleSet.SubscriptionID != "" {
+		return scaleSet.SubscriptionID
+	}
+	return m.subscription
+}
+
+// inSubscription returns true if the scale set is in the subscription of an
+// instance ID, or if either of them is unknown.
+func (m *AzureManager) inSubscription(scaleSet *ScaleSet, subscriptionID string) bool {
+	own := m.subscriptionOf(scaleSet)
+	return subscriptionID == "" || own == "" || strings.EqualFold(own, subscriptionID)
+}
+
+// clientsOf returns the clients of the subscription of the scale set.
+func (m *AzureManager) clientsOf(scaleSet *ScaleSet) (*subscriptionClients, error) {
+	return m.subscriptionClientsOf(scaleSet.SubscriptionID)
+}
+
+// subscriptionClientsOf returns the clients of the subscription, created the
+// first time they're needed for another subscription than the one of the
+// manager.
+func (m *AzureManager) subscriptionClientsOf(subscriptionID string) (*subscriptionClients, error) {
+	if !m.isOtherSubscription(subscriptionID) {
+		return &subscriptionClients{
+			scaleSetClient:   m.scaleSetClient,
+			scaleSetVmClient: m.scaleSetVmClient,
+			protectionClient: m.protectionClient,
+			flexibleClient:   m.flexibleClient,
+		}, nil
+	}
+	if m.newSubscriptionClients == nil {
+		return nil, fmt.Errorf("scale sets of other subscriptions than %s are not supported", m.subscription)
+	}
+
+	m.subscriptionsMutex.Lock()
+	defer m.subscriptionsMutex.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if clients, found := m.otherSubscriptionClients[key]; found {
+		return clients, nil
+	}
+	if m.otherSubscriptionClients == nil {
+		m.otherSubscriptionClients = make(map[string]*subscriptionClients)
+	}
+	clients := m.newSubscriptionClients(subscriptionID)
+	m.otherSubscriptionClients[key] = clients
+	m.log().V(2).Infof("Created the clients of subscription %s", subscriptionID)
+	return clients, nil
+}
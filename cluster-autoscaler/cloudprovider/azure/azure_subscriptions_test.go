@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+// withOtherSubscription sets the subscription of the manager to sub and makes
+// it create the clients of the other subscriptions from the given mocks. It
+// returns the subscriptions the clients were created for.
+func withOtherSubscription(m *AzureManager, ssClient *scaleSetClientMock, vmClient *scaleSetVMClientMock) *[]string {
+	m.subscription = "sub"
+	created := make([]string, 0)
+	m.newSubscriptionClients = func(subscriptionID string) *subscriptionClients {
+		created = append(created, subscriptionID)
+		return &subscriptionClients{scaleSetClient: ssClient, scaleSetVmClient: vmClient}
+	}
+	return &created
+}
+
+func TestParseNodeGroupSpecSubscription(t *testing.T) {
+	spec, err := parseNodeGroupSpec("1:5:sub2/rg2/ss1")
+	assert.NoError(t, err)
+	assert.Equal(t, nodeGroupSpec{minSize: 1, maxSize: 5, subscriptionID: "sub2", resourceGroup: "rg2", name: "ss1"}, *spec)
+
+	for _, invalid := range []string{"1:5:sub2//ss1", "1:5:/rg2/ss1", "1:5:a/b/c/d"} {
+		_, err := parseNodeGroupSpec(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	scaleSet, err := buildScaleSet("1:5:sub2/rg2/ss1", m)
+	assert.NoError(t, err)
+	assert.Equal(t, "sub2/rg2/ss1", scaleSet.Id())
+	_, err = buildAvailabilitySet("1:5:sub2/rg2/as1", m)
+	assert.Error(t, err)
+}
+
+func TestScaleSetSubscription(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	otherSSClient := &scaleSetClientMock{}
+	otherVMClient := &scaleSetVMClientMock{}
+	created := withOtherSubscription(m, otherSSClient, otherVMClient)
+	m.sizeCacheTTL = 0
+
+	otherVMs := newTestVMListResult("ss1", 1)
+	otherID := strings.Replace(*(*otherVMs.Value)[0].ID, "/subscriptions/sub/", "/subscriptions/sub2/", 1)
+	(*otherVMs.Value)[0].ID = &otherID
+	ssClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 2), nil)
+	vmClient.On("List", "rg", "ss1").Return(newTestVMListResult("ss1", 2), nil)
+	otherSSClient.On("Get", "rg", "ss1").Return(newTestScaleSet("ss1", 1), nil)
+	otherSSClient.On("CreateOrUpdate", "rg", "ss1", mock.Anything).Return(nil)
+	otherVMClient.On("List", "rg", "ss1").Return(otherVMs, nil)
+
+	ss1 := registerTestScaleSet(t, m, "1:5:ss1")
+	ss2 := registerTestScaleSet(t, m, "1:5:SUB2/rg/ss1")
+	assert.NoError(t, m.Refresh())
+	assert.Equal(t, 3, len(m.scaleSetCache))
+	assert.NotEqual(t, m.scaleSetKey(ss1), m.scaleSetKey(ss2))
+
+	// The scale sets with the same name and resource group in both
+	// subscriptions are reached through the clients of their subscription,
+	// created once.
+	size, err := m.GetScaleSetSize(context.Background(), ss1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	size, err = m.GetScaleSetSize(context.Background(), ss2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+	assert.NoError(t, m.SetScaleSetSize(context.Background(), ss2, 3))
+	m.resizes.Wait()
+	otherSSClient.AssertCalled(t, "CreateOrUpdate", "rg", "ss1", mock.Anything)
+	ssClient.AssertNotCalled(t, "CreateOrUpdate", "rg", "ss1", mock.Anything)
+	assert.Equal(t, []string{"SUB2"}, *created)
+
+	// The instances are matched by their subscription.
+	scaleSet, err := m.GetScaleSetForInstance(&AzureRef{Name: "azure://" + strings.ToLower(otherID)})
+	assert.NoError(t, err)
+	assert.Equal(t, ss2, scaleSet)
+	scaleSet, err = m.GetScaleSetForInstance(&AzureRef{Name: "azure://" + *(*newTestVMListResult("ss1", 1).Value)[0].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, ss1, scaleSet)
+
+	// Without clients for other subscriptions their scale sets fail.
+	m.newSubscriptionClients = nil
+	m.otherSubscriptionClients = nil
+	_, err = m.GetScaleSetSize(context.Background(), ss2)
+	assert.EqualError(t, err, "scale sets of other subscriptions than sub are not supported")
+}
+
+func TestAutoDiscoverScaleSetsInSubscriptions(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	vmClient := &scaleSetVMClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, vmClient)
+	otherSSClient := &scaleSetClientMock{}
+	otherVMClient := &scaleSetVMClientMock{}
+	withOtherSubscription(m, otherSSClient, otherVMClient)
+	m.discoveryResourceGroups = parseDiscoveryResourceGroups("sub2/rg", "rg")
+	tags := map[string]string{"cluster-autoscaler-enabled": "true"}
+	for _, client := range []*scaleSetClientMock{ssClient, otherSSClient} {
+		client.On("Get", "rg", "pool").Return(newTestScaleSet("pool", 1), nil)
+		client.On("List", "rg").Return(compute.VirtualMachineScaleSetListResult{
+			Value: &[]compute.VirtualMachineScaleSet{newTestTaggedScaleSet("pool", tags)},
+		}, nil)
+	}
+	for _, client := range []*scaleSetVMClientMock{vmClient, otherVMClient} {
+		client.On("List", "rg", "pool").Return(compute.VirtualMachineScaleSetVMListResult{}, nil)
+	}
+
+	provider, err := BuildAzureCloudProviderWithDiscovery(m, cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:cluster-autoscaler-enabled=true,min=1,max=10"},
+	}, nil)
+	assert.NoError(t, err)
+	ids := make([]string, 0)
+	for _, nodeGroup := range provider.NodeGroups() {
+		ids = append(ids, nodeGroup.Id())
+	}
+	assert.Equal(t, []string{"pool", "sub2/rg/pool"}, ids)
+	otherSSClient.AssertCalled(t, "Get", "rg", "pool")
+}
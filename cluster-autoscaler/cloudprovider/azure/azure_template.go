@@ -0,0 +1,341 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// scaleSetPriorityLabel is set to scaleSetPrioritySpot on the template nodes
+// of spot scale sets, so that only the pods tolerating evictions select them.
+const (
+	scaleSetPriorityLabel = "kubernetes.azure.com/scalesetpriority"
+	scaleSetPrioritySpot  = "spot"
+)
+
+// scaleSetTemplate describes the VMs of a scale set, used to build template nodes.
+type scaleSetTemplate struct {
+	VMSize *vmSize
+	// GPU is the number of GPUs of the VMs, the one of the VM size unless
+	// set by the gpuCountTag of the scale set.
+	GPU      int64
+	Location string
+	// Zone of the scale set, empty if it's not zonal or spans several zones.
+	Zone string
+	// Spot is true if the VMs of the scale set may be evicted.
+	Spot bool
+	Tags map[string]*string
+}
+
+// getScaleSetTemplate returns the template of the VMs of the scale set from its model.
+func (m *AzureManager) getScaleSetTemplate(asConfig *ScaleSet) (*scaleSetTemplate, error) {
+	clients, err := m.clientsOf(asConfig)
+	if err != nil {
+		return nil, err
+	}
+	set, err := clients.scaleSetClient.Get(m.resourceGroup(asConfig), asConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+	location := ""
+	if set.Location != nil {
+		location = *set.Location
+	}
+	// A known VM size set on the scale set takes precedence over its model.
+	size, found := m.lookupVMSize(asConfig.VMSize, location)
+	if !found {
+		if set.Sku == nil || set.Sku.Name == nil {
+			return nil, fmt.Errorf("VM size of scale set %s is unknown", asConfig.Name)
+		}
+		size, found = m.lookupVMSize(*set.Sku.Name, location)
+		if !found {
+			return nil, fmt.Errorf("VM size %s of scale set %s is not supported", *set.Sku.Name, asConfig.Name)
+		}
+	}
+	template := &scaleSetTemplate{
+		VMSize:   size,
+		GPU:      size.GPU,
+		Location: location,
+		Spot:     asConfig.Spot,
+	}
+	// The template node can only be in the zone of single zone scale sets.
+	if set.Zones != nil && len(*set.Zones) == 1 {
+		template.Zone = (*set.Zones)[0]
+	}
+	if set.Tags != nil {
+		template.Tags = *set.Tags
+		if count, found := gpuCountFromTags(m.log(), asConfig.Name, template.Tags); found {
+			template.GPU = count
+		}
+	}
+	return template, nil
+}
+
+// lookupVMSize returns the resources of the named VM size. The sizes missing
+// from VMSizes, e.g. new ones, are listed from Azure in the given location,
+// with their GPUs read from the SKUs of the subscription.
+func (m *AzureManager) lookupVMSize(name string, location string) (*vmSize, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if size, found := getVMSize(name); found {
+		return size, true
+	}
+	if m.vmSizeClient == nil || location == "" {
+		return nil, false
+	}
+
+	m.vmSizesMutex.Lock()
+	defer m.vmSizesMutex.Unlock()
+	sizes, found := m.locationVMSizes[strings.ToLower(location)]
+	if !found {
+		result, err := m.vmSizeClient.List(location)
+		if err != nil {
+			m.log().Warningf("Failed to list the VM sizes of location %s: %v", location, err)
+			return nil, false
+		}
+		gpus := m.listSKUGPUs()
+		sizes = make(map[string]*vmSize)
+		if result.Value != nil {
+			for _, size := range *result.Value {
+				if size.Name == nil || size.NumberOfCores == nil || size.MemoryInMB == nil {
+					continue
+				}
+				sizes[strings.ToLower(*size.Name)] = &vmSize{
+					Name:     *size.Name,
+					VCPU:     int64(*size.NumberOfCores),
+					MemoryMb: int64(*size.MemoryInMB),
+					GPU:      gpus[strings.ToLower(*size.Name)],
+				}
+			}
+		}
+		if m.locationVMSizes == nil {
+			m.locationVMSizes = make(map[string]map[string]*vmSize)
+		}
+		m.locationVMSizes[strings.ToLower(location)] = sizes
+	}
+	size, found := sizes[strings.ToLower(name)]
+	return size, found
+}
+
+// skuGPUsCapability is the capability of the VM SKUs giving their number of GPUs.
+const skuGPUsCapability = "GPUs"
+
+// listSKUGPUs returns the GPUs of the VM sizes having some, by lowercase name.
+// The SKUs are listed once, the VM sizes listed before they could be are
+// assumed to have no GPU. The caller must hold vmSizesMutex.
+func (m *AzureManager) listSKUGPUs() map[string]int64 {
+	if m.skuGPUs != nil || m.resourceSkuClient == nil {
+		return m.skuGPUs
+	}
+	result, err := m.resourceSkuClient.List()
+	gpus := make(map[string]int64)
+	for err == nil {
+		if result.Value != nil {
+			for _, sku := range *result.Value {
+				if sku.Name == nil || sku.ResourceType == nil || !strings.EqualFold(*sku.ResourceType, "virtualMachines") || sku.Capabilities == nil {
+					continue
+				}
+				for _, capability := range *sku.Capabilities {
+					if capability.Name == nil || capability.Value == nil || *capability.Name != skuGPUsCapability {
+						continue
+					}
+					if count, err := strconv.ParseInt(*capability.Value, 10, 64); err == nil && count > 0 {
+						gpus[strings.ToLower(*sku.Name)] = count
+					}
+				}
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			m.skuGPUs = gpus
+			return gpus
+		}
+		result, err = m.resourceSkuClient.ListNextResults(result)
+	}
+	m.log().Warningf("Failed to list the VM SKUs, assuming the listed VM sizes have no GPU: %v", err)
+	return nil
+}
+
+func (m *AzureManager) buildNodeFromTemplate(nodeGroupName string, template *scaleSetTemplate) (*apiv1.Node, error) {
+	node := apiv1.Node{}
+	nodeName := fmt.Sprintf("%s-%d", nodeGroupName, rand.Int63())
+
+	node.ObjectMeta = metav1.ObjectMeta{
+		Name:     nodeName,
+		SelfLink: fmt.Sprintf("/api/v1/nodes/%s", nodeName),
+		Labels:   map[string]string{},
+	}
+
+	node.Status = apiv1.NodeStatus{
+		Capacity: apiv1.ResourceList{},
+	}
+
+	// TODO: get a real value.
+	node.Status.Capacity[apiv1.ResourcePods] = *resource.NewQuantity(110, resource.DecimalSI)
+	node.Status.Capacity[apiv1.ResourceCPU] = *resource.NewQuantity(template.VMSize.VCPU, resource.DecimalSI)
+	node.Status.Capacity[apiv1.ResourceNvidiaGPU] = *resource.NewQuantity(template.GPU, resource.DecimalSI)
+	node.Status.Capacity[apiv1.ResourceMemory] = *resource.NewQuantity(template.VMSize.MemoryMb*1024*1024, resource.DecimalSI)
+	// The GPUs are advertised by the NVIDIA device plugin.
+	if template.GPU > 0 {
+		node.Status.Capacity[gpu.ResourceNvidiaGPU] = *resource.NewQuantity(template.GPU, resource.DecimalSI)
+	}
+
+	// TODO: use proper allocatable!!
+	node.Status.Allocatable = node.Status.Capacity
+
+	// The GPU label first, so that the tags can set another value.
+	if template.GPU > 0 {
+		node.Labels[azureGPULabel] = azureGPULabelValue
+	}
+	// NodeLabels
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, extractLabelsFromTags(template.Tags))
+	// GenericLabels
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, buildGenericLabels(template, nodeName))
+
+	node.Spec.Taints = extractTaintsFromTags(m.log(), template.Tags)
+
+	node.Status.Conditions = cloudprovider.BuildReadyConditions()
+	return &node, nil
+}
+
+func buildGenericLabels(template *scaleSetTemplate, nodeName string) map[string]string {
+	result := make(map[string]string)
+	result[kubeletapis.LabelArch] = cloudprovider.DefaultArch
+	result[kubeletapis.LabelOS] = cloudprovider.DefaultOS
+
+	result[kubeletapis.LabelInstanceType] = template.VMSize.Name
+
+	result[kubeletapis.LabelZoneRegion] = template.Location
+	if template.Zone != "" {
+		result[kubeletapis.LabelZoneFailureDomain] = template.Location + "-" + template.Zone
+	}
+	if template.Spot {
+		result[scaleSetPriorityLabel] = scaleSetPrioritySpot
+	}
+	result[kubeletapis.LabelHostname] = nodeName
+	return result
+}
+
+// Prefixes of the scale set tags setting labels and taints of the template
+// nodes. Azure doesn't allow "/" in tag names, so the tags can also use "_"
+// as separator, see templateTagKey.
+const (
+	nodeTemplateLabelTagPrefix = "k8s.io/cluster-autoscaler/node-template/label/"
+	nodeTemplateTaintTagPrefix = "k8s.io/cluster-autoscaler/node-template/taint/"
+)
+
+// gpuCountTag is the tag of the scale sets setting the number of GPUs of the
+// template nodes, e.g. for VM sizes whose GPUs are unknown. The "_" separator
+// can be used like in the label and taint tags.
+const gpuCountTag = "k8s.io/cluster-autoscaler/node-template/resources/nvidia.com/gpu"
+
+// azureGPULabel is the label acs-engine adds to the GPU nodes, with the
+// azureGPULabelValue, so that the pods can select them.
+const (
+	azureGPULabel      = "accelerator"
+	azureGPULabelValue = "nvidia"
+)
+
+// gpuCountFromTags returns the number of GPUs set by the gpuCountTag of the
+// scale set, if any. An invalid count is logged and ignored.
+func gpuCountFromTags(logger Logger, name string, tags map[string]*string) (int64, bool) {
+	underscoreTag := strings.Replace(gpuCountTag, "/", "_", -1)
+	for k, v := range tags {
+		if v == nil || !strings.EqualFold(k, gpuCountTag) && !strings.EqualFold(k, underscoreTag) {
+			continue
+		}
+		count, err := strconv.ParseInt(*v, 10, 64)
+		if err != nil || count < 0 {
+			logger.Warningf("Ignoring the GPU count tag of scale set %s, expected a non-negative integer, got %q", name, *v)
+			return 0, false
+		}
+		return count, true
+	}
+	return 0, false
+}
+
+// templateTagKey returns the label or taint key set by the tag if its name
+// has the given prefix, with either "/" or "_" as separator. Tag names are
+// case-insensitive in Azure. In the "_" form, the "_" of the key stand for
+// "/", e.g. k8s.io_cluster-autoscaler_node-template_label_example.com_pool
+// sets the example.com/pool label, so a "_" of the key itself is written as
+// "~2", e.g. k8s.io_cluster-autoscaler_node-template_label_node~2role sets
+// the node_role label.
+func templateTagKey(tagName string, prefix string) (string, bool) {
+	if len(tagName) > len(prefix) && strings.EqualFold(tagName[:len(prefix)], prefix) {
+		return tagName[len(prefix):], true
+	}
+	underscorePrefix := strings.Replace(prefix, "/", "_", -1)
+	if len(tagName) > len(underscorePrefix) && strings.EqualFold(tagName[:len(underscorePrefix)], underscorePrefix) {
+		key := strings.Replace(tagName[len(underscorePrefix):], "_", "/", -1)
+		return strings.Replace(key, "~2", "_", -1), true
+	}
+	return "", false
+}
+
+// extractLabelsFromTags returns the node labels set as tags of the scale set
+// with the k8s.io/cluster-autoscaler/node-template/label/ prefix.
+func extractLabelsFromTags(tags map[string]*string) map[string]string {
+	result := make(map[string]string)
+
+	for k, v := range tags {
+		if label, found := templateTagKey(k, nodeTemplateLabelTagPrefix); found && v != nil {
+			result[label] = *v
+		}
+	}
+	return result
+}
+
+// extractTaintsFromTags returns the node taints set as tags of the scale set
+// with the k8s.io/cluster-autoscaler/node-template/taint/ prefix and a
+// value:effect value.
+func extractTaintsFromTags(logger Logger, tags map[string]*string) []apiv1.Taint {
+	taints := make([]apiv1.Taint, 0)
+
+	for k, v := range tags {
+		key, found := templateTagKey(k, nodeTemplateTaintTagPrefix)
+		if !found || v == nil {
+			continue
+		}
+		values := strings.SplitN(*v, ":", 2)
+		if len(values) != 2 {
+			logger.Warningf("Ignoring taint %s with invalid value %q, expected value:effect", key, *v)
+			continue
+		}
+		effect := apiv1.TaintEffect(values[1])
+		if effect != apiv1.TaintEffectNoSchedule && effect != apiv1.TaintEffectPreferNoSchedule && effect != apiv1.TaintEffectNoExecute {
+			logger.Warningf("Ignoring taint %s with invalid effect %q", key, values[1])
+			continue
+		}
+		taints = append(taints, apiv1.Taint{
+			Key:    key,
+			Value:  values[0],
+			Effect: effect,
+		})
+	}
+	return taints
+}
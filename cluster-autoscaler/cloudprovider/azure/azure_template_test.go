@@ -0,0 +1,305 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+func TestGetVMSize(t *testing.T) {
+	size, found := getVMSize("Standard_D2_v2")
+	assert.True(t, found)
+	assert.Equal(t, int64(2), size.VCPU)
+	assert.Equal(t, int64(7168), size.MemoryMb)
+	assert.Equal(t, int64(0), size.GPU)
+
+	size, found = getVMSize("standard_nc6")
+	assert.True(t, found)
+	assert.Equal(t, "Standard_NC6", size.Name)
+	assert.Equal(t, int64(6), size.VCPU)
+	assert.Equal(t, int64(1), size.GPU)
+
+	_, found = getVMSize("Standard_Unknown")
+	assert.False(t, found)
+}
+
+func TestBuildGenericLabels(t *testing.T) {
+	labels := buildGenericLabels(&scaleSetTemplate{
+		VMSize: &vmSize{
+			Name:     "Standard_D2_v2",
+			VCPU:     2,
+			MemoryMb: 7168,
+		},
+		Location: "westeurope",
+	}, "sillyname")
+	assert.Equal(t, "westeurope", labels[kubeletapis.LabelZoneRegion])
+	assert.Equal(t, "sillyname", labels[kubeletapis.LabelHostname])
+	assert.Equal(t, "Standard_D2_v2", labels[kubeletapis.LabelInstanceType])
+	assert.Equal(t, cloudprovider.DefaultArch, labels[kubeletapis.LabelArch])
+	assert.Equal(t, cloudprovider.DefaultOS, labels[kubeletapis.LabelOS])
+}
+
+func newTestTags(tags map[string]string) map[string]*string {
+	result := make(map[string]*string)
+	for k, v := range tags {
+		v := v
+		result[k] = &v
+	}
+	return result
+}
+
+func TestExtractLabelsFromTags(t *testing.T) {
+	labels := extractLabelsFromTags(newTestTags(map[string]string{
+		"k8s.io/cluster-autoscaler/node-template/label/foo":                "bar",
+		"K8s.io_Cluster-Autoscaler_Node-Template_Label_example.com_pool":   "gpu",
+		"k8s.io_cluster-autoscaler_node-template_label_node~2role":         "worker",
+		"k8s.io_cluster-autoscaler_node-template_label_":                   "empty",
+		"prefix-k8s.io/cluster-autoscaler/node-template/label/not-a-label": "baz",
+		"bar": "baz",
+	}))
+	assert.Equal(t, map[string]string{
+		"foo":              "bar",
+		"example.com/pool": "gpu",
+		"node_role":        "worker",
+	}, labels)
+}
+
+func TestExtractTaintsFromTags(t *testing.T) {
+	taints := extractTaintsFromTags(defaultLogger, newTestTags(map[string]string{
+		"k8s.io/cluster-autoscaler/node-template/taint/dedicated":       "foo:NoSchedule",
+		"k8s.io/cluster-autoscaler/node-template/taint/invalid":         "foo",
+		"k8s.io/cluster-autoscaler/node-template/taint/effect":          "foo:NoRun",
+		"k8s.io_cluster-autoscaler_node-template_taint_example.com_gpu": "true:NoExecute",
+		"bar": "baz",
+	}))
+	sort.Slice(taints, func(i, j int) bool { return taints[i].Key < taints[j].Key })
+	assert.Equal(t, []apiv1.Taint{
+		{
+			Key:    "dedicated",
+			Value:  "foo",
+			Effect: apiv1.TaintEffectNoSchedule,
+		},
+		{
+			Key:    "example.com/gpu",
+			Value:  "true",
+			Effect: apiv1.TaintEffectNoExecute,
+		},
+	}, taints)
+}
+
+func TestTemplateNodeInfo(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "0:5:ss1")
+
+	set := newTestScaleSet("ss1", 0)
+	skuName := "Standard_D2_v2"
+	location := "westeurope"
+	tags := newTestTags(map[string]string{
+		"k8s.io/cluster-autoscaler/node-template/label/pool": "gpu",
+	})
+	set.Sku.Name = &skuName
+	set.Location = &location
+	set.Tags = &tags
+	set.Zones = &[]string{"2"}
+	ssClient.On("Get", "rg", "ss1").Return(set, nil)
+
+	nodeInfo, err := scaleSet.TemplateNodeInfo()
+	assert.NoError(t, err)
+	node := nodeInfo.Node()
+	cpu := node.Status.Capacity[apiv1.ResourceCPU]
+	memory := node.Status.Capacity[apiv1.ResourceMemory]
+	assert.Equal(t, int64(2), cpu.Value())
+	assert.Equal(t, int64(7168*1024*1024), memory.Value())
+	assert.Equal(t, "gpu", node.Labels["pool"])
+	assert.Equal(t, "westeurope", node.Labels[kubeletapis.LabelZoneRegion])
+	assert.Equal(t, "westeurope-2", node.Labels[kubeletapis.LabelZoneFailureDomain])
+	assert.Equal(t, "Standard_D2_v2", node.Labels[kubeletapis.LabelInstanceType])
+
+	// Scale sets spanning several zones have no zone label.
+	set.Zones = &[]string{"1", "2"}
+	ssClient.ExpectedCalls = nil
+	ssClient.On("Get", "rg", "ss1").Return(set, nil)
+	nodeInfo, err = scaleSet.TemplateNodeInfo()
+	assert.NoError(t, err)
+	_, found := nodeInfo.Node().Labels[kubeletapis.LabelZoneFailureDomain]
+	assert.False(t, found)
+}
+
+func newTestResourceSku(resourceType string, name string, gpus string) compute.ResourceSku {
+	capability := skuGPUsCapability
+	return compute.ResourceSku{
+		ResourceType: &resourceType,
+		Name:         &name,
+		Capabilities: &[]compute.ResourceSkuCapabilities{{Name: &capability, Value: &gpus}},
+	}
+}
+
+func TestTemplateNodeInfoListedVMSize(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	sizeClient := &vmSizeClientMock{}
+	skuClient := &resourceSkuClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.vmSizeClient = sizeClient
+	m.resourceSkuClient = skuClient
+	scaleSet := registerTestScaleSet(t, m, "0:5:ss1")
+
+	set := newTestScaleSet("ss1", 0)
+	skuName := "Standard_New_v9"
+	location := "westeurope"
+	set.Sku.Name = &skuName
+	set.Location = &location
+	ssClient.On("Get", "rg", "ss1").Return(set, nil)
+	name, cores, memory := "standard_new_v9", int32(4), int32(16384)
+	sizeClient.On("List", "westeurope").Return(compute.VirtualMachineSizeListResult{
+		Value: &[]compute.VirtualMachineSize{{Name: &name, NumberOfCores: &cores, MemoryInMB: &memory}},
+	}, nil).Once()
+	nextLink := "next"
+	skuClient.On("List").Return(compute.ResourceSkusResult{
+		Value:    &[]compute.ResourceSku{newTestResourceSku("disks", "Standard_New_v9", "8")},
+		NextLink: &nextLink,
+	}, nil).Once()
+	skuClient.On("ListNextResults", "next").Return(compute.ResourceSkusResult{
+		Value: &[]compute.ResourceSku{newTestResourceSku("virtualMachines", "Standard_New_v9", "2")},
+	}, nil).Once()
+
+	// The VM size missing from VMSizes is listed once per location, and its
+	// GPUs from the VM SKUs.
+	for i := 0; i < 2; i++ {
+		nodeInfo, err := scaleSet.TemplateNodeInfo()
+		assert.NoError(t, err)
+		cpu := nodeInfo.Node().Status.Capacity[apiv1.ResourceCPU]
+		mem := nodeInfo.Node().Status.Capacity[apiv1.ResourceMemory]
+		gpu := nodeInfo.Node().Status.Capacity[apiv1.ResourceNvidiaGPU]
+		assert.Equal(t, int64(4), cpu.Value())
+		assert.Equal(t, int64(16384*1024*1024), mem.Value())
+		assert.Equal(t, int64(2), gpu.Value())
+	}
+	sizeClient.AssertNumberOfCalls(t, "List", 1)
+	skuClient.AssertNumberOfCalls(t, "List", 1)
+}
+
+func TestListSKUGPUsFailure(t *testing.T) {
+	skuClient := &resourceSkuClientMock{}
+	m := newTestAzureManagerWithMocks(&scaleSetClientMock{}, &scaleSetVMClientMock{})
+	m.resourceSkuClient = skuClient
+
+	// The SKUs are listed again until they could be.
+	skuClient.On("List").Return(compute.ResourceSkusResult{}, fmt.Errorf("list failed")).Once()
+	assert.Nil(t, m.listSKUGPUs())
+	skuClient.On("List").Return(compute.ResourceSkusResult{
+		Value: &[]compute.ResourceSku{
+			newTestResourceSku("virtualMachines", "Standard_NC6", "1"),
+			newTestResourceSku("virtualMachines", "Standard_D2_v3", "0"),
+		},
+	}, nil).Once()
+	assert.Equal(t, map[string]int64{"standard_nc6": 1}, m.listSKUGPUs())
+	assert.Equal(t, map[string]int64{"standard_nc6": 1}, m.listSKUGPUs())
+	skuClient.AssertNumberOfCalls(t, "List", 2)
+}
+
+func TestTemplateNodeInfoUnknownVMSize(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSet := registerTestScaleSet(t, m, "0:5:ss1")
+
+	set := newTestScaleSet("ss1", 0)
+	skuName := "Standard_Unknown"
+	set.Sku.Name = &skuName
+	ssClient.On("Get", "rg", "ss1").Return(set, nil)
+
+	_, err := scaleSet.TemplateNodeInfo()
+	assert.EqualError(t, err, "VM size Standard_Unknown of scale set ss1 is not supported")
+}
+
+func TestTemplateNodeInfoVMSizeOverride(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	m.scaleSetVMSizes = map[string]string{"ss1": "standard_d4_v2", "ss2": "Standard_Unknown"}
+	overridden := registerTestScaleSet(t, m, "0:5:ss1")
+	unknown := registerTestScaleSet(t, m, "0:5:ss2")
+	assert.Equal(t, "standard_d4_v2", overridden.VMSize)
+
+	skuName := "Standard_D2_v2"
+	for _, name := range []string{"ss1", "ss2"} {
+		set := newTestScaleSet(name, 0)
+		set.Sku.Name = &skuName
+		ssClient.On("Get", "rg", name).Return(set, nil)
+	}
+
+	// The override takes precedence over the VM size of the model.
+	nodeInfo, err := overridden.TemplateNodeInfo()
+	assert.NoError(t, err)
+	cpu := nodeInfo.Node().Status.Capacity[apiv1.ResourceCPU]
+	assert.Equal(t, int64(8), cpu.Value())
+	assert.Equal(t, "Standard_D4_v2", nodeInfo.Node().Labels[kubeletapis.LabelInstanceType])
+
+	// An unknown override is ignored.
+	nodeInfo, err = unknown.TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "Standard_D2_v2", nodeInfo.Node().Labels[kubeletapis.LabelInstanceType])
+}
+
+func TestTemplateNodeInfoGPU(t *testing.T) {
+	ssClient := &scaleSetClientMock{}
+	m := newTestAzureManagerWithMocks(ssClient, &scaleSetVMClientMock{})
+	scaleSets := make(map[string]*ScaleSet)
+	for _, test := range []struct {
+		name string
+		size string
+		tags map[string]string
+	}{
+		{"nseries", "Standard_NC12s_v3", nil},
+		{"tagged", "Standard_D2_v2", map[string]string{"k8s.io_cluster-autoscaler_node-template_resources_nvidia.com_gpu": "2"}},
+		{"invalid", "Standard_NC6", map[string]string{gpuCountTag: "many"}},
+		{"cpu", "Standard_D2_v2", nil},
+	} {
+		scaleSets[test.name] = registerTestScaleSet(t, m, "0:5:"+test.name)
+		set := newTestScaleSet(test.name, 0)
+		size := test.size
+		set.Sku.Name = &size
+		tags := newTestTags(test.tags)
+		set.Tags = &tags
+		ssClient.On("Get", "rg", test.name).Return(set, nil)
+	}
+
+	for name, expected := range map[string]int64{"nseries": 2, "tagged": 2, "invalid": 1, "cpu": 0} {
+		nodeInfo, err := scaleSets[name].TemplateNodeInfo()
+		assert.NoError(t, err)
+		node := nodeInfo.Node()
+		gpus, found := node.Status.Capacity[gpu.ResourceNvidiaGPU]
+		assert.Equal(t, expected > 0, found, name)
+		assert.Equal(t, expected, gpus.Value(), name)
+		alphaGPUs := node.Status.Capacity[apiv1.ResourceNvidiaGPU]
+		assert.Equal(t, expected, alphaGPUs.Value(), name)
+		// The label lets the pods select the GPU nodes.
+		label, found := node.Labels[azureGPULabel]
+		assert.Equal(t, expected > 0, found, name)
+		if found {
+			assert.Equal(t, "nvidia", label, name)
+		}
+	}
+}
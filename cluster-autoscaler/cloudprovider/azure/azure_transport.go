@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// tlsVersions are the values of tlsMinVersion in the cloud-config.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPSender returns the HTTP client sending the requests of the Azure
+// clients and of the service principal tokens, with the proxy, CA bundle and
+// minimum TLS version of the config. The proxy defaults to the one of the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables. Each request is
+// canceled after the request timeout of the config.
+func newHTTPSender(cfg *Config) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.HTTPProxy != "" {
+		if err := validateEndpoint(cfg.HTTPProxy); err != nil {
+			return nil, fmt.Errorf("azure: invalid httpProxy: %v", err)
+		}
+		proxyURL, err := url.Parse(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("azure: invalid httpProxy: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSMinVersion != "" {
+		version, found := tlsVersions[cfg.TLSMinVersion]
+		if !found {
+			return nil, fmt.Errorf("azure: tlsMinVersion must be \"1.2\" or \"1.3\", got %q", cfg.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cfg.CACertFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("azure: failed to read CA bundle %s: %v", cfg.CACertFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("azure: no certificate found in CA bundle %s", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// The settings of http.DefaultTransport otherwise.
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	timeout := defaultRequestTimeout
+	if cfg.CloudProviderRequestTimeout > 0 {
+		timeout = time.Duration(cfg.CloudProviderRequestTimeout) * time.Second
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
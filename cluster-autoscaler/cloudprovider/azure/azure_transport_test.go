@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPSenderCACertFile(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// The handshake of the client not trusting the server is expected to fail.
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	f, err := ioutil.TempFile("", "ca-bundle")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	assert.NoError(t, f.Close())
+
+	sender, err := newHTTPSender(&Config{})
+	assert.NoError(t, err)
+	_, err = sender.Get(server.URL)
+	assert.Error(t, err)
+
+	sender, err = newHTTPSender(&Config{CACertFile: f.Name(), TLSMinVersion: "1.2"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), sender.Transport.(*http.Transport).TLSClientConfig.MinVersion)
+	resp, err := sender.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	_, err = newHTTPSender(&Config{CACertFile: "/nonexistent/ca-bundle"})
+	assert.Error(t, err)
+	_, err = newHTTPSender(&Config{CACertFile: os.DevNull})
+	assert.EqualError(t, err, "azure: no certificate found in CA bundle "+os.DevNull)
+}
+
+func TestNewHTTPSenderInvalidConfig(t *testing.T) {
+	_, err := newHTTPSender(&Config{TLSMinVersion: "1.1"})
+	assert.EqualError(t, err, `azure: tlsMinVersion must be "1.2" or "1.3", got "1.1"`)
+	_, err = newHTTPSender(&Config{HTTPProxy: "proxy:3128"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid httpProxy")
+}
+
+func TestNewHTTPSenderRequestTimeout(t *testing.T) {
+	sender, err := newHTTPSender(&Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, sender.Timeout)
+	sender, err = newHTTPSender(&Config{CloudProviderRequestTimeout: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, sender.Timeout)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxied := make([]string, 0)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+		switch r.URL.Host {
+		case "login.example":
+			fmt.Fprintf(w, `{"access_token": "proxied-token", "expires_in": "3600", "expires_on": "%d", "token_type": "Bearer"}`, time.Now().Add(time.Hour).Unix())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer proxy.Close()
+
+	cfg := &Config{AADTenantID: "tenant", AADClientID: "client", AADClientSecret: "secret", HTTPProxy: proxy.URL}
+	sender, err := newHTTPSender(cfg)
+	assert.NoError(t, err)
+	resp, err := sender.Get("http://management.example/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	// The token requests go through the proxy too.
+	env := azure.PublicCloud
+	env.ActiveDirectoryEndpoint = "http://login.example/"
+	p, err := newReloadableTokenProvider(cfg, env, sender, defaultLogger)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Refresh())
+	assert.Equal(t, "proxied-token", p.OAuthToken())
+	assert.Equal(t, []string{"management.example", "login.example"}, proxied)
+}
@@ -0,0 +1,626 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import "strings"
+
+type vmSize struct {
+	Name     string
+	VCPU     int64
+	MemoryMb int64
+	GPU      int64
+}
+
+// VMSizes is a map of the resources of Azure VM sizes
+var VMSizes = map[string]*vmSize{
+	"Standard_A0": {
+		Name:     "Standard_A0",
+		VCPU:     1,
+		MemoryMb: 768,
+		GPU:      0,
+	},
+	"Standard_A1": {
+		Name:     "Standard_A1",
+		VCPU:     1,
+		MemoryMb: 1792,
+		GPU:      0,
+	},
+	"Standard_A2": {
+		Name:     "Standard_A2",
+		VCPU:     2,
+		MemoryMb: 3584,
+		GPU:      0,
+	},
+	"Standard_A3": {
+		Name:     "Standard_A3",
+		VCPU:     4,
+		MemoryMb: 7168,
+		GPU:      0,
+	},
+	"Standard_A4": {
+		Name:     "Standard_A4",
+		VCPU:     8,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_A5": {
+		Name:     "Standard_A5",
+		VCPU:     2,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_A6": {
+		Name:     "Standard_A6",
+		VCPU:     4,
+		MemoryMb: 28672,
+		GPU:      0,
+	},
+	"Standard_A7": {
+		Name:     "Standard_A7",
+		VCPU:     8,
+		MemoryMb: 57344,
+		GPU:      0,
+	},
+	"Standard_A1_v2": {
+		Name:     "Standard_A1_v2",
+		VCPU:     1,
+		MemoryMb: 2048,
+		GPU:      0,
+	},
+	"Standard_A2_v2": {
+		Name:     "Standard_A2_v2",
+		VCPU:     2,
+		MemoryMb: 4096,
+		GPU:      0,
+	},
+	"Standard_A4_v2": {
+		Name:     "Standard_A4_v2",
+		VCPU:     4,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_A8_v2": {
+		Name:     "Standard_A8_v2",
+		VCPU:     8,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_A2m_v2": {
+		Name:     "Standard_A2m_v2",
+		VCPU:     2,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_A4m_v2": {
+		Name:     "Standard_A4m_v2",
+		VCPU:     4,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_A8m_v2": {
+		Name:     "Standard_A8m_v2",
+		VCPU:     8,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_B1s": {
+		Name:     "Standard_B1s",
+		VCPU:     1,
+		MemoryMb: 1024,
+		GPU:      0,
+	},
+	"Standard_B1ms": {
+		Name:     "Standard_B1ms",
+		VCPU:     1,
+		MemoryMb: 2048,
+		GPU:      0,
+	},
+	"Standard_B2s": {
+		Name:     "Standard_B2s",
+		VCPU:     2,
+		MemoryMb: 4096,
+		GPU:      0,
+	},
+	"Standard_B2ms": {
+		Name:     "Standard_B2ms",
+		VCPU:     2,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_B4ms": {
+		Name:     "Standard_B4ms",
+		VCPU:     4,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_B8ms": {
+		Name:     "Standard_B8ms",
+		VCPU:     8,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_D1_v2": {
+		Name:     "Standard_D1_v2",
+		VCPU:     1,
+		MemoryMb: 3584,
+		GPU:      0,
+	},
+	"Standard_D2_v2": {
+		Name:     "Standard_D2_v2",
+		VCPU:     2,
+		MemoryMb: 7168,
+		GPU:      0,
+	},
+	"Standard_D3_v2": {
+		Name:     "Standard_D3_v2",
+		VCPU:     4,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_D4_v2": {
+		Name:     "Standard_D4_v2",
+		VCPU:     8,
+		MemoryMb: 28672,
+		GPU:      0,
+	},
+	"Standard_D5_v2": {
+		Name:     "Standard_D5_v2",
+		VCPU:     16,
+		MemoryMb: 57344,
+		GPU:      0,
+	},
+	"Standard_D11_v2": {
+		Name:     "Standard_D11_v2",
+		VCPU:     2,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_D12_v2": {
+		Name:     "Standard_D12_v2",
+		VCPU:     4,
+		MemoryMb: 28672,
+		GPU:      0,
+	},
+	"Standard_D13_v2": {
+		Name:     "Standard_D13_v2",
+		VCPU:     8,
+		MemoryMb: 57344,
+		GPU:      0,
+	},
+	"Standard_D14_v2": {
+		Name:     "Standard_D14_v2",
+		VCPU:     16,
+		MemoryMb: 114688,
+		GPU:      0,
+	},
+	"Standard_D15_v2": {
+		Name:     "Standard_D15_v2",
+		VCPU:     20,
+		MemoryMb: 143360,
+		GPU:      0,
+	},
+	"Standard_DS1_v2": {
+		Name:     "Standard_DS1_v2",
+		VCPU:     1,
+		MemoryMb: 3584,
+		GPU:      0,
+	},
+	"Standard_DS2_v2": {
+		Name:     "Standard_DS2_v2",
+		VCPU:     2,
+		MemoryMb: 7168,
+		GPU:      0,
+	},
+	"Standard_DS3_v2": {
+		Name:     "Standard_DS3_v2",
+		VCPU:     4,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_DS4_v2": {
+		Name:     "Standard_DS4_v2",
+		VCPU:     8,
+		MemoryMb: 28672,
+		GPU:      0,
+	},
+	"Standard_DS5_v2": {
+		Name:     "Standard_DS5_v2",
+		VCPU:     16,
+		MemoryMb: 57344,
+		GPU:      0,
+	},
+	"Standard_DS11_v2": {
+		Name:     "Standard_DS11_v2",
+		VCPU:     2,
+		MemoryMb: 14336,
+		GPU:      0,
+	},
+	"Standard_DS12_v2": {
+		Name:     "Standard_DS12_v2",
+		VCPU:     4,
+		MemoryMb: 28672,
+		GPU:      0,
+	},
+	"Standard_DS13_v2": {
+		Name:     "Standard_DS13_v2",
+		VCPU:     8,
+		MemoryMb: 57344,
+		GPU:      0,
+	},
+	"Standard_DS14_v2": {
+		Name:     "Standard_DS14_v2",
+		VCPU:     16,
+		MemoryMb: 114688,
+		GPU:      0,
+	},
+	"Standard_DS15_v2": {
+		Name:     "Standard_DS15_v2",
+		VCPU:     20,
+		MemoryMb: 143360,
+		GPU:      0,
+	},
+	"Standard_D2_v3": {
+		Name:     "Standard_D2_v3",
+		VCPU:     2,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_D4_v3": {
+		Name:     "Standard_D4_v3",
+		VCPU:     4,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_D8_v3": {
+		Name:     "Standard_D8_v3",
+		VCPU:     8,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_D16_v3": {
+		Name:     "Standard_D16_v3",
+		VCPU:     16,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_D32_v3": {
+		Name:     "Standard_D32_v3",
+		VCPU:     32,
+		MemoryMb: 131072,
+		GPU:      0,
+	},
+	"Standard_D64_v3": {
+		Name:     "Standard_D64_v3",
+		VCPU:     64,
+		MemoryMb: 262144,
+		GPU:      0,
+	},
+	"Standard_D2s_v3": {
+		Name:     "Standard_D2s_v3",
+		VCPU:     2,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_D4s_v3": {
+		Name:     "Standard_D4s_v3",
+		VCPU:     4,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_D8s_v3": {
+		Name:     "Standard_D8s_v3",
+		VCPU:     8,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_D16s_v3": {
+		Name:     "Standard_D16s_v3",
+		VCPU:     16,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_D32s_v3": {
+		Name:     "Standard_D32s_v3",
+		VCPU:     32,
+		MemoryMb: 131072,
+		GPU:      0,
+	},
+	"Standard_D64s_v3": {
+		Name:     "Standard_D64s_v3",
+		VCPU:     64,
+		MemoryMb: 262144,
+		GPU:      0,
+	},
+	"Standard_E2_v3": {
+		Name:     "Standard_E2_v3",
+		VCPU:     2,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_E4_v3": {
+		Name:     "Standard_E4_v3",
+		VCPU:     4,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_E8_v3": {
+		Name:     "Standard_E8_v3",
+		VCPU:     8,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_E16_v3": {
+		Name:     "Standard_E16_v3",
+		VCPU:     16,
+		MemoryMb: 131072,
+		GPU:      0,
+	},
+	"Standard_E32_v3": {
+		Name:     "Standard_E32_v3",
+		VCPU:     32,
+		MemoryMb: 262144,
+		GPU:      0,
+	},
+	"Standard_E64_v3": {
+		Name:     "Standard_E64_v3",
+		VCPU:     64,
+		MemoryMb: 442368,
+		GPU:      0,
+	},
+	"Standard_E2s_v3": {
+		Name:     "Standard_E2s_v3",
+		VCPU:     2,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_E4s_v3": {
+		Name:     "Standard_E4s_v3",
+		VCPU:     4,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_E8s_v3": {
+		Name:     "Standard_E8s_v3",
+		VCPU:     8,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_E16s_v3": {
+		Name:     "Standard_E16s_v3",
+		VCPU:     16,
+		MemoryMb: 131072,
+		GPU:      0,
+	},
+	"Standard_E32s_v3": {
+		Name:     "Standard_E32s_v3",
+		VCPU:     32,
+		MemoryMb: 262144,
+		GPU:      0,
+	},
+	"Standard_E64s_v3": {
+		Name:     "Standard_E64s_v3",
+		VCPU:     64,
+		MemoryMb: 442368,
+		GPU:      0,
+	},
+	"Standard_F1": {
+		Name:     "Standard_F1",
+		VCPU:     1,
+		MemoryMb: 2048,
+		GPU:      0,
+	},
+	"Standard_F2": {
+		Name:     "Standard_F2",
+		VCPU:     2,
+		MemoryMb: 4096,
+		GPU:      0,
+	},
+	"Standard_F4": {
+		Name:     "Standard_F4",
+		VCPU:     4,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_F8": {
+		Name:     "Standard_F8",
+		VCPU:     8,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_F16": {
+		Name:     "Standard_F16",
+		VCPU:     16,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_F1s": {
+		Name:     "Standard_F1s",
+		VCPU:     1,
+		MemoryMb: 2048,
+		GPU:      0,
+	},
+	"Standard_F2s": {
+		Name:     "Standard_F2s",
+		VCPU:     2,
+		MemoryMb: 4096,
+		GPU:      0,
+	},
+	"Standard_F4s": {
+		Name:     "Standard_F4s",
+		VCPU:     4,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_F8s": {
+		Name:     "Standard_F8s",
+		VCPU:     8,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_F16s": {
+		Name:     "Standard_F16s",
+		VCPU:     16,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_F2s_v2": {
+		Name:     "Standard_F2s_v2",
+		VCPU:     2,
+		MemoryMb: 4096,
+		GPU:      0,
+	},
+	"Standard_F4s_v2": {
+		Name:     "Standard_F4s_v2",
+		VCPU:     4,
+		MemoryMb: 8192,
+		GPU:      0,
+	},
+	"Standard_F8s_v2": {
+		Name:     "Standard_F8s_v2",
+		VCPU:     8,
+		MemoryMb: 16384,
+		GPU:      0,
+	},
+	"Standard_F16s_v2": {
+		Name:     "Standard_F16s_v2",
+		VCPU:     16,
+		MemoryMb: 32768,
+		GPU:      0,
+	},
+	"Standard_F32s_v2": {
+		Name:     "Standard_F32s_v2",
+		VCPU:     32,
+		MemoryMb: 65536,
+		GPU:      0,
+	},
+	"Standard_F64s_v2": {
+		Name:     "Standard_F64s_v2",
+		VCPU:     64,
+		MemoryMb: 131072,
+		GPU:      0,
+	},
+	"Standard_F72s_v2": {
+		Name:     "Standard_F72s_v2",
+		VCPU:     72,
+		MemoryMb: 147456,
+		GPU:      0,
+	},
+	"Standard_NC6": {
+		Name:     "Standard_NC6",
+		VCPU:     6,
+		MemoryMb: 57344,
+		GPU:      1,
+	},
+	"Standard_NC12": {
+		Name:     "Standard_NC12",
+		VCPU:     12,
+		MemoryMb: 114688,
+		GPU:      2,
+	},
+	"Standard_NC24": {
+		Name:     "Standard_NC24",
+		VCPU:     24,
+		MemoryMb: 229376,
+		GPU:      4,
+	},
+	"Standard_NV6": {
+		Name:     "Standard_NV6",
+		VCPU:     6,
+		MemoryMb: 57344,
+		GPU:      1,
+	},
+	"Standard_NV12": {
+		Name:     "Standard_NV12",
+		VCPU:     12,
+		MemoryMb: 114688,
+		GPU:      2,
+	},
+	"Standard_NV24": {
+		Name:     "Standard_NV24",
+		VCPU:     24,
+		MemoryMb: 229376,
+		GPU:      4,
+	},
+	"Standard_NC6s_v2": {
+		Name:     "Standard_NC6s_v2",
+		VCPU:     6,
+		MemoryMb: 114688,
+		GPU:      1,
+	},
+	"Standard_NC12s_v2": {
+		Name:     "Standard_NC12s_v2",
+		VCPU:     12,
+		MemoryMb: 229376,
+		GPU:      2,
+	},
+	"Standard_NC24s_v2": {
+		Name:     "Standard_NC24s_v2",
+		VCPU:     24,
+		MemoryMb: 458752,
+		GPU:      4,
+	},
+	"Standard_NC6s_v3": {
+		Name:     "Standard_NC6s_v3",
+		VCPU:     6,
+		MemoryMb: 114688,
+		GPU:      1,
+	},
+	"Standard_NC12s_v3": {
+		Name:     "Standard_NC12s_v3",
+		VCPU:     12,
+		MemoryMb: 229376,
+		GPU:      2,
+	},
+	"Standard_NC24s_v3": {
+		Name:     "Standard_NC24s_v3",
+		VCPU:     24,
+		MemoryMb: 458752,
+		GPU:      4,
+	},
+	"Standard_ND6s": {
+		Name:     "Standard_ND6s",
+		VCPU:     6,
+		MemoryMb: 114688,
+		GPU:      1,
+	},
+	"Standard_ND12s": {
+		Name:     "Standard_ND12s",
+		VCPU:     12,
+		MemoryMb: 229376,
+		GPU:      2,
+	},
+	"Standard_ND24s": {
+		Name:     "Standard_ND24s",
+		VCPU:     24,
+		MemoryMb: 458752,
+		GPU:      4,
+	},
+}
+
+// getVMSize returns the resources of the VM size, Azure compares the names of
+// VM sizes case-insensitively.
+func getVMSize(name string) (*vmSize, bool) {
+	if size, found := VMSizes[name]; found {
+		return size, true
+	}
+	for sizeName, size := range VMSizes {
+		if strings.EqualFold(sizeName, name) {
+			return size, true
+		}
+	}
+	return nil, false
+}
@@ -53,15 +53,17 @@ type CloudProviderBuilder struct {
 	cloudConfig             string
 	clusterName             string
 	autoprovisioningEnabled bool
+	awsAssumeRoleARN        string
 }
 
 // NewCloudProviderBuilder builds a new builder from static settings
-func NewCloudProviderBuilder(cloudProviderFlag string, cloudConfig string, clusterName string, autoprovisioningEnabled bool) CloudProviderBuilder {
+func NewCloudProviderBuilder(cloudProviderFlag string, cloudConfig string, clusterName string, autoprovisioningEnabled bool, awsAssumeRoleARN string) CloudProviderBuilder {
 	return CloudProviderBuilder{
 		cloudProviderFlag:       cloudProviderFlag,
 		cloudConfig:             cloudConfig,
 		clusterName:             clusterName,
 		autoprovisioningEnabled: autoprovisioningEnabled,
+		awsAssumeRoleARN:        awsAssumeRoleARN,
 	}
 }
 
@@ -130,7 +132,7 @@ func (b CloudProviderBuilder) buildAWS(do cloudprovider.NodeGroupDiscoveryOption
 		defer config.Close()
 	}
 
-	manager, err := aws.CreateAwsManager(config, do)
+	manager, err := aws.CreateAwsManager(config, do, b.awsAssumeRoleARN)
 	if err != nil {
 		glog.Fatalf("Failed to create AWS Manager: %v", err)
 	}
@@ -143,23 +145,20 @@ func (b CloudProviderBuilder) buildAWS(do cloudprovider.NodeGroupDiscoveryOption
 }
 
 func (b CloudProviderBuilder) buildAzure(do cloudprovider.NodeGroupDiscoveryOptions, rl *cloudprovider.ResourceLimiter) cloudprovider.CloudProvider {
-	var config io.ReadCloser
+	var manager *azure.AzureManager
+	var err error
 	if b.cloudConfig != "" {
-		glog.Info("Creating Azure Manager using cloud-config file: %v", b.cloudConfig)
-		var err error
-		config, err := os.Open(b.cloudConfig)
-		if err != nil {
-			glog.Fatalf("Couldn't open cloud provider configuration %s: %#v", b.cloudConfig, err)
-		}
-		defer config.Close()
+		glog.Infof("Creating Azure Manager using cloud-config file: %v", b.cloudConfig)
+		// The credentials are reloaded when the file changes.
+		manager, err = azure.CreateAzureManagerFromFile(b.cloudConfig)
 	} else {
 		glog.Info("Creating Azure Manager with default configuration.")
+		manager, err = azure.CreateAzureManager(nil)
 	}
-	manager, err := azure.CreateAzureManager(config)
 	if err != nil {
 		glog.Fatalf("Failed to create Azure Manager: %v", err)
 	}
-	provider, err := azure.BuildAzureCloudProvider(manager, do.NodeGroupSpecs, rl)
+	provider, err := azure.BuildAzureCloudProviderWithDiscovery(manager, do, rl)
 	if err != nil {
 		glog.Fatalf("Failed to create Azure cloud provider: %v", err)
 	}
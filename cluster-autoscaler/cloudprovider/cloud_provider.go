@@ -25,6 +25,8 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	kube_client "k8s.io/client-go/kubernetes"
+	kube_record "k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/plugin/pkg/scheduler/schedulercache"
 )
 
@@ -142,6 +144,89 @@ type NodeGroup interface {
 	Autoprovisioned() bool
 }
 
+// NodeGroupWithUnremovableNodes is a node group some of whose nodes can't be
+// removed because the cloud provider protects them, e.g. from scale-in. Such
+// nodes are not considered for scale-down. Implementation optional.
+type NodeGroupWithUnremovableNodes interface {
+	NodeGroup
+
+	// UnremovableReason returns why the given node can't be removed from the
+	// node group, or an empty string if it can be removed.
+	UnremovableReason(node *apiv1.Node) (string, error)
+}
+
+// NodeGroupWithMaxNodeProvisionTime is a node group whose nodes take a known
+// time to come up, used instead of --max-node-provision-time to consider them
+// failed to. Implementation optional.
+type NodeGroupWithMaxNodeProvisionTime interface {
+	NodeGroup
+
+	// MaxNodeProvisionTime returns the time after which the new nodes of the
+	// node group can be considered failed to come up, or 0 if it's unknown.
+	MaxNodeProvisionTime() time.Duration
+}
+
+// NodeGroupWithWarmPool is a node group which may provision its nodes faster
+// from a pool of pre-initialized instances. The most-pods, least-waste and
+// price expanders prefer such node groups to the equally good others, the
+// random expander ignores it. Implementation optional.
+type NodeGroupWithWarmPool interface {
+	NodeGroup
+
+	// HasWarmPool returns whether the node group has a warm pool to
+	// provision its nodes from.
+	HasWarmPool() bool
+}
+
+// NodeGroupWithFlexibleNodes is a node group whose nodes may be of different
+// sizes, e.g. of any instance type matching some requirements. TemplateNodeInfo
+// returns its smallest node, the pods not fitting it are estimated on its
+// largest node. Implementation optional.
+type NodeGroupWithFlexibleNodes interface {
+	NodeGroup
+
+	// MaxTemplateNodeInfo returns a template of the largest node the node
+	// group may create, or nil if all its nodes are of the same size.
+	MaxTemplateNodeInfo() (*schedulercache.NodeInfo, error)
+}
+
+// StatusRecorder records events on the status ConfigMap of the autoscaler,
+// like the LogEventRecorder of clusterstate.
+type StatusRecorder interface {
+	Eventf(eventtype, reason, message string, args ...interface{})
+}
+
+// CloudProviderWithEventRecorders is a cloud provider recording the operations
+// on its node groups as events. Implementation optional.
+type CloudProviderWithEventRecorders interface {
+	CloudProvider
+
+	// SetEventRecorders sets the recorders of the events on the Kubernetes
+	// objects and on the status ConfigMap. Either recorder may be nil.
+	SetEventRecorders(recorder kube_record.EventRecorder, status StatusRecorder)
+}
+
+// CloudProviderWithKubeClient is a cloud provider reading the Kubernetes
+// objects of its nodes. Implementation optional.
+type CloudProviderWithKubeClient interface {
+	CloudProvider
+
+	// SetKubeClient sets the client of the Kubernetes API server.
+	SetKubeClient(client kube_client.Interface)
+}
+
+// CloudProviderWithGPUNodes is a cloud provider knowing which of its nodes
+// should have GPU, e.g. from their VM size, so that the ones whose GPUs aren't
+// allocatable yet are treated as unready while their driver is installed.
+// Implementation optional, otherwise only the nodes with the GKE GPU label
+// are expected to have GPU.
+type CloudProviderWithGPUNodes interface {
+	CloudProvider
+
+	// NodeHasGPU returns true if the node should have GPU once started.
+	NodeHasGPU(node *apiv1.Node) bool
+}
+
 // PricingModel contains information about the node price and how it changes in time.
 type PricingModel interface {
 	// NodePrice returns a price of running the given node for a given period of time.
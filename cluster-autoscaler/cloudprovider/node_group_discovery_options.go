@@ -25,14 +25,18 @@ import (
 )
 
 const (
-	autoDiscovererTypeMIG = "mig"
-	autoDiscovererTypeASG = "asg"
+	autoDiscovererTypeMIG   = "mig"
+	autoDiscovererTypeASG   = "asg"
+	autoDiscovererTypeLabel = "label"
 
 	migAutoDiscovererKeyPrefix   = "namePrefix"
 	migAutoDiscovererKeyMinNodes = "min"
 	migAutoDiscovererKeyMaxNodes = "max"
 
 	asgAutoDiscovererKeyTag = "tag"
+
+	vmssAutoDiscovererKeyMinNodes = "min"
+	vmssAutoDiscovererKeyMaxNodes = "max"
 )
 
 var validMIGAutoDiscovererKeys = strings.Join([]string{
@@ -93,6 +97,20 @@ func (o NodeGroupDiscoveryOptions) ParseASGAutoDiscoverySpecs() ([]ASGAutoDiscov
 	return cfgs, nil
 }
 
+// ParseVMSSAutoDiscoverySpecs returns any provided NodeGroupAutoDiscoverySpecs
+// parsed into configuration appropriate for Azure VMSS autodiscovery.
+func (o NodeGroupDiscoveryOptions) ParseVMSSAutoDiscoverySpecs() ([]VMSSAutoDiscoveryConfig, error) {
+	cfgs := make([]VMSSAutoDiscoveryConfig, len(o.NodeGroupAutoDiscoverySpecs))
+	var err error
+	for i, spec := range o.NodeGroupAutoDiscoverySpecs {
+		cfgs[i], err = parseVMSSAutoDiscoverySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfgs, nil
+}
+
 // A MIGAutoDiscoveryConfig specifies how to autodiscover GCE MIGs.
 type MIGAutoDiscoveryConfig struct {
 	// Re is a regexp passed using the eq filter to the GCE list API.
@@ -188,3 +206,62 @@ func parseASGAutoDiscoverySpec(spec string) (ASGAutoDiscoveryConfig, error) {
 	}
 	return cfg, nil
 }
+
+// A VMSSAutoDiscoveryConfig specifies how to autodiscover Azure VM scale sets.
+type VMSSAutoDiscoveryConfig struct {
+	// Tags to match on. Any scale set with all of the provided tags and
+	// values will be autoscaled.
+	Tags map[string]string
+	// MinSize specifies the minimum size for all scale sets that match Tags.
+	MinSize int
+	// MaxSize specifies the maximum size for all scale sets that match Tags.
+	MaxSize int
+}
+
+func parseVMSSAutoDiscoverySpec(spec string) (VMSSAutoDiscoveryConfig, error) {
+	cfg := VMSSAutoDiscoveryConfig{Tags: make(map[string]string)}
+
+	tokens := strings.SplitN(spec, ":", 2)
+	if len(tokens) != 2 {
+		return cfg, fmt.Errorf("spec \"%s\" should be discoverer:key=value,key=value", spec)
+	}
+	discoverer := tokens[0]
+	if discoverer != autoDiscovererTypeLabel {
+		return cfg, fmt.Errorf("unsupported discoverer specified: %s", discoverer)
+	}
+
+	for _, arg := range strings.Split(tokens[1], ",") {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return cfg, fmt.Errorf("invalid key=value pair %s", arg)
+		}
+		k, v := kv[0], kv[1]
+
+		var err error
+		switch k {
+		case vmssAutoDiscovererKeyMinNodes:
+			if cfg.MinSize, err = strconv.Atoi(v); err != nil {
+				return cfg, fmt.Errorf("invalid minimum nodes: %s", v)
+			}
+		case vmssAutoDiscovererKeyMaxNodes:
+			if cfg.MaxSize, err = strconv.Atoi(v); err != nil {
+				return cfg, fmt.Errorf("invalid maximum nodes: %s", v)
+			}
+		default:
+			cfg.Tags[k] = v
+		}
+	}
+	if len(cfg.Tags) == 0 {
+		return cfg, errors.New("no tag supplied")
+	}
+	if cfg.MinSize < 0 {
+		return cfg, fmt.Errorf("minimum size %d must not be negative", cfg.MinSize)
+	}
+	if cfg.MinSize > cfg.MaxSize {
+		return cfg, fmt.Errorf("minimum size %d is greater than maximum size %d", cfg.MinSize, cfg.MaxSize)
+	}
+	if cfg.MaxSize < 1 {
+		return cfg, fmt.Errorf("maximum size %d must be at least 1", cfg.MaxSize)
+	}
+	return cfg, nil
+}
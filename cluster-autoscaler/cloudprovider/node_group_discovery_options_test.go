@@ -185,3 +185,77 @@ func TestParseASGAutoDiscoverySpecs(t *testing.T) {
 		})
 	}
 }
+
+func TestParseVMSSAutoDiscoverySpecs(t *testing.T) {
+	cases := []struct {
+		name    string
+		specs   []string
+		want    []VMSSAutoDiscoveryConfig
+		wantErr bool
+	}{
+		{
+			name: "GoodSpecs",
+			specs: []string{
+				"label:cluster-autoscaler-enabled=true,min=1,max=10",
+				"label:pool=gpu,env=,max=5",
+			},
+			want: []VMSSAutoDiscoveryConfig{
+				{Tags: map[string]string{"cluster-autoscaler-enabled": "true"}, MinSize: 1, MaxSize: 10},
+				{Tags: map[string]string{"pool": "gpu", "env": ""}, MinSize: 0, MaxSize: 5},
+			},
+		},
+		{
+			name:    "MissingLabelType",
+			specs:   []string{"cluster-autoscaler-enabled=true,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "WrongType",
+			specs:   []string{"asg:cluster-autoscaler-enabled=true,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "MissingTag",
+			specs:   []string{"label:min=1,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "ValueMissingKey",
+			specs:   []string{"label:=true,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "KeyMissingSeparator",
+			specs:   []string{"label:cluster-autoscaler-enabled,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "InvalidMin",
+			specs:   []string{"label:cluster-autoscaler-enabled=true,min=one,max=10"},
+			wantErr: true,
+		},
+		{
+			name:    "MinGreaterThanMax",
+			specs:   []string{"label:cluster-autoscaler-enabled=true,min=5,max=1"},
+			wantErr: true,
+		},
+		{
+			name:    "MissingMax",
+			specs:   []string{"label:cluster-autoscaler-enabled=true"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			do := NodeGroupDiscoveryOptions{NodeGroupAutoDiscoverySpecs: tc.specs}
+			got, err := do.ParseVMSSAutoDiscoverySpecs()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, assert.ObjectsAreEqualValues(tc.want, got), "\ngot: %#v\nwant: %#v", got, tc.want)
+		})
+	}
+}
@@ -19,6 +19,7 @@ package test
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -52,6 +53,7 @@ type TestCloudProvider struct {
 	machineTypes      []string
 	machineTemplates  map[string]*schedulercache.NodeInfo
 	resourceLimiter   *cloudprovider.ResourceLimiter
+	unremovable       map[string]string
 }
 
 // NewTestCloudProvider builds new TestCloudProvider
@@ -62,6 +64,7 @@ func NewTestCloudProvider(onScaleUp OnScaleUpFunc, onScaleDown OnScaleDownFunc)
 		onScaleUp:       onScaleUp,
 		onScaleDown:     onScaleDown,
 		resourceLimiter: cloudprovider.NewResourceLimiter(make(map[string]int64), make(map[string]int64)),
+		unremovable:     make(map[string]string),
 	}
 }
 
@@ -79,6 +82,7 @@ func NewTestAutoprovisioningCloudProvider(onScaleUp OnScaleUpFunc, onScaleDown O
 		machineTypes:      machineTypes,
 		machineTemplates:  machineTemplates,
 		resourceLimiter:   cloudprovider.NewResourceLimiter(make(map[string]int64), make(map[string]int64)),
+		unremovable:       make(map[string]string),
 	}
 }
 
@@ -190,6 +194,13 @@ func (tcp *TestCloudProvider) AddNode(nodeGroupId string, node *apiv1.Node) {
 	tcp.nodes[node.Name] = nodeGroupId
 }
 
+// SetUnremovableReason makes the given node unremovable for the given reason.
+func (tcp *TestCloudProvider) SetUnremovableReason(nodeName string, reason string) {
+	tcp.Lock()
+	defer tcp.Unlock()
+	tcp.unremovable[nodeName] = reason
+}
+
 // GetResourceLimiter returns struct containing limits (max, min) for resources (cores, memory etc.).
 func (tcp *TestCloudProvider) GetResourceLimiter() (*cloudprovider.ResourceLimiter, error) {
 	return tcp.resourceLimiter, nil
@@ -222,6 +233,10 @@ type TestNodeGroup struct {
 	exist           bool
 	autoprovisioned bool
 	machineType     string
+	// maxNodeProvisionTime is returned by MaxNodeProvisionTime
+	maxNodeProvisionTime time.Duration
+	// maxTemplate is returned by MaxTemplateNodeInfo
+	maxTemplate *schedulercache.NodeInfo
 }
 
 // MaxSize returns maximum size of the node group.
@@ -258,6 +273,38 @@ func (tng *TestNodeGroup) SetTargetSize(size int) {
 	tng.targetSize = size
 }
 
+// SetMaxNodeProvisionTime sets the max node provision time of the group.
+// Function is used only in tests.
+func (tng *TestNodeGroup) SetMaxNodeProvisionTime(provisionTime time.Duration) {
+	tng.Lock()
+	defer tng.Unlock()
+	tng.maxNodeProvisionTime = provisionTime
+}
+
+// MaxNodeProvisionTime returns the time set with SetMaxNodeProvisionTime, 0
+// if it wasn't.
+func (tng *TestNodeGroup) MaxNodeProvisionTime() time.Duration {
+	tng.Lock()
+	defer tng.Unlock()
+	return tng.maxNodeProvisionTime
+}
+
+// SetMaxTemplate sets the template of the largest node of the group. Function
+// is used only in tests.
+func (tng *TestNodeGroup) SetMaxTemplate(template *schedulercache.NodeInfo) {
+	tng.Lock()
+	defer tng.Unlock()
+	tng.maxTemplate = template
+}
+
+// MaxTemplateNodeInfo returns the template set with SetMaxTemplate, nil if it
+// wasn't.
+func (tng *TestNodeGroup) MaxTemplateNodeInfo() (*schedulercache.NodeInfo, error) {
+	tng.Lock()
+	defer tng.Unlock()
+	return tng.maxTemplate, nil
+}
+
 // IncreaseSize increases the size of the node group. To delete a node you need
 // to explicitly name it and use DeleteNode. This function should wait until
 // node group size is updated.
@@ -320,6 +367,14 @@ func (tng *TestNodeGroup) DeleteNodes(nodes []*apiv1.Node) error {
 	return nil
 }
 
+// UnremovableReason returns why the node can't be removed, set with
+// SetUnremovableReason.
+func (tng *TestNodeGroup) UnremovableReason(node *apiv1.Node) (string, error) {
+	tng.cloudProvider.Lock()
+	defer tng.cloudProvider.Unlock()
+	return tng.cloudProvider.unremovable[node.Name], nil
+}
+
 // Id returns an unique identifier of the node group.
 func (tng *TestNodeGroup) Id() string {
 	tng.Lock()
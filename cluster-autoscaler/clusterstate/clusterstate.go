@@ -523,12 +523,16 @@ func (csr *ClusterStateRegistry) updateReadinessStats(currentTime time.Time) {
 	}
 
 	for _, unregistered := range csr.unregisteredNodes {
-		if unregistered.UnregisteredSince.Add(csr.config.MaxNodeProvisionTime).Before(currentTime) {
-			nodeGroup, errNg := csr.cloudProvider.NodeGroupForNode(unregistered.Node)
-			if errNg != nil {
-				glog.Warningf("Failed to get nodegroup for %s: %v", unregistered.Node.Name, errNg)
-				continue
-			}
+		nodeGroup, errNg := csr.cloudProvider.NodeGroupForNode(unregistered.Node)
+		if errNg != nil {
+			glog.Warningf("Failed to get nodegroup for %s: %v", unregistered.Node.Name, errNg)
+			continue
+		}
+		if nodeGroup == nil || reflect.ValueOf(nodeGroup).IsNil() {
+			glog.Warningf("Nodegroup is nil for %s", unregistered.Node.Name)
+			continue
+		}
+		if unregistered.UnregisteredSince.Add(MaxNodeProvisionTime(nodeGroup, csr.config.MaxNodeProvisionTime)).Before(currentTime) {
 			perNgCopy := perNodeGroup[nodeGroup.Id()]
 			perNgCopy.LongUnregistered += 1
 			perNodeGroup[nodeGroup.Id()] = perNgCopy
@@ -914,3 +918,19 @@ func getNotRegisteredNodes(allNodes []*apiv1.Node, cloudProvider cloudprovider.C
 	}
 	return notRegistered, nil
 }
+
+// MaxNodeProvisionTime returns the time after which the new nodes of the node
+// group are considered failed to come up: the one of the node group if it
+// implements NodeGroupWithMaxNodeProvisionTime and knows it, defaultTime
+// otherwise, including for nil node groups.
+func MaxNodeProvisionTime(nodeGroup cloudprovider.NodeGroup, defaultTime time.Duration) time.Duration {
+	if nodeGroup == nil || reflect.ValueOf(nodeGroup).IsNil() {
+		return defaultTime
+	}
+	if withTime, ok := nodeGroup.(cloudprovider.NodeGroupWithMaxNodeProvisionTime); ok {
+		if provisionTime := withTime.MaxNodeProvisionTime(); provisionTime > 0 {
+			return provisionTime
+		}
+	}
+	return defaultTime
+}
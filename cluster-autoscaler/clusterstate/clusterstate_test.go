@@ -22,6 +22,7 @@ import (
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	testprovider "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/test"
 	"k8s.io/autoscaler/cluster-autoscaler/clusterstate/api"
 	"k8s.io/autoscaler/cluster-autoscaler/clusterstate/utils"
@@ -490,6 +491,90 @@ func TestUnregisteredNodes(t *testing.T) {
 	assert.Equal(t, 0, len(clusterstate.GetUnregisteredNodes()))
 }
 
+func TestUnregisteredNodesWithNodeGroupProvisionTime(t *testing.T) {
+	ng1_1 := BuildTestNode("ng1-1", 1000, 1000)
+	ng1_1.Spec.ProviderID = "ng1-1"
+	ng1_2 := BuildTestNode("ng1-2", 1000, 1000)
+	ng1_2.Spec.ProviderID = "ng1-2"
+	provider := testprovider.NewTestCloudProvider(nil, nil)
+	provider.AddNodeGroup("ng1", 1, 10, 2)
+	provider.AddNode("ng1", ng1_1)
+	provider.AddNode("ng1", ng1_2)
+	provider.GetNodeGroup("ng1").(*testprovider.TestNodeGroup).SetMaxNodeProvisionTime(time.Minute)
+
+	fakeClient := &fake.Clientset{}
+	fakeLogRecorder, _ := utils.NewStatusMapRecorder(fakeClient, "kube-system", kube_record.NewFakeRecorder(5), false)
+	clusterstate := NewClusterStateRegistry(provider, ClusterStateRegistryConfig{
+		MaxTotalUnreadyPercentage: 10,
+		OkTotalUnreadyCount:       1,
+		MaxNodeProvisionTime:      time.Hour,
+	}, fakeLogRecorder)
+	now := time.Now()
+	err := clusterstate.UpdateNodes([]*apiv1.Node{ng1_1}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(clusterstate.GetUnregisteredNodes()))
+
+	// The node group's own provision time is used instead of the global one.
+	err = clusterstate.UpdateNodes([]*apiv1.Node{ng1_1}, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, clusterstate.GetClusterReadiness().LongUnregistered)
+}
+
+// typedNilNodeGroupProvider returns a typed nil node group for the nodes
+// which aren't registered, like a provider whose node group was removed after
+// it listed the nodes.
+type typedNilNodeGroupProvider struct {
+	*testprovider.TestCloudProvider
+	registered map[string]bool
+}
+
+func (p *typedNilNodeGroupProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.NodeGroup, error) {
+	if !p.registered[node.Name] {
+		var nodeGroup *testprovider.TestNodeGroup
+		return nodeGroup, nil
+	}
+	return p.TestCloudProvider.NodeGroupForNode(node)
+}
+
+func TestUnregisteredNodesWithoutNodeGroup(t *testing.T) {
+	ng1_1 := BuildTestNode("ng1-1", 1000, 1000)
+	ng1_1.Spec.ProviderID = "ng1-1"
+	ng1_2 := BuildTestNode("ng1-2", 1000, 1000)
+	ng1_2.Spec.ProviderID = "ng1-2"
+	testProvider := testprovider.NewTestCloudProvider(nil, nil)
+	testProvider.AddNodeGroup("ng1", 1, 10, 2)
+	testProvider.AddNode("ng1", ng1_1)
+	testProvider.AddNode("ng1", ng1_2)
+	provider := &typedNilNodeGroupProvider{TestCloudProvider: testProvider, registered: map[string]bool{"ng1-1": true}}
+
+	fakeClient := &fake.Clientset{}
+	fakeLogRecorder, _ := utils.NewStatusMapRecorder(fakeClient, "kube-system", kube_record.NewFakeRecorder(5), false)
+	clusterstate := NewClusterStateRegistry(provider, ClusterStateRegistryConfig{
+		MaxTotalUnreadyPercentage: 10,
+		OkTotalUnreadyCount:       1,
+		MaxNodeProvisionTime:      time.Minute,
+	}, fakeLogRecorder)
+	now := time.Now()
+	err := clusterstate.UpdateNodes([]*apiv1.Node{ng1_1}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(clusterstate.GetUnregisteredNodes()))
+
+	// The unregistered node without node group is skipped.
+	err = clusterstate.UpdateNodes([]*apiv1.Node{ng1_1}, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, clusterstate.GetClusterReadiness().LongUnregistered)
+	assert.Equal(t, time.Hour, MaxNodeProvisionTime(nil, time.Hour))
+}
+
+func TestMaxNodeProvisionTime(t *testing.T) {
+	provider := testprovider.NewTestCloudProvider(nil, nil)
+	provider.AddNodeGroup("ng1", 1, 10, 2)
+	nodeGroup := provider.GetNodeGroup("ng1").(*testprovider.TestNodeGroup)
+	assert.Equal(t, time.Hour, MaxNodeProvisionTime(nodeGroup, time.Hour))
+	nodeGroup.SetMaxNodeProvisionTime(time.Minute)
+	assert.Equal(t, time.Minute, MaxNodeProvisionTime(nodeGroup, time.Hour))
+}
+
 func TestUpdateLastTransitionTimes(t *testing.T) {
 	now := metav1.Time{Time: time.Now()}
 	later := metav1.Time{Time: now.Time.Add(10 * time.Second)}
@@ -139,11 +139,26 @@ func ScaleUp(context *AutoscalingContext, unschedulablePods []*apiv1.Pod, nodes
 			Pods:      make([]*apiv1.Pod, 0),
 		}
 
+		// The nodes of a flexible node group may be larger than its template,
+		// the pods fitting only its largest node are estimated on it.
+		var maxNodeInfo *schedulercache.NodeInfo
+		if flexible, ok := nodeGroup.(cloudprovider.NodeGroupWithFlexibleNodes); ok {
+			maxNodeInfo, err = flexible.MaxTemplateNodeInfo()
+			if err != nil {
+				glog.Errorf("Failed to get largest node template of %s: %v", nodeGroup.Id(), err)
+				maxNodeInfo = nil
+			}
+		}
+		flexiblePods := make([]*apiv1.Pod, 0)
+
 		for _, pod := range unschedulablePods {
 			err = context.PredicateChecker.CheckPredicates(pod, nil, nodeInfo, simulator.ReturnVerboseError)
 			if err == nil {
 				option.Pods = append(option.Pods, pod)
 				podsRemainUnschedulable[pod] = false
+			} else if maxNodeInfo != nil && context.PredicateChecker.CheckPredicates(pod, nil, maxNodeInfo, simulator.ReturnSimpleError) == nil {
+				flexiblePods = append(flexiblePods, pod)
+				podsRemainUnschedulable[pod] = false
 			} else {
 				glog.V(2).Infof("Scale-up predicate failed: %v", err)
 				if _, exists := podsRemainUnschedulable[pod]; !exists {
@@ -151,23 +166,39 @@ func ScaleUp(context *AutoscalingContext, unschedulablePods []*apiv1.Pod, nodes
 				}
 			}
 		}
-		passingPods := make([]*apiv1.Pod, len(option.Pods))
-		copy(passingPods, option.Pods)
+		passingPods := make([]*apiv1.Pod, 0, len(option.Pods)+len(flexiblePods))
+		passingPods = append(passingPods, option.Pods...)
+		passingPods = append(passingPods, flexiblePods...)
 		podsPassingPredicates[nodeGroup.Id()] = passingPods
 
-		if len(option.Pods) > 0 {
+		if len(passingPods) > 0 {
+			// The upcoming nodes are only counted for the pods fitting the
+			// template, the others need nodes larger than it.
 			if context.EstimatorName == estimator.BinpackingEstimatorName {
 				binpackingEstimator := estimator.NewBinpackingNodeEstimator(context.PredicateChecker)
 				option.NodeCount = binpackingEstimator.Estimate(option.Pods, nodeInfo, upcomingNodes)
+				if len(flexiblePods) > 0 {
+					option.NodeCount += binpackingEstimator.Estimate(flexiblePods, maxNodeInfo, nil)
+				}
 			} else if context.EstimatorName == estimator.BasicEstimatorName {
 				basicEstimator := estimator.NewBasicNodeEstimator()
 				for _, pod := range option.Pods {
 					basicEstimator.Add(pod)
 				}
 				option.NodeCount, option.Debug = basicEstimator.Estimate(nodeInfo.Node(), upcomingNodes)
+				if len(flexiblePods) > 0 {
+					flexibleEstimator := estimator.NewBasicNodeEstimator()
+					for _, pod := range flexiblePods {
+						flexibleEstimator.Add(pod)
+					}
+					nodeCount, debug := flexibleEstimator.Estimate(maxNodeInfo.Node(), nil)
+					option.NodeCount += nodeCount
+					option.Debug += debug
+				}
 			} else {
 				glog.Fatalf("Unrecognized estimator: %s", context.EstimatorName)
 			}
+			option.Pods = passingPods
 			if option.NodeCount > 0 {
 				expansionOptions = append(expansionOptions, option)
 			} else {
@@ -350,7 +381,7 @@ func executeScaleUp(context *AutoscalingContext, info nodegroupset.ScaleUpInfo)
 			NodeGroupName:   info.Group.Id(),
 			Increase:        increase,
 			Time:            time.Now(),
-			ExpectedAddTime: time.Now().Add(context.MaxNodeProvisionTime),
+			ExpectedAddTime: time.Now().Add(clusterstate.MaxNodeProvisionTime(info.Group, context.MaxNodeProvisionTime)),
 		})
 	metrics.RegisterScaleUp(increase)
 	context.LogRecorder.Eventf(apiv1.EventTypeNormal, "ScaledUpGroup",
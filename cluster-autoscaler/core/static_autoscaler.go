@@ -19,6 +19,7 @@ package core
 import (
 	"time"
 
+	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	"k8s.io/autoscaler/cluster-autoscaler/clusterstate/utils"
 	"k8s.io/autoscaler/cluster-autoscaler/metrics"
@@ -123,7 +124,13 @@ func (a *StaticAutoscaler) RunOnce(currentTime time.Time) errors.AutoscalerError
 	// Treat those nodes as unready until GPU actually becomes available and let
 	// our normal handling for booting up nodes deal with this.
 	// TODO: Remove this call when we handle dynamically provisioned resources.
-	allNodes, readyNodes = gpu.FilterOutNodesWithUnreadyGpus(allNodes, readyNodes)
+	hasGpu := gpu.HasGPULabel
+	if provider, ok := autoscalingContext.CloudProvider.(cloudprovider.CloudProviderWithGPUNodes); ok {
+		hasGpu = func(node *apiv1.Node) bool {
+			return gpu.HasGPULabel(node) || provider.NodeHasGPU(node)
+		}
+	}
+	allNodes, readyNodes = gpu.FilterOutNodesWithUnreadyGpusMatching(allNodes, readyNodes, hasGpu)
 	if len(readyNodes) == 0 {
 		glog.Warningf("No ready nodes in the cluster")
 		scaleDown.CleanUpUnneededNodes()
@@ -320,17 +320,17 @@ func removeOldUnregisteredNodes(unregisteredNodes []clusterstate.UnregisteredNod
 	currentTime time.Time, logRecorder *utils.LogEventRecorder) (bool, error) {
 	removedAny := false
 	for _, unregisteredNode := range unregisteredNodes {
-		if unregisteredNode.UnregisteredSince.Add(context.MaxNodeProvisionTime).Before(currentTime) {
+		nodeGroup, err := context.CloudProvider.NodeGroupForNode(unregisteredNode.Node)
+		if err != nil {
+			glog.Warningf("Failed to get node group for %s: %v", unregisteredNode.Node.Name, err)
+			return removedAny, err
+		}
+		if nodeGroup == nil || reflect.ValueOf(nodeGroup).IsNil() {
+			glog.Warningf("No node group for node %s, skipping", unregisteredNode.Node.Name)
+			continue
+		}
+		if unregisteredNode.UnregisteredSince.Add(clusterstate.MaxNodeProvisionTime(nodeGroup, context.MaxNodeProvisionTime)).Before(currentTime) {
 			glog.V(0).Infof("Removing unregistered node %v", unregisteredNode.Node.Name)
-			nodeGroup, err := context.CloudProvider.NodeGroupForNode(unregisteredNode.Node)
-			if err != nil {
-				glog.Warningf("Failed to get node group for %s: %v", unregisteredNode.Node.Name, err)
-				return removedAny, err
-			}
-			if nodeGroup == nil || reflect.ValueOf(nodeGroup).IsNil() {
-				glog.Warningf("No node group for node %s, skipping", unregisteredNode.Node.Name)
-				continue
-			}
 			size, err := nodeGroup.TargetSize()
 			if err != nil {
 				glog.Warningf("Failed to get node group size, err: %v", err)
@@ -363,7 +363,7 @@ func fixNodeGroupSize(context *AutoscalingContext, currentTime time.Time) (bool,
 		if incorrectSize == nil {
 			continue
 		}
-		if incorrectSize.FirstObserved.Add(context.MaxNodeProvisionTime).Before(currentTime) {
+		if incorrectSize.FirstObserved.Add(clusterstate.MaxNodeProvisionTime(nodeGroup, context.MaxNodeProvisionTime)).Before(currentTime) {
 			delta := incorrectSize.CurrentSize - incorrectSize.ExpectedSize
 			if delta < 0 {
 				glog.V(0).Infof("Decreasing size of %s, expected=%d current=%d delta=%d", nodeGroup.Id(),
@@ -383,6 +383,7 @@ func fixNodeGroupSize(context *AutoscalingContext, currentTime time.Time) (bool,
 // getPotentiallyUnneededNodes returns nodes that are:
 // - managed by the cluster autoscaler
 // - in groups with size > min size
+// - not protected from removal by the cloud provider
 func getPotentiallyUnneededNodes(context *AutoscalingContext, nodes []*apiv1.Node) []*apiv1.Node {
 	result := make([]*apiv1.Node, 0, len(nodes))
 
@@ -407,6 +408,17 @@ func getPotentiallyUnneededNodes(context *AutoscalingContext, nodes []*apiv1.Nod
 			glog.V(1).Infof("Skipping %s - node group min size reached", node.Name)
 			continue
 		}
+		if withUnremovable, ok := nodeGroup.(cloudprovider.NodeGroupWithUnremovableNodes); ok {
+			reason, err := withUnremovable.UnremovableReason(node)
+			if err != nil {
+				glog.Warningf("Error while checking whether %s can be removed: %v", node.Name, err)
+				continue
+			}
+			if reason != "" {
+				glog.V(1).Infof("Skipping %s - unremovable: %s", node.Name, reason)
+				continue
+			}
+		}
 		result = append(result, node)
 	}
 	return result
@@ -470,6 +470,12 @@ func TestGetPotentiallyUnneededNodes(t *testing.T) {
 	ok1 := result[0].Name == "ng1-1" && result[1].Name == "ng1-2"
 	ok2 := result[1].Name == "ng1-1" && result[0].Name == "ng1-2"
 	assert.True(t, ok1 || ok2)
+
+	// The nodes the cloud provider protects from removal are skipped.
+	provider.SetUnremovableReason("ng1-2", "protected")
+	result = getPotentiallyUnneededNodes(context, []*apiv1.Node{ng1_1, ng1_2, ng2_1, noNg})
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "ng1-1", result[0].Name)
 }
 
 func TestConfigurePredicateCheckerForLoop(t *testing.T) {
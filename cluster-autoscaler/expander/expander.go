@@ -48,3 +48,26 @@ type Option struct {
 type Strategy interface {
 	BestOption(options []Option, nodeInfo map[string]*schedulercache.NodeInfo) *Option
 }
+
+// HasWarmPool returns whether the node group of the option provisions its
+// nodes from a warm pool, see cloudprovider.NodeGroupWithWarmPool.
+func HasWarmPool(option Option) bool {
+	nodeGroup, ok := option.NodeGroup.(cloudprovider.NodeGroupWithWarmPool)
+	return ok && nodeGroup.HasWarmPool()
+}
+
+// PreferWarmPools returns the options of the node groups with a warm pool if
+// any, all the options otherwise. The strategies break the ties between
+// equally good options with it, since such node groups provision faster.
+func PreferWarmPools(options []Option) []Option {
+	var warm []Option
+	for _, option := range options {
+		if HasWarmPool(option) {
+			warm = append(warm, option)
+		}
+	}
+	if len(warm) == 0 {
+		return options
+	}
+	return warm
+}
@@ -51,5 +51,5 @@ func (m *mostpods) BestOption(expansionOptions []expander.Option, nodeInfo map[s
 		return nil
 	}
 
-	return m.fallbackStrategy.BestOption(maxOptions, nodeInfo)
+	return m.fallbackStrategy.BestOption(expander.PreferWarmPools(maxOptions), nodeInfo)
 }
@@ -21,6 +21,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	"k8s.io/autoscaler/cluster-autoscaler/expander"
 )
 
@@ -43,3 +44,28 @@ func TestMostPods(t *testing.T) {
 
 	assert.True(t, assert.ObjectsAreEqual(*ret, eo1) || assert.ObjectsAreEqual(*ret, eo1b))
 }
+
+type warmPoolNodeGroup struct {
+	cloudprovider.NodeGroup
+	warm bool
+}
+
+func (ng *warmPoolNodeGroup) HasWarmPool() bool {
+	return ng.warm
+}
+
+func TestMostPodsPrefersWarmPools(t *testing.T) {
+	cold := expander.Option{Debug: "cold", NodeGroup: &warmPoolNodeGroup{}, Pods: []*apiv1.Pod{nil}}
+	warm := expander.Option{Debug: "warm", NodeGroup: &warmPoolNodeGroup{warm: true}, Pods: []*apiv1.Pod{nil}}
+	e := NewStrategy()
+
+	for i := 0; i < 10; i++ {
+		ret := e.BestOption([]expander.Option{cold, warm}, nil)
+		assert.Equal(t, warm, *ret)
+	}
+
+	// The node group fitting the most pods wins anyway.
+	colder := expander.Option{Debug: "colder", NodeGroup: &warmPoolNodeGroup{}, Pods: []*apiv1.Pod{nil, nil}}
+	ret := e.BestOption([]expander.Option{colder, warm}, nil)
+	assert.Equal(t, colder, *ret)
+}
@@ -140,7 +140,9 @@ nextoption:
 
 		glog.V(5).Infof("Price expander for %s: %s", option.NodeGroup.Id(), debug)
 
-		if bestOption == nil || bestOptionScore > optionScore {
+		// Ties are broken in favor of the node groups with a warm pool.
+		if bestOption == nil || bestOptionScore > optionScore ||
+			(bestOptionScore == optionScore && expander.HasWarmPool(option) && !expander.HasWarmPool(*bestOption)) {
 			bestOption = &expander.Option{
 				NodeGroup: option.NodeGroup,
 				NodeCount: option.NodeCount,
@@ -24,6 +24,7 @@ import (
 	"k8s.io/autoscaler/cluster-autoscaler/expander"
 
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	testprovider "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/test"
 	. "k8s.io/autoscaler/cluster-autoscaler/utils/test"
 	"k8s.io/kubernetes/plugin/pkg/scheduler/schedulercache"
@@ -305,3 +306,50 @@ func TestPriceExpander(t *testing.T) {
 		SimpleNodeUnfitness,
 	).BestOption(options3, nodeInfosForGroups).Debug, "ng3")
 }
+
+type warmPoolNodeGroup struct {
+	cloudprovider.NodeGroup
+}
+
+func (ng *warmPoolNodeGroup) HasWarmPool() bool {
+	return true
+}
+
+func TestPriceExpanderPrefersWarmPools(t *testing.T) {
+	n1 := BuildTestNode("n1", 1000, 1000)
+	n2 := BuildTestNode("n2", 1000, 1000)
+	p1 := BuildTestPod("p1", 1000, 0)
+
+	provider := testprovider.NewTestCloudProvider(nil, nil)
+	provider.AddNodeGroup("ng1", 1, 10, 1)
+	provider.AddNodeGroup("ng2", 1, 10, 1)
+	provider.AddNode("ng1", n1)
+	provider.AddNode("ng2", n2)
+	ng1, _ := provider.NodeGroupForNode(n1)
+	ng2, _ := provider.NodeGroupForNode(n2)
+
+	ni1 := schedulercache.NewNodeInfo()
+	ni1.SetNode(n1)
+	ni2 := schedulercache.NewNodeInfo()
+	ni2.SetNode(n2)
+	nodeInfosForGroups := map[string]*schedulercache.NodeInfo{
+		"ng1": ni1, "ng2": ni2,
+	}
+	strategy := NewStrategy(
+		&testPricingModel{
+			podPrice:  map[string]float64{"p1": 20.0, "stabilize": 10},
+			nodePrice: map[string]float64{"n1": 20.0, "n2": 20.0},
+		},
+		&testPreferredNodeProvider{
+			preferred: buildNode(1000, 1024*1024*1024),
+		},
+		SimpleNodeUnfitness,
+	)
+
+	// Both node groups cost the same, the one with a warm pool wins the tie
+	// whatever its position.
+	cold := expander.Option{NodeGroup: ng1, NodeCount: 1, Pods: []*apiv1.Pod{p1}, Debug: "ng1"}
+	warm := expander.Option{NodeGroup: &warmPoolNodeGroup{ng2}, NodeCount: 1, Pods: []*apiv1.Pod{p1}, Debug: "ng2"}
+	assert.Contains(t, strategy.BestOption([]expander.Option{cold, warm}, nodeInfosForGroups).Debug, "ng2")
+	assert.Contains(t, strategy.BestOption([]expander.Option{warm, cold}, nodeInfosForGroups).Debug, "ng2")
+}
@@ -70,7 +70,7 @@ func (l *leastwaste) BestOption(expansionOptions []expander.Option, nodeInfo map
 		return nil
 	}
 
-	return l.fallbackStrategy.BestOption(leastWastedOptions, nodeInfo)
+	return l.fallbackStrategy.BestOption(expander.PreferWarmPools(leastWastedOptions), nodeInfo)
 }
 
 func resourcesForPods(pods []*apiv1.Pod) (cpu resource.Quantity, memory resource.Quantity) {
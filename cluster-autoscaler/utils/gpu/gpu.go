@@ -38,17 +38,27 @@ const (
 // This is a hack/workaround for nodes with GPU coming up without installed drivers, resulting
 // in GPU missing from their allocatable and capacity.
 func FilterOutNodesWithUnreadyGpus(allNodes, readyNodes []*apiv1.Node) ([]*apiv1.Node, []*apiv1.Node) {
+	return FilterOutNodesWithUnreadyGpusMatching(allNodes, readyNodes, HasGPULabel)
+}
+
+// HasGPULabel returns true if the node has the GKE label of the nodes with GPU.
+func HasGPULabel(node *apiv1.Node) bool {
+	_, found := node.Labels[GPULabel]
+	return found
+}
+
+// FilterOutNodesWithUnreadyGpusMatching is FilterOutNodesWithUnreadyGpus for
+// the nodes which should have GPU according to hasGpu, e.g. the cloud provider.
+func FilterOutNodesWithUnreadyGpusMatching(allNodes, readyNodes []*apiv1.Node, hasGpu func(node *apiv1.Node) bool) ([]*apiv1.Node, []*apiv1.Node) {
 	newAllNodes := make([]*apiv1.Node, 0)
 	newReadyNodes := make([]*apiv1.Node, 0)
 	nodesWithUnreadyGpu := make(map[string]*apiv1.Node)
 	for _, node := range readyNodes {
 		isUnready := false
-		_, hasGpuLabel := node.Labels[GPULabel]
 		gpuAllocatable, hasGpuAllocatable := node.Status.Allocatable[ResourceNvidiaGPU]
-		// We expect node to have GPU based on label, but it doesn't show up
-		// on node object. Assume the node is still not fully started (installing
-		// GPU drivers).
-		if hasGpuLabel && (!hasGpuAllocatable || gpuAllocatable.IsZero()) {
+		// We expect node to have GPU, but it doesn't show up on node object.
+		// Assume the node is still not fully started (installing GPU drivers).
+		if (!hasGpuAllocatable || gpuAllocatable.IsZero()) && hasGpu(node) {
 			newNode, err := getUnreadyNodeCopy(node)
 			if err != nil {
 				glog.Errorf("Failed to override status of node %v with unready GPU: %v",
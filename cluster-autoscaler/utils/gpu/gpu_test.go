@@ -187,3 +187,29 @@ func TestGetGpuRequests(t *testing.T) {
 	assert.Equal(t, len(requestInfo["SomeOtherGpu"].Pods), 1)
 	assert.Equal(t, requestInfo["SomeOtherGpu"].Pods[0], pod1OtherGpu)
 }
+
+func TestFilterOutNodesWithUnreadyGpusMatching(t *testing.T) {
+	readyCondition := apiv1.NodeCondition{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue}
+	newNode := func(name string, size string) *apiv1.Node {
+		return &apiv1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"size": size}},
+			Status:     apiv1.NodeStatus{Conditions: []apiv1.NodeCondition{readyCondition}},
+		}
+	}
+	gpuNode := newNode("gpu", "nc6")
+	cpuNode := newNode("cpu", "d2")
+	hasGpu := func(node *apiv1.Node) bool {
+		return node.Labels["size"] == "nc6"
+	}
+
+	// The node without label but expected to have GPU is unready.
+	allNodes, readyNodes := FilterOutNodesWithUnreadyGpusMatching([]*apiv1.Node{gpuNode, cpuNode}, []*apiv1.Node{gpuNode, cpuNode}, hasGpu)
+	assert.Equal(t, []*apiv1.Node{cpuNode}, readyNodes)
+	assert.Equal(t, 2, len(allNodes))
+	assert.Equal(t, apiv1.ConditionFalse, allNodes[0].Status.Conditions[0].Status)
+
+	// It's ready once its GPU is allocatable.
+	gpuNode.Status.Allocatable = apiv1.ResourceList{ResourceNvidiaGPU: *resource.NewQuantity(1, resource.DecimalSI)}
+	_, readyNodes = FilterOutNodesWithUnreadyGpusMatching([]*apiv1.Node{gpuNode, cpuNode}, []*apiv1.Node{gpuNode, cpuNode}, hasGpu)
+	assert.Equal(t, []*apiv1.Node{gpuNode, cpuNode}, readyNodes)
+}